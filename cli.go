@@ -0,0 +1,394 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/SocialHarvest/harvester/lib/config"
+	"github.com/SocialHarvest/harvester/lib/harvester"
+	"github.com/SocialHarvestVendors/cron"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Command line subcommands for ad-hoc harvesting and looking after the harvester. They all use the same config as the server (the --conf flag
+// can be given before the command or after it, with its other flags). Commands exit with 0 on success, 1 when something failed (including
+// API errors during a harvest) and 2 when they were used wrong.
+const (
+	exitOk    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: harvester [--conf social-harvest-conf.json] [command]
+
+Without a command, the harvester runs on its schedule along with the API server.
+
+Commands:
+  run        Harvest a territory, network and action (all of them if not given).
+             --territory, --network, --action (content, accounts, keyword, account or growth)
+             --once to harvest right away and exit, otherwise it harvests on the territory's schedule until stopped
+  backfill   Harvest from as far back as the APIs allow, ignoring where the last harvest left off.
+             --territory, --network, --action, --pages (the most pages of results to get, per keyword or account)
+  schedule   list: show the scheduled jobs and when they run next
+  state      show: show where the last harvests left off (--territory, --network)
+             reset: forget where the last harvests left off (--territory is required, --network, --action, --value)
+  migrate    up: apply the database migrations that haven't been applied (--to a version, all of them by default)
+             down: undo the most recently applied migrations (--steps, 1 by default)
+             status: show which migrations have been applied`)
+}
+
+// Runs the command given on the command line and returns the exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "run":
+		return runHarvestCommand(args[1:], false)
+	case "backfill":
+		return runHarvestCommand(args[1:], true)
+	case "schedule":
+		return runScheduleCommand(args[1:])
+	case "state":
+		return runStateCommand(args[1:])
+	case "migrate":
+		return runMigrateCommand(args[1:])
+	case "help":
+		usage()
+		return exitOk
+	}
+	fmt.Fprintln(os.Stderr, "Unknown command: "+args[0])
+	usage()
+	return exitUsage
+}
+
+// harvester run|backfill [--territory name] [--network name] [--action name] [--once] [--pages n]
+func runHarvestCommand(args []string, backfill bool) int {
+	name := "run"
+	if backfill {
+		name = "backfill"
+	}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&confFile, "conf", confFile, "Path to the Social Harvest configuration file.")
+	territoryName := flags.String("territory", "", "The territory to harvest (all of them by default).")
+	network := flags.String("network", "", "The network to harvest (all of them by default).")
+	action := flags.String("action", "", "content, accounts, keyword, account or growth (content and accounts by default).")
+	once := flags.Bool("once", false, "Harvest right away and exit rather than harvesting on the territory's schedule.")
+	pages := flags.Int("pages", 0, "The most pages of results to get for each keyword or account (backfill only, defaults to the territory's limit).")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if unexpectedArgs(flags) {
+		return exitUsage
+	}
+
+	c, err := loadConfig(false)
+	if err != nil {
+		return exitError
+	}
+	if *territoryName != "" && len(findTerritories(c, *territoryName)) == 0 {
+		fmt.Fprintln(os.Stderr, "Unknown territory: "+*territoryName)
+		return exitUsage
+	}
+	networks := config.ScheduleNetworks
+	if *network != "" {
+		networks = []string{*network}
+	}
+	funcs := map[string][]harvestFunc{}
+	for _, n := range networks {
+		funcs[n] = harvestFunctionsFor(n, *action)
+		if *network != "" && len(funcs[n]) == 0 {
+			fmt.Fprintln(os.Stderr, "There is nothing to harvest for network "+*network+" and action "+*action+".")
+			return exitUsage
+		}
+	}
+
+	for i := range c.Harvest.Territories {
+		if backfill && *pages > 0 {
+			c.Harvest.Territories[i].Limits.MaxResultsPages = *pages
+		}
+		// Everything is harvested when asked (or on the territory's own schedule), whether keywords are due or not
+		c.Harvest.Territories[i].Schedule.Adaptive.Enabled = false
+	}
+	configureHarvester(c)
+
+	// The API errors the harvest ran into (they're logged as they happen)
+	failed := 0
+	harvest := func() {
+		started := time.Now()
+		before := harvester.HarvestedCounts()
+		errorsBefore := harvestErrorCount()
+		for _, n := range networks {
+			for _, f := range funcs[n] {
+				runHarvest(f, findTerritories(currentConfig(), *territoryName)...)
+			}
+		}
+		failed = harvestErrorCount() - errorsBefore
+		printHarvestSummary(before, harvester.HarvestedCounts(), failed, time.Since(started))
+	}
+
+	if backfill {
+		ignoreHarvestState = true
+	}
+	if backfill || *once {
+		harvest()
+		shutdown(shutdownTimeout)
+		if failed > 0 {
+			return exitError
+		}
+		return exitOk
+	}
+	return runOnSchedule(c, *territoryName, networks, *action, harvest)
+}
+
+// Harvests on the schedule configured for the territory (or the first territory's schedule if harvesting all of them) until interrupted.
+// When several networks are harvested, the first network's schedule is used.
+func runOnSchedule(c config.SocialHarvestConf, territoryName string, networks []string, action string, harvest func()) int {
+	territories := findTerritories(c, territoryName)
+	if len(territories) == 0 {
+		fmt.Fprintln(os.Stderr, "There are no territories configured.")
+		return exitError
+	}
+	scheduleAction := scheduledAction(action)
+	spec := territories[0].ScheduleFor(networks[0], scheduleAction)
+	if spec == "" {
+		fmt.Fprintln(os.Stderr, "There is no "+scheduleAction+" schedule for "+territories[0].Name+" on "+networks[0]+", use --once to harvest right away.")
+		return exitUsage
+	}
+
+	runs, err := config.NextRuns(spec, time.Now(), 1)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid schedule "+spec+": "+err.Error())
+		return exitError
+	}
+	scheduler := cron.New()
+	scheduler.AddFunc(spec, harvest, "Harvesting from the command line - "+spec)
+	scheduler.Start()
+	fmt.Println("Harvesting on the schedule " + spec + ", next at " + runs[0].Format(time.RFC1123) + ". Press Ctrl+C to stop.")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	scheduler.Stop()
+	shutdown(shutdownTimeout)
+	fmt.Println("Stopped.")
+	return exitOk
+}
+
+// harvester schedule list
+func runScheduleCommand(args []string) int {
+	if len(args) == 0 || args[0] != "list" {
+		usage()
+		return exitUsage
+	}
+	flags := flag.NewFlagSet("schedule", flag.ContinueOnError)
+	flags.StringVar(&confFile, "conf", confFile, "Path to the Social Harvest configuration file.")
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	if unexpectedArgs(flags) {
+		return exitUsage
+	}
+
+	c, err := loadConfig(false)
+	if err != nil {
+		return exitError
+	}
+	// Only lists the jobs, nothing is scheduled (no maintenance tasks run) and the saved schedule is left alone
+	jobs, err := config.PlannedJobs(c, configJobs(c))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not read the saved schedule: "+err.Error())
+		return exitError
+	}
+	for _, job := range jobs {
+		next := ""
+		if runs, err := config.NextRuns(job.Spec, time.Now(), 1); err == nil && len(runs) > 0 {
+			next = runs[0].Format(time.RFC1123)
+		}
+		if job.Paused {
+			next = "paused"
+		}
+		fmt.Printf("%s  %-20s %-10s %-8s %-16s next: %s\n", job.Id, job.Territory, job.Network, job.Action, job.Spec, next)
+	}
+	fmt.Printf("%d jobs scheduled.\n", len(jobs))
+	return exitOk
+}
+
+// harvester state show|reset [--territory name] [--network name] [--action name] [--value keyword]
+func runStateCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "show" && args[0] != "reset") {
+		usage()
+		return exitUsage
+	}
+	flags := flag.NewFlagSet("state", flag.ContinueOnError)
+	flags.StringVar(&confFile, "conf", confFile, "Path to the Social Harvest configuration file.")
+	territoryName := flags.String("territory", "", "The territory.")
+	network := flags.String("network", "", "The network.")
+	action := flags.String("action", "", "The harvest action (reset only), ie. TwitterPublicMessagesByKeyword.")
+	value := flags.String("value", "", "The keyword, account, etc. (reset only).")
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	if unexpectedArgs(flags) {
+		return exitUsage
+	}
+
+	c, err := loadConfig(false)
+	if err != nil {
+		return exitError
+	}
+	publishConfig(c, config.NewDatabase(c))
+
+	if args[0] == "reset" {
+		if *territoryName == "" {
+			fmt.Fprintln(os.Stderr, "A --territory is required to reset the harvest state.")
+			return exitUsage
+		}
+		removed, err := currentDatabase().ResetHarvestState(*territoryName, *network, *action, *value)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not reset the harvest state: "+err.Error())
+			return exitError
+		}
+		fmt.Printf("Harvest state reset, %d records removed.\n", removed)
+		return exitOk
+	}
+
+	states, err := currentDatabase().HarvestStates(*territoryName, *network)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not get the harvest state: "+err.Error())
+		return exitError
+	}
+	for _, state := range states {
+		fmt.Printf("%-20s %-10s %-32s %-24s last id: %-24s last time: %s (%d items, harvested %s)\n", state.Territory, state.Network, state.Action, state.Value, state.LastIdHarvested, state.LastTimeHarvested.Format(time.RFC1123), state.ItemsHarvested, state.HarvestTime.Format(time.RFC1123))
+	}
+	fmt.Printf("%d harvest states.\n", len(states))
+	return exitOk
+}
+
+// harvester migrate up|down|status [--to version] [--steps n]
+func runMigrateCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "up" && args[0] != "down" && args[0] != "status") {
+		usage()
+		return exitUsage
+	}
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.StringVar(&confFile, "conf", confFile, "Path to the Social Harvest configuration file.")
+	to := flags.Int("to", 0, "The version to migrate up to (up only, the latest by default).")
+	steps := flags.Int("steps", 1, "The number of migrations to undo (down only).")
+	if err := flags.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	if unexpectedArgs(flags) {
+		return exitUsage
+	}
+
+	c, err := loadConfig(false)
+	if err != nil {
+		return exitError
+	}
+	// Migrations are only applied when asked for here
+	c.Database.AutoMigrate = false
+	database := config.NewDatabase(c)
+	defer database.Close()
+	if database.Store == nil {
+		fmt.Fprintln(os.Stderr, "There is no database to migrate, check the database settings.")
+		return exitError
+	}
+
+	var migrations []config.Migration
+	switch args[0] {
+	case "up":
+		migrations, err = database.MigrateUp(*to)
+	case "down":
+		migrations, err = database.MigrateDown(*steps)
+	case "status":
+		status, err := database.MigrationStatus()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not get the migration status: "+err.Error())
+			return exitError
+		}
+		for _, m := range status {
+			applied := "pending"
+			if m.Applied {
+				applied = "applied " + m.AppliedAt.Format(time.RFC1123)
+			}
+			fmt.Printf("%4d  %-50s %s\n", m.Version, m.Description, applied)
+		}
+		return exitOk
+	}
+	verb, done := "Applied", "applied"
+	if args[0] == "down" {
+		verb, done = "Undid", "undone"
+	}
+	for _, m := range migrations {
+		fmt.Printf("%s %d: %s\n", verb, m.Version, m.Description)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitError
+	}
+	fmt.Printf("%d migrations %s.\n", len(migrations), done)
+	return exitOk
+}
+
+// Whether or not there's anything left on the command line after the flags. Flags stop being parsed at the first argument that isn't one,
+// so anything after it (like a misplaced --conf) would otherwise be silently ignored.
+func unexpectedArgs(flags *flag.FlagSet) bool {
+	if flags.NArg() == 0 {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "Unexpected arguments: %v\n", flags.Args())
+	usage()
+	return true
+}
+
+// Returns the territory with the given name, or all of them if the name is empty.
+func findTerritories(c config.SocialHarvestConf, name string) []config.Territory {
+	if name == "" {
+		return c.Harvest.Territories
+	}
+	for _, t := range c.Harvest.Territories {
+		if t.Name == name {
+			return []config.Territory{t}
+		}
+	}
+	return []config.Territory{}
+}
+
+// Prints the number of items harvested for each series between two counts (see harvester.HarvestedCounts()) and the number of API errors.
+func printHarvestSummary(before map[string]int, after map[string]int, failed int, took time.Duration) {
+	series := []string{}
+	for s := range after {
+		series = append(series, s)
+	}
+	sort.Strings(series)
+	total := 0
+	fmt.Println("Harvest summary:")
+	for _, s := range series {
+		if n := after[s] - before[s]; n > 0 {
+			fmt.Printf("  %-20s %d\n", s, n)
+			total += n
+		}
+	}
+	fmt.Printf("%d items harvested in %s.\n", total, took)
+	if failed > 0 {
+		fmt.Printf("%d API errors, see the log.\n", failed)
+	}
+}
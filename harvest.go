@@ -24,7 +24,7 @@ import (
 	"math"
 	"net/url"
 	"strconv"
-	//"sync"
+	"sync"
 	"time"
 )
 
@@ -41,16 +41,20 @@ import (
 // This was the original thinking for filters, but Fluentd may be enough? If this is introduced, it will be in the future (lower priority).
 
 // Harvest Facebook publicly accessible posts by searching keyword criteria
-func FacebookPublicMessagesByKeyword() {
+func FacebookPublicMessagesByKeyword(territories ...config.Territory) {
 	params := harvester.FacebookParams{}
 
-	for _, territory := range socialHarvest.Config.Harvest.Territories {
+	for _, territory := range territories {
 		// If different credentials were set for the territory, this will find and set them
 		// TODO: Change this. Always pass the credentials for overrides. OR, always set them back on each harvest (harvests do happen one by one).
 		// NOTE: Pass to the params strut. simple.
 		//harvester.NewFacebookTerritoryCredentials(territory.Name)
 
 		for _, keyword := range territory.Content.Keywords {
+			// Territories with adaptive scheduling only harvest keywords (and accounts) when they're due
+			if !harvestDue(territory, "facebook", "FacebookPublicMessagesByKeyword", keyword) {
+				continue
+			}
 			// Reset Until and Since, just in case. The for loop below could have changed it for the next keyword.
 			params.Until = ""
 			params.Since = ""
@@ -79,7 +83,11 @@ func FacebookPublicMessagesByKeyword() {
 
 			// Fetch X pages of results
 			for i := 0; i < maxPages; i++ {
-				lastHarvestTime := socialHarvest.Database.GetLastHarvestTime(territory.Name, "facebook", "FacebookPublicMessagesByKeyword", keyword)
+				// Stop at a page boundary when shutting down (see shutdown()) or once the territory's budget runs out
+				if shuttingDown() || !withinBudget(territory, "facebook") {
+					break
+				}
+				lastHarvestTime := getLastHarvestTime(territory.Name, "facebook", "FacebookPublicMessagesByKeyword", keyword)
 				sinceStr := ""
 				if !lastHarvestTime.IsZero() {
 					sinceTimeUnix := lastHarvestTime.Unix()
@@ -98,9 +106,7 @@ func FacebookPublicMessagesByKeyword() {
 				log.Println("harvested a page of results from facebook for keyword: " + keyword)
 
 				// Always save this on each page (if anything was harvested). Then if something crashes for some reason during a harvest of several pages, we can pick up where we left off. Rather than starting over again.
-				if harvestState.ItemsHarvested > 0 {
-					socialHarvest.Database.SetLastHarvestTime(territory.Name, "facebook", "FacebookPublicMessagesByKeyword", keyword, harvestState.LastTime, harvestState.LastId, harvestState.ItemsHarvested)
-				}
+				harvestedPage(territory.Name, "facebook", "FacebookPublicMessagesByKeyword", keyword, harvestState)
 
 				// We also avoid using "break" because the for loop is now based on number of pages to harvest.
 				// But this could lead to harvesting pages taht don't exist, so we should still "break" in that case.
@@ -117,16 +123,20 @@ func FacebookPublicMessagesByKeyword() {
 }
 
 // Harvest Facebook publicly accessible posts from a specific account (user or page)
-func FacebookMessagesByAccount() {
+func FacebookMessagesByAccount(territories ...config.Territory) {
 	params := harvester.FacebookParams{}
 
-	for _, territory := range socialHarvest.Config.Harvest.Territories {
+	for _, territory := range territories {
 		// If different credentials were set for the territory, this will find and set them
 		// TODO: Change this. Always pass the credentials for overrides. OR, always set them back on each harvest (harvests do happen one by one).
 		// NOTE: Pass to the params strut. simple.
 		//harvester.NewFacebookTerritoryCredentials(territory.Name)
 
 		for _, account := range territory.Accounts.Facebook {
+			// Territories with adaptive scheduling only harvest keywords (and accounts) when they're due
+			if !harvestDue(territory, "facebook", "FacebookMessagesByAccount", account) {
+				continue
+			}
 			// Reset Until and Since, just in case. The for loop below could have changed it for the next account.
 			params.Until = ""
 			params.Since = ""
@@ -151,7 +161,11 @@ func FacebookMessagesByAccount() {
 
 			// Fetch X pages of results
 			for i := 0; i < maxPages; i++ {
-				lastHarvestTime := socialHarvest.Database.GetLastHarvestTime(territory.Name, "facebook", "FacebookMessagesByAccount", account)
+				// Stop at a page boundary when shutting down (see shutdown()) or once the territory's budget runs out
+				if shuttingDown() || !withinBudget(territory, "facebook") {
+					break
+				}
+				lastHarvestTime := getLastHarvestTime(territory.Name, "facebook", "FacebookMessagesByAccount", account)
 				sinceStr := ""
 				if !lastHarvestTime.IsZero() {
 					sinceTimeUnix := lastHarvestTime.Unix()
@@ -169,9 +183,7 @@ func FacebookMessagesByAccount() {
 				// log.Println("harvested a page of results from facebook")
 
 				// Always save this on each page. Then if something crashes for some reason during a harvest of several pages, we can pick up where we left off. Rather than starting over again.
-				if harvestState.ItemsHarvested > 0 {
-					socialHarvest.Database.SetLastHarvestTime(territory.Name, "facebook", "FacebookMessagesByAccount", account, harvestState.LastTime, harvestState.LastId, harvestState.ItemsHarvested)
-				}
+				harvestedPage(territory.Name, "facebook", "FacebookMessagesByAccount", account, harvestState)
 				// We also avoid using "break" because the for loop is now based on number of pages to harvest.
 				// But this could lead to harvesting pages taht don't exist, so we should still "break" in that case.
 				// Since every call to FacebookFeed() should return with a new Until value, we'll look to see if it's empty. If so, it was the latest page of results from FB. Break the loop.
@@ -187,10 +199,14 @@ func FacebookMessagesByAccount() {
 }
 
 // Track Facebook account changes for public pages (without extended permissions, we can't determine personal account growth/number of friends)
-func FacebookGrowthByAccount() {
-	for _, territory := range socialHarvest.Config.Harvest.Territories {
+func FacebookGrowthByAccount(territories ...config.Territory) {
+	for _, territory := range territories {
 		for _, account := range territory.Accounts.Facebook {
-			harvester.FacebookAccountDetails(territory.Name, account)
+			if shuttingDown() || !withinBudget(territory, "facebook") {
+				break
+			}
+			err := harvester.FacebookAccountDetails(territory.Name, account)
+			harvestedAccount(territory.Name, "facebook", "FacebookGrowthByAccount", account, err)
 			// log.Println("harvested a account stats from facebook")
 		}
 	}
@@ -198,8 +214,8 @@ func FacebookGrowthByAccount() {
 }
 
 // Searches Twitter for status updates by territory keyword criteria
-func TwitterPublicMessagesByKeyword() {
-	for _, territory := range socialHarvest.Config.Harvest.Territories {
+func TwitterPublicMessagesByKeyword(territories ...config.Territory) {
+	for _, territory := range territories {
 		// If different credentials were set for the territory, this will find and set them
 		harvester.NewTwitterTerritoryCredentials(territory.Name)
 
@@ -216,6 +232,10 @@ func TwitterPublicMessagesByKeyword() {
 		// Search all keywords
 		if len(territory.Content.Keywords) > 0 {
 			for _, keyword := range territory.Content.Keywords {
+				// Territories with adaptive scheduling only harvest keywords (and accounts) when they're due
+				if !harvestDue(territory, "twitter", "TwitterPublicMessagesByKeyword", keyword) {
+					continue
+				}
 				log.Print("Searching for: " + keyword)
 
 				// A globally set limit in the Social Harvest config (or default of "100")
@@ -244,12 +264,16 @@ func TwitterPublicMessagesByKeyword() {
 
 				// Fetch all pages (it keeps going until there are no more, but that could be problematic for API rate limits - so in the Social Harvest config, a limit can be put on number of pages returned)
 				for i := 0; i < maxPages; i++ {
+					// Stop at a page boundary when shutting down (see shutdown()) or once the territory's budget runs out
+					if shuttingDown() || !withinBudget(territory, "twitter") {
+						break
+					}
 					// Note: The "since" seems to get removed in the "next" pagination link.
 					// It would have worked perfectly and stopped if they held on to it as a limiter. Now, we need to hold on to it in the harvester and watch.
 					// When results start coming in that have a time older than this "since" value - break the loop (also note, configuration can limit pages too).
 					// However. If nothing has truly been posted since the last harvest, then no results will be returned when passing "since" and that will help a little.
 					// So always pass it. Since we only get the "next" page, we don't need to change it (and it does help particularly with account feeds).
-					lastHarvestId := socialHarvest.Database.GetLastHarvestId(territory.Name, "twitter", "TwitterPublicMessagesByKeyword", keyword)
+					lastHarvestId := getLastHarvestId(territory.Name, "twitter", "TwitterPublicMessagesByKeyword", keyword)
 					if lastHarvestId != "" {
 						params.Set("since_id", lastHarvestId)
 					}
@@ -259,9 +283,7 @@ func TwitterPublicMessagesByKeyword() {
 					harvestState = updatedHarvestState
 					//log.Println("harvested a page of results from twitter")
 
-					if harvestState.ItemsHarvested > 0 {
-						socialHarvest.Database.SetLastHarvestTime(territory.Name, "twitter", "TwitterPublicMessagesByKeyword", keyword, harvestState.LastTime, harvestState.LastId, harvestState.ItemsHarvested)
-					}
+					harvestedPage(territory.Name, "twitter", "TwitterPublicMessagesByKeyword", keyword, harvestState)
 					// We also avoid using "break" because the for loop is now based on number of pages to harvest.
 					// But this could lead to harvesting pages taht don't exist, so we should still "break" in that case.
 					// Since every call to FacebookFeed() should return with a new Until value, we'll look to see if it's empty. If so, it was the latest page of results from FB. Break the loop.
@@ -278,12 +300,16 @@ func TwitterPublicMessagesByKeyword() {
 }
 
 // Get status updates from an account's timeline
-func TwitterPublicMessagesByAccount() {
-	for _, territory := range socialHarvest.Config.Harvest.Territories {
+func TwitterPublicMessagesByAccount(territories ...config.Territory) {
+	for _, territory := range territories {
 		// If different credentials were set for the territory, this will find and set them
 		harvester.NewTwitterTerritoryCredentials(territory.Name)
 
 		for _, account := range territory.Accounts.Twitter {
+			// Territories with adaptive scheduling only harvest keywords (and accounts) when they're due
+			if !harvestDue(territory, "twitter", "TwitterPublicMessagesByAccount", account) {
+				continue
+			}
 			// Build params for search
 			params := url.Values{}
 			params.Set("include_entities", "true")
@@ -309,7 +335,11 @@ func TwitterPublicMessagesByAccount() {
 
 			// Fetch X pages of results
 			for i := 0; i < maxPages; i++ {
-				lastHarvestId := socialHarvest.Database.GetLastHarvestId(territory.Name, "twitter", "TwitterPublicMessagesByAccount", account)
+				// Stop at a page boundary when shutting down (see shutdown()) or once the territory's budget runs out
+				if shuttingDown() || !withinBudget(territory, "twitter") {
+					break
+				}
+				lastHarvestId := getLastHarvestId(territory.Name, "twitter", "TwitterPublicMessagesByAccount", account)
 				if lastHarvestId != "" {
 					params.Set("since_id", lastHarvestId)
 				}
@@ -326,9 +356,7 @@ func TwitterPublicMessagesByAccount() {
 				harvestState = updatedHarvestState
 
 				// Always save this on each page. Then if something crashes for some reason during a harvest of several pages, we can pick up where we left off. Rather than starting over again.
-				if harvestState.ItemsHarvested > 0 {
-					socialHarvest.Database.SetLastHarvestTime(territory.Name, "twitter", "TwitterPublicMessagesByAccount", account, harvestState.LastTime, harvestState.LastId, harvestState.ItemsHarvested)
-				}
+				harvestedPage(territory.Name, "twitter", "TwitterPublicMessagesByAccount", account, harvestState)
 				// We also avoid using "break" because the for loop is now based on number of pages to harvest.
 				// But this could lead to harvesting pages taht don't exist, so we should still "break" in that case.
 				// Since every call to FacebookFeed() should return with a new Until value, we'll look to see if it's empty. If so, it was the latest page of results from FB. Break the loop.
@@ -344,10 +372,14 @@ func TwitterPublicMessagesByAccount() {
 }
 
 // Track Twitter account changes
-func TwitterGrowthByAccount() {
-	for _, territory := range socialHarvest.Config.Harvest.Territories {
+func TwitterGrowthByAccount(territories ...config.Territory) {
+	for _, territory := range territories {
 		for _, account := range territory.Accounts.Twitter {
-			harvester.TwitterAccountDetails(territory.Name, account)
+			if shuttingDown() || !withinBudget(territory, "twitter") {
+				break
+			}
+			err := harvester.TwitterAccountDetails(territory.Name, account)
+			harvestedAccount(territory.Name, "twitter", "TwitterGrowthByAccount", account, err)
 			// log.Println("harvested a account stats from twitter")
 		}
 	}
@@ -355,8 +387,8 @@ func TwitterGrowthByAccount() {
 }
 
 // Searches Instagram for media by territory keyword criteria (first needs to get tags)
-func InstagramMediaByKeyword() {
-	for _, territory := range socialHarvest.Config.Harvest.Territories {
+func InstagramMediaByKeyword(territories ...config.Territory) {
+	for _, territory := range territories {
 		// If different credentials were set for the territory, this will find and set them
 		harvester.NewInstagramTerritoryCredentials(territory.Name)
 
@@ -388,6 +420,10 @@ func InstagramMediaByKeyword() {
 		// Search all keywords
 		if len(territory.Content.InstagramTags) > 0 {
 			for _, tag := range territory.Content.InstagramTags {
+				// Territories with adaptive scheduling only harvest keywords (and accounts) when they're due
+				if !harvestDue(territory, "instagram", "InstagramMediaByKeyword", tag) {
+					continue
+				}
 				// log.Print("Searching for: " + tag)
 
 				// A globally set limit in the Social Harvest config (or default of "100")
@@ -428,7 +464,11 @@ func InstagramMediaByKeyword() {
 
 				// Fetch X pages of results
 				for i := 0; i < maxPages; i++ {
-					lastHarvestId := socialHarvest.Database.GetLastHarvestId(territory.Name, "instagram", "InstagramMediaByKeyword", tag)
+					// Stop at a page boundary when shutting down (see shutdown()) or once the territory's budget runs out
+					if shuttingDown() || !withinBudget(territory, "instagram") {
+						break
+					}
+					lastHarvestId := getLastHarvestId(territory.Name, "instagram", "InstagramMediaByKeyword", tag)
 					params.Set("max_tag_id", lastHarvestId)
 
 					updatedParams, updatedHarvestState := harvester.InstagramSearch(territory.Name, harvestState, tag, params)
@@ -437,9 +477,7 @@ func InstagramMediaByKeyword() {
 					// log.Println("harvested a page of results from instagram")
 
 					// Always save this on each page. Then if something crashes for some reason during a harvest of several pages, we can pick up where we left off. Rather than starting over again.
-					if harvestState.ItemsHarvested > 0 {
-						socialHarvest.Database.SetLastHarvestTime(territory.Name, "instagram", "InstagramMediaByKeyword", tag, harvestState.LastTime, harvestState.LastId, harvestState.ItemsHarvested)
-					}
+					harvestedPage(territory.Name, "instagram", "InstagramMediaByKeyword", tag, harvestState)
 					// We also avoid using "break" because the for loop is now based on number of pages to harvest.
 					// But this could lead to harvesting pages taht don't exist, so we should still "break" in that case.
 					if params.Get("max_tag_id") == "" {
@@ -454,10 +492,14 @@ func InstagramMediaByKeyword() {
 }
 
 // Track Instagram account changes
-func InstagramGrowthByAccount() {
-	for _, territory := range socialHarvest.Config.Harvest.Territories {
+func InstagramGrowthByAccount(territories ...config.Territory) {
+	for _, territory := range territories {
 		for _, account := range territory.Accounts.Instagram {
-			harvester.InstagramAccountDetails(territory.Name, account)
+			if shuttingDown() || !withinBudget(territory, "instagram") {
+				break
+			}
+			err := harvester.InstagramAccountDetails(territory.Name, account)
+			harvestedAccount(territory.Name, "instagram", "InstagramGrowthByAccount", account, err)
 			// log.Println("harvested a account stats from instagram")
 		}
 	}
@@ -465,8 +507,8 @@ func InstagramGrowthByAccount() {
 }
 
 // Searches Google+ for activities (posts) by territory keyword criteria
-func GooglePlusActivitieByKeyword() {
-	for _, territory := range socialHarvest.Config.Harvest.Territories {
+func GooglePlusActivitieByKeyword(territories ...config.Territory) {
+	for _, territory := range territories {
 		// If different credentials were set for the territory, this will find and set them
 		harvester.NewGooglePlusTerritoryCredentials(territory.Name)
 
@@ -475,6 +517,10 @@ func GooglePlusActivitieByKeyword() {
 		// Search all keywords
 		if len(territory.Content.Keywords) > 0 {
 			for _, keyword := range territory.Content.Keywords {
+				// Territories with adaptive scheduling only harvest keywords (and accounts) when they're due
+				if !harvestDue(territory, "googlePlus", "GooglePlusActivitieByKeyword", keyword) {
+					continue
+				}
 				// log.Print("Searching for: " + keyword)
 
 				// A globally set limit in the Social Harvest config (or default of "100")
@@ -513,7 +559,11 @@ func GooglePlusActivitieByKeyword() {
 
 				// Fetch X pages of results
 				for i := 0; i < maxPages; i++ {
-					// lastHarvestId := socialHarvest.Database.GetLastHarvestId(territory.Name, "googlePlus", "GooglePlusActivitieByKeyword", keyword)
+					// Stop at a page boundary when shutting down (see shutdown()) or once the territory's budget runs out
+					if shuttingDown() || !withinBudget(territory, "googlePlus") {
+						break
+					}
+					// lastHarvestId := getLastHarvestId(territory.Name, "googlePlus", "GooglePlusActivitieByKeyword", keyword)
 					// This is a bit difficult. Google+ has a "nextPageToken" which is true pagination, whereas other networks have a since/until but start from the latest.
 					// This means Google+ would allow us to never miss a single thing. This is handy if we're trying to get everything and don't rest for long periods of time
 					// between harvests. However, we do. A typical harvest cycle is every hour. A lot can be posted since then and by going back to where the harvest left off,
@@ -529,9 +579,7 @@ func GooglePlusActivitieByKeyword() {
 					// log.Println("harvested a page of results from instagram")
 
 					// Always save this on each page. Then if something crashes for some reason during a harvest of several pages, we can pick up where we left off. Rather than starting over again.
-					if harvestState.ItemsHarvested > 0 {
-						socialHarvest.Database.SetLastHarvestTime(territory.Name, "googlePlus", "GooglePlusActivitieByKeyword", keyword, harvestState.LastTime, harvestState.LastId, harvestState.ItemsHarvested)
-					}
+					harvestedPage(territory.Name, "googlePlus", "GooglePlusActivitieByKeyword", keyword, harvestState)
 					// We also avoid using "break" because the for loop is now based on number of pages to harvest.
 					// But this could lead to harvesting pages taht don't exist, so we should still "break" in that case.
 					if params.Get("nextPageToken") == "" {
@@ -546,8 +594,8 @@ func GooglePlusActivitieByKeyword() {
 }
 
 // Searches Google+ for activities (posts) by territory account criteria
-func GooglePlusActivitieByAccount() {
-	for _, territory := range socialHarvest.Config.Harvest.Territories {
+func GooglePlusActivitieByAccount(territories ...config.Territory) {
+	for _, territory := range territories {
 		// If different credentials were set for the territory, this will find and set them
 		harvester.NewGooglePlusTerritoryCredentials(territory.Name)
 
@@ -556,6 +604,10 @@ func GooglePlusActivitieByAccount() {
 		// Search all accounts
 		if len(territory.Accounts.GooglePlus) > 0 {
 			for _, account := range territory.Accounts.GooglePlus {
+				// Territories with adaptive scheduling only harvest keywords (and accounts) when they're due
+				if !harvestDue(territory, "googlePlus", "GooglePlusActivitieByAccount", account) {
+					continue
+				}
 				// log.Print("Searching for: " + account)
 
 				// A globally set limit in the Social Harvest config (or default of "100")
@@ -586,7 +638,11 @@ func GooglePlusActivitieByAccount() {
 
 				// Fetch X pages of results
 				for i := 0; i < maxPages; i++ {
-					// lastHarvestId := socialHarvest.Database.GetLastHarvestId(territory.Name, "googlePlus", "GooglePlusActivitieByAccount", account)
+					// Stop at a page boundary when shutting down (see shutdown()) or once the territory's budget runs out
+					if shuttingDown() || !withinBudget(territory, "googlePlus") {
+						break
+					}
+					// lastHarvestId := getLastHarvestId(territory.Name, "googlePlus", "GooglePlusActivitieByAccount", account)
 					// This is a bit difficult. Google+ has a "nextPageToken" which is true pagination, whereas other networks have a since/until but start from the latest.
 					// This means Google+ would allow us to never miss a single thing. This is handy if we're trying to get everything and don't rest for long periods of time
 					// between harvests. However, we do. A typical harvest cycle is every hour. A lot can be posted since then and by going back to where the harvest left off,
@@ -602,9 +658,7 @@ func GooglePlusActivitieByAccount() {
 					// log.Println("harvested a page of results from instagram")
 
 					// Always save this on each page. Then if something crashes for some reason during a harvest of several pages, we can pick up where we left off. Rather than starting over again.
-					if harvestState.ItemsHarvested > 0 {
-						socialHarvest.Database.SetLastHarvestTime(territory.Name, "googlePlus", "GooglePlusActivitieByAccount", account, harvestState.LastTime, harvestState.LastId, harvestState.ItemsHarvested)
-					}
+					harvestedPage(territory.Name, "googlePlus", "GooglePlusActivitieByAccount", account, harvestState)
 					// We also avoid using "break" because the for loop is now based on number of pages to harvest.
 					// But this could lead to harvesting pages taht don't exist, so we should still "break" in that case.
 					if params.Get("nextPageToken") == "" {
@@ -619,10 +673,14 @@ func GooglePlusActivitieByAccount() {
 }
 
 // Track Google+ account changes
-func GooglePlusGrowthByAccount() {
-	for _, territory := range socialHarvest.Config.Harvest.Territories {
+func GooglePlusGrowthByAccount(territories ...config.Territory) {
+	for _, territory := range territories {
 		for _, account := range territory.Accounts.GooglePlus {
-			harvester.GooglePlusAccountDetails(territory.Name, account)
+			if shuttingDown() || !withinBudget(territory, "googlePlus") {
+				break
+			}
+			err := harvester.GooglePlusAccountDetails(territory.Name, account)
+			harvestedAccount(territory.Name, "googlePlus", "GooglePlusGrowthByAccount", account, err)
 			// log.Println("harvested a account stats from google+")
 		}
 	}
@@ -630,38 +688,321 @@ func GooglePlusGrowthByAccount() {
 }
 
 // Track YouTube account (channel) changes
-func YouTubeGrowthByAccount() {
-	for _, territory := range socialHarvest.Config.Harvest.Territories {
+func YouTubeGrowthByAccount(territories ...config.Territory) {
+	for _, territory := range territories {
 		for _, account := range territory.Accounts.YouTube {
-			harvester.YouTubeAccountDetails(territory.Name, account)
+			if shuttingDown() || !withinBudget(territory, "youTube") {
+				break
+			}
+			err := harvester.YouTubeAccountDetails(territory.Name, account)
+			harvestedAccount(territory.Name, "youTube", "YouTubeGrowthByAccount", account, err)
 			// log.Println("harvested a account stats from YouTube")
 		}
 	}
 	return
 }
 
+// All of the harvest functions above take the territories to harvest. This allows harvesting a copy of a territory that only has some of
+// its keywords or accounts (see territoryWithValue()).
+type harvestFunc func(territories ...config.Territory)
+
+// Harvests and maintenance tasks hold a read lock while they run, so shutting down can wait for them (and stop new ones) by taking the
+// write lock. Config reloads don't take it, running harvests carry on with the config they started with (see useConfig()).
+var harvestLock sync.RWMutex
+
+// Runs a harvest function while holding the harvest lock.
+func runHarvest(f harvestFunc, territories ...config.Territory) {
+	harvestLock.RLock()
+	defer harvestLock.RUnlock()
+	snapshot, done := useConfig()
+	defer done()
+	defer loadCursors(snapshot.Database, territories...)()
+	f(territories...)
+}
+
+// Reads where each keyword and account of the territories left off all at once, rather than as the harvest gets to them. The returned
+// function lets go of them once the harvest is done.
+func loadCursors(database *config.SocialHarvestDB, territories ...config.Territory) func() {
+	loaded := []string{}
+	if !ignoreHarvestState {
+		for _, t := range territories {
+			if err := database.LoadCursors(t.Name); err != nil {
+				log.Println(err)
+				continue
+			}
+			loaded = append(loaded, t.Name)
+		}
+	}
+	return func() {
+		for _, name := range loaded {
+			database.ReleaseCursors(name)
+		}
+	}
+}
+
 // Simply calls every other function here, harvesting everything
-func HarvestAll() {
-	HarvestAllContent()
-	HarvestAllAccounts()
+func HarvestAll(territoryNames ...string) {
+	HarvestAllContent(territoryNames...)
+	HarvestAllAccounts(territoryNames...)
 }
 
 // Calls all harvest functions that gather content (public posts and such)
-func HarvestAllContent() {
-	go FacebookPublicMessagesByKeyword()
-	go FacebookMessagesByAccount()
-	go TwitterPublicMessagesByKeyword()
-	go TwitterPublicMessagesByAccount()
-	go InstagramMediaByKeyword()
-	go GooglePlusActivitieByKeyword()
-	go GooglePlusActivitieByAccount()
+func HarvestAllContent(territoryNames ...string) {
+	territories := territoriesToHarvest(territoryNames...)
+	go runHarvest(FacebookPublicMessagesByKeyword, territories...)
+	go runHarvest(FacebookMessagesByAccount, territories...)
+	go runHarvest(TwitterPublicMessagesByKeyword, territories...)
+	go runHarvest(TwitterPublicMessagesByAccount, territories...)
+	go runHarvest(InstagramMediaByKeyword, territories...)
+	go runHarvest(GooglePlusActivitieByKeyword, territories...)
+	go runHarvest(GooglePlusActivitieByAccount, territories...)
 }
 
 // Calls all harvest functions that gather information about account changes/growth
-func HarvestAllAccounts() {
-	go FacebookGrowthByAccount()
-	go TwitterGrowthByAccount()
-	go InstagramGrowthByAccount()
-	go GooglePlusGrowthByAccount()
-	go YouTubeGrowthByAccount()
+func HarvestAllAccounts(territoryNames ...string) {
+	territories := territoriesToHarvest(territoryNames...)
+	go runHarvest(FacebookGrowthByAccount, territories...)
+	go runHarvest(TwitterGrowthByAccount, territories...)
+	go runHarvest(InstagramGrowthByAccount, territories...)
+	go runHarvest(GooglePlusGrowthByAccount, territories...)
+	go runHarvest(YouTubeGrowthByAccount, territories...)
+}
+
+// The harvest functions for each network and action (see config.ScheduleNetworks and config.ScheduleActions). This is how a schedule entry
+// for a single territory knows what to call. "content" gathers messages and "accounts" gathers account changes/growth.
+var harvestFunctions = map[string]map[string][]harvestFunc{
+	"twitter": {
+		"content":  {TwitterPublicMessagesByKeyword, TwitterPublicMessagesByAccount},
+		"accounts": {TwitterGrowthByAccount},
+	},
+	"facebook": {
+		"content":  {FacebookPublicMessagesByKeyword, FacebookMessagesByAccount},
+		"accounts": {FacebookGrowthByAccount},
+	},
+	"instagram": {
+		"content":  {InstagramMediaByKeyword},
+		"accounts": {InstagramGrowthByAccount},
+	},
+	"googlePlus": {
+		"content":  {GooglePlusActivitieByKeyword, GooglePlusActivitieByAccount},
+		"accounts": {GooglePlusGrowthByAccount},
+	},
+	"youTube": {
+		"accounts": {YouTubeGrowthByAccount},
+	},
+}
+
+// Harvest functions that can be run on their own (from the command line or the API) in addition to the "content" and "accounts" actions.
+var harvestActions = map[string]map[string]harvestFunc{
+	"twitter": {
+		"keyword": TwitterPublicMessagesByKeyword,
+		"account": TwitterPublicMessagesByAccount,
+		"growth":  TwitterGrowthByAccount,
+	},
+	"facebook": {
+		"keyword": FacebookPublicMessagesByKeyword,
+		"account": FacebookMessagesByAccount,
+		"growth":  FacebookGrowthByAccount,
+	},
+	"instagram": {
+		"keyword": InstagramMediaByKeyword,
+		"growth":  InstagramGrowthByAccount,
+	},
+	"googlePlus": {
+		"keyword": GooglePlusActivitieByKeyword,
+		"account": GooglePlusActivitieByAccount,
+		"growth":  GooglePlusGrowthByAccount,
+	},
+	"youTube": {
+		"growth": YouTubeGrowthByAccount,
+	},
+}
+
+// Returns the harvest functions for a network and action. No action means both "content" and "accounts".
+func harvestFunctionsFor(network string, action string) []harvestFunc {
+	if action == "" {
+		return append(append([]harvestFunc{}, harvestFunctions[network]["content"]...), harvestFunctions[network]["accounts"]...)
+	}
+	if funcs, ok := harvestFunctions[network][action]; ok {
+		return funcs
+	}
+	if f, ok := harvestActions[network][action]; ok {
+		return []harvestFunc{f}
+	}
+	return []harvestFunc{}
+}
+
+// Returns the scheduled action ("content" or "accounts") that an action is part of.
+func scheduledAction(action string) string {
+	if action == "accounts" || action == "growth" {
+		return "accounts"
+	}
+	return "content"
+}
+
+// Harvests a single territory for one network and action. The functions run one after another (rather than in their own goroutines)
+// because they share the same API rate limits for the network.
+func HarvestTerritory(territoryName string, network string, action string) {
+	harvestLock.RLock()
+	defer harvestLock.RUnlock()
+	snapshot, done := useConfig()
+	defer done()
+	territories := findTerritories(snapshot.Config, territoryName)
+	defer loadCursors(snapshot.Database, territories...)()
+	for _, f := range harvestFunctions[network][action] {
+		f(territories...)
+	}
+}
+
+// Saves where the harvest left off after each page of results (if anything was harvested). Then if something crashes for some reason during
+// a harvest of several pages, we can pick up where we left off. Rather than starting over again. This also reports the progress (and API errors)
+// of harvest runs.
+func harvestedPage(territory string, network string, action string, value string, harvestState config.HarvestState) {
+	if harvestState.ItemsHarvested > 0 {
+		currentDatabase().SetLastHarvestTime(territory, network, action, value, harvestState.LastTime, harvestState.LastId, harvestState.ItemsHarvested)
+	}
+	reportHarvestProgress(territory, network, action, value, harvestState.ItemsHarvested)
+	if harvestState.Error != nil {
+		reportHarvestError(territory, network, action, value, harvestState.Error)
+	}
+	if socialHarvest.Schedule != nil {
+		socialHarvest.Schedule.Adaptive.Page(territory, network, action, value, harvestState.ItemsHarvested)
+	}
+
+	// Items harvested add up over the pages for a keyword, so only the new ones are spent
+	key := territory + "|" + network + "|" + action + "|" + value
+	pageItemsLock.Lock()
+	items := harvestState.ItemsHarvested - pageItems[key]
+	pageItems[key] = harvestState.ItemsHarvested
+	pageItemsLock.Unlock()
+	socialHarvest.Budgets.Spend(territory, network, 1, items, time.Now())
+}
+
+// The items harvested so far for each keyword (or account, etc.) being harvested.
+var pageItems = map[string]int{}
+var pageItemsLock sync.Mutex
+
+// Whether or not a keyword (or account, etc.) should be harvested now. Not once the territory's budget for the network ran out and, if
+// the territory uses adaptive scheduling, not until the keyword is due.
+func harvestDue(territory config.Territory, network string, action string, value string) bool {
+	if !withinBudget(territory, network) {
+		return false
+	}
+	if territory.Schedule.Adaptive.Enabled && socialHarvest.Schedule != nil {
+		if !socialHarvest.Schedule.Adaptive.Begin(territory, network, action, value, time.Now()) {
+			return false
+		}
+	}
+	pageItemsLock.Lock()
+	delete(pageItems, territory.Name+"|"+network+"|"+action+"|"+value)
+	pageItemsLock.Unlock()
+	return true
+}
+
+// Whether or not the territory has budget left for the network (see config.Budget).
+func withinBudget(territory config.Territory, network string) bool {
+	return socialHarvest.Budgets.Allows(territory, network, time.Now())
+}
+
+// Reports the progress of harvest runs after an account's details were harvested (there's no harvest state to save for those), along
+// with the error if they couldn't be.
+func harvestedAccount(territory string, network string, action string, account string, err error) {
+	if err != nil {
+		reportHarvestError(territory, network, action, account, err)
+	}
+	reportHarvestProgress(territory, network, action, account, 1)
+	socialHarvest.Budgets.Spend(territory, network, 1, 1, time.Now())
+}
+
+// Backfills ignore where the last harvest left off and go back as far as the API (and the page limits) allow.
+var ignoreHarvestState = false
+
+// Returns the id of the last item harvested, so the harvest can pick up where it left off (unless backfilling).
+func getLastHarvestId(territory string, network string, action string, value string) string {
+	if ignoreHarvestState {
+		return ""
+	}
+	return currentDatabase().GetLastHarvestId(territory, network, action, value)
+}
+
+// Returns the time of the last item harvested, so the harvest can pick up where it left off (unless backfilling).
+func getLastHarvestTime(territory string, network string, action string, value string) time.Time {
+	if ignoreHarvestState {
+		return time.Time{}
+	}
+	return currentDatabase().GetLastHarvestTime(territory, network, action, value)
+}
+
+// Returns the configured territories to harvest. If territory names are given, only those territories are returned. Otherwise, all are.
+func territoriesToHarvest(territoryNames ...string) []config.Territory {
+	c := currentConfig()
+	if len(territoryNames) == 0 {
+		return c.Harvest.Territories
+	}
+	territories := []config.Territory{}
+	for _, territory := range c.Harvest.Territories {
+		for _, name := range territoryNames {
+			if territory.Name == name {
+				territories = append(territories, territory)
+				break
+			}
+		}
+	}
+	return territories
+}
+
+// Where the time of the last engagement lookup for each territory and network is kept (in the settings, by this key followed by the
+// territory and network), so lookups carry on where they left off after a restart or on another harvester in the cluster.
+const engagementSettingsKey = "engagement_lookup"
+
+// Looks up the engagement counts of messages again as they reach each of the configured ages, so the message_engagement series shows
+// how their reach grew. Messages are looked up in batches where the network allows it and the lookups count against the budgets. The
+// time of the lookup is only kept for a territory and network once all of its ages were looked up, otherwise the ages that were skipped
+// (the budget ran out or the harvester is shutting down) are looked up next time.
+func MessageEngagementByAge(snapshot *configSnapshot, territories ...config.Territory) {
+	for _, territory := range territories {
+		for _, network := range []string{"twitter", "facebook", "instagram", "googlePlus"} {
+			now := time.Now()
+			key := engagementSettingsKey + "|" + territory.Name + "|" + network
+			var last time.Time
+			if s, err := snapshot.Database.Settings(key); err == nil {
+				last, _ = time.Parse(time.RFC3339, s.Value)
+			}
+			complete := true
+			for age, window := range snapshot.Config.Harvest.Engagement.Windows(last, now) {
+				if shuttingDown() || !withinBudget(territory, network) {
+					complete = false
+					break
+				}
+				messages, err := snapshot.Database.Messages(territory.Name, network, window[0], window[1])
+				if err != nil {
+					log.Println("Could not read messages to look up their engagement: " + err.Error())
+					complete = false
+					break
+				}
+				if len(messages) == 0 {
+					continue
+				}
+				var found, calls int
+				switch network {
+				case "twitter":
+					harvester.NewTwitterTerritoryCredentials(territory.Name)
+					found, calls = harvester.TwitterEngagement(messages)
+				case "facebook":
+					found, calls = harvester.FacebookEngagement(messages, harvester.FacebookParams{AccessToken: harvester.FacebookTerritoryToken(territory.Name)})
+				case "instagram":
+					harvester.NewInstagramTerritoryCredentials(territory.Name)
+					found, calls = harvester.InstagramEngagement(messages)
+				case "googlePlus":
+					harvester.NewGooglePlusTerritoryCredentials(territory.Name)
+					found, calls = harvester.GooglePlusEngagement(messages)
+				}
+				socialHarvest.Budgets.Spend(territory.Name, network, calls, found, time.Now())
+				log.Println("Looked up the engagement of " + strconv.Itoa(found) + " of " + strconv.Itoa(len(messages)) + " " + network + " messages from " + territory.Name + " at " + age.String() + " old.")
+			}
+			if complete {
+				snapshot.Database.SaveSettings(config.Settings{Key: key, Value: now.Format(time.RFC3339), Modified: now})
+			}
+		}
+	}
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"github.com/SocialHarvest/harvester/lib/config"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -11,3 +13,73 @@ func TestFacebookPublicMessagesByKeyword(t *testing.T) {
 	assert.Equal(t, "foo", "foo", "should be foo")
 
 }
+
+func TestTerritoryWithValue(t *testing.T) {
+	territory := config.Territory{Name: "test"}
+	territory.Content.Keywords = []string{"golang", "gopher"}
+	territory.Accounts.Twitter = []string{"golang"}
+	territory.Accounts.Facebook = []string{"golang"}
+
+	only, ok := territoryWithValue(territory, "twitter", "gopher")
+	assert.Equal(t, true, ok, "gopher is a keyword of the territory")
+	assert.Equal(t, []string{"gopher"}, only.Content.Keywords, "only the keyword should be harvested")
+	assert.Equal(t, []string{}, only.Accounts.Twitter, "no Twitter accounts should be harvested")
+	assert.Equal(t, []string{"golang"}, only.Accounts.Facebook, "other networks are left alone")
+	assert.Equal(t, []string{"golang", "gopher"}, territory.Content.Keywords, "the territory should not be changed")
+
+	_, ok = territoryWithValue(territory, "twitter", "rust")
+	assert.Equal(t, false, ok, "rust is not a keyword or account of the territory")
+}
+
+func TestReportHarvestError(t *testing.T) {
+	run := &HarvestRun{Id: "errors", Territory: "test", Network: "twitter", Status: RunRunning, Errors: []string{}, functions: []string{"TwitterGrowthByAccount"}, progress: map[string]*runProgress{}}
+	other := &HarvestRun{Id: "other", Territory: "test", Network: "facebook", Status: RunRunning, Errors: []string{}, functions: []string{"FacebookGrowthByAccount"}, progress: map[string]*runProgress{}}
+	harvestRunsLock.Lock()
+	harvestRuns[run.Id] = run
+	harvestRuns[other.Id] = other
+	harvestRunsLock.Unlock()
+	defer func() {
+		harvestRunsLock.Lock()
+		delete(harvestRuns, run.Id)
+		delete(harvestRuns, other.Id)
+		harvestRunsLock.Unlock()
+	}()
+
+	before := harvestErrorCount()
+	reportHarvestError("test", "twitter", "TwitterGrowthByAccount", "golang", errors.New("rate limited"))
+	assert.Equal(t, before+1, harvestErrorCount(), "the error should be counted")
+	assert.Equal(t, []string{"test twitter TwitterGrowthByAccount golang: rate limited"}, run.Errors, "the error should be added to the run")
+	assert.Equal(t, []string{}, other.Errors, "runs for other networks should be left alone")
+}
+
+func TestReloadDoesNotWaitForHarvests(t *testing.T) {
+	previous := current()
+	defer publishConfig(previous.Config, previous.Database)
+
+	first := config.SocialHarvestConf{}
+	first.Harvest.Territories = []config.Territory{{Name: "first"}}
+	publishConfig(first, nil)
+	snapshot, done := useConfig()
+
+	second := config.SocialHarvestConf{}
+	second.Harvest.Territories = []config.Territory{{Name: "second"}}
+	old := publishConfig(second, nil)
+	assert.Equal(t, snapshot, old, "the snapshot in use should be the one replaced")
+	assert.Equal(t, "second", currentConfig().Harvest.Territories[0].Name, "the new config should be current right away")
+	assert.Equal(t, "first", snapshot.Config.Harvest.Territories[0].Name, "the running harvest should keep its config")
+	select {
+	case <-old.idle:
+		t.Error("the replaced snapshot is still in use")
+	default:
+	}
+
+	done()
+	select {
+	case <-old.idle:
+	default:
+		t.Error("the replaced snapshot should be idle once the harvest is done")
+	}
+	next, done := useConfig()
+	defer done()
+	assert.Equal(t, "second", next.Config.Harvest.Territories[0].Name, "new harvests should use the new config")
+}
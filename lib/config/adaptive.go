@@ -0,0 +1,229 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Adaptive scheduling polls busy keywords and accounts more often and quiet ones less often. A territory's content jobs run every
+// "minMinutes" and each keyword (or account) is only harvested when it's due. After each harvest of a keyword, how full its pages were
+// decides when it's due next: full pages (or running into the page limit) halve the interval, nothing at all doubles it. Intervals stay
+// between the territory's minimum and maximum and are stretched if the keywords of a network would need more API calls an hour than
+// "maxCallsPerHour" allows.
+type AdaptiveSchedule struct {
+	keys map[string]*adaptiveKey
+	mu   sync.Mutex
+}
+
+// How a keyword (or account) is being polled.
+type AdaptiveKey struct {
+	Territory    string        `json:"territory"`
+	Network      string        `json:"network"`
+	Action       string        `json:"action"`
+	Value        string        `json:"value"`
+	Interval     time.Duration `json:"interval"`
+	Next         time.Time     `json:"next"`
+	ItemsPerPage float64       `json:"itemsPerPage"`
+	PagesPerRun  float64       `json:"pagesPerRun"`
+	LastRun      time.Time     `json:"lastRun"`
+}
+
+type adaptiveKey struct {
+	AdaptiveKey
+	limits adaptiveLimits
+	// The harvest in progress (until it's settled)
+	running bool
+	pages   int
+	items   int
+}
+
+type adaptiveLimits struct {
+	min          time.Duration
+	max          time.Duration
+	callsPerHour int
+	perPage      int
+	maxPages     int
+}
+
+// Defaults for the territory's adaptive schedule.
+const (
+	defaultAdaptiveMinMinutes = 5
+	defaultAdaptiveMaxMinutes = 240
+)
+
+// How much the latest harvest counts toward the averages (exponentially weighted).
+const adaptiveWeight = 0.5
+
+func NewAdaptiveSchedule() *AdaptiveSchedule {
+	return &AdaptiveSchedule{keys: map[string]*adaptiveKey{}}
+}
+
+// Returns the shortest interval for the territory, which is how often its content jobs run when adaptive scheduling is enabled.
+func (t Territory) AdaptiveMinInterval() time.Duration {
+	return adaptiveLimitsFor(t).min
+}
+
+// Returns a cron spec that runs every minimum interval.
+func (t Territory) AdaptiveSpec() string {
+	return "@every " + strconv.Itoa(int(t.AdaptiveMinInterval().Minutes())) + "m"
+}
+
+func adaptiveLimitsFor(t Territory) adaptiveLimits {
+	a := t.Schedule.Adaptive
+	l := adaptiveLimits{
+		min:          time.Duration(a.MinMinutes) * time.Minute,
+		max:          time.Duration(a.MaxMinutes) * time.Minute,
+		callsPerHour: a.MaxCallsPerHour,
+		maxPages:     t.Limits.MaxResultsPages,
+	}
+	if l.min <= 0 {
+		l.min = defaultAdaptiveMinMinutes * time.Minute
+	}
+	if l.max < l.min {
+		l.max = defaultAdaptiveMaxMinutes * time.Minute
+		if l.max < l.min {
+			l.max = l.min
+		}
+	}
+	l.perPage, _ = strconv.Atoi(t.Limits.ResultsPerPage)
+	if l.perPage <= 0 {
+		l.perPage = 100
+	}
+	if l.maxPages <= 0 {
+		l.maxPages = 10
+	}
+	return l
+}
+
+// Returns true if the keyword (or account, etc.) is due to be harvested and if so, starts tracking the harvest. Keywords that haven't
+// been harvested yet are always due.
+func (a *AdaptiveSchedule) Begin(territory Territory, network string, action string, value string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id := adaptiveId(territory.Name, network, action, value)
+	k, ok := a.keys[id]
+	if !ok {
+		k = &adaptiveKey{AdaptiveKey: AdaptiveKey{Territory: territory.Name, Network: network, Action: action, Value: value}}
+		a.keys[id] = k
+	}
+	k.limits = adaptiveLimitsFor(territory)
+	a.settle(k)
+	if now.Before(k.Next) {
+		return false
+	}
+	k.running = true
+	k.pages = 0
+	k.items = 0
+	k.LastRun = now
+	return true
+}
+
+// Records a page of results for a keyword being harvested. Items are the total for the harvest so far (see HarvestState).
+func (a *AdaptiveSchedule) Page(territory string, network string, action string, value string, itemsHarvested int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	k, ok := a.keys[adaptiveId(territory, network, action, value)]
+	if !ok || !k.running {
+		return
+	}
+	k.pages++
+	k.items = itemsHarvested
+}
+
+// Returns how each keyword is being polled.
+func (a *AdaptiveSchedule) Keys() []AdaptiveKey {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	keys := []AdaptiveKey{}
+	for _, k := range a.keys {
+		a.settle(k)
+		keys = append(keys, k.AdaptiveKey)
+	}
+	return keys
+}
+
+// Works out when the keyword is due next from the last harvest of it. Harvests are settled when they're looked at next, rather than when
+// they end, so the harvest functions don't need to say when they're done with a keyword. Must be called with the lock held.
+func (a *AdaptiveSchedule) settle(k *adaptiveKey) {
+	if !k.running {
+		return
+	}
+	k.running = false
+	l := k.limits
+
+	fill := 0.0
+	if k.pages > 0 {
+		fill = float64(k.items) / float64(k.pages*l.perPage)
+		k.ItemsPerPage = average(k.ItemsPerPage, float64(k.items)/float64(k.pages), k.PagesPerRun == 0)
+	}
+	k.PagesPerRun = average(k.PagesPerRun, float64(k.pages), k.PagesPerRun == 0)
+
+	interval := k.Interval
+	switch {
+	case interval == 0:
+		interval = l.min
+	case k.items == 0:
+		interval *= 2
+	case k.pages >= l.maxPages || fill >= 0.75:
+		// There was probably more to get
+		interval /= 2
+	case fill < 0.25:
+		interval = interval * 3 / 2
+	}
+	interval = clampDuration(interval, l.min, l.max)
+
+	// Stretch the interval if polling this often would go over the network's budget of API calls
+	if l.callsPerHour > 0 {
+		calls := k.PagesPerRun / interval.Hours()
+		for id, other := range a.keys {
+			if other != k && other.Interval > 0 && strings.HasPrefix(id, k.Territory+"|"+k.Network+"|") {
+				calls += other.PagesPerRun / other.Interval.Hours()
+			}
+		}
+		if calls > float64(l.callsPerHour) {
+			interval = clampDuration(time.Duration(float64(interval)*calls/float64(l.callsPerHour)), l.min, l.max)
+		}
+	}
+
+	k.Interval = interval
+	k.Next = k.LastRun.Add(interval)
+}
+
+func adaptiveId(territory string, network string, action string, value string) string {
+	return territory + "|" + network + "|" + action + "|" + value
+}
+
+func average(avg float64, value float64, first bool) float64 {
+	if first {
+		return value
+	}
+	return avg*(1-adaptiveWeight) + value*adaptiveWeight
+}
+
+func clampDuration(d time.Duration, min time.Duration, max time.Duration) time.Duration {
+	if d < min {
+		return min
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
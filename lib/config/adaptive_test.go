@@ -0,0 +1,68 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+// Harvests the keyword if it's due and returns the interval worked out for it afterwards.
+func adaptiveHarvest(a *AdaptiveSchedule, territory Territory, now time.Time, pages int, items int) (bool, time.Duration) {
+	if !a.Begin(territory, "twitter", "TwitterPublicMessagesByKeyword", "golang", now) {
+		return false, 0
+	}
+	for i := 1; i <= pages; i++ {
+		a.Page(territory.Name, "twitter", "TwitterPublicMessagesByKeyword", "golang", items*i/pages)
+	}
+	keys := a.Keys()
+	return true, keys[0].Interval
+}
+
+func TestAdaptiveScheduleFollowsVelocity(t *testing.T) {
+	territory := Territory{Name: "test"}
+	territory.Schedule.Adaptive.Enabled = true
+	territory.Schedule.Adaptive.MinMinutes = 10
+	territory.Schedule.Adaptive.MaxMinutes = 80
+	territory.Limits.ResultsPerPage = "100"
+	a := NewAdaptiveSchedule()
+	now := time.Now()
+
+	// The first harvest starts at the minimum interval
+	_, interval := adaptiveHarvest(a, territory, now, 1, 50)
+	if interval != 10*time.Minute {
+		t.Fatalf("expected the minimum interval, got %s", interval)
+	}
+	if due := a.Begin(territory, "twitter", "TwitterPublicMessagesByKeyword", "golang", now.Add(5*time.Minute)); due {
+		t.Error("the keyword should not be due before its interval")
+	}
+
+	// Nothing harvested backs off, up to the maximum
+	for i := 1; i <= 4; i++ {
+		now = now.Add(interval)
+		_, interval = adaptiveHarvest(a, territory, now, 1, 0)
+	}
+	if interval != 80*time.Minute {
+		t.Errorf("expected idle keywords to back off to the maximum interval, got %s", interval)
+	}
+
+	// Full pages speed it back up
+	now = now.Add(interval)
+	_, interval = adaptiveHarvest(a, territory, now, 2, 200)
+	if interval != 40*time.Minute {
+		t.Errorf("expected a busy keyword to be polled twice as often, got %s", interval)
+	}
+}
+
+func TestAdaptiveScheduleStaysWithinCallBudget(t *testing.T) {
+	territory := Territory{Name: "test"}
+	territory.Schedule.Adaptive.Enabled = true
+	territory.Schedule.Adaptive.MinMinutes = 10
+	territory.Schedule.Adaptive.MaxMinutes = 120
+	territory.Schedule.Adaptive.MaxCallsPerHour = 6
+	a := NewAdaptiveSchedule()
+
+	// 2 pages every 10 minutes would be 12 calls an hour
+	_, interval := adaptiveHarvest(a, territory, time.Now(), 2, 200)
+	if interval != 20*time.Minute {
+		t.Errorf("expected the interval to be stretched to stay within budget, got %s", interval)
+	}
+}
@@ -0,0 +1,269 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"database/sql"
+	"github.com/SocialHarvestVendors/sqlx"
+	"log"
+	"sync"
+	"time"
+)
+
+// Keeps track of what each territory spent of its budgets (see Budget). Spending is counted by the hour and by the day (starting on the
+// hour and at midnight) and once a budget runs out, the territory isn't harvested from that network until the next hour or day. Spending
+// is saved to the store (see SetStore()) as it happens and read back at the start of each hour and day, so it carries over restarts.
+type BudgetTracker struct {
+	spent map[string]*budgetSpending
+	store BudgetStore
+	mu    sync.Mutex
+}
+
+// Where budget spending is saved. SocialHarvestDB is one (the budget_spending table).
+type BudgetStore interface {
+	// Adds to what a territory spent on a network in the period ("hour" or "day") that began at start
+	AddBudgetSpending(territory string, network string, period string, start time.Time, calls int, items int) error
+	// Returns the calls made and items harvested by a territory from a network in the period that began at start
+	BudgetSpending(territory string, network string, period string, start time.Time) (int, int, error)
+}
+
+const (
+	BudgetHour = "hour"
+	BudgetDay  = "day"
+)
+
+// Saved spending is kept for a couple of days, it's only needed until the day is over.
+const budgetSpendingKept = 2
+
+type budgetSpending struct {
+	hour      time.Time
+	day       time.Time
+	hourCalls int
+	hourItems int
+	dayCalls  int
+	dayItems  int
+}
+
+// What's left of a territory's budget for a network. A remaining value of -1 means there's no limit.
+type BudgetStatus struct {
+	Territory         string    `json:"territory"`
+	Network           string    `json:"network"`
+	Budget            Budget    `json:"budget"`
+	CallsThisHour     int       `json:"callsThisHour"`
+	CallsToday        int       `json:"callsToday"`
+	ItemsThisHour     int       `json:"itemsThisHour"`
+	ItemsToday        int       `json:"itemsToday"`
+	CallsLeftThisHour int       `json:"callsLeftThisHour"`
+	CallsLeftToday    int       `json:"callsLeftToday"`
+	ItemsLeftThisHour int       `json:"itemsLeftThisHour"`
+	ItemsLeftToday    int       `json:"itemsLeftToday"`
+	Exhausted         bool      `json:"exhausted"`
+	ExhaustedUntil    time.Time `json:"exhaustedUntil,omitempty"`
+}
+
+func NewBudgetTracker() *BudgetTracker {
+	return &BudgetTracker{spent: map[string]*budgetSpending{}}
+}
+
+// Returns the territory's budget for the network and whether or not it has one.
+func (t Territory) BudgetFor(network string) (Budget, bool) {
+	if b, ok := t.Limits.Budgets[network]; ok {
+		return b, true
+	}
+	b, ok := t.Limits.Budgets["everything"]
+	return b, ok
+}
+
+// Sets where spending is saved (nil to only keep it in memory). Spending is read back from it from then on.
+func (b *BudgetTracker) SetStore(store BudgetStore) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.store = store
+	b.spent = map[string]*budgetSpending{}
+}
+
+// Records API calls made and items harvested for a territory from a network.
+func (b *BudgetTracker) Spend(territory string, network string, calls int, items int, now time.Time) {
+	b.mu.Lock()
+	s := b.spending(territory, network, now)
+	s.hourCalls += calls
+	s.dayCalls += calls
+	s.hourItems += items
+	s.dayItems += items
+	store, hour, day := b.store, s.hour, s.day
+	b.mu.Unlock()
+
+	if store == nil || (calls == 0 && items == 0) {
+		return
+	}
+	if err := store.AddBudgetSpending(territory, network, BudgetHour, hour, calls, items); err != nil {
+		log.Println(err)
+	}
+	if err := store.AddBudgetSpending(territory, network, BudgetDay, day, calls, items); err != nil {
+		log.Println(err)
+	}
+}
+
+// Whether or not the territory has budget left to harvest from the network.
+func (b *BudgetTracker) Allows(territory Territory, network string, now time.Time) bool {
+	return !b.Status(territory, network, now).Exhausted
+}
+
+// Returns what the territory spent of its budget for the network and what's left.
+func (b *BudgetTracker) Status(territory Territory, network string, now time.Time) BudgetStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.spending(territory.Name, network, now)
+	budget, _ := territory.BudgetFor(network)
+	status := BudgetStatus{
+		Territory:         territory.Name,
+		Network:           network,
+		Budget:            budget,
+		CallsThisHour:     s.hourCalls,
+		CallsToday:        s.dayCalls,
+		ItemsThisHour:     s.hourItems,
+		ItemsToday:        s.dayItems,
+		CallsLeftThisHour: remaining(budget.CallsPerHour, s.hourCalls),
+		CallsLeftToday:    remaining(budget.CallsPerDay, s.dayCalls),
+		ItemsLeftThisHour: remaining(budget.ItemsPerHour, s.hourItems),
+		ItemsLeftToday:    remaining(budget.ItemsPerDay, s.dayItems),
+	}
+	// The daily budget running out outlasts the hourly one
+	if status.CallsLeftToday == 0 || status.ItemsLeftToday == 0 {
+		status.Exhausted = true
+		status.ExhaustedUntil = s.day.AddDate(0, 0, 1)
+	} else if status.CallsLeftThisHour == 0 || status.ItemsLeftThisHour == 0 {
+		status.Exhausted = true
+		status.ExhaustedUntil = s.hour.Add(time.Hour)
+	}
+	return status
+}
+
+// Returns the spending for the current hour and day, starting them over (with whatever was saved for them) when a new hour or day begins.
+// Must be called with the lock held.
+func (b *BudgetTracker) spending(territory string, network string, now time.Time) *budgetSpending {
+	key := territory + "|" + network
+	s, ok := b.spent[key]
+	if !ok {
+		s = &budgetSpending{}
+		b.spent[key] = s
+	}
+	hour := now.Truncate(time.Hour)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if !s.hour.Equal(hour) {
+		s.hour = hour
+		s.hourCalls, s.hourItems = b.saved(territory, network, BudgetHour, hour)
+	}
+	if !s.day.Equal(day) {
+		s.day = day
+		s.dayCalls, s.dayItems = b.saved(territory, network, BudgetDay, day)
+	}
+	return s
+}
+
+// Returns the calls and items saved for the period (nothing if there's no store or it can't be read).
+func (b *BudgetTracker) saved(territory string, network string, period string, start time.Time) (int, int) {
+	if b.store == nil {
+		return 0, 0
+	}
+	calls, items, err := b.store.BudgetSpending(territory, network, period, start)
+	if err != nil {
+		log.Println(err)
+		return 0, 0
+	}
+	return calls, items
+}
+
+func remaining(limit int, spent int) int {
+	if limit <= 0 {
+		return -1
+	}
+	if spent >= limit {
+		return 0
+	}
+	return limit - spent
+}
+
+// Adds to the spending saved for a period, adding a row for it if there's none yet (and removing the rows of periods long gone).
+func saveBudgetSpending(db *sqlx.DB, dialect string, territory string, network string, period string, start time.Time, calls int, items int) error {
+	p := placeholderFor(dialect)
+	c := func(column string) string {
+		return quoteColumn(dialect, column)
+	}
+	update := "UPDATE budget_spending SET " + c("calls") + " = " + c("calls") + " + " + p(1) + ", " + c("items") + " = " + c("items") + " + " + p(2) +
+		" WHERE " + c("territory") + " = " + p(3) + " AND " + c("network") + " = " + p(4) + " AND " + c("period") + " = " + p(5) + " AND " + c("start") + " = " + p(6)
+	res, err := db.Exec(update, calls, items, territory, network, period, start)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+
+	_, err = db.Exec("INSERT INTO budget_spending ("+quoteColumns(dialect, []string{"territory", "network", "period", "start", "calls", "items"})+") VALUES ("+p(1)+", "+p(2)+", "+p(3)+", "+p(4)+", "+p(5)+", "+p(6)+")", territory, network, period, start, calls, items)
+	if err != nil {
+		// Another harvester sharing the database added it in the meantime (or MySQL didn't count a row that didn't change)
+		_, err = db.Exec(update, calls, items, territory, network, period, start)
+		return err
+	}
+	_, err = db.Exec("DELETE FROM budget_spending WHERE "+c("start")+" < "+p(1), start.AddDate(0, 0, -budgetSpendingKept))
+	return err
+}
+
+// Returns the calls and items saved for a period (none if there's no row for it).
+func savedBudgetSpending(db *sqlx.DB, dialect string, territory string, network string, period string, start time.Time) (int, int, error) {
+	p := placeholderFor(dialect)
+	c := func(column string) string {
+		return quoteColumn(dialect, column)
+	}
+	spent := struct {
+		Calls int `db:"calls"`
+		Items int `db:"items"`
+	}{}
+	err := db.Get(&spent, "SELECT "+c("calls")+", "+c("items")+" FROM budget_spending WHERE "+c("territory")+" = "+p(1)+" AND "+c("network")+" = "+p(2)+" AND "+c("period")+" = "+p(3)+" AND "+c("start")+" = "+p(4), territory, network, period, start)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	return spent.Calls, spent.Items, err
+}
+
+// Adds to what a territory spent of its budget for a network in a period (see BudgetTracker). Without a SQL database there's nowhere to
+// save it, so it's only kept in memory.
+func (database *SocialHarvestDB) AddBudgetSpending(territory string, network string, period string, start time.Time, calls int, items int) error {
+	if database == nil {
+		return nil
+	}
+	m, ok := database.Store.(Migratable)
+	if !ok {
+		return nil
+	}
+	db, dialect := m.SQL()
+	return saveBudgetSpending(db, dialect, territory, network, period, start, calls, items)
+}
+
+// Returns what a territory spent of its budget for a network in a period (nothing without a SQL database).
+func (database *SocialHarvestDB) BudgetSpending(territory string, network string, period string, start time.Time) (int, int, error) {
+	if database == nil {
+		return 0, 0, nil
+	}
+	m, ok := database.Store.(Migratable)
+	if !ok {
+		return 0, 0, nil
+	}
+	db, dialect := m.SQL()
+	return savedBudgetSpending(db, dialect, territory, network, period, start)
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBudgetRunsOutAndStartsOver(t *testing.T) {
+	territory := Territory{Name: "test"}
+	territory.Limits.Budgets = map[string]Budget{
+		"everything": Budget{CallsPerHour: 2},
+		"twitter":    Budget{ItemsPerDay: 100},
+	}
+	b := NewBudgetTracker()
+	now := time.Date(2014, 10, 1, 12, 30, 0, 0, time.UTC)
+
+	b.Spend("test", "facebook", 2, 10, now)
+	status := b.Status(territory, "facebook", now)
+	if !status.Exhausted || status.CallsLeftThisHour != 0 || status.ItemsLeftToday != -1 {
+		t.Errorf("expected the hourly call budget to run out, got %+v", status)
+	}
+	if !status.ExhaustedUntil.Equal(time.Date(2014, 10, 1, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the budget to be exhausted until the next hour, got %s", status.ExhaustedUntil)
+	}
+	if !b.Allows(territory, "facebook", now.Add(time.Hour)) {
+		t.Error("the budget should start over the next hour")
+	}
+
+	// Twitter has its own budget
+	b.Spend("test", "twitter", 5, 60, now)
+	if !b.Allows(territory, "twitter", now) {
+		t.Error("the twitter budget has items left")
+	}
+	b.Spend("test", "twitter", 1, 40, now.Add(2*time.Hour))
+	if b.Allows(territory, "twitter", now.Add(3*time.Hour)) {
+		t.Error("the daily item budget should have run out")
+	}
+	if !b.Allows(territory, "twitter", now.AddDate(0, 0, 1)) {
+		t.Error("the daily budget should start over the next day")
+	}
+}
+
+// Keeps budget spending in memory, like the budget_spending table.
+type memoryBudgetStore struct {
+	spent map[string][2]int
+	lock  sync.Mutex
+}
+
+func (s *memoryBudgetStore) AddBudgetSpending(territory string, network string, period string, start time.Time, calls int, items int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := territory + "|" + network + "|" + period + "|" + start.String()
+	s.spent[key] = [2]int{s.spent[key][0] + calls, s.spent[key][1] + items}
+	return nil
+}
+
+func (s *memoryBudgetStore) BudgetSpending(territory string, network string, period string, start time.Time) (int, int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	spent := s.spent[territory+"|"+network+"|"+period+"|"+start.String()]
+	return spent[0], spent[1], nil
+}
+
+func TestBudgetSpendingCarriesOverRestarts(t *testing.T) {
+	territory := Territory{Name: "test"}
+	territory.Limits.Budgets = map[string]Budget{"twitter": Budget{CallsPerHour: 3, ItemsPerDay: 100}}
+	store := &memoryBudgetStore{spent: map[string][2]int{}}
+	now := time.Date(2014, 10, 1, 12, 30, 0, 0, time.UTC)
+
+	b := NewBudgetTracker()
+	b.SetStore(store)
+	b.Spend("test", "twitter", 2, 60, now)
+
+	// A new tracker (after a restart) picks up where the last one left off
+	restarted := NewBudgetTracker()
+	restarted.SetStore(store)
+	status := restarted.Status(territory, "twitter", now.Add(10*time.Minute))
+	if status.CallsThisHour != 2 || status.ItemsToday != 60 {
+		t.Errorf("expected the saved spending to be read back, got %+v", status)
+	}
+	restarted.Spend("test", "twitter", 1, 0, now.Add(10*time.Minute))
+	if restarted.Allows(territory, "twitter", now.Add(10*time.Minute)) {
+		t.Error("the hourly call budget should have run out")
+	}
+
+	// The next hour only the day's spending carries over
+	status = NewBudgetTracker().Status(territory, "twitter", now.Add(time.Hour))
+	if status.CallsThisHour != 0 {
+		t.Errorf("expected nothing to be spent without a store, got %+v", status)
+	}
+	b.SetStore(store)
+	status = b.Status(territory, "twitter", now.Add(time.Hour))
+	if status.CallsThisHour != 0 || status.CallsToday != 3 || status.ItemsToday != 60 {
+		t.Errorf("expected a new hour with the day's spending, got %+v", status)
+	}
+}
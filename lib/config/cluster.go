@@ -0,0 +1,230 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Several harvesters can share the same config and database and split the work between them. Each one records a heartbeat in the
+// "harvester_nodes" table and the nodes with a recent heartbeat make up the cluster. Territories (or territory/network pairs) are assigned
+// to nodes using rendezvous hashing, so every node comes to the same answer on its own and when a node joins or dies only its share moves.
+type SocialHarvestCluster struct {
+	NodeId   string
+	Hostname string
+	Started  time.Time
+	Database *SocialHarvestDB
+	enabled  bool
+	shardBy  string
+	interval time.Duration
+	nodes    []string
+	mu       sync.RWMutex
+}
+
+const (
+	ShardByTerritory = "territory"
+	ShardByNetwork   = "network"
+)
+
+// How often heartbeats are sent by default. A node is considered gone after missing 3 of them.
+const defaultHeartbeatSeconds = 15
+
+// Sets up the cluster membership for this harvester. If clustering isn't enabled (or there's no database), this node owns everything.
+func NewCluster(config SocialHarvestConf, database *SocialHarvestDB) *SocialHarvestCluster {
+	hostname, _ := os.Hostname()
+	c := &SocialHarvestCluster{
+		NodeId:   config.Cluster.NodeId,
+		Hostname: hostname,
+		Started:  time.Now(),
+		Database: database,
+	}
+	if c.NodeId == "" {
+		c.NodeId = hostname + "-" + strconv.Itoa(os.Getpid())
+	}
+	c.Configure(config)
+	go c.heartbeats()
+	return c
+}
+
+// Applies the cluster settings from the config (on start up and when the config is reloaded). The node id can't be changed.
+func (c *SocialHarvestCluster) Configure(config SocialHarvestConf) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enabled = config.Cluster.Enabled
+	c.shardBy = ShardByTerritory
+	if config.Cluster.ShardBy == ShardByNetwork {
+		c.shardBy = ShardByNetwork
+	}
+	c.interval = time.Duration(config.Cluster.HeartbeatSeconds) * time.Second
+	if c.interval <= 0 {
+		c.interval = defaultHeartbeatSeconds * time.Second
+	}
+	if !c.enabled {
+		c.nodes = []string{}
+	}
+}
+
+// Whether or not clustering is enabled.
+func (c *SocialHarvestCluster) Enabled() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.enabled
+}
+
+// How the work is split, either ShardByTerritory or ShardByNetwork.
+func (c *SocialHarvestCluster) ShardBy() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.shardBy
+}
+
+// Returns the ids of the nodes currently in the cluster (including this one).
+func (c *SocialHarvestCluster) Nodes() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.members()
+}
+
+// Returns the key work is assigned by for the territory and network.
+func (c *SocialHarvestCluster) ShardKey(territory string, network string) string {
+	if c.ShardBy() == ShardByNetwork {
+		return territory + "|" + network
+	}
+	return territory
+}
+
+// Returns the id of the node that harvests the territory and network.
+func (c *SocialHarvestCluster) Owner(territory string, network string) string {
+	key := c.ShardKey(territory, network)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return rendezvousOwner(c.members(), key)
+}
+
+// Whether or not this node harvests the territory and network.
+func (c *SocialHarvestCluster) Owns(territory string, network string) bool {
+	if !c.Enabled() {
+		return true
+	}
+	return c.Owner(territory, network) == c.NodeId
+}
+
+// Removes this node from the cluster right away (rather than waiting for the others to notice its heartbeat stopped).
+func (c *SocialHarvestCluster) Leave() {
+	if database := c.database(); c.Enabled() && database != nil {
+		database.RemoveNode(c.NodeId)
+	}
+}
+
+// Changes the database heartbeats are recorded in (when the config is reloaded).
+func (c *SocialHarvestCluster) SetDatabase(database *SocialHarvestDB) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Database = database
+}
+
+func (c *SocialHarvestCluster) database() *SocialHarvestDB {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Database
+}
+
+// Must be called with the lock held (read is fine).
+func (c *SocialHarvestCluster) members() []string {
+	// This node is always a member, even before its first heartbeat made it into the database (or if the database is unreachable)
+	if !containsString(c.nodes, c.NodeId) {
+		return append([]string{c.NodeId}, c.nodes...)
+	}
+	nodes := make([]string, len(c.nodes))
+	copy(nodes, c.nodes)
+	return nodes
+}
+
+func (c *SocialHarvestCluster) heartbeats() {
+	for {
+		c.mu.RLock()
+		enabled, interval, database := c.enabled, c.interval, c.Database
+		c.mu.RUnlock()
+		if enabled && database != nil {
+			c.heartbeat(database, interval)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Records this node's heartbeat and refreshes the list of nodes. If the database can't be reached, the last known list is kept.
+func (c *SocialHarvestCluster) heartbeat(database *SocialHarvestDB, interval time.Duration) {
+	now := time.Now()
+	err := database.NodeHeartbeat(HarvesterNode{Id: c.NodeId, Hostname: c.Hostname, Started: c.Started, Heartbeat: now})
+	if err != nil {
+		log.Println("Cluster heartbeat failed: " + err.Error())
+		return
+	}
+	gone := now.Add(-3 * interval)
+	nodes, err := database.Nodes(gone)
+	if err != nil {
+		log.Println("Could not get the cluster nodes: " + err.Error())
+		return
+	}
+	ids := []string{}
+	for _, n := range nodes {
+		ids = append(ids, n.Id)
+	}
+
+	c.mu.Lock()
+	if !sameStrings(ids, c.nodes) {
+		log.Println("Cluster membership changed, " + strconv.Itoa(len(ids)) + " nodes: " + strings.Join(ids, ", "))
+	}
+	c.nodes = ids
+	c.mu.Unlock()
+
+	// Clean up after nodes that have been gone a while
+	database.RemoveStaleNodes(now.Add(-10 * interval))
+}
+
+// Picks the node with the highest hash for the key (highest random weight).
+func rendezvousOwner(nodes []string, key string) string {
+	owner := ""
+	var highest uint64
+	for _, node := range nodes {
+		h := fnv.New64a()
+		h.Write([]byte(node + "|" + key))
+		weight := h.Sum64()
+		if owner == "" || weight > highest {
+			owner, highest = node, weight
+		}
+	}
+	return owner
+}
+
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestRendezvousOwnerOnlyMovesWhatItMust(t *testing.T) {
+	territories := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	before := map[string]string{}
+	for _, territory := range territories {
+		before[territory] = rendezvousOwner([]string{"node1", "node2", "node3"}, territory)
+	}
+
+	// node2 dies, only its territories should move
+	for _, territory := range territories {
+		owner := rendezvousOwner([]string{"node1", "node3"}, territory)
+		if before[territory] != "node2" && owner != before[territory] {
+			t.Errorf("territory %s moved from %s to %s", territory, before[territory], owner)
+		}
+		if owner == "node2" {
+			t.Errorf("territory %s is still owned by a dead node", territory)
+		}
+	}
+}
+
+func TestClusterOwnsEverythingWhenDisabled(t *testing.T) {
+	c := &SocialHarvestCluster{NodeId: "node1"}
+	c.Configure(SocialHarvestConf{})
+	if !c.Owns("foo", "twitter") {
+		t.Error("expected a node to own everything when clustering is disabled")
+	}
+
+	conf := SocialHarvestConf{}
+	conf.Cluster.Enabled = true
+	conf.Cluster.ShardBy = ShardByNetwork
+	c.Configure(conf)
+	c.nodes = []string{"node0", "node2"}
+	if len(c.Nodes()) != 3 {
+		t.Errorf("expected this node to always be a member, got %v", c.Nodes())
+	}
+	if c.ShardKey("foo", "twitter") != "foo|twitter" {
+		t.Errorf("expected territory/network pairs to be sharded, got %s", c.ShardKey("foo", "twitter"))
+	}
+}
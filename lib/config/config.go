@@ -18,18 +18,21 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type SocialHarvest struct {
-	Config   SocialHarvestConf
 	Schedule *SocialHarvestSchedule
-	Database *SocialHarvestDB
+	Cluster  *SocialHarvestCluster
+	Budgets  *BudgetTracker
 }
 
 type HarvestState struct {
@@ -37,6 +40,8 @@ type HarvestState struct {
 	LastTime       time.Time
 	PagesHarvested int
 	ItemsHarvested int
+	// Why the last page couldn't be harvested (nil if it was)
+	Error error
 }
 
 type Harvest struct{}
@@ -68,13 +73,39 @@ type SocialHarvestConf struct {
 		Password      string `json:"password"`
 		Database      string `json:"database"`
 		RetentionDays int    `json:"retentionDays"`
-		PartitionDays int    `json:"partitionDays"`
+		// Days to keep particular series for instead of retentionDays (ie. {"contributor_growth": 365}), 0 keeps a series forever
+		Retention map[string]int `json:"retention"`
+		// Expired rows are deleted this many at a time, where whole partitions can't be dropped (default 1000)
+		PurgeBatchSize int `json:"purgeBatchSize"`
+		PartitionDays  int `json:"partitionDays"`
+		// Applies any schema migrations that haven't been applied when the harvester starts (SQLite always does)
+		AutoMigrate bool `json:"autoMigrate"`
+		// Harvested data is queued by series and written in batches by a few writers for each series (defaults 100 rows, a queue of
+		// 1000 rows, 2 writers and 1 second). Harvests wait when a queue is full.
+		BatchSize    int `json:"batchSize"`
+		QueueSize    int `json:"queueSize"`
+		Writers      int `json:"writers"`
+		FlushSeconds int `json:"flushSeconds"`
 	} `json:"database"`
 	Schema struct {
 		Compact bool `json:"compact"`
 	} `json:"schema"`
 	Logs struct {
 		Directory string `json:"directory"`
+		// How often buffered log data is written out, even if the buffer isn't full (default 60)
+		FlushSeconds int `json:"flushSeconds"`
+		// Log files are rotated once they reach either size or age (defaults 10MB and 60 minutes)
+		MaxFileBytes  int  `json:"maxFileBytes"`
+		RotateMinutes int  `json:"rotateMinutes"`
+		Compress      bool `json:"compress"`
+		// Writes a ".manifest.json" next to each log file once it's complete
+		Manifest bool `json:"manifest"`
+		// The number of log workers for each series and the size of each one's buffer (defaults 4 and 65536)
+		Workers     int `json:"workers"`
+		BufferBytes int `json:"bufferBytes"`
+		// What to do when the log workers can't keep up: "block", "spill" (to disk) or "drop" (default), for all series or by series
+		Overflow       string            `json:"overflow"`
+		SeriesOverflow map[string]string `json:"seriesOverflow"`
 	} `json:"logs"`
 	Debug struct {
 		WebProfile bool `json:"webProfile"`
@@ -83,64 +114,195 @@ type SocialHarvestConf struct {
 			ReleaseStage string `json:"releaseStage"`
 		} `json:"bugsnag"`
 	} `json:"debug"`
+	// Several harvesters sharing the same config and database can split the territories between them
+	Cluster struct {
+		Enabled bool `json:"enabled"`
+		// Defaults to the hostname and process id
+		NodeId string `json:"nodeId"`
+		// "territory" (default) or "network" to split territory/network pairs
+		ShardBy          string `json:"shardBy"`
+		HeartbeatSeconds int    `json:"heartbeatSeconds"`
+	} `json:"cluster"`
 	Services ServicesConfig `json:"services"`
 	Harvest  HarvestConfig  `json:"harvest"`
+	// Where harvested data goes. Without any sinks, it's stored in the database and written to the log files.
+	Sinks []SinkConfig `json:"sinks"`
+}
+
+// An output for harvested data (see harvester.Emit()). Each sink has its own queue, retries and filters so a slow or failing one
+// doesn't hold up the others (unless it's set to block when its queue is full).
+type SinkConfig struct {
+	// "database", "log", "stdout" or "webhook" (or any type registered with harvester.RegisterSink())
+	Type string `json:"type"`
+	// Identifies the sink in the stats, defaults to the type
+	Name string `json:"name"`
+	// Only these series go to the sink, all of them if empty
+	Series  []string     `json:"series"`
+	Filters []SinkFilter `json:"filters"`
+	// Where the webhook sink posts batches of records to, with any extra headers
+	Url     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// Records are queued and written in batches at least every few seconds. Without a queue, records are written as they're
+	// harvested (the default for the database and log sinks, which buffer on their own).
+	QueueSize    int `json:"queueSize"`
+	BatchSize    int `json:"batchSize"`
+	FlushSeconds int `json:"flushSeconds"`
+	// A batch that fails is tried again this many times, waiting longer each time, before it's dropped (defaults 3 and 1). Set
+	// retries to 0 to never try again.
+	Retries      *int `json:"retries"`
+	RetrySeconds int  `json:"retrySeconds"`
+	// "block" (default) waits for room in a full queue, "drop" throws the record away
+	Overflow string `json:"overflow"`
+}
+
+// Keeps (or with exclude, leaves out) records whose field has one of the values. The field is the name used in the log files and
+// database (ie. "network" or "contributor_lang"). Records without the field aren't filtered.
+type SinkFilter struct {
+	Field   string   `json:"field"`
+	Values  []string `json:"values"`
+	Exclude bool     `json:"exclude"`
 }
 
 type HarvestConfig struct {
-	QuestionRegex string `json:"questionRegex"`
-	Territories   []struct {
-		Services ServicesConfig `json:"-"`
-		Name     string         `json:"name"`
-		Content  struct {
-			Options struct {
-				KeepMessage          bool   `json:"keepMessage"`
-				Lang                 string `json:"lang"`
-				TwitterGeocode       string `json:"twitterGeocode"`
-				OnlyUseInstagramTags bool   `json:"onlyUseInstagramTags"`
-			} `json:"options"`
-			Keywords      []string `json:"keywords"`
-			Urls          []string `json:"urls"`
-			InstagramTags []string `json:"instagramTags"`
-		} `json:"content"`
-		Accounts struct {
-			Twitter    []string `json:"twitter"`
-			Facebook   []string `json:"facebook"`
-			GooglePlus []string `json:"googlePlus"`
-			YouTube    []string `json:"youTube"`
-			Instagram  []string `json:"instagram"`
-		} `json:"accounts"`
-		Schedule struct {
-			Everything struct {
-				Content  string `json:"content"`
-				Accounts string `json:"accounts"`
-				Streams  string `json:"streams"`
-			} `json:"everything"`
-			Twitter struct {
-				Content  string `json:"content"`
-				Accounts string `json:"accounts"`
-				Streams  string `json:"streams"`
-			} `json:"twitter"`
-			Facebook struct {
-				Content  string `json:"content"`
-				Accounts string `json:"accounts"`
-				Streams  string `json:"streams"`
-			} `json:"facebook"`
-			GooglePlus struct {
-				Content  string `json:"content"`
-				Accounts string `json:"accounts"`
-			} `json:"googlePlus"`
-			YouTube struct {
-				Content  string `json:"content"`
-				Accounts string `json:"accounts"`
-				Streams  string `json:"streams"`
-			} `json:"youTube"`
-		} `json:"schedule"`
-		Limits struct {
-			MaxResultsPages int    `json:"maxResultsPages"`
-			ResultsPerPage  string `json:"resultsPerPage"`
-		} `json:"limits"`
-	} `json:"territories"`
+	QuestionRegex string      `json:"questionRegex"`
+	Territories   []Territory `json:"territories"`
+	Engagement    Engagement  `json:"engagement"`
+}
+
+// Messages are looked up again once they reach each of the ages (ie. "1h", "24h" and "7d") to record their engagement counts at the
+// time. The schedule is how often to look for messages that reached an age (default every 15 minutes).
+type Engagement struct {
+	Ages     []string `json:"ages"`
+	Schedule string   `json:"schedule"`
+}
+
+// Returns the schedule for looking up engagement counts again.
+func (e Engagement) ScheduleSpec() string {
+	if e.Schedule == "" {
+		return "@every 15m"
+	}
+	return e.Schedule
+}
+
+// Returns the configured ages (skipping any that can't be parsed).
+func (e Engagement) AgeDurations() []time.Duration {
+	ages := []time.Duration{}
+	for _, a := range e.Ages {
+		age, err := ParseAge(a)
+		if err != nil {
+			log.Println("Invalid engagement age " + a + ": " + err.Error())
+			continue
+		}
+		ages = append(ages, age)
+	}
+	return ages
+}
+
+// Returns the messages' time range to look up again for each age. Messages reaching the age between the last and this lookup are due.
+// The first time around (or after a long while without lookups) it goes back no further than one day.
+func (e Engagement) Windows(last time.Time, now time.Time) map[time.Duration][2]time.Time {
+	if last.IsZero() || now.Sub(last) > 24*time.Hour {
+		last = now.Add(-24 * time.Hour)
+	}
+	windows := map[time.Duration][2]time.Time{}
+	for _, age := range e.AgeDurations() {
+		windows[age] = [2]time.Time{last.Add(-age), now.Add(-age)}
+	}
+	return windows
+}
+
+// Parses an age like time.ParseDuration() does, also allowing a number of days (ie. "7d").
+func ParseAge(age string) (time.Duration, error) {
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(age, "d"))
+		if err != nil || days <= 0 {
+			return 0, errors.New("not a number of days")
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(age)
+	if err == nil && d <= 0 {
+		err = errors.New("must be positive")
+	}
+	return d, err
+}
+
+// A territory is a set of criteria (keywords, accounts, etc.) to harvest from several social media networks on a schedule.
+type Territory struct {
+	Services ServicesConfig `json:"-"`
+	Name     string         `json:"name"`
+	Content  struct {
+		Options struct {
+			KeepMessage          bool   `json:"keepMessage"`
+			Lang                 string `json:"lang"`
+			TwitterGeocode       string `json:"twitterGeocode"`
+			OnlyUseInstagramTags bool   `json:"onlyUseInstagramTags"`
+		} `json:"options"`
+		Keywords      []string `json:"keywords"`
+		Urls          []string `json:"urls"`
+		InstagramTags []string `json:"instagramTags"`
+	} `json:"content"`
+	Accounts struct {
+		Twitter    []string `json:"twitter"`
+		Facebook   []string `json:"facebook"`
+		GooglePlus []string `json:"googlePlus"`
+		YouTube    []string `json:"youTube"`
+		Instagram  []string `json:"instagram"`
+	} `json:"accounts"`
+	Schedule struct {
+		Everything struct {
+			Content  string `json:"content"`
+			Accounts string `json:"accounts"`
+			Streams  string `json:"streams"`
+		} `json:"everything"`
+		Twitter struct {
+			Content  string `json:"content"`
+			Accounts string `json:"accounts"`
+			Streams  string `json:"streams"`
+		} `json:"twitter"`
+		Facebook struct {
+			Content  string `json:"content"`
+			Accounts string `json:"accounts"`
+			Streams  string `json:"streams"`
+		} `json:"facebook"`
+		GooglePlus struct {
+			Content  string `json:"content"`
+			Accounts string `json:"accounts"`
+		} `json:"googlePlus"`
+		YouTube struct {
+			Content  string `json:"content"`
+			Accounts string `json:"accounts"`
+			Streams  string `json:"streams"`
+		} `json:"youTube"`
+		Instagram struct {
+			Content  string `json:"content"`
+			Accounts string `json:"accounts"`
+		} `json:"instagram"`
+		// What to do when a job is still running when it's due again: "skip" (default), "queue" or "allow"
+		Overlap string `json:"overlap"`
+		// Polls busy keywords and accounts more often and quiet ones less often (see AdaptiveSchedule). Content jobs then run every
+		// minMinutes (default 5) instead of on their schedule and keywords are harvested when due, at most every maxMinutes (default 240).
+		Adaptive struct {
+			Enabled         bool `json:"enabled"`
+			MinMinutes      int  `json:"minMinutes"`
+			MaxMinutes      int  `json:"maxMinutes"`
+			MaxCallsPerHour int  `json:"maxCallsPerHour"`
+		} `json:"adaptive"`
+	} `json:"schedule"`
+	Limits struct {
+		MaxResultsPages int    `json:"maxResultsPages"`
+		ResultsPerPage  string `json:"resultsPerPage"`
+		// API calls and items harvested allowed for each network, by network name or "everything" for any network without its own budget
+		Budgets map[string]Budget `json:"budgets"`
+	} `json:"limits"`
+}
+
+// How much a territory can harvest from a network each hour and day. Zero means no limit.
+type Budget struct {
+	CallsPerHour int `json:"callsPerHour"`
+	CallsPerDay  int `json:"callsPerDay"`
+	ItemsPerHour int `json:"itemsPerHour"`
+	ItemsPerDay  int `json:"itemsPerDay"`
 }
 
 type ServicesConfig struct {
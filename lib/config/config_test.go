@@ -0,0 +1,41 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	for age, expected := range map[string]time.Duration{"1h": time.Hour, "90m": 90 * time.Minute, "7d": 7 * 24 * time.Hour} {
+		if d, err := ParseAge(age); err != nil || d != expected {
+			t.Errorf("expected %s to be %v, got %v (%v)", age, expected, d, err)
+		}
+	}
+	for _, age := range []string{"", "d", "-1h", "0d", "week"} {
+		if _, err := ParseAge(age); err == nil {
+			t.Errorf("expected %q to be invalid", age)
+		}
+	}
+}
+
+func TestEngagementWindows(t *testing.T) {
+	e := Engagement{Ages: []string{"1h", "1d", "nonsense"}}
+	now := time.Date(2014, 10, 15, 12, 0, 0, 0, time.UTC)
+	windows := e.Windows(now.Add(-15*time.Minute), now)
+	if len(windows) != 2 {
+		t.Fatalf("expected a window for each valid age, got %v", windows)
+	}
+	if w := windows[time.Hour]; !w[0].Equal(now.Add(-75*time.Minute)) || !w[1].Equal(now.Add(-time.Hour)) {
+		t.Errorf("unexpected window for messages an hour old: %v", w)
+	}
+	if w := windows[24*time.Hour]; w[1].Sub(w[0]) != 15*time.Minute {
+		t.Errorf("unexpected window for messages a day old: %v", w)
+	}
+	// Without a previous lookup it only goes back a day
+	if w := e.Windows(time.Time{}, now)[time.Hour]; w[1].Sub(w[0]) != 24*time.Hour {
+		t.Errorf("expected the first lookup to go back a day: %v", w)
+	}
+	if e.ScheduleSpec() != "@every 15m" {
+		t.Error("unexpected default schedule")
+	}
+}
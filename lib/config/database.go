@@ -17,29 +17,220 @@
 package config
 
 import (
-	"bytes"
-	//"github.com/asaskevich/govalidator"
-	_ "github.com/SocialHarvestVendors/pq"
+	"errors"
 	"github.com/SocialHarvestVendors/sqlx"
-	// _ "github.com/mathume/monet"
 	"log"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// The database harvested data is stored to. A database is optional (Social Harvest can just log to disk), so every method here does
+// nothing (or returns an error) when there isn't one. The work is done by a Storage, picked from those registered by the configured type.
 type SocialHarvestDB struct {
-	Postgres *sqlx.DB
-	MonetDB  *sqlx.DB
-	Series   []string
-	Schema   struct {
-		Compact bool `json:"compact"`
-	}
+	Store         Storage
+	Type          string
+	Series        []string
 	RetentionDays int
-	PartitionDays int
+	// Retention periods of series that differ from RetentionDays
+	Retention map[string]int
+	// How many expired rows are deleted at a time (see EnforceRetention())
+	PurgeBatchSize int
+	// What the latest retention run removed from each series
+	retention     map[string]RetentionReport
+	retentionLock sync.Mutex
+	// Writes harvested data in batches (see batchWriter)
+	writer *batchWriter
+	// Harvest cursors of the territories loaded at the start of their harvests (see LoadCursors()) and the number of harvests using them
+	cursors     map[string]SocialHarvestHarvest
+	cursorsFor  map[string]int
+	cursorsLock sync.Mutex
+}
+
+// A database backend. Each one stores the series (messages, shared links, etc.), the harvest cursors (where each harvest left off) and
+// settings, and can say whether or not it's reachable. A backend can optionally implement Locker, NodeStore, Partitioner and Purger too.
+type Storage interface {
+	// Stores a row of one of the series or a SocialHarvestHarvest, which is appended to the harvest history
+	StoreRow(row interface{}) error
+	// Saves where a harvest left off, replacing the cursor for its territory, network, action and value
+	SaveCursor(cursor SocialHarvestHarvest) error
+	// Returns the cursor for a territory, network, action and value (empty if there is none)
+	LastHarvest(territory string, network string, action string, value string) (SocialHarvestHarvest, error)
+	// Returns the cursors for a territory and network, both optional
+	Cursors(territory string, network string) ([]SocialHarvestHarvest, error)
+	// Removes cursors so harvests start over. The network, action and value are optional. Returns the number removed.
+	ResetCursors(territory string, network string, action string, value string) (int64, error)
+	SaveSettings(settingsRow Settings) error
+	Settings(key string) (Settings, error)
+	Ping() error
+	Close() error
+}
+
+// A Storage that can lock jobs for all the harvesters sharing the database (see SocialHarvestDB.JobLock()). Returns false if the lock is
+// held elsewhere or couldn't be checked.
+type Locker interface {
+	JobLock(key string, wait bool) (func(), bool)
+}
+
+// A Storage that can keep track of the harvesters in a cluster (see SocialHarvestCluster).
+type NodeStore interface {
+	NodeHeartbeat(node HarvesterNode) error
+	Nodes(since time.Time) ([]HarvesterNode, error)
+	RemoveNode(id string) error
+	RemoveStaleNodes(before time.Time) error
+}
+
+// A Storage that can partition the series tables by time. Partitions for the period holding the given time and the next few are created
+// if they don't exist yet.
+type Partitioner interface {
+	PreparePartitions(now time.Time) error
+}
+
+// A Storage that can remove expired data from a series. Partitions holding nothing but rows older than the given time are dropped, then
+// any other rows older than it are deleted batchSize at a time. Returns the number of rows removed and the partitions dropped.
+type Purger interface {
+	Purge(table string, before time.Time, batchSize int) (int64, []string, error)
+}
+
+// A Storage that can read back the messages harvested (their engagement counts anyway, see engagementColumns) from a territory and network
+// in a time range.
+type MessageReader interface {
+	Messages(territory string, network string, from time.Time, to time.Time) ([]SocialHarvestMessage, error)
+}
+
+// What the latest retention run removed from a series.
+type RetentionReport struct {
+	Series     string    `json:"series"`
+	Days       int       `json:"days"`
+	Before     time.Time `json:"before"`
+	Rows       int64     `json:"rows"`
+	Partitions []string  `json:"partitions"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+	// Rows removed by every run since the harvester connected to the database
+	TotalRows int64 `json:"totalRows"`
+}
+
+// Connects to a backend using the configuration.
+type StorageFactory func(config SocialHarvestConf) (Storage, error)
+
+var storageFactories = map[string]StorageFactory{}
+var storageLock sync.RWMutex
+
+// Keep a list of series (tables/collections/series - whatever the database calls them, we're going with series because we're really dealing with time with just about all our data)
+// These do relate to structures in lib/config/series.go
+var SeriesNames = []string{"messages", "shared_links", "mentions", "hashtags", "contributor_growth", "message_engagement"}
+
+// The downside to not using upper.io/db or something like it is that INSERT statements incur technical debt.
+// There will be a maintenance burden in keeping the field names up to date...But I think it's manageable.
+// ...and values have to be in the right order, maintaining this in a repeated fashion leads to spelling mistakes, etc. All the reasons I HATE dealing with SQL...But oh well.
+//
+// Returns the table (series) a row is stored in and its columns, which are named after the `db` tags of the row's struct. Certain series
+// will contain more or less data depending on configuration. Compact storage reduces the number of fields stored on series and assumes the
+// database supports JOINs (or is making some other query) to get the data from the `messages` series. This saves on disk space, but
+// increases query complexity. Full flat storage / expanded schema. This uses more disk space, but the queries should be faster. The table
+// is empty if the row isn't one of the series (or harvest state).
+func seriesColumns(row interface{}, compact bool) (string, []string) {
+	switch row.(type) {
+	case SocialHarvestMessage:
+		return "messages", []string{"time", "harvest_id", "territory", "network", "message_id", "contributor_id", "contributor_screen_name", "contributor_name", "contributor_gender", "contributor_type", "contributor_longitude", "contributor_latitude", "contributor_geohash", "contributor_lang", "contributor_country", "contributor_city", "contributor_region", "contributor_city_pop", "contributor_likes", "contributor_statuses_count", "contributor_listed_count", "contributor_followers", "contributor_verified", "message", "is_question", "category", "sentiment", "facebook_shares", "twitter_retweet_count", "twitter_favorite_count", "like_count", "google_plus_reshares", "google_plus_ones"}
+	case SocialHarvestMessageEngagement:
+		return "message_engagement", []string{"time", "harvest_id", "territory", "network", "message_id", "facebook_shares", "twitter_retweet_count", "twitter_favorite_count", "like_count", "google_plus_reshares", "google_plus_ones"}
+	case SocialHarvestSharedLink:
+		if compact {
+			return "shared_links", []string{"time", "harvest_id", "territory", "network", "message_id", "contributor_id", "type", "preview", "source", "url", "expanded_url", "host"}
+		}
+		return "shared_links", []string{"time", "harvest_id", "territory", "network", "message_id", "contributor_id", "contributor_screen_name", "contributor_name", "contributor_gender", "contributor_type", "contributor_longitude", "contributor_latitude", "contributor_geohash", "contributor_lang", "contributor_country", "contributor_city", "contributor_region", "contributor_city_pop", "type", "preview", "source", "url", "expanded_url", "host"}
+	case SocialHarvestMention:
+		if compact {
+			return "mentions", []string{"time", "harvest_id", "territory", "network", "message_id", "contributor_id", "mentioned_id", "mentioned_screen_name", "mentioned_name", "mentioned_gender", "mentioned_type", "mentioned_longitude", "mentioned_latitude", "mentioned_geohash", "mentioned_lang"}
+		}
+		return "mentions", []string{"time", "harvest_id", "territory", "network", "message_id", "contributor_id", "contributor_screen_name", "contributor_name", "contributor_gender", "contributor_type", "contributor_longitude", "contributor_latitude", "contributor_geohash", "contributor_lang", "mentioned_id", "mentioned_screen_name", "mentioned_name", "mentioned_gender", "mentioned_type", "mentioned_longitude", "mentioned_latitude", "mentioned_geohash", "mentioned_lang"}
+	case SocialHarvestHashtag:
+		if compact {
+			return "hashtags", []string{"time", "harvest_id", "territory", "network", "message_id", "tag", "keyword", "contributor_id"}
+		}
+		return "hashtags", []string{"time", "harvest_id", "territory", "network", "message_id", "tag", "keyword", "contributor_id", "contributor_screen_name", "contributor_name", "contributor_gender", "contributor_type", "contributor_longitude", "contributor_latitude", "contributor_geohash", "contributor_lang", "contributor_country", "contributor_city", "contributor_region", "contributor_city_pop"}
+	case SocialHarvestContributorGrowth:
+		return "contributor_growth", []string{"time", "harvest_id", "territory", "network", "contributor_id", "likes", "talking_about", "were_here", "checkins", "views", "status_updates", "listed", "favorites", "followers", "following", "plus_ones", "comments"}
+	case SocialHarvestHarvest:
+		return "harvest_history", []string{"territory", "network", "action", "value", "last_time_harvested", "last_id_harvested", "items_harvested", "harvest_time"}
+	}
+	return "", nil
+}
+
+// The columns of a message that change when it's harvested again (its engagement counts).
+var engagementColumns = []string{"facebook_shares", "twitter_retweet_count", "twitter_favorite_count", "like_count", "google_plus_reshares", "google_plus_ones"}
+
+// Updates the engagement counts of the messages that are already stored and returns the others (which still need to be inserted).
+func updateEngagement(db *sqlx.DB, messages []interface{}, placeholder func(n int) string) ([]interface{}, error) {
+	placeholders := make([]string, len(messages))
+	args := make([]interface{}, len(messages))
+	for i, m := range messages {
+		placeholders[i] = placeholder(i + 1)
+		args[i] = m.(SocialHarvestMessage).HarvestId
+	}
+	stored := []string{}
+	if err := db.Select(&stored, "SELECT harvest_id FROM messages WHERE harvest_id IN ("+strings.Join(placeholders, ", ")+")", args...); err != nil {
+		return messages, err
+	}
+	if len(stored) == 0 {
+		return messages, nil
+	}
+
+	set := make([]string, len(engagementColumns))
+	for i, c := range engagementColumns {
+		set[i] = c + " = :" + c
+	}
+	query := "UPDATE messages SET " + strings.Join(set, ", ") + " WHERE harvest_id = :harvest_id"
+	others := []interface{}{}
+	for _, m := range messages {
+		if !containsString(stored, m.(SocialHarvestMessage).HarvestId) {
+			others = append(others, m)
+			continue
+		}
+		if _, err := db.NamedExec(query, m); err != nil {
+			return messages, err
+		}
+	}
+	return others, nil
 }
 
-var database = SocialHarvestDB{}
+// Returns the query for the messages a MessageReader reads back, given how the database quotes the time column and its placeholders.
+func messagesQuery(timeColumn string, placeholder func(n int) string) string {
+	return "SELECT " + timeColumn + ", harvest_id, territory, network, message_id, " + strings.Join(engagementColumns, ", ") + " FROM messages WHERE territory = " +
+		placeholder(1) + " AND network = " + placeholder(2) + " AND " + timeColumn + " >= " + placeholder(3) + " AND " + timeColumn + " < " + placeholder(4) + " ORDER BY " + timeColumn
+}
+
+// The columns of the harvest cursors (and their history).
+var _, cursorColumns = seriesColumns(SocialHarvestHarvest{}, false)
+
+// Returns an insert statement with named parameters for the columns, ie. insertQuery("INSERT INTO", "messages", ...) or "INSERT OR IGNORE INTO".
+func insertQuery(insert string, table string, columns []string) string {
+	return insert + " " + table + " (" + strings.Join(columns, ", ") + ") VALUES (:" + strings.Join(columns, ", :") + ")"
+}
+
+// Makes a backend available for the given database type (backends register themselves when the package is initialized).
+func RegisterStorage(name string, factory StorageFactory) {
+	storageLock.Lock()
+	defer storageLock.Unlock()
+	storageFactories[name] = factory
+}
+
+// Returns the database types that can be configured.
+func StorageTypes() []string {
+	storageLock.RLock()
+	defer storageLock.RUnlock()
+	types := []string{}
+	for name := range storageFactories {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	return types
+}
 
 // Optional settings table/collection holds Social Harvest configurations and configured dashboards for persistence and clustered servers it is more or less a key value store.
 // Data is stored as JSON string. The Social Harvest config JSON string should easily map to the SocialHarvestConf struct. Other values could be for JavaScript on the front-end.
@@ -49,80 +240,86 @@ type Settings struct {
 	Modified time.Time `json:"modified" db:"modified" bson:"modified"`
 }
 
-// Initializes the database and returns the client, setting it to `database.Postgres` in the current package scope
+// A harvester that is (or was) part of the cluster. Each one updates its heartbeat regularly, see SocialHarvestCluster.
+type HarvesterNode struct {
+	Id        string    `json:"id" db:"id" bson:"id"`
+	Hostname  string    `json:"hostname" db:"hostname" bson:"hostname"`
+	Started   time.Time `json:"started" db:"started" bson:"started"`
+	Heartbeat time.Time `json:"heartbeat" db:"heartbeat" bson:"heartbeat"`
+}
+
+// Initializes the database for the configured type and returns it. A database is not required, so if none is configured (or it can't be
+// connected to) the returned database just doesn't store anything.
 func NewDatabase(config SocialHarvestConf) *SocialHarvestDB {
-	// A database is not required to use Social Harvest
+	database := &SocialHarvestDB{
+		Type:   config.Database.Type,
+		Series: SeriesNames,
+		// Data older than the (optional) retention period won't be stored, and is removed once it's stored (see EnforceRetention()).
+		RetentionDays:  config.Database.RetentionDays,
+		Retention:      map[string]int{},
+		PurgeBatchSize: config.Database.PurgeBatchSize,
+		retention:      map[string]RetentionReport{},
+	}
+	for series, days := range config.Database.Retention {
+		database.Retention[series] = days
+	}
+	if database.PurgeBatchSize <= 0 {
+		database.PurgeBatchSize = 1000
+	}
 	if config.Database.Type == "" {
-		return &database
+		return database
 	}
-	var err error
-
-	// Holds some options that will adjust the schema
-	database.Schema = config.Schema
 
-	switch config.Database.Type {
-	case "postgres", "postgresql":
-		// Note that sqlx just wraps database/sql and `database.Postgres` gets a sqlx.DB which is essentially a wrapped sql.DB
-		database.Postgres, err = sqlx.Connect("postgres", "host="+config.Database.Host+" port="+strconv.Itoa(config.Database.Port)+" sslmode=disable dbname="+config.Database.Database+" user="+config.Database.User+" password="+config.Database.Password)
+	storageLock.RLock()
+	factory, ok := storageFactories[config.Database.Type]
+	storageLock.RUnlock()
+	if !ok {
+		log.Println("Unknown database type: " + config.Database.Type)
+		return database
+	}
+	store, err := factory(config)
+	if err != nil {
+		log.Println(err)
+		return database
+	}
+	database.Store = store
+	if config.Database.AutoMigrate {
+		applied, err := database.MigrateUp(0)
+		for _, m := range applied {
+			log.Println("Applied migration " + strconv.Itoa(m.Version) + ": " + m.Description)
+		}
 		if err != nil {
 			log.Println(err)
-			return &database
 		}
-		// TODO: Try MonetDB
-		// case "monetdb":
-		// 	database.MonetDB, err = sqlx.Connect("monetdb", "host="+config.Database.Host+" port="+strconv.Itoa(config.Database.Port)+" dbname="+config.Database.Database+" user="+config.Database.User+" password="+config.Database.Password)
-		// 	if err != nil {
-		// 		log.Println(err)
-		// 		return &database
-		// 	}
 	}
-
-	// Data older than the (optional) retention period won't be stored.
-	database.RetentionDays = config.Database.RetentionDays
-	// Optional partitioning (useful for Postgres which has a PARTITION feature)
-	database.PartitionDays = config.Database.PartitionDays
-
-	// Keep a list of series (tables/collections/series - whatever the database calls them, we're going with series because we're really dealing with time with just about all our data)
-	// These do relate to structures in lib/config/series.go
-	database.Series = []string{"messages", "shared_links", "mentions", "hashtags", "contributor_growth"}
-
-	return &database
+	database.writer = newBatchWriter(store, writeOptionsFor(config))
+	return database
 }
 
 // Saves a settings key/value (Social Harvest config or dashboard settings, etc. - anything that needs configuration data can optionally store it using this function)
 // TODO: Maybe just make this update the JSON file OR save to some sort of localstore so the settings don't go into the database where data is harvested
 func (database *SocialHarvestDB) SaveSettings(settingsRow Settings) {
-	if len(settingsRow.Key) > 0 {
-
-		var count int
-		err := database.Postgres.Get(&count, "SELECT count(*) FROM settings;")
-		if err != nil {
-			log.Println(err)
-			return
-		}
+	if database.Store == nil || len(settingsRow.Key) == 0 {
+		return
+	}
+	// Overwrites whatever version is there, but still keeps it in the history if the database keeps versions
+	var err error
+	if db, dialect, sqlErr := database.settingsSQL(); sqlErr == nil {
+		_, err = putSettings(db, dialect, settingsRow.Key, settingsRow.Value, time.Time{}, true)
+	} else {
+		err = database.Store.SaveSettings(settingsRow)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
 
-		// If it already exists, update
-		if count > 0 {
-			tx, err := database.Postgres.Beginx()
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			tx.MustExec("UPDATE settings SET value = $1 WHERE key = $2", settingsRow.Value, settingsRow.Key)
-			tx.Commit()
-
-		} else {
-			// Otherwise, save new
-			tx, err := database.Postgres.Beginx()
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			tx.NamedExec("INSERT INTO settings (key, value, modified) VALUES (:key, :value, :modified)", settingsRow)
-			tx.Commit()
-		}
+// Returns the settings for a key.
+func (database *SocialHarvestDB) Settings(key string) (Settings, error) {
+	if database.Store == nil {
+		return Settings{}, errors.New("no database")
 	}
-	return
+	return database.Store.Settings(key)
 }
 
 // Sets the last harvest time for a given action, value, network set.
@@ -142,54 +339,123 @@ func (database *SocialHarvestDB) SetLastHarvestTime(territory string, network st
 		HarvestTime:       time.Now(),
 	}
 
-	//log.Println(lastTimeHarvested)
+	if database.Store == nil {
+		return
+	}
+	if err := database.Store.SaveCursor(lastHarvestRow); err != nil {
+		log.Println(err)
+		return
+	}
+	database.cursorsLock.Lock()
+	if database.cursorsFor[territory] > 0 {
+		database.cursors[cursorKey(territory, network, action, value)] = lastHarvestRow
+	}
+	database.cursorsLock.Unlock()
+	// Keep the history of harvests too
 	database.StoreRow(lastHarvestRow)
 }
 
-// Gets the last harvest time for a given action, value, and network (NOTE: This doesn't necessarily need to have been set, it could be empty...check with time.IsZero()).
-func (database *SocialHarvestDB) GetLastHarvestTime(territory string, network string, action string, value string) time.Time {
-	var lastHarvestTime time.Time
-	var lastHarvest SocialHarvestHarvest
-	if database.Postgres != nil {
-		database.Postgres.Get(&lastHarvest, "SELECT * FROM harvest WHERE network = $1 AND action = $2 AND value = $3 AND territory = $4", network, action, value, territory)
+// Reads all of the territory's harvest cursors at once, so the harvest (which is about to start) doesn't need to ask for each keyword
+// and account as it gets to them. They're read again at the start of every harvest (in case they were changed elsewhere, like by another
+// harvester in the cluster or the command line) and kept until the last harvest using them calls ReleaseCursors().
+func (database *SocialHarvestDB) LoadCursors(territory string) error {
+	if database.Store == nil {
+		return nil
+	}
+	cursors, err := database.Store.Cursors(territory, "")
+	if err != nil {
+		return err
+	}
+	database.cursorsLock.Lock()
+	defer database.cursorsLock.Unlock()
+	if database.cursors == nil {
+		database.cursors = map[string]SocialHarvestHarvest{}
+		database.cursorsFor = map[string]int{}
 	}
+	database.dropCursors(territory)
+	for _, c := range cursors {
+		database.cursors[cursorKey(c.Territory, c.Network, c.Action, c.Value)] = c
+	}
+	database.cursorsFor[territory]++
+	return nil
+}
 
-	// log.Println(lastHarvest)
-	lastHarvestTime = lastHarvest.LastTimeHarvested
-	return lastHarvestTime
+// Lets go of the territory's cursors loaded by LoadCursors() once a harvest is done with them. When no harvest is using them anymore,
+// they're read from the database as they're needed until they're loaded again.
+func (database *SocialHarvestDB) ReleaseCursors(territory string) {
+	database.cursorsLock.Lock()
+	defer database.cursorsLock.Unlock()
+	if database.cursorsFor[territory] == 0 {
+		return
+	}
+	database.cursorsFor[territory]--
+	if database.cursorsFor[territory] == 0 {
+		delete(database.cursorsFor, territory)
+		database.dropCursors(territory)
+	}
+}
+
+// Removes the territory's loaded cursors (the lock must be held).
+func (database *SocialHarvestDB) dropCursors(territory string) {
+	for k, c := range database.cursors {
+		if c.Territory == territory {
+			delete(database.cursors, k)
+		}
+	}
+}
+
+func cursorKey(territory string, network string, action string, value string) string {
+	return territory + "|" + network + "|" + action + "|" + value
+}
+
+// Gets the last harvest time for a given action, value, and network (NOTE: This doesn't necessarily need to have been set, it could be empty...check with time.IsZero()).
+func (database *SocialHarvestDB) GetLastHarvestTime(territory string, network string, action string, value string) time.Time {
+	return database.lastHarvest(territory, network, action, value).LastTimeHarvested
 }
 
 // Gets the last harvest id for a given task, param, and network.
 func (database *SocialHarvestDB) GetLastHarvestId(territory string, network string, action string, value string) string {
-	lastHarvestId := ""
-	var lastHarvest SocialHarvestHarvest
-	if database.Postgres != nil {
-		database.Postgres.Get(&lastHarvest, "SELECT * FROM harvest WHERE network = $1 AND action = $2 AND value = $3 AND territory = $4", network, action, value, territory)
-	}
+	return database.lastHarvest(territory, network, action, value).LastIdHarvested
+}
 
-	lastHarvestId = lastHarvest.LastIdHarvested
-	return lastHarvestId
+func (database *SocialHarvestDB) lastHarvest(territory string, network string, action string, value string) SocialHarvestHarvest {
+	if database.Store == nil {
+		return SocialHarvestHarvest{}
+	}
+	database.cursorsLock.Lock()
+	if database.cursorsFor[territory] > 0 {
+		lastHarvest := database.cursors[cursorKey(territory, network, action, value)]
+		database.cursorsLock.Unlock()
+		return lastHarvest
+	}
+	database.cursorsLock.Unlock()
+	lastHarvest, err := database.Store.LastHarvest(territory, network, action, value)
+	if err != nil {
+		log.Println(err)
+	}
+	return lastHarvest
 }
 
 // Stores a harvested row of data into the configured database.
 func (database *SocialHarvestDB) StoreRow(row interface{}) {
 	// A database connection is not required to use Social Harvest (could be logging to file)
-	if database.Postgres == nil {
+	if database.Store == nil {
 		// log.Println("There appears to be no database connection.")
 		return
 	}
 
 	// If data is to be expired after a certain point, don't try to save data that is beyond that expiration (the harvester can pull in data from the past - sometimes months in the past)
-	if database.RetentionDays > 0 {
+	table, _ := seriesColumns(row, false)
+	if days := database.RetentionFor(table); days > 0 {
 		// Only certain series will have a "Time" field, if FieldByName("Time") was ran on the wrong row value, then it would panic and crash the application.
 		// TODO: Rethink the use of an interface{} here because I worry about the performance with reflection. Or at least benchmark all this.
 		// It would stink to have "StoreMessage" and "StoreSharedLink" etc. So interface{} was convenient... But also a little annoying.
 		switch row.(type) {
-		case SocialHarvestMessage, SocialHarvestSharedLink, SocialHarvestMention, SocialHarvestHashtag:
+		case SocialHarvestMessage, SocialHarvestSharedLink, SocialHarvestMention, SocialHarvestHashtag, SocialHarvestContributorGrowth, SocialHarvestMessageEngagement:
 			v := reflect.ValueOf(row)
 			rowTime := v.FieldByName("Time").Interface().(time.Time).Unix()
 			now := time.Now().Unix()
-			retentionSeconds := int64(database.RetentionDays * 86400)
+			retentionSeconds := int64(days * 86400)
 			if rowTime <= (now - retentionSeconds) {
 				// log.Println("Harvested data falls outside retention period.")
 				return
@@ -197,192 +463,220 @@ func (database *SocialHarvestDB) StoreRow(row interface{}) {
 		}
 	}
 
-	// The downside to not using upper.io/db or something like it is that INSERT statements incur technical debt.
-	// There will be a maintenance burden in keeping the field names up to date...But I think it's manageable.
-	// ...and values have to be in the right order, maintaining this in a repeated fashion leads to spelling mistakes, etc. All the reasons I HATE dealing with SQL...But oh well.
+	// Queue the row to be written with others of its series (waiting for room in the queue if need be)
+	if database.writer != nil && database.writer.enqueue(table, row) {
+		return
+	}
+	if err := database.Store.StoreRow(row); err != nil {
+		log.Println(err)
+	}
+}
 
-	var err error
+// Stops queueing harvested data and waits for what's queued to be written. Anything stored afterwards is written right away. Returns false
+// if the queued data wasn't written within the timeout.
+func (database *SocialHarvestDB) StopWriting(timeout time.Duration) bool {
+	if database == nil || database.writer == nil {
+		return true
+	}
+	return database.writer.stop(timeout)
+}
 
-	// The following will insert the data into the supported databases. Certain series will contain more or less data depending on configuration.
-	// Compact storage reduces the number of fields stored on series and assumes the database supports JOINs (or is making some other query) to get the data from the `messages` series.
-	// This saves on disk space, but increases query complexity. Full flat storage / expanded schema. This uses more disk space, but the queries should be faster.
+// Returns the number of rows queued, written and that failed to be written for each series.
+func (database *SocialHarvestDB) WriteCounts() map[string]WriteCounts {
+	counts := map[string]WriteCounts{}
+	if database.writer == nil {
+		return counts
+	}
+	database.writer.countsLock.Lock()
+	defer database.writer.countsLock.Unlock()
+	for table, c := range database.writer.counts {
+		counts[table] = *c
+	}
+	return counts
+}
 
-	if database.Postgres != nil {
-		// Check if valid type to store and determine the proper table/collection based on it
-		switch row.(type) {
-		case SocialHarvestMessage:
-			_, err = database.Postgres.NamedExec("INSERT INTO messages (time, harvest_id, territory, network, message_id, contributor_id, contributor_screen_name, contributor_name, contributor_gender, contributor_type, contributor_longitude, contributor_latitude, contributor_geohash, contributor_lang, contributor_country, contributor_city, contributor_region, contributor_city_pop, contributor_likes, contributor_statuses_count, contributor_listed_count, contributor_followers, contributor_verified, message, is_question, category, sentiment, facebook_shares, twitter_retweet_count, twitter_favorite_count, like_count, google_plus_reshares, google_plus_ones) VALUES (:time, :harvest_id, :territory, :network, :message_id, :contributor_id, :contributor_screen_name, :contributor_name, :contributor_gender, :contributor_type, :contributor_longitude, :contributor_latitude, :contributor_geohash, :contributor_lang, :contributor_country, :contributor_city, :contributor_region, :contributor_city_pop, :contributor_likes, :contributor_statuses_count, :contributor_listed_count, :contributor_followers, :contributor_verified, :message, :is_question, :category, :sentiment, :facebook_shares, :twitter_retweet_count, :twitter_favorite_count, :like_count, :google_plus_reshares, :google_plus_ones);", row)
-			if err != nil {
-				//log.Println(err)
-			} else {
-				//log.Println("Successful insert")
-			}
-		case SocialHarvestSharedLink:
-			if database.Schema.Compact {
-				_, err = database.Postgres.NamedExec("INSERT INTO shared_links (time, harvest_id, territory, network, message_id, contributor_id, type, preview, source, url, expanded_url, host) VALUES (:time, :harvest_id, :territory, :network, :message_id, :contributor_id, :type, :preview, :source, :url, :expanded_url, :host);", row)
-			} else {
-				_, err = database.Postgres.NamedExec("INSERT INTO shared_links (time, harvest_id, territory, network, message_id, contributor_id, contributor_screen_name, contributor_name, contributor_gender, contributor_type, contributor_longitude, contributor_latitude, contributor_geohash, contributor_lang, contributor_country, contributor_city, contributor_region, contributor_city_pop, type, preview, source, url, expanded_url, host) VALUES (:time, :harvest_id, :territory, :network, :message_id, :contributor_id, :contributor_screen_name, :contributor_name, :contributor_gender, :contributor_type, :contributor_longitude, :contributor_latitude, :contributor_geohash, :contributor_lang, :contributor_country, :contributor_city, :contributor_region, :contributor_city_pop, :type, :preview, :source, :url, :expanded_url, :host);", row)
-			}
-			if err != nil {
-				//log.Println(err)
-			}
-		case SocialHarvestMention:
-			if database.Schema.Compact {
-				_, err = database.Postgres.NamedExec("INSERT INTO mentions (time, harvest_id, territory, network, message_id, contributor_id, mentioned_id, mentioned_screen_name, mentioned_name, mentioned_gender, mentioned_type, mentioned_longitude, mentioned_latitude, mentioned_geohash, mentioned_lang) VALUES (:time, :harvest_id, :territory, :network, :message_id, :contributor_id, :mentioned_id, :mentioned_screen_name, :mentioned_name, :mentioned_gender, :mentioned_type, :mentioned_longitude, :mentioned_latitude, :mentioned_geohash, :mentioned_lang);", row)
-			} else {
-				_, err = database.Postgres.NamedExec("INSERT INTO mentions (time, harvest_id, territory, network, message_id, contributor_id, contributor_screen_name, contributor_name, contributor_gender, contributor_type, contributor_longitude, contributor_latitude, contributor_geohash, contributor_lang, mentioned_id, mentioned_screen_name, mentioned_name, mentioned_gender, mentioned_type, mentioned_longitude, mentioned_latitude, mentioned_geohash, mentioned_lang) VALUES (:time, :harvest_id, :territory, :network, :message_id, :contributor_id, :contributor_screen_name, :contributor_name, :contributor_gender, :contributor_type, :contributor_longitude, :contributor_latitude, :contributor_geohash, :contributor_lang, :mentioned_id, :mentioned_screen_name, :mentioned_name, :mentioned_gender, :mentioned_type, :mentioned_longitude, :mentioned_latitude, :mentioned_geohash, :mentioned_lang);", row)
-			}
-			if err != nil {
-				//log.Println(err)
-			}
-		case SocialHarvestHashtag:
-			if database.Schema.Compact {
-				_, err = database.Postgres.NamedExec("INSERT INTO hashtags (time, harvest_id, territory, network, message_id, tag, keyword, contributor_id) VALUES (:time, :harvest_id, :territory, :network, :message_id, :tag, :keyword, :contributor_id);", row)
-			} else {
-				_, err = database.Postgres.NamedExec("INSERT INTO hashtags (time, harvest_id, territory, network, message_id, tag, keyword, contributor_id, contributor_screen_name, contributor_name, contributor_gender, contributor_type, contributor_longitude, contributor_latitude, contributor_geohash, contributor_lang, contributor_country, contributor_city, contributor_region, contributor_city_pop) VALUES (:time, :harvest_id, :territory, :network, :message_id, :tag, :keyword, :contributor_id, :contributor_screen_name, :contributor_name, :contributor_gender, :contributor_type, :contributor_longitude, :contributor_latitude, :contributor_geohash, :contributor_lang, :contributor_country, :contributor_city, :contributor_region, :contributor_city_pop);", row)
-			}
-			if err != nil {
-				//log.Println(err)
-			}
-		case SocialHarvestContributorGrowth:
-			_, err = database.Postgres.NamedExec(`INSERT INTO contributor_growth (
-			time, harvest_id, territory, network, contributor_id, likes, talking_about, were_here, checkins, views, status_updates, listed, favorites, followers, following, plus_ones, comments) VALUES (:time, :harvest_id, :territory, :network, :contributor_id, :likes, :talking_about, :were_here, :checkins, :views, :status_updates, :listed, :favorites, :followers, :following, :plus_ones, :comments);`, row)
-			if err != nil {
-				// log.Println(err)
-			}
-		case SocialHarvestHarvest:
-			_, err = database.Postgres.NamedExec("INSERT INTO harvest (territory, network, action, value, last_time_harvested, last_id_harvested, items_harvested, harvest_time) VALUES (:territory, :network, :action, :value, :last_time_harvested, :last_id_harvested, :items_harvested, :harvest_time);", row)
-			if err != nil {
-				//log.Println(err)
-			}
-		default:
-			// log.Println("trying to store unknown collection")
+// Returns the messages harvested from a territory and network in the time range (without everything but their ids and engagement counts).
+func (database *SocialHarvestDB) Messages(territory string, network string, from time.Time, to time.Time) ([]SocialHarvestMessage, error) {
+	if r, ok := database.Store.(MessageReader); ok {
+		return r.Messages(territory, network, from, to)
+	}
+	return []SocialHarvestMessage{}, errors.New("the database can't read messages")
+}
+
+// Returns the number of days a series is kept for (0 keeps it forever).
+func (database *SocialHarvestDB) RetentionFor(series string) int {
+	if days, ok := database.Retention[series]; ok {
+		return days
+	}
+	for _, s := range database.Series {
+		if s == series {
+			return database.RetentionDays
+		}
+	}
+	return 0
+}
+
+// Removes the data that's past the retention period of each series and returns what was removed. Does nothing if the database can't.
+func (database *SocialHarvestDB) EnforceRetention() []RetentionReport {
+	reports := []RetentionReport{}
+	p, ok := database.Store.(Purger)
+	if !ok {
+		return reports
+	}
+	for _, series := range database.Series {
+		days := database.RetentionFor(series)
+		if days <= 0 {
+			continue
+		}
+		report := RetentionReport{Series: series, Days: days, Before: time.Now().AddDate(0, 0, -days), Partitions: []string{}}
+		rows, partitions, err := p.Purge(series, report.Before, database.PurgeBatchSize)
+		report.Rows = rows
+		report.Partitions = append(report.Partitions, partitions...)
+		report.Time = time.Now()
+		if err != nil {
+			report.Error = err.Error()
+			log.Println("Could not remove expired " + series + ": " + err.Error())
 		}
+		database.retentionLock.Lock()
+		report.TotalRows = database.retention[series].TotalRows + rows
+		database.retention[series] = report
+		database.retentionLock.Unlock()
+		reports = append(reports, report)
 	}
+	return reports
+}
 
+// Returns what the latest retention run removed from each series.
+func (database *SocialHarvestDB) RetentionReports() map[string]RetentionReport {
+	reports := map[string]RetentionReport{}
+	database.retentionLock.Lock()
+	defer database.retentionLock.Unlock()
+	for series, r := range database.retention {
+		reports[series] = r
+	}
+	return reports
 }
 
-// Creates a partition table in a Postgres database
-// NOTE: If this fails to run ahead of time, we have a problem... Though checking on a trigger on every insert carries with it too much overhead.
-// So I'm going to look into columnar store databases in hopes to find performance there. FDWs for Postgres perhaps and also MonetDB (which should be SQL compatible).
-// Though I imagine partitioning will still be a really nice thing to have in the future. Come back to this...
-// TODO: Look at this: https://github.com/keithf4/pg_partman ... probably should just use that.
-func (database *SocialHarvestDB) CreatePartitionTable(table string) error {
-	var err error
+// Runs a query that deletes rows older than the given time (a batch at a time) until nothing is left to delete. Returns the rows deleted.
+func deleteInBatches(db *sqlx.DB, query string, before time.Time) (int64, error) {
+	var removed int64
+	for {
+		result, err := db.Exec(query, before)
+		if err != nil {
+			return removed, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+		if n == 0 {
+			return removed, nil
+		}
+	}
+}
 
-	if database.Postgres != nil && database.PartitionDays > 0 {
-		t := time.Now()
-		df := t.Format("01022006")
-
-		var buffer bytes.Buffer
-		buffer.WriteString("CREATE TABLE IF NOT EXISTS ")
-		buffer.WriteString(table)
-		buffer.WriteString("_")
-		buffer.WriteString(df)
-		buffer.WriteString(" (LIKE ")
-		buffer.WriteString(table)
-		buffer.WriteString(" INCLUDING ALL) INHERITS (")
-		buffer.WriteString(table)
-		buffer.WriteString(");")
-
-		// Unique (if table is in `database.Series` which is a list of tables with harvest_id fields)
-		for _, v := range database.Series {
-			if table == v {
-				buffer.WriteString(`ALTER TABLE "`)
-				buffer.WriteString(table)
-				buffer.WriteString("_")
-				buffer.WriteString(df)
-				buffer.WriteString(`" ADD CONSTRAINT "`)
-				buffer.WriteString(table)
-				buffer.WriteString("_")
-				buffer.WriteString(df)
-				buffer.WriteString(`_harvest_id_unique" UNIQUE ("harvest_id") NOT DEFERRABLE INITIALLY IMMEDIATE;`)
-			}
+// Makes sure the series tables are partitioned up to a little while from now, if the database supports partitioning (and it's configured).
+func (database *SocialHarvestDB) PreparePartitions() error {
+	if p, ok := database.Store.(Partitioner); ok {
+		return p.PreparePartitions(time.Now())
+	}
+	return nil
+}
+
+// Takes a lock on the given key that's shared with every other harvester using the same database, so a job only runs in one place at a time.
+// If wait is true, it blocks until the lock is free. Otherwise false is returned when someone else holds it. The returned func releases the lock.
+// Without a database (or one that can't lock) there's nobody to coordinate with, so the lock is always "taken". If the database can lock
+// but the lock can't be checked (ie. the database is down), it isn't taken, so the job is skipped rather than maybe run twice. Each lock
+// that's held keeps one of the database's pooled connections busy until it's released (see README.md).
+func (database *SocialHarvestDB) JobLock(key string, wait bool) (func(), bool) {
+	if database != nil {
+		if l, ok := database.Store.(Locker); ok {
+			return l.JobLock(key, wait)
 		}
+	}
+	return func() {}, true
+}
 
-		//database.PartitionDays
-
-		// TODO: A few of these to provide enough coverage for harvested data. Unfortunately harvested data can date back a few months...
-		// So there might even need to be a catch all table that catches data.
-		dfu := t.Format("2006-01-02")
-		dfl := t.Format("2006-01-02")
-		// TODO
-		//const day = 24 * 60 * 60
-		//lowerTime := time.Unix((t.Unix() - (database.PartitionDays * day)))
-		//dfl := lowerTime.Format("2006-01-02")
-
-		// ...and create/update the trigger when we make the new partiton. This way the trigger is always kept in sync with the partition tables available
-		buffer.WriteString(" CREATE OR REPLACE FUNCTION public.")
-		buffer.WriteString(table)
-		buffer.WriteString("_part_insert_tgr_func() ")
-		buffer.WriteString("RETURNS TRIGGER AS $$ ")
-		buffer.WriteString("BEGIN ")
-		buffer.WriteString("IF( NEW.time >= '")
-		// lower time limit
-		buffer.WriteString(dfl)
-		buffer.WriteString("' AND NEW.time < '")
-		// upper time limit
-		buffer.WriteString(dfu)
-		buffer.WriteString("' ) THEN ")
-		buffer.WriteString("INSERT INTO public.")
-		buffer.WriteString(table)
-		buffer.WriteString("_")
-		//buffer.WriteString(df) // date
-		buffer.WriteString(" VALUES (NEW.*); ")
-		buffer.WriteString("ELSE ")
-		buffer.WriteString("RAISE EXCEPTION 'Date out of range. Fix trigger function.'; ")
-		buffer.WriteString("END IF; ")
-		buffer.WriteString("RETURN NULL; ")
-		buffer.WriteString("END; ")
-		buffer.WriteString("$$ ")
-		buffer.WriteString("LANGUAGE plpgsql; ")
-
-		// Set a trigger to call the function (only needs to be set once... - is there a create trigger if not exists?)
-		buffer.WriteString("CREATE TRIGGER partition_insert_trigger BEFORE INSERT ON ")
-		buffer.WriteString(table)
-		buffer.WriteString(" FOR EACH ROW EXECUTE PROCEDURE public.")
-		buffer.WriteString(table)
-		buffer.WriteString("_part_insert_tgr_func();")
-
-		// CREATE OR REPLACE FUNCTION my_schema.my_data_insert_trigger_function()
-		// RETURNS TRIGGER AS $$
-		// BEGIN
-		//     IF ( NEW.create_date >= '2010-01-01' AND NEW.create_date < '2010-02-01' ) THEN
-		//         INSERT INTO my_schema.my_data_201001 VALUES (NEW.*);
-		//     ELSE
-		//         RAISE EXCEPTION 'Date out of range.  Fix parent_insert_trigger_function()!';
-		//     END IF;
-		//     RETURN NULL;
-		// END;
-		// $$
-		// LANGUAGE plpgsql;
-
-		// -- Create a trigger to call the function before insert.
-		// CREATE TRIGGER my_data_insert_trigger
-		//     BEFORE INSERT ON my_schema.my_data
-		//     FOR EACH ROW EXECUTE PROCEDURE my_schema.my_data_insert_trigger_function();
-
-		query := buffer.String()
-		buffer.Reset()
-
-		_, err = database.Postgres.Exec(query)
-	}
-	return err
+// Returns the harvest state (cursor) for each action and value (keyword, account, etc.) harvested. The territory and network are optional.
+func (database *SocialHarvestDB) HarvestStates(territory string, network string) ([]SocialHarvestHarvest, error) {
+	if database.Store == nil {
+		return []SocialHarvestHarvest{}, errors.New("no database")
+	}
+	return database.Store.Cursors(territory, network)
+}
+
+// Removes the harvest state so the next harvest starts over (as far back as the API and configured page limits allow). The network, action
+// and value are optional. Returns the number of rows removed.
+func (database *SocialHarvestDB) ResetHarvestState(territory string, network string, action string, value string) (int64, error) {
+	if database.Store == nil {
+		return 0, errors.New("no database")
+	}
+	n, err := database.Store.ResetCursors(territory, network, action, value)
+	// Any harvest that's running carries on without the old cursors
+	database.cursorsLock.Lock()
+	delete(database.cursorsFor, territory)
+	database.dropCursors(territory)
+	database.cursorsLock.Unlock()
+	return n, err
+}
+
+// Records a heartbeat for the node (adding it if it's new).
+func (database *SocialHarvestDB) NodeHeartbeat(node HarvesterNode) error {
+	s, ok := database.Store.(NodeStore)
+	if !ok {
+		return errors.New("no database")
+	}
+	return s.NodeHeartbeat(node)
+}
+
+// Returns all nodes that have sent a heartbeat since the given time, ordered by id.
+func (database *SocialHarvestDB) Nodes(since time.Time) ([]HarvesterNode, error) {
+	s, ok := database.Store.(NodeStore)
+	if !ok {
+		return []HarvesterNode{}, errors.New("no database")
+	}
+	return s.Nodes(since)
+}
+
+// Removes a node (when it leaves the cluster).
+func (database *SocialHarvestDB) RemoveNode(id string) error {
+	s, ok := database.Store.(NodeStore)
+	if !ok {
+		return errors.New("no database")
+	}
+	return s.RemoveNode(id)
+}
+
+// Removes nodes that haven't sent a heartbeat since the given time (they're gone).
+func (database *SocialHarvestDB) RemoveStaleNodes(before time.Time) error {
+	s, ok := database.Store.(NodeStore)
+	if !ok {
+		return errors.New("no database")
+	}
+	return s.RemoveStaleNodes(before)
 }
 
 // Checks access to the database
 func (database *SocialHarvestDB) HasAccess() bool {
-	var err error
+	return database.Store != nil && database.Store.Ping() == nil
+}
 
-	if database.Postgres != nil {
-		var c int
-		err = database.Postgres.Get(&c, "SELECT COUNT(*) FROM messages")
-		if err == nil {
-			return true
-		} else {
-			return false
-		}
-	}
+// How long closing the database waits for queued data to be written.
+const closeWriteTimeout = 30 * time.Second
+
+// Writes whatever is queued and closes the connection to the database.
+func (database *SocialHarvestDB) Close() error {
+	return database.CloseWithin(closeWriteTimeout)
+}
 
-	return false
+// Writes whatever is queued, waiting no longer than the given timeout, and closes the connection to the database.
+func (database *SocialHarvestDB) CloseWithin(timeout time.Duration) error {
+	if database == nil || database.Store == nil {
+		return nil
+	}
+	if !database.StopWriting(timeout) {
+		log.Println("Timed out writing to the database before closing it, some harvested data may be lost.")
+	}
+	return database.Store.Close()
 }
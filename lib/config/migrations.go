@@ -0,0 +1,537 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"errors"
+	"github.com/SocialHarvestVendors/sqlx"
+	"strings"
+	"time"
+)
+
+// Versioned changes to the database schema. Each migration has the statements to apply it (up) and to undo it (down) for each SQL
+// dialect. The versions that were applied are kept in the schema_version table. Migrations must never be changed once released,
+// changes to the schema go in a new migration at the end of the list.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(dialect string) []string
+	Down        func(dialect string) []string
+}
+
+// Whether or not a migration has been applied (and when).
+type MigrationStatus struct {
+	Version     int       `json:"version"`
+	Description string    `json:"description"`
+	Applied     bool      `json:"applied"`
+	AppliedAt   time.Time `json:"appliedAt,omitempty"`
+}
+
+// A Storage with a SQL database that can be migrated. Returns the database and its dialect ("postgres", "mysql" or "sqlite").
+type Migratable interface {
+	SQL() (*sqlx.DB, string)
+}
+
+// A table created by a migration. Column types are "varchar(n)", "text", "timestamp", "smallint", "int", "bigint" or "float".
+type migrationTable struct {
+	name       string
+	columns    [][2]string
+	primaryKey []string
+	// Index names (which need to be unique across all the tables) and their column
+	indexes [][2]string
+}
+
+// The contributor columns the series share. Like everything else in a migration, these must not change.
+var migrationContributorColumns = [][2]string{
+	{"contributor_screen_name", "varchar(255)"},
+	{"contributor_name", "varchar(255)"},
+	{"contributor_gender", "smallint"},
+	{"contributor_type", "varchar(100)"},
+	{"contributor_longitude", "float"},
+	{"contributor_latitude", "float"},
+	{"contributor_geohash", "varchar(100)"},
+	{"contributor_lang", "varchar(8)"},
+}
+
+var migrationContributorLocationColumns = [][2]string{
+	{"contributor_country", "varchar(6)"},
+	{"contributor_city", "varchar(75)"},
+	{"contributor_region", "varchar(50)"},
+	{"contributor_city_pop", "int"},
+}
+
+var migrationSeriesColumns = [][2]string{
+	{"time", "timestamp"},
+	{"harvest_id", "varchar(255)"},
+	{"territory", "varchar(255)"},
+	{"network", "varchar(75)"},
+}
+
+func columns(lists ...[][2]string) [][2]string {
+	all := [][2]string{}
+	for _, l := range lists {
+		all = append(all, l...)
+	}
+	return all
+}
+
+var seriesTables = []migrationTable{
+	{
+		name: "messages",
+		columns: columns(migrationSeriesColumns, [][2]string{{"message_id", "varchar(255)"}, {"contributor_id", "varchar(255)"}}, migrationContributorColumns, migrationContributorLocationColumns, [][2]string{
+			{"contributor_likes", "int"},
+			{"contributor_statuses_count", "int"},
+			{"contributor_listed_count", "int"},
+			{"contributor_followers", "int"},
+			{"contributor_verified", "smallint"},
+			{"message", "text"},
+			{"is_question", "smallint"},
+			{"category", "varchar(100)"},
+			{"sentiment", "smallint"},
+			{"facebook_shares", "int"},
+			{"twitter_retweet_count", "int"},
+			{"twitter_favorite_count", "int"},
+			{"like_count", "int"},
+			{"google_plus_reshares", "int"},
+			{"google_plus_ones", "int"},
+		}),
+		primaryKey: []string{"harvest_id"},
+		indexes:    [][2]string{{"msg_time_key", "time"}, {"msg_message_id_key", "message_id"}, {"msg_contributor_id_key", "contributor_id"}, {"msg_contributor_geohash_key", "contributor_geohash"}, {"msg_question_key", "is_question"}, {"msg_category_key", "category"}},
+	},
+	{
+		name: "shared_links",
+		columns: columns(migrationSeriesColumns, [][2]string{{"message_id", "varchar(255)"}, {"contributor_id", "varchar(255)"}}, migrationContributorColumns, migrationContributorLocationColumns, [][2]string{
+			{"type", "varchar(100)"},
+			{"preview", "varchar(255)"},
+			{"source", "varchar(255)"},
+			{"url", "varchar(255)"},
+			{"expanded_url", "varchar(255)"},
+			{"host", "varchar(150)"},
+		}),
+		primaryKey: []string{"harvest_id"},
+		indexes:    [][2]string{{"sl_time_key", "time"}, {"sl_message_id_key", "message_id"}, {"sl_contributor_id_key", "contributor_id"}, {"sl_contributor_geohash_key", "contributor_geohash"}, {"sl_url_key", "url"}, {"sl_expanded_url_key", "expanded_url"}, {"sl_host_key", "host"}},
+	},
+	{
+		name: "mentions",
+		columns: columns(migrationSeriesColumns, [][2]string{{"message_id", "varchar(255)"}, {"contributor_id", "varchar(255)"}}, migrationContributorColumns, [][2]string{
+			{"mentioned_id", "varchar(255)"},
+			{"mentioned_screen_name", "varchar(255)"},
+			{"mentioned_name", "varchar(255)"},
+			{"mentioned_gender", "smallint"},
+			{"mentioned_type", "varchar(75)"},
+			{"mentioned_longitude", "float"},
+			{"mentioned_latitude", "float"},
+			{"mentioned_geohash", "varchar(100)"},
+			{"mentioned_lang", "varchar(8)"},
+		}),
+		primaryKey: []string{"harvest_id"},
+		indexes:    [][2]string{{"m_time_key", "time"}, {"m_message_id_key", "message_id"}, {"m_contributor_id_key", "contributor_id"}, {"m_contributor_geohash_key", "contributor_geohash"}, {"m_mentioned_id_key", "mentioned_id"}},
+	},
+	{
+		name:       "hashtags",
+		columns:    columns(migrationSeriesColumns, [][2]string{{"message_id", "varchar(255)"}, {"tag", "varchar(255)"}, {"keyword", "varchar(150)"}, {"contributor_id", "varchar(255)"}}, migrationContributorColumns, migrationContributorLocationColumns),
+		primaryKey: []string{"harvest_id"},
+		indexes:    [][2]string{{"h_time_key", "time"}, {"h_message_id_key", "message_id"}, {"h_tag_key", "tag"}, {"h_keyword_key", "keyword"}, {"h_contributor_id_key", "contributor_id"}, {"h_contributor_geohash_key", "contributor_geohash"}},
+	},
+	{
+		name: "contributor_growth",
+		columns: columns(migrationSeriesColumns, [][2]string{
+			{"contributor_id", "varchar(255)"},
+			{"likes", "bigint"},
+			{"talking_about", "bigint"},
+			{"were_here", "bigint"},
+			{"checkins", "bigint"},
+			{"views", "bigint"},
+			{"status_updates", "bigint"},
+			{"listed", "bigint"},
+			{"favorites", "bigint"},
+			{"followers", "bigint"},
+			{"following", "bigint"},
+			{"plus_ones", "bigint"},
+			{"comments", "bigint"},
+		}),
+		primaryKey: []string{"harvest_id"},
+		indexes:    [][2]string{{"cg_time_key", "time"}, {"cg_contributor_id_key", "contributor_id"}},
+	},
+}
+
+var engagementTables = []migrationTable{
+	{
+		name: "message_engagement",
+		columns: columns(migrationSeriesColumns, [][2]string{
+			{"message_id", "varchar(255)"},
+			{"facebook_shares", "int"},
+			{"twitter_retweet_count", "int"},
+			{"twitter_favorite_count", "int"},
+			{"like_count", "int"},
+			{"google_plus_reshares", "int"},
+			{"google_plus_ones", "int"},
+		}),
+		// A message is harvested many times, each time is kept
+		primaryKey: []string{"harvest_id", "time"},
+		indexes:    [][2]string{{"me_time_key", "time"}, {"me_message_id_key", "message_id"}},
+	},
+}
+
+var harvestColumns = [][2]string{
+	{"territory", "varchar(150)"},
+	{"network", "varchar(75)"},
+	{"action", "varchar(150)"},
+	{"value", "varchar(255)"},
+	{"last_time_harvested", "timestamp"},
+	{"last_id_harvested", "varchar(255)"},
+	{"items_harvested", "int"},
+	{"harvest_time", "timestamp"},
+}
+
+var harvestTables = []migrationTable{
+	{name: "harvest", columns: harvestColumns, primaryKey: []string{"territory", "network", "action", "value"}},
+	{name: "harvest_history", columns: harvestColumns, indexes: [][2]string{{"harvest_history_time_key", "harvest_time"}}},
+}
+
+var nodeTables = []migrationTable{
+	{
+		name:       "harvester_nodes",
+		columns:    [][2]string{{"id", "varchar(255)"}, {"hostname", "varchar(255)"}, {"started", "timestamp"}, {"heartbeat", "timestamp"}},
+		primaryKey: []string{"id"},
+	},
+}
+
+var settingsTables = []migrationTable{
+	{
+		name:       "settings",
+		columns:    [][2]string{{"key", "varchar(150)"}, {"value", "text"}, {"modified", "timestamp"}},
+		primaryKey: []string{"key"},
+	},
+}
+
+var settingsHistoryTables = []migrationTable{
+	{
+		name:    "settings_history",
+		columns: [][2]string{{"key", "varchar(150)"}, {"value", "text"}, {"modified", "timestamp"}, {"deleted", "smallint"}},
+		indexes: [][2]string{{"settings_history_key_key", "key"}},
+	},
+}
+
+var budgetTables = []migrationTable{
+	{
+		name:       "budget_spending",
+		columns:    [][2]string{{"territory", "varchar(150)"}, {"network", "varchar(75)"}, {"period", "varchar(10)"}, {"start", "timestamp"}, {"calls", "int"}, {"items", "int"}},
+		primaryKey: []string{"territory", "network", "period", "start"},
+	},
+}
+
+// All of the migrations, in order.
+var Migrations = []Migration{
+	{1, "Create the series tables", createTables(seriesTables), dropTables(seriesTables)},
+	{2, "Create the harvest cursor and history tables", createTables(harvestTables), dropTables(harvestTables)},
+	{3, "Create the harvester nodes table", createTables(nodeTables), dropTables(nodeTables)},
+	{4, "Create the settings table", createTables(settingsTables), dropTables(settingsTables)},
+	{5, "Create the message engagement table", createTables(engagementTables), dropTables(engagementTables)},
+	{6, "Create the settings history table", createTables(settingsHistoryTables), dropTables(settingsHistoryTables)},
+	{7, "Create the budget spending table", createTables(budgetTables), dropTables(budgetTables)},
+	{8, "Key the harvest cursors by territory, network, action and value", rekeyHarvestCursors, keepHarvestCursorKey},
+}
+
+// Databases set up with the SQL scripts from before the cursors were kept one per keyword have a harvest table keyed by harvest_time,
+// which creating the tables doesn't change. The table is rebuilt with the right key, keeping the latest cursor for each keyword. The
+// other rows are history, so they're copied to harvest_history (unless they're already there). Tables created by the migrations
+// already have the right key and are just rebuilt the same.
+func rekeyHarvestCursors(dialect string) []string {
+	rekeyed := migrationTable{name: "harvest_rekeyed", columns: harvestColumns, primaryKey: harvestTables[0].primaryKey}
+	names := make([]string, len(harvestColumns))
+	for i, c := range harvestColumns {
+		names[i] = c[0]
+	}
+	columns := quoteColumns(dialect, names)
+	keyed := []string{}
+	matched := []string{}
+	for _, c := range append(append([]string{}, rekeyed.primaryKey...), "harvest_time") {
+		if c != "harvest_time" {
+			keyed = append(keyed, quoteColumn(dialect, c)+" IS NOT NULL")
+		}
+		matched = append(matched, "hh."+quoteColumn(dialect, c)+" = h."+quoteColumn(dialect, c))
+	}
+	from := " FROM harvest WHERE " + strings.Join(keyed, " AND ")
+
+	// Left behind if the migration failed part way before
+	statements := []string{"DROP TABLE IF EXISTS harvest_rekeyed"}
+	if dialect == "mysql" {
+		statements = append(statements, "DROP TABLE IF EXISTS harvest_unkeyed")
+	}
+	statements = append(statements, createTables([]migrationTable{rekeyed})(dialect)...)
+	switch dialect {
+	case "postgres":
+		key := quoteColumns(dialect, rekeyed.primaryKey)
+		statements = append(statements, "INSERT INTO harvest_rekeyed ("+columns+") SELECT DISTINCT ON ("+key+") "+columns+from+" ORDER BY "+key+", \"harvest_time\" DESC NULLS LAST")
+	case "mysql":
+		updates := []string{}
+		for _, c := range names {
+			if !inStrings(rekeyed.primaryKey, c) {
+				updates = append(updates, quoteColumn(dialect, c)+" = VALUES("+quoteColumn(dialect, c)+")")
+			}
+		}
+		// Rows are inserted oldest first, so the latest one is what's left for each keyword
+		statements = append(statements, "INSERT INTO harvest_rekeyed ("+columns+") SELECT "+columns+from+" ORDER BY `harvest_time` ON DUPLICATE KEY UPDATE "+strings.Join(updates, ", "))
+	default:
+		statements = append(statements, "INSERT OR REPLACE INTO harvest_rekeyed ("+columns+") SELECT "+columns+from+" ORDER BY \"harvest_time\"")
+	}
+	statements = append(statements, "INSERT INTO harvest_history ("+columns+") SELECT "+columns+" FROM harvest h WHERE NOT EXISTS (SELECT 1 FROM harvest_history hh WHERE "+strings.Join(matched, " AND ")+")")
+	switch dialect {
+	case "postgres":
+		statements = append(statements, "DROP TABLE harvest", "ALTER TABLE harvest_rekeyed RENAME TO harvest", "ALTER INDEX harvest_rekeyed_pkey RENAME TO harvest_pkey")
+	case "mysql":
+		// MySQL doesn't undo changes to tables when a migration fails, so the old table is only dropped once the new one took its place
+		statements = append(statements, "RENAME TABLE harvest TO harvest_unkeyed, harvest_rekeyed TO harvest", "DROP TABLE harvest_unkeyed")
+	default:
+		statements = append(statements, "DROP TABLE harvest", "ALTER TABLE harvest_rekeyed RENAME TO harvest")
+	}
+	return statements
+}
+
+// The harvest table had the right key before the migration, unless it was set up with the old SQL scripts (which was a mistake), so
+// there's nothing to undo.
+func keepHarvestCursorKey(dialect string) []string {
+	return []string{}
+}
+
+// Tables are only created if they don't exist yet, so databases set up with the SQL scripts can be migrated too.
+func createTables(tables []migrationTable) func(dialect string) []string {
+	return func(dialect string) []string {
+		statements := []string{}
+		for _, t := range tables {
+			definitions := []string{}
+			for _, c := range t.columns {
+				definitions = append(definitions, quoteColumn(dialect, c[0])+" "+columnType(dialect, c[1], inStrings(t.primaryKey, c[0])))
+			}
+			if len(t.primaryKey) > 0 {
+				definitions = append(definitions, "PRIMARY KEY ("+quoteColumns(dialect, t.primaryKey)+")")
+			}
+			// MySQL can't create an index if it doesn't exist, so its indexes are created along with the table
+			if dialect == "mysql" {
+				for _, index := range t.indexes {
+					definitions = append(definitions, "KEY "+index[0]+" ("+quoteColumn(dialect, index[1])+")")
+				}
+			}
+			create := "CREATE TABLE IF NOT EXISTS " + t.name + " (" + strings.Join(definitions, ", ") + ")"
+			if dialect == "mysql" {
+				create += " ENGINE=InnoDB DEFAULT CHARSET=utf8 ROW_FORMAT=DYNAMIC"
+			}
+			statements = append(statements, create)
+			if dialect != "mysql" {
+				for _, index := range t.indexes {
+					statements = append(statements, "CREATE INDEX IF NOT EXISTS "+index[0]+" ON "+t.name+" ("+quoteColumn(dialect, index[1])+")")
+				}
+			}
+		}
+		return statements
+	}
+}
+
+func dropTables(tables []migrationTable) func(dialect string) []string {
+	return func(dialect string) []string {
+		statements := []string{}
+		for i := len(tables) - 1; i >= 0; i-- {
+			statements = append(statements, "DROP TABLE IF EXISTS "+tables[i].name)
+		}
+		return statements
+	}
+}
+
+// Key columns can't be null.
+func columnType(dialect string, t string, key bool) string {
+	if key {
+		// A MySQL timestamp that can't be null and has no default is set to the current time whenever the row is updated
+		if dialect == "mysql" && t == "timestamp" {
+			return "timestamp(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)"
+		}
+		return columnType(dialect, t, false) + " NOT NULL"
+	}
+	if dialect == "sqlite" {
+		switch {
+		case t == "timestamp":
+			return "TIMESTAMP"
+		case t == "float":
+			return "REAL"
+		case strings.HasSuffix(t, "int"):
+			return "INTEGER"
+		}
+		return "TEXT"
+	}
+	switch t {
+	case "timestamp":
+		if dialect == "mysql" {
+			return "timestamp(6) NULL DEFAULT NULL"
+		}
+		return "timestamp(6)"
+	case "float":
+		if dialect == "mysql" {
+			return "double"
+		}
+		return "float8"
+	}
+	return t
+}
+
+// Some of the column names (key, value, time...) are reserved words.
+func quoteColumn(dialect string, column string) string {
+	if dialect == "mysql" {
+		return "`" + column + "`"
+	}
+	return `"` + column + `"`
+}
+
+func quoteColumns(dialect string, columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = quoteColumn(dialect, c)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func inStrings(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func placeholderFor(dialect string) func(n int) string {
+	if dialect == "postgres" {
+		return postgresPlaceholder
+	}
+	return questionPlaceholder
+}
+
+// Returns each migration and whether or not it has been applied.
+func migrationStatus(db *sqlx.DB, dialect string) ([]MigrationStatus, error) {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL PRIMARY KEY, description VARCHAR(255), applied TIMESTAMP NULL)"); err != nil {
+		return nil, err
+	}
+	applied := []struct {
+		Version int       `db:"version"`
+		Applied time.Time `db:"applied"`
+	}{}
+	if err := db.Select(&applied, "SELECT version, applied FROM schema_version"); err != nil {
+		return nil, err
+	}
+	appliedAt := map[int]time.Time{}
+	for _, a := range applied {
+		appliedAt[a.Version] = a.Applied
+	}
+	status := []MigrationStatus{}
+	for _, m := range Migrations {
+		at, ok := appliedAt[m.Version]
+		status = append(status, MigrationStatus{Version: m.Version, Description: m.Description, Applied: ok, AppliedAt: at})
+	}
+	return status, nil
+}
+
+// Applies the migrations that haven't been applied yet, up to and including the given version (all of them if it's 0). Each migration is
+// applied in a transaction (though MySQL commits changes to tables right away). Returns the migrations applied.
+func migrateUp(db *sqlx.DB, dialect string, to int) ([]Migration, error) {
+	status, err := migrationStatus(db, dialect)
+	if err != nil {
+		return nil, err
+	}
+	done := []Migration{}
+	for i, m := range Migrations {
+		if status[i].Applied {
+			continue
+		}
+		if to > 0 && m.Version > to {
+			break
+		}
+		p := placeholderFor(dialect)
+		if err := runMigration(db, m.Up(dialect), "INSERT INTO schema_version (version, description, applied) VALUES ("+p(1)+", "+p(2)+", "+p(3)+")", m.Version, m.Description, time.Now()); err != nil {
+			return done, errors.New("migration " + m.Description + " failed: " + err.Error())
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// Undoes the given number of the most recently applied migrations. Returns the migrations undone.
+func migrateDown(db *sqlx.DB, dialect string, steps int) ([]Migration, error) {
+	status, err := migrationStatus(db, dialect)
+	if err != nil {
+		return nil, err
+	}
+	done := []Migration{}
+	for i := len(Migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		if !status[i].Applied {
+			continue
+		}
+		m := Migrations[i]
+		if err := runMigration(db, m.Down(dialect), "DELETE FROM schema_version WHERE version = "+placeholderFor(dialect)(1), m.Version); err != nil {
+			return done, errors.New("undoing migration " + m.Description + " failed: " + err.Error())
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// Runs the statements of a migration and records it in schema_version, all in one transaction.
+func runMigration(db *sqlx.DB, statements []string, record string, args ...interface{}) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Returns the status of each migration.
+func (database *SocialHarvestDB) MigrationStatus() ([]MigrationStatus, error) {
+	m, ok := database.Store.(Migratable)
+	if !ok {
+		return nil, errors.New("the database can't be migrated")
+	}
+	db, dialect := m.SQL()
+	return migrationStatus(db, dialect)
+}
+
+// Applies the migrations that haven't been applied, up to and including the given version (all of them if it's 0).
+func (database *SocialHarvestDB) MigrateUp(to int) ([]Migration, error) {
+	m, ok := database.Store.(Migratable)
+	if !ok {
+		return nil, errors.New("the database can't be migrated")
+	}
+	db, dialect := m.SQL()
+	return migrateUp(db, dialect, to)
+}
+
+// Undoes the given number of the most recently applied migrations.
+func (database *SocialHarvestDB) MigrateDown(steps int) ([]Migration, error) {
+	m, ok := database.Store.(Migratable)
+	if !ok {
+		return nil, errors.New("the database can't be migrated")
+	}
+	db, dialect := m.SQL()
+	return migrateDown(db, dialect, steps)
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrationsCoverSeries(t *testing.T) {
+	tables := map[string]map[string]bool{}
+	for _, table := range append(append(append(append(seriesTables, harvestTables...), nodeTables...), settingsTables...), engagementTables...) {
+		tables[table.name] = map[string]bool{}
+		for _, c := range table.columns {
+			tables[table.name][c[0]] = true
+		}
+	}
+	rows := []interface{}{SocialHarvestMessage{}, SocialHarvestSharedLink{}, SocialHarvestMention{}, SocialHarvestHashtag{}, SocialHarvestContributorGrowth{}, SocialHarvestHarvest{}, SocialHarvestMessageEngagement{}}
+	for _, row := range rows {
+		table, columns := seriesColumns(row, false)
+		for _, c := range columns {
+			if !tables[table][c] {
+				t.Errorf("no migration creates the %s column of %s", c, table)
+			}
+		}
+	}
+	if len(tables["harvest"]) != len(tables["harvest_history"]) {
+		t.Error("the harvest cursors and history should have the same columns")
+	}
+
+	for i, m := range Migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %s should be version %d", m.Description, i+1)
+		}
+		for _, dialect := range []string{"postgres", "mysql", "sqlite"} {
+			// Rekeying the harvest cursors can't be undone (and doesn't need to be)
+			if len(m.Up(dialect)) == 0 || (len(m.Down(dialect)) == 0 && m.Version != 8) {
+				t.Errorf("migration %d has nothing to do for %s", m.Version, dialect)
+			}
+		}
+	}
+}
+
+func TestCreateTables(t *testing.T) {
+	sqlite := strings.Join(createTables(harvestTables)("sqlite"), ";\n")
+	if !strings.Contains(sqlite, `CREATE TABLE IF NOT EXISTS harvest ("territory" TEXT NOT NULL, "network" TEXT NOT NULL, "action" TEXT NOT NULL, "value" TEXT NOT NULL, "last_time_harvested" TIMESTAMP, "last_id_harvested" TEXT, "items_harvested" INTEGER, "harvest_time" TIMESTAMP, PRIMARY KEY ("territory", "network", "action", "value"))`) {
+		t.Errorf("unexpected statements: %s", sqlite)
+	}
+	if !strings.Contains(sqlite, `CREATE INDEX IF NOT EXISTS harvest_history_time_key ON harvest_history ("harvest_time")`) {
+		t.Errorf("expected the history to be indexed: %s", sqlite)
+	}
+	mysql := createTables(harvestTables)("mysql")
+	if len(mysql) != 2 || !strings.Contains(mysql[1], "KEY harvest_history_time_key (`harvest_time`)") {
+		t.Errorf("expected MySQL indexes to be created with the tables: %v", mysql)
+	}
+	if down := dropTables(harvestTables)("postgres"); down[0] != "DROP TABLE IF EXISTS harvest_history" {
+		t.Errorf("expected tables to be dropped in reverse order: %v", down)
+	}
+}
+
+func TestMigrationStatements(t *testing.T) {
+	keys := map[string][]string{}
+	for _, tables := range [][]migrationTable{seriesTables, harvestTables, nodeTables, settingsTables, engagementTables, settingsHistoryTables, budgetTables} {
+		for _, table := range tables {
+			keys[table.name] = table.primaryKey
+		}
+	}
+	keys["harvest_rekeyed"] = keys["harvest"]
+	for _, dialect := range []string{"postgres", "mysql", "sqlite"} {
+		for _, m := range Migrations {
+			for _, statement := range m.Up(dialect) {
+				if strings.Contains(statement, "NULL DEFAULT NULL NOT NULL") || strings.Contains(statement, "NOT NULL NOT NULL") {
+					t.Errorf("migration %d has a key column that can be null for %s: %s", m.Version, dialect, statement)
+				}
+				if !strings.HasPrefix(statement, "CREATE TABLE") {
+					continue
+				}
+				key := keys[strings.Fields(statement)[5]]
+				if len(key) == 0 && strings.Contains(statement, "PRIMARY KEY") || len(key) > 0 && !strings.Contains(statement, "PRIMARY KEY ("+quoteColumns(dialect, key)+")") {
+					t.Errorf("migration %d has the wrong primary key for %s: %s", m.Version, dialect, statement)
+				}
+			}
+		}
+	}
+
+	mysql := strings.Join(createTables(budgetTables)("mysql"), "")
+	if !strings.Contains(mysql, "`start` timestamp(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)") || !strings.Contains(mysql, "`calls` int,") {
+		t.Errorf("unexpected MySQL columns: %s", mysql)
+	}
+	mysql = strings.Join(createTables(engagementTables)("mysql"), "")
+	if !strings.Contains(mysql, "`time` timestamp(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)") || !strings.Contains(mysql, "`harvest_id` varchar(255) NOT NULL") {
+		t.Errorf("unexpected MySQL columns: %s", mysql)
+	}
+	if postgres := strings.Join(createTables(budgetTables)("postgres"), ""); !strings.Contains(postgres, `"start" timestamp(6) NOT NULL`) {
+		t.Errorf("unexpected Postgres columns: %s", postgres)
+	}
+
+	// Databases set up with the old scripts get the harvest table rebuilt with the cursors' key
+	for dialect, last := range map[string]string{
+		"postgres": "ALTER INDEX harvest_rekeyed_pkey RENAME TO harvest_pkey",
+		"mysql":    "DROP TABLE harvest_unkeyed",
+		"sqlite":   "ALTER TABLE harvest_rekeyed RENAME TO harvest",
+	} {
+		statements := Migrations[7].Up(dialect)
+		rebuilt := strings.Join(statements, ";\n")
+		if statements[len(statements)-1] != last || !strings.Contains(rebuilt, "PRIMARY KEY ("+quoteColumns(dialect, []string{"territory", "network", "action", "value"})+")") || !strings.Contains(rebuilt, "INSERT INTO harvest_history") {
+			t.Errorf("unexpected statements to rekey the harvest table for %s: %s", dialect, rebuilt)
+		}
+	}
+}
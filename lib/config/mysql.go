@@ -0,0 +1,235 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"errors"
+	"fmt"
+	_ "github.com/SocialHarvestVendors/mysql"
+	"github.com/SocialHarvestVendors/sqlx"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stores harvested data, harvest state, settings and cluster nodes in MySQL (using the SQL files in scripts/mysql for the tables).
+type MySQLStorage struct {
+	DB      *sqlx.DB
+	Compact bool
+}
+
+func init() {
+	RegisterStorage("mysql", NewMySQLStorage)
+}
+
+// Connects to the configured MySQL database, through its socket if one is configured.
+func NewMySQLStorage(config SocialHarvestConf) (Storage, error) {
+	address := "unix(" + config.Database.Socket + ")"
+	if config.Database.Socket == "" {
+		port := config.Database.Port
+		if port == 0 {
+			port = 3306
+		}
+		address = "tcp(" + config.Database.Host + ":" + strconv.Itoa(port) + ")"
+	}
+	// parseTime is needed to scan timestamps into time.Time
+	db, err := sqlx.Connect("mysql", config.Database.User+":"+config.Database.Password+"@"+address+"/"+config.Database.Database+"?parseTime=true&charset=utf8")
+	if err != nil {
+		return nil, err
+	}
+	return &MySQLStorage{DB: db, Compact: config.Schema.Compact}, nil
+}
+
+// Writes a row of harvested data (or harvest state) to the table for its series. Rows that were already stored (with the same harvest_id)
+// are skipped, so harvesting something twice doesn't fail.
+func (s *MySQLStorage) StoreRow(row interface{}) error {
+	table, columns := seriesColumns(row, s.Compact)
+	if table == "" {
+		return errors.New("unknown series")
+	}
+	_, err := s.DB.NamedExec(insertQuery("INSERT INTO", table, columns)+onDuplicate(table), row)
+	return err
+}
+
+// Writes several rows of the same series with one statement.
+func (s *MySQLStorage) StoreRows(rows []interface{}) error {
+	table, columns := seriesColumns(rows[0], s.Compact)
+	if table == "" {
+		return errors.New("unknown series")
+	}
+	for _, batch := range batchesOf(rows, len(columns), 65535) {
+		query, args := batchInsert("INSERT INTO", table, columns, batch, questionPlaceholder)
+		if _, err := s.DB.Exec(query+onDuplicate(table), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes a series' rows older than the given time, a batch at a time (there are no partitions to drop).
+func (s *MySQLStorage) Purge(table string, before time.Time, batchSize int) (int64, []string, error) {
+	n, err := deleteInBatches(s.DB, "DELETE FROM "+table+" WHERE `time` < ? LIMIT "+strconv.Itoa(batchSize), before)
+	return n, []string{}, err
+}
+
+// What to do when a row of the series is already stored: messages get their engagement counts updated and anything else is skipped (the
+// harvest history has no unique key).
+func onDuplicate(table string) string {
+	switch table {
+	case "harvest_history":
+		return ""
+	case "messages":
+		set := make([]string, len(engagementColumns))
+		for i, c := range engagementColumns {
+			set[i] = c + " = VALUES(" + c + ")"
+		}
+		return " ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+	}
+	return " ON DUPLICATE KEY UPDATE harvest_id = harvest_id"
+}
+
+// Returns the messages harvested from a territory and network in the time range (just their ids and engagement counts).
+func (s *MySQLStorage) Messages(territory string, network string, from time.Time, to time.Time) ([]SocialHarvestMessage, error) {
+	messages := []SocialHarvestMessage{}
+	err := s.DB.Select(&messages, messagesQuery("`time`", questionPlaceholder), territory, network, from, to)
+	return messages, err
+}
+
+// Saves where a harvest left off, replacing the cursor for its territory, network, action and value.
+func (s *MySQLStorage) SaveCursor(cursor SocialHarvestHarvest) error {
+	_, err := s.DB.NamedExec(insertQuery("INSERT INTO", "harvest", cursorColumns)+" ON DUPLICATE KEY UPDATE last_time_harvested = VALUES(last_time_harvested), last_id_harvested = VALUES(last_id_harvested), items_harvested = VALUES(items_harvested), harvest_time = VALUES(harvest_time)", cursor)
+	return err
+}
+
+// Returns the cursor for the action and value (it's empty if there isn't one).
+func (s *MySQLStorage) LastHarvest(territory string, network string, action string, value string) (SocialHarvestHarvest, error) {
+	var lastHarvest SocialHarvestHarvest
+	err := s.DB.Get(&lastHarvest, "SELECT * FROM harvest WHERE network = ? AND action = ? AND value = ? AND territory = ?", network, action, value, territory)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return lastHarvest, err
+}
+
+// Returns the cursor for each action and value (keyword, account, etc.) harvested. The territory and network are optional.
+func (s *MySQLStorage) Cursors(territory string, network string) ([]SocialHarvestHarvest, error) {
+	cursors := []SocialHarvestHarvest{}
+	err := s.DB.Select(&cursors, "SELECT * FROM harvest WHERE (? = '' OR territory = ?) AND (? = '' OR network = ?) ORDER BY territory, network, action, value", territory, territory, network, network)
+	return cursors, err
+}
+
+// Removes cursors. The network, action and value are optional. Returns the number removed.
+func (s *MySQLStorage) ResetCursors(territory string, network string, action string, value string) (int64, error) {
+	res, err := s.DB.Exec("DELETE FROM harvest WHERE territory = ? AND (? = '' OR network = ?) AND (? = '' OR action = ?) AND (? = '' OR value = ?)", territory, network, network, action, action, value, value)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Saves a settings key/value, updating it if the key already exists.
+func (s *MySQLStorage) SaveSettings(settingsRow Settings) error {
+	_, err := s.DB.NamedExec("INSERT INTO settings (`key`, value, modified) VALUES (:key, :value, :modified) ON DUPLICATE KEY UPDATE value = VALUES(value), modified = VALUES(modified)", settingsRow)
+	return err
+}
+
+// Returns the settings for a key.
+func (s *MySQLStorage) Settings(key string) (Settings, error) {
+	var settingsRow Settings
+	err := s.DB.Get(&settingsRow, "SELECT * FROM settings WHERE `key` = ?", key)
+	return settingsRow, err
+}
+
+// Checks that the database can be reached and the tables are there.
+func (s *MySQLStorage) Ping() error {
+	var c int
+	return s.DB.Get(&c, "SELECT COUNT(*) FROM messages")
+}
+
+func (s *MySQLStorage) SQL() (*sqlx.DB, string) {
+	return s.DB, "mysql"
+}
+
+func (s *MySQLStorage) Close() error {
+	return s.DB.Close()
+}
+
+// Takes a lock on the given key that's shared with every other harvester using the same database (see SocialHarvestDB.JobLock()).
+// MySQL's named locks belong to a connection, so a transaction is used to hold on to one until the lock is released. If the lock can't be
+// checked, it isn't taken.
+func (s *MySQLStorage) JobLock(key string, wait bool) (func(), bool) {
+	unlock := func() {}
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		log.Println(err)
+		return unlock, false
+	}
+	// A negative timeout waits for as long as it takes
+	timeout := 0
+	if wait {
+		timeout = -1
+	}
+	name := mysqlLockName(key)
+	var locked sql.NullInt64
+	err = tx.Get(&locked, "SELECT GET_LOCK(?, ?)", name, timeout)
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return unlock, false
+	}
+	if locked.Int64 != 1 {
+		tx.Rollback()
+		return unlock, false
+	}
+	return func() {
+		tx.Exec("SELECT RELEASE_LOCK(?)", name)
+		tx.Rollback()
+	}, true
+}
+
+// Lock names are limited to 64 characters (since MySQL 5.7) and keys include territory names, so the key is hashed.
+func mysqlLockName(key string) string {
+	return fmt.Sprintf("social_harvest_%x", sha1.Sum([]byte(key)))
+}
+
+// Records a heartbeat for the node (adding it if it's new).
+func (s *MySQLStorage) NodeHeartbeat(node HarvesterNode) error {
+	_, err := s.DB.NamedExec("INSERT INTO harvester_nodes (id, hostname, started, heartbeat) VALUES (:id, :hostname, :started, :heartbeat) ON DUPLICATE KEY UPDATE hostname = VALUES(hostname), started = VALUES(started), heartbeat = VALUES(heartbeat)", node)
+	return err
+}
+
+// Returns all nodes that have sent a heartbeat since the given time, ordered by id.
+func (s *MySQLStorage) Nodes(since time.Time) ([]HarvesterNode, error) {
+	nodes := []HarvesterNode{}
+	err := s.DB.Select(&nodes, "SELECT * FROM harvester_nodes WHERE heartbeat >= ? ORDER BY id", since)
+	return nodes, err
+}
+
+// Removes a node (when it leaves the cluster).
+func (s *MySQLStorage) RemoveNode(id string) error {
+	_, err := s.DB.Exec("DELETE FROM harvester_nodes WHERE id = ?", id)
+	return err
+}
+
+// Removes nodes that haven't sent a heartbeat since the given time (they're gone).
+func (s *MySQLStorage) RemoveStaleNodes(before time.Time) error {
+	_, err := s.DB.Exec("DELETE FROM harvester_nodes WHERE heartbeat < ?", before)
+	return err
+}
@@ -0,0 +1,499 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	_ "github.com/SocialHarvestVendors/pq"
+	"github.com/SocialHarvestVendors/sqlx"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stores harvested data, harvest state, settings and cluster nodes in Postgres (using the SQL files in scripts/postgresql for the tables).
+type PostgresStorage struct {
+	DB            *sqlx.DB
+	Compact       bool
+	Series        []string
+	PartitionDays int
+}
+
+func init() {
+	RegisterStorage("postgres", NewPostgresStorage)
+	RegisterStorage("postgresql", NewPostgresStorage)
+}
+
+// Connects to the configured Postgres database.
+func NewPostgresStorage(config SocialHarvestConf) (Storage, error) {
+	// Note that sqlx just wraps database/sql and gives a sqlx.DB which is essentially a wrapped sql.DB
+	db, err := sqlx.Connect("postgres", "host="+config.Database.Host+" port="+strconv.Itoa(config.Database.Port)+" sslmode=disable dbname="+config.Database.Database+" user="+config.Database.User+" password="+config.Database.Password)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStorage{
+		DB:            db,
+		Compact:       config.Schema.Compact,
+		Series:        SeriesNames,
+		PartitionDays: config.Database.PartitionDays,
+	}, nil
+}
+
+// Writes a row of harvested data (or harvest state) to the table for its series.
+func (s *PostgresStorage) StoreRow(row interface{}) error {
+	table, columns := seriesColumns(row, s.Compact)
+	if table == "" {
+		return errors.New("unknown series")
+	}
+	// A message that's already stored gets its engagement counts updated instead
+	if table == "messages" {
+		rows, err := updateEngagement(s.DB, []interface{}{row}, postgresPlaceholder)
+		if err != nil || len(rows) == 0 {
+			return err
+		}
+	}
+	// Rows that were already stored (the same harvest id) are skipped, like they are in the other databases
+	_, err := s.DB.NamedExec(insertQuery("INSERT INTO", table, columns)+" ON CONFLICT DO NOTHING", row)
+	return err
+}
+
+// Writes several rows of the same series with one statement. Rows that were already stored are skipped, rather than failing the batch.
+func (s *PostgresStorage) StoreRows(rows []interface{}) error {
+	table, columns := seriesColumns(rows[0], s.Compact)
+	if table == "" {
+		return errors.New("unknown series")
+	}
+	if table == "messages" {
+		var err error
+		if rows, err = updateEngagement(s.DB, rows, postgresPlaceholder); err != nil || len(rows) == 0 {
+			return err
+		}
+	}
+	// Postgres allows up to 65535 values in a statement
+	for _, batch := range batchesOf(rows, len(columns), 65535) {
+		query, args := batchInsert("INSERT INTO", table, columns, batch, postgresPlaceholder)
+		if _, err := s.DB.Exec(query+" ON CONFLICT DO NOTHING", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the messages harvested from a territory and network in the time range (just their ids and engagement counts).
+func (s *PostgresStorage) Messages(territory string, network string, from time.Time, to time.Time) ([]SocialHarvestMessage, error) {
+	messages := []SocialHarvestMessage{}
+	err := s.DB.Select(&messages, messagesQuery("\"time\"", postgresPlaceholder), territory, network, from, to)
+	return messages, err
+}
+
+// Saves where a harvest left off, replacing the cursor for its territory, network, action and value.
+func (s *PostgresStorage) SaveCursor(cursor SocialHarvestHarvest) error {
+	_, err := s.DB.NamedExec(insertQuery("INSERT INTO", "harvest", cursorColumns)+" ON CONFLICT (territory, network, action, value) DO UPDATE SET last_time_harvested = EXCLUDED.last_time_harvested, last_id_harvested = EXCLUDED.last_id_harvested, items_harvested = EXCLUDED.items_harvested, harvest_time = EXCLUDED.harvest_time", cursor)
+	return err
+}
+
+// Returns the cursor for the action and value (it's empty if there isn't one).
+func (s *PostgresStorage) LastHarvest(territory string, network string, action string, value string) (SocialHarvestHarvest, error) {
+	var lastHarvest SocialHarvestHarvest
+	err := s.DB.Get(&lastHarvest, "SELECT * FROM harvest WHERE network = $1 AND action = $2 AND value = $3 AND territory = $4", network, action, value, territory)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return lastHarvest, err
+}
+
+// Returns the cursor for each action and value (keyword, account, etc.) harvested. The territory and network are optional.
+func (s *PostgresStorage) Cursors(territory string, network string) ([]SocialHarvestHarvest, error) {
+	cursors := []SocialHarvestHarvest{}
+	err := s.DB.Select(&cursors, "SELECT * FROM harvest WHERE ($1 = '' OR territory = $1) AND ($2 = '' OR network = $2) ORDER BY territory, network, action, value", territory, network)
+	return cursors, err
+}
+
+// Removes cursors. The network, action and value are optional. Returns the number removed.
+func (s *PostgresStorage) ResetCursors(territory string, network string, action string, value string) (int64, error) {
+	res, err := s.DB.Exec("DELETE FROM harvest WHERE territory = $1 AND ($2 = '' OR network = $2) AND ($3 = '' OR action = $3) AND ($4 = '' OR value = $4)", territory, network, action, value)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Saves a settings key/value, updating it if the key already exists.
+func (s *PostgresStorage) SaveSettings(settingsRow Settings) error {
+	_, err := s.DB.NamedExec("INSERT INTO settings (key, value, modified) VALUES (:key, :value, :modified) ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, modified = EXCLUDED.modified", settingsRow)
+	return err
+}
+
+// Returns the settings for a key.
+func (s *PostgresStorage) Settings(key string) (Settings, error) {
+	var settingsRow Settings
+	err := s.DB.Get(&settingsRow, "SELECT * FROM settings WHERE key = $1", key)
+	return settingsRow, err
+}
+
+// Checks that the database can be reached and the tables are there.
+func (s *PostgresStorage) Ping() error {
+	var c int
+	return s.DB.Get(&c, "SELECT COUNT(*) FROM messages")
+}
+
+func (s *PostgresStorage) SQL() (*sqlx.DB, string) {
+	return s.DB, "postgres"
+}
+
+func (s *PostgresStorage) Close() error {
+	return s.DB.Close()
+}
+
+// Takes a lock on the given key that's shared with every other harvester using the same database (see SocialHarvestDB.JobLock()).
+// A Postgres advisory lock is used within a transaction so it's released even if this harvester goes away without unlocking. The
+// transaction holds on to one of the pool's connections until the lock is released. If the lock can't be checked, it isn't taken.
+func (s *PostgresStorage) JobLock(key string, wait bool) (func(), bool) {
+	unlock := func() {}
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		log.Println(err)
+		return unlock, false
+	}
+	locked := true
+	if wait {
+		_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", key)
+	} else {
+		err = tx.Get(&locked, "SELECT pg_try_advisory_xact_lock(hashtext($1))", key)
+	}
+	if err != nil {
+		log.Println(err)
+		tx.Rollback()
+		return unlock, false
+	}
+	if !locked {
+		tx.Rollback()
+		return unlock, false
+	}
+	// Nothing was written in the transaction, rolling it back just ends it (and releases the lock)
+	return func() { tx.Rollback() }, true
+}
+
+// Records a heartbeat for the node (adding it if it's new).
+func (s *PostgresStorage) NodeHeartbeat(node HarvesterNode) error {
+	_, err := s.DB.NamedExec("INSERT INTO harvester_nodes (id, hostname, started, heartbeat) VALUES (:id, :hostname, :started, :heartbeat) ON CONFLICT (id) DO UPDATE SET hostname = EXCLUDED.hostname, started = EXCLUDED.started, heartbeat = EXCLUDED.heartbeat", node)
+	return err
+}
+
+// Returns all nodes that have sent a heartbeat since the given time, ordered by id.
+func (s *PostgresStorage) Nodes(since time.Time) ([]HarvesterNode, error) {
+	nodes := []HarvesterNode{}
+	err := s.DB.Select(&nodes, "SELECT * FROM harvester_nodes WHERE heartbeat >= $1 ORDER BY id", since)
+	return nodes, err
+}
+
+// Removes a node (when it leaves the cluster).
+func (s *PostgresStorage) RemoveNode(id string) error {
+	_, err := s.DB.Exec("DELETE FROM harvester_nodes WHERE id = $1", id)
+	return err
+}
+
+// Removes nodes that haven't sent a heartbeat since the given time (they're gone).
+func (s *PostgresStorage) RemoveStaleNodes(before time.Time) error {
+	_, err := s.DB.Exec("DELETE FROM harvester_nodes WHERE heartbeat < $1", before)
+	return err
+}
+
+// The number of partitions kept ready after the current one.
+const partitionsAhead = 2
+
+// A partition of a series table holding the rows from one time (inclusive) up to another (exclusive).
+type partition struct {
+	name string
+	from time.Time
+	to   time.Time
+}
+
+// Returns the partition of the table that holds the given time. Partitions are "PartitionDays" long, counted from the Unix epoch (in UTC)
+// so they line up the same way every time.
+func partitionFor(table string, t time.Time, days int) partition {
+	period := int64(days) * 86400
+	from := time.Unix(t.Unix()/period*period, 0).UTC()
+	to := from.AddDate(0, 0, days)
+	return partition{name: table + "_p" + from.Format("20060102") + "_" + to.Format("20060102"), from: from, to: to}
+}
+
+// Returns the partition from the name of a partition table (see partitionFor()).
+func parsePartition(table string, name string) (partition, bool) {
+	dates := strings.Split(strings.TrimPrefix(name, table+"_p"), "_")
+	if !strings.HasPrefix(name, table+"_p") || len(dates) != 2 {
+		return partition{}, false
+	}
+	from, err := time.Parse("20060102", dates[0])
+	if err != nil {
+		return partition{}, false
+	}
+	to, err := time.Parse("20060102", dates[1])
+	if err != nil {
+		return partition{}, false
+	}
+	return partition{name: name, from: from, to: to}, true
+}
+
+// Makes sure each series has partitions for the current period and the next few. With Postgres 11 or newer, series tables are partitioned
+// declaratively (an empty series table is recreated as a partitioned table) with a default partition catching anything older. Otherwise
+// partitions inherit from the series table and a trigger routes rows to them, leaving anything older in the series table itself.
+func (s *PostgresStorage) PreparePartitions(now time.Time) error {
+	if s.PartitionDays <= 0 {
+		return nil
+	}
+	var version int
+	if err := s.DB.Get(&version, "SELECT current_setting('server_version_num')::int"); err != nil {
+		return err
+	}
+	for _, table := range s.Series {
+		partitions := []partition{}
+		for i := 0; i <= partitionsAhead; i++ {
+			partitions = append(partitions, partitionFor(table, now.AddDate(0, 0, i*s.PartitionDays), s.PartitionDays))
+		}
+		declarative, err := s.partitionedDeclaratively(table, version)
+		if err != nil {
+			return err
+		}
+		if declarative {
+			err = s.createDeclarativePartitions(table, partitions)
+		} else {
+			err = s.createInheritedPartitions(table, partitions)
+		}
+		if err != nil {
+			return errors.New("could not partition " + table + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Returns true if the table is partitioned declaratively, first turning it into a partitioned table if the server supports it and the
+// table is empty (a table with data in it can't be changed into a partitioned one without copying everything).
+func (s *PostgresStorage) partitionedDeclaratively(table string, version int) (bool, error) {
+	var kind string
+	if err := s.DB.Get(&kind, "SELECT c.relkind FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.relname = $1 AND n.nspname = current_schema()", table); err != nil {
+		return false, err
+	}
+	if kind == "p" {
+		return true, nil
+	}
+	if version < 110000 {
+		return false, nil
+	}
+	var empty bool
+	if err := s.DB.Get(&empty, "SELECT NOT EXISTS (SELECT 1 FROM "+table+")"); err != nil {
+		return false, err
+	}
+	if !empty {
+		return false, nil
+	}
+
+	// The primary key of a partitioned table has to include the column it's partitioned by
+	statements := []string{
+		"ALTER TABLE " + table + " RENAME TO " + table + "_unpartitioned",
+		"CREATE TABLE " + table + " (LIKE " + table + "_unpartitioned INCLUDING DEFAULTS) PARTITION BY RANGE (\"time\")",
+		"DROP TABLE " + table + "_unpartitioned",
+		"ALTER TABLE " + table + " ADD PRIMARY KEY (harvest_id, \"time\")",
+		"CREATE TABLE " + table + "_default PARTITION OF " + table + " DEFAULT",
+	}
+	for _, t := range append(append([]migrationTable{}, seriesTables...), engagementTables...) {
+		if t.name == table {
+			for _, index := range t.indexes {
+				statements = append(statements, "CREATE INDEX IF NOT EXISTS "+index[0]+" ON "+table+" (\""+index[1]+"\")")
+			}
+		}
+	}
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return false, err
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+func (s *PostgresStorage) createDeclarativePartitions(table string, partitions []partition) error {
+	for _, p := range partitions {
+		_, err := s.DB.Exec("CREATE TABLE IF NOT EXISTS " + p.name + " PARTITION OF " + table + " FOR VALUES FROM ('" + p.from.Format(time.RFC3339) + "') TO ('" + p.to.Format(time.RFC3339) + "')")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Creates the partitions as tables inheriting from the series table and replaces the trigger function that routes rows to them, so it
+// always knows about every partition. All in one transaction so rows are never routed to a partition that isn't there.
+func (s *PostgresStorage) createInheritedPartitions(table string, partitions []partition) error {
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	for _, p := range partitions {
+		_, err := tx.Exec("CREATE TABLE IF NOT EXISTS " + p.name + " (LIKE " + table + " INCLUDING ALL, CHECK (\"time\" >= '" + p.from.Format(time.RFC3339) + "' AND \"time\" < '" + p.to.Format(time.RFC3339) + "')) INHERITS (" + table + ")")
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := routePartitions(tx, table); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// The tables partitioning a series table (either way).
+const partitionsQuery = "SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid JOIN pg_class p ON p.oid = i.inhparent WHERE p.relname = $1"
+
+// Replaces the trigger function that routes rows to the partitions inheriting from the series table, so it knows about every partition.
+func routePartitions(tx *sqlx.Tx, table string) error {
+	names := []string{}
+	if err := tx.Select(&names, partitionsQuery, table); err != nil {
+		return err
+	}
+	existing := []partition{}
+	for _, name := range names {
+		if p, ok := parsePartition(table, name); ok {
+			existing = append(existing, p)
+		}
+	}
+	for _, statement := range []string{
+		partitionTriggerFunction(table, existing),
+		"DROP TRIGGER IF EXISTS " + table + "_partition_insert ON " + table,
+		"CREATE TRIGGER " + table + "_partition_insert BEFORE INSERT ON " + table + " FOR EACH ROW EXECUTE PROCEDURE " + table + "_partition_insert()",
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes a series' rows older than the given time. Partitions that end by then are dropped whole, the rest are deleted a batch at a time.
+func (s *PostgresStorage) Purge(table string, before time.Time, batchSize int) (int64, []string, error) {
+	var removed int64
+	dropped := []string{}
+	names := []string{}
+	if err := s.DB.Select(&names, partitionsQuery, table); err != nil {
+		return removed, dropped, err
+	}
+	expired := []partition{}
+	for _, name := range names {
+		if p, ok := parsePartition(table, name); ok && !p.to.After(before) {
+			expired = append(expired, p)
+		}
+	}
+	if len(expired) > 0 {
+		var kind string
+		if err := s.DB.Get(&kind, "SELECT relkind FROM pg_class WHERE relname = $1", table); err != nil {
+			return removed, dropped, err
+		}
+		tx, err := s.DB.Beginx()
+		if err != nil {
+			return removed, dropped, err
+		}
+		var rows int64
+		for _, p := range expired {
+			var n int64
+			if err := tx.Get(&n, "SELECT count(*) FROM "+p.name); err != nil {
+				tx.Rollback()
+				return removed, dropped, err
+			}
+			if _, err := tx.Exec("DROP TABLE " + p.name); err != nil {
+				tx.Rollback()
+				return removed, dropped, err
+			}
+			rows += n
+		}
+		// Rows are routed by a trigger unless the table is partitioned declaratively, which mustn't route to the dropped partitions
+		if kind != "p" {
+			if err := routePartitions(tx, table); err != nil {
+				tx.Rollback()
+				return removed, dropped, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return removed, dropped, err
+		}
+		removed += rows
+		for _, p := range expired {
+			dropped = append(dropped, p.name)
+		}
+	}
+
+	n, err := deleteInBatches(s.DB, "DELETE FROM "+table+" WHERE \"time\" < $1 AND harvest_id IN (SELECT harvest_id FROM "+table+" WHERE \"time\" < $1 LIMIT "+strconv.Itoa(batchSize)+")", before)
+	return removed + n, dropped, err
+}
+
+// Returns the trigger function that inserts rows into the partition for their time (skipping rows already in it). Rows that don't belong
+// to any partition (late historical data) stay in the series table.
+//
+// Each partition (and the series table) has its own primary key, which doesn't stop the same harvest_id from going into two of them. So
+// where the key doesn't include the time (which picks the partition), the trigger first skips rows whose key is already in the series
+// table or any of its partitions. Two rows with the same key and different times inserted at the very same moment could still both get
+// in, harvests don't emit those.
+func partitionTriggerFunction(table string, partitions []partition) string {
+	sort.Sort(partitionsByTime(partitions))
+	var buffer bytes.Buffer
+	buffer.WriteString("CREATE OR REPLACE FUNCTION " + table + "_partition_insert() RETURNS TRIGGER AS $$ BEGIN ")
+	if key := seriesPrimaryKey(table); len(partitions) > 0 && len(key) > 0 && !inStrings(key, "time") {
+		matches := []string{}
+		for _, c := range key {
+			matches = append(matches, quoteColumn("postgres", c)+" = NEW."+quoteColumn("postgres", c))
+		}
+		buffer.WriteString("IF EXISTS (SELECT 1 FROM " + table + " WHERE " + strings.Join(matches, " AND ") + ") THEN RETURN NULL; END IF; ")
+	}
+	for i, p := range partitions {
+		if i > 0 {
+			buffer.WriteString("ELS")
+		}
+		buffer.WriteString("IF NEW.\"time\" >= '" + p.from.Format(time.RFC3339) + "' AND NEW.\"time\" < '" + p.to.Format(time.RFC3339) + "' THEN ")
+		buffer.WriteString("INSERT INTO " + p.name + " VALUES (NEW.*) ON CONFLICT DO NOTHING; RETURN NULL; ")
+	}
+	if len(partitions) > 0 {
+		buffer.WriteString("END IF; ")
+	}
+	buffer.WriteString("RETURN NEW; END; $$ LANGUAGE plpgsql")
+	return buffer.String()
+}
+
+// Returns the primary key the migrations give a series table.
+func seriesPrimaryKey(table string) []string {
+	for _, t := range append(append([]migrationTable{}, seriesTables...), engagementTables...) {
+		if t.name == table {
+			return t.primaryKey
+		}
+	}
+	return []string{}
+}
+
+// Newest first, since that's where most rows go.
+type partitionsByTime []partition
+
+func (p partitionsByTime) Len() int           { return len(p) }
+func (p partitionsByTime) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p partitionsByTime) Less(i, j int) bool { return p[i].from.After(p[j].from) }
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPartitionFor(t *testing.T) {
+	p := partitionFor("messages", time.Date(2014, 10, 15, 12, 0, 0, 0, time.UTC), 7)
+	if !p.from.Before(time.Date(2014, 10, 15, 12, 0, 0, 0, time.UTC)) || p.to.Sub(p.from) != 7*24*time.Hour {
+		t.Errorf("unexpected partition range: %v to %v", p.from, p.to)
+	}
+	// Every time in the period gets the same partition
+	if partitionFor("messages", p.from, 7) != p || partitionFor("messages", p.to.Add(-time.Second), 7) != p || partitionFor("messages", p.to, 7) == p {
+		t.Error("expected partitions to line up")
+	}
+	parsed, ok := parsePartition("messages", p.name)
+	if !ok || !parsed.from.Equal(p.from) || !parsed.to.Equal(p.to) {
+		t.Errorf("could not parse the partition name %s", p.name)
+	}
+	if _, ok := parsePartition("messages", "messages_default"); ok {
+		t.Error("the default partition isn't a time range")
+	}
+}
+
+func TestPartitionTriggerFunction(t *testing.T) {
+	older := partitionFor("messages", time.Date(2014, 10, 1, 0, 0, 0, 0, time.UTC), 7)
+	newer := partitionFor("messages", time.Date(2014, 10, 15, 0, 0, 0, 0, time.UTC), 7)
+	f := partitionTriggerFunction("messages", []partition{older, newer})
+	if strings.Index(f, newer.name) > strings.Index(f, older.name) {
+		t.Error("expected the newest partition to be checked first")
+	}
+	if strings.Count(f, "ELSIF") != 1 || !strings.HasSuffix(f, "END IF; RETURN NEW; END; $$ LANGUAGE plpgsql") {
+		t.Errorf("unexpected trigger function: %s", f)
+	}
+	if f := partitionTriggerFunction("messages", []partition{}); strings.Contains(f, "IF") {
+		t.Errorf("unexpected trigger function without partitions: %s", f)
+	}
+
+	// Rows already in another partition (or the series table) are skipped, unless the time is part of the key
+	if !strings.Contains(f, `BEGIN IF EXISTS (SELECT 1 FROM messages WHERE "harvest_id" = NEW."harvest_id") THEN RETURN NULL; END IF; IF NEW."time"`) {
+		t.Errorf("expected the trigger to skip harvest ids that are already stored: %s", f)
+	}
+	engagement := partitionFor("message_engagement", time.Date(2014, 10, 15, 0, 0, 0, 0, time.UTC), 7)
+	if f := partitionTriggerFunction("message_engagement", []partition{engagement}); strings.Contains(f, "EXISTS") {
+		t.Errorf("unexpected check for rows keyed by time: %s", f)
+	}
+}
@@ -17,30 +17,731 @@
 package config
 
 import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/SocialHarvestVendors/cron"
+	"io/ioutil"
 	"log"
+	"os"
+	"sync"
+	"time"
 )
 
 type SocialHarvestSchedule struct {
 	Cron *cron.Cron
+	// Called when a job runs (on schedule or when triggered). It's set by the harvester (main) since this package doesn't know how to harvest.
+	Run func(territory string, network string, action string)
+	// The territories that jobs can be scheduled for
+	Territories []string
+	// Used to make sure a job only runs on one harvester at a time when several share a database (optional)
+	Database *SocialHarvestDB
+	// Scheduled runs are skipped for territories another harvester in the cluster owns (optional)
+	Cluster *SocialHarvestCluster
+	// When keywords and accounts are due for territories with adaptive scheduling
+	Adaptive *AdaptiveSchedule
+	jobs     []*ScheduledJob
+	removed  []string
+	// Upkeep for the harvester itself (see SetMaintenance())
+	maintenance []maintenanceTask
+	// The names of the cron entries, by job id (or "maintenance|" and the task name). Entries are added and removed one at a time, rather
+	// than rebuilding the cron, so the others keep their timers.
+	cronEntries map[string]string
+	// Runs in progress and queued by lock key (see ScheduledJob.LockKey()), so jobs for the same territory, network and action share limits
+	running map[string]int
+	queued  map[string]bool
+	idle    *sync.Cond
+	mu      sync.Mutex
 }
 
+// A harvest job on the schedule. Jobs come from the config or are added through the API, either way the id is derived from the
+// territory, network, action and spec so it stays the same across restarts.
+type ScheduledJob struct {
+	Id        string `json:"id"`
+	Territory string `json:"territory"`
+	Network   string `json:"network"`
+	Action    string `json:"action"`
+	Spec      string `json:"spec"`
+	Paused    bool   `json:"paused"`
+	Source    string `json:"source"`
+	// What to do if the job is due (or triggered) while it's still running
+	Overlap string `json:"overlap"`
+}
+
+const (
+	ScheduleSourceConfig = "config"
+	ScheduleSourceApi    = "api"
+)
+
+// Overlap policies. "skip" doesn't run the job if it's already running, "queue" runs it again once the current run is done (several
+// runs that come due in the meantime only queue one more run) and "allow" runs it regardless.
+const (
+	OverlapSkip  = "skip"
+	OverlapQueue = "queue"
+	OverlapAllow = "allow"
+)
+
+var OverlapPolicies = []string{OverlapSkip, OverlapQueue, OverlapAllow}
+
+// Changes made to the schedule through the API are saved here so they survive a restart (the config file is left alone).
+var ScheduleStateFile = "./sh-data/schedule.json"
+
+type scheduleState struct {
+	Added   []ScheduledJob `json:"added"`
+	Removed []string       `json:"removed"`
+	Paused  []string       `json:"paused"`
+}
+
+var ErrJobNotFound = errors.New("scheduled job not found")
+
 var schedule = SocialHarvestSchedule{}
 
-// Set up the schedule so it is accessible by others and start it
-func NewSchedule(config SocialHarvestConf) *SocialHarvestSchedule {
-	c := cron.New()
+// A task the harvester runs on a schedule to look after itself (rather than harvest), like preparing database partitions.
+type maintenanceTask struct {
+	name string
+	spec string
+	run  func()
+}
 
-	//c.AddFunc("@hourly", func() { log.Println("Every hour") })
-	//c.AddFunc("0 5 * * * *", func() { log.Println("Every 5 minutes") }, "Optional name here. Useful when inspecting.")
+// The networks and actions that can be scheduled for each territory. "content" harvests messages (by keyword and from accounts) and
+// "accounts" harvests account details to track growth.
+var ScheduleNetworks = []string{"twitter", "facebook", "instagram", "googlePlus", "youTube"}
+var ScheduleActions = []string{"content", "accounts"}
+
+// Set up the schedule so it is accessible by others and start it. Jobs are set with SetConfigJobs() and Restore().
+func NewSchedule(config SocialHarvestConf) *SocialHarvestSchedule {
+	schedule.mu.Lock()
+	defer schedule.mu.Unlock()
 
+	// There should only ever be one cron running
+	if schedule.Cron != nil {
+		schedule.Cron.Stop()
+	}
+	c := cron.New()
 	c.Start()
 	schedule.Cron = c
+	schedule.jobs = []*ScheduledJob{}
+	schedule.removed = []string{}
+	schedule.maintenance = []maintenanceTask{}
+	schedule.cronEntries = map[string]string{}
+	// Runs that are in progress are still tracked
+	if schedule.running == nil {
+		schedule.running = map[string]int{}
+		schedule.queued = map[string]bool{}
+		schedule.idle = sync.NewCond(&schedule.mu)
+		schedule.Adaptive = NewAdaptiveSchedule()
+	}
+	schedule.Territories = []string{}
+	for _, t := range config.Harvest.Territories {
+		schedule.Territories = append(schedule.Territories, t.Name)
+	}
 	return &schedule
 }
 
-func AddToSchedule() {
+// Stops the schedule. Nothing else is started on it, but jobs that are already running carry on.
+func (s *SocialHarvestSchedule) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Cron != nil {
+		s.Cron.Stop()
+	}
+}
+
+// Changes the database jobs are locked in (when the config is reloaded). Jobs that are running keep their locks in the old one.
+func (s *SocialHarvestSchedule) SetDatabase(database *SocialHarvestDB) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Database = database
+}
+
+func (s *SocialHarvestSchedule) database() *SocialHarvestDB {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Database
+}
+
+// Returns the id for a job (an md5 of what it does and when).
+func ScheduledJobId(territory string, network string, action string, spec string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(territory+"|"+network+"|"+action+"|"+spec)))
+}
+
+// The key that's locked while the job runs. Any jobs for the same territory, network and action won't run at the same time.
+func (j ScheduledJob) LockKey() string {
+	return "harvest|" + j.Territory + "|" + j.Network + "|" + j.Action
+}
+
+// The name shown for the job's cron entry
+func (j ScheduledJob) Name() string {
+	return "Harvesting " + j.Territory + " " + j.Network + " " + j.Action + " - " + j.Spec
+}
 
+// Validates a cron spec and returns the next count run times after the given time.
+func NextRuns(spec string, from time.Time, count int) ([]time.Time, error) {
+	runs := []time.Time{}
+	if spec == "" {
+		return runs, errors.New("a cron spec is required")
+	}
+	sched, err := cron.Parse(spec)
+	if err != nil {
+		return runs, err
+	}
+	next := from
+	for i := 0; i < count; i++ {
+		next = sched.Next(next)
+		if next.IsZero() {
+			break
+		}
+		runs = append(runs, next)
+	}
+	return runs, nil
+}
+
+// Adds a job to the schedule after validating it. Jobs added through the API are persisted.
+func (s *SocialHarvestSchedule) AddJob(job ScheduledJob) (ScheduledJob, error) {
+	if err := s.validateJob(job); err != nil {
+		return job, err
+	}
+	if job.Source == "" {
+		job.Source = ScheduleSourceApi
+	}
+	if job.Overlap == "" {
+		job.Overlap = OverlapSkip
+	}
+	job.Id = ScheduledJobId(job.Territory, job.Network, job.Action, job.Spec)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.find(job.Id) != nil {
+		return job, errors.New("this job is already scheduled")
+	}
+	if err := s.addToCron(job); err != nil {
+		return job, err
+	}
+	s.jobs = append(s.jobs, &job)
+	s.removed = removeString(s.removed, job.Id)
+	if job.Source == ScheduleSourceApi {
+		s.save()
+	}
+	return job, nil
+}
+
+// Sets the jobs that come from the config (on start up or when the config is reloaded). Only the differences are applied: jobs the config
+// no longer has are removed and new ones are added. Unchanged jobs keep their paused state and jobs added through the API are left alone.
+// Returns the number of jobs added and removed.
+func (s *SocialHarvestSchedule) SetConfigJobs(config SocialHarvestConf, jobs []ScheduledJob) (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Territories = []string{}
+	for _, t := range config.Harvest.Territories {
+		s.Territories = append(s.Territories, t.Name)
+	}
+
+	wanted := map[string]bool{}
+	added := 0
+	for _, job := range jobs {
+		job.Source = ScheduleSourceConfig
+		job.Id = ScheduledJobId(job.Territory, job.Network, job.Action, job.Spec)
+		if job.Overlap == "" {
+			job.Overlap = OverlapSkip
+		}
+		wanted[job.Id] = true
+		// Already scheduled (the overlap policy may have changed though) or removed through the API
+		if existing := s.find(job.Id); existing != nil {
+			existing.Overlap = job.Overlap
+			continue
+		}
+		if containsString(s.removed, job.Id) {
+			continue
+		}
+		if err := s.validateJob(job); err != nil {
+			log.Println("Could not schedule " + job.Name() + ": " + err.Error())
+			continue
+		}
+		if err := s.addToCron(job); err != nil {
+			log.Println("Could not schedule " + job.Name() + ": " + err.Error())
+			continue
+		}
+		j := job
+		s.jobs = append(s.jobs, &j)
+		added++
+	}
+
+	kept := []*ScheduledJob{}
+	for _, j := range s.jobs {
+		if j.Source != ScheduleSourceConfig || wanted[j.Id] {
+			kept = append(kept, j)
+		} else {
+			s.removeFromCron(j.Id)
+		}
+	}
+	removed := len(s.jobs) - len(kept)
+	s.jobs = kept
+	return added, removed
+}
+
+// Removes a job from the schedule.
+func (s *SocialHarvestSchedule) RemoveJob(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := s.find(id)
+	if job == nil {
+		return ErrJobNotFound
+	}
+	jobs := []*ScheduledJob{}
+	for _, j := range s.jobs {
+		if j.Id != id {
+			jobs = append(jobs, j)
+		}
+	}
+	s.jobs = jobs
+	s.removeFromCron(id)
+	// Config jobs would come back on restart, so remember they were removed
+	if job.Source == ScheduleSourceConfig {
+		s.removed = append(s.removed, id)
+	}
+	s.save()
+	return nil
+}
+
+// Pauses (or resumes) a job. Paused jobs stay on the schedule but don't run until resumed (they can still be triggered).
+func (s *SocialHarvestSchedule) PauseJob(id string, paused bool) (ScheduledJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := s.find(id)
+	if job == nil {
+		return ScheduledJob{}, ErrJobNotFound
+	}
+	job.Paused = paused
+	s.save()
+	return *job, nil
+}
+
+// Runs a job right away (in the background) without affecting its schedule.
+func (s *SocialHarvestSchedule) TriggerJob(id string) (ScheduledJob, error) {
+	s.mu.Lock()
+	job := s.find(id)
+	s.mu.Unlock()
+	if job == nil {
+		return ScheduledJob{}, ErrJobNotFound
+	}
+	go s.runJob(id, true)
+	return *job, nil
+}
+
+// Returns a copy of all the jobs on the schedule.
+func (s *SocialHarvestSchedule) Jobs() []ScheduledJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := []ScheduledJob{}
+	for _, j := range s.jobs {
+		jobs = append(jobs, *j)
+	}
+	return jobs
+}
+
+// Returns how many runs of a job (or any other run of the same territory, network and action) are in progress.
+func (s *SocialHarvestSchedule) Running(id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := s.find(id)
+	if job == nil {
+		return 0
+	}
+	return s.running[job.LockKey()]
+}
+
+// Returns a job by id.
+func (s *SocialHarvestSchedule) Job(id string) (ScheduledJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := s.find(id)
+	if job == nil {
+		return ScheduledJob{}, ErrJobNotFound
+	}
+	return *job, nil
+}
+
+// Reads the changes saved from the API. There are none if nothing was ever changed.
+func readScheduleState() (scheduleState, error) {
+	state := scheduleState{}
+	b, err := ioutil.ReadFile(ScheduleStateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return state, err
+	}
+	err = json.Unmarshal(b, &state)
+	return state, err
+}
+
+// Returns the jobs that would be scheduled for the config's jobs with the changes saved from the API applied, without scheduling
+// anything or saving the schedule (for listing the schedule from the command line while the harvester may be running elsewhere).
+func PlannedJobs(config SocialHarvestConf, jobs []ScheduledJob) ([]ScheduledJob, error) {
+	state, err := readScheduleState()
+	if err != nil {
+		return []ScheduledJob{}, err
+	}
+	// Only used to validate the jobs like the schedule would
+	s := &SocialHarvestSchedule{Territories: []string{}}
+	for _, t := range config.Harvest.Territories {
+		s.Territories = append(s.Territories, t.Name)
+	}
+	planned := []ScheduledJob{}
+	seen := map[string]bool{}
+	add := func(job ScheduledJob, source string) {
+		job.Source = source
+		job.Id = ScheduledJobId(job.Territory, job.Network, job.Action, job.Spec)
+		if job.Overlap == "" {
+			job.Overlap = OverlapSkip
+		}
+		if seen[job.Id] || containsString(state.Removed, job.Id) || s.validateJob(job) != nil {
+			return
+		}
+		seen[job.Id] = true
+		job.Paused = containsString(state.Paused, job.Id)
+		planned = append(planned, job)
+	}
+	for _, job := range jobs {
+		add(job, ScheduleSourceConfig)
+	}
+	for _, job := range state.Added {
+		add(job, ScheduleSourceApi)
+	}
+	return planned, nil
+}
+
+// Applies the changes saved from the API (added, removed and paused jobs) on top of the jobs from the config.
+// This should be called after the config's jobs have been added.
+func (s *SocialHarvestSchedule) Restore() {
+	if _, err := os.Stat(ScheduleStateFile); os.IsNotExist(err) {
+		return
+	}
+	state, err := readScheduleState()
+	if err != nil {
+		log.Println("Could not read the saved schedule: " + err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.removed = state.Removed
+	s.mu.Unlock()
+
+	for _, job := range state.Added {
+		job.Source = ScheduleSourceApi
+		if _, err := s.AddJob(job); err != nil {
+			log.Println("Could not restore scheduled job " + job.Name() + ": " + err.Error())
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := []*ScheduledJob{}
+	for _, j := range s.jobs {
+		if !containsString(state.Removed, j.Id) {
+			jobs = append(jobs, j)
+		} else {
+			s.removeFromCron(j.Id)
+		}
+		j.Paused = containsString(state.Paused, j.Id)
+	}
+	s.jobs = jobs
+	s.save()
+}
+
+func (s *SocialHarvestSchedule) validateJob(job ScheduledJob) error {
+	if !containsString(s.Territories, job.Territory) {
+		return errors.New("unknown territory: " + job.Territory)
+	}
+	if !containsString(ScheduleNetworks, job.Network) {
+		return errors.New("unknown network: " + job.Network)
+	}
+	if !containsString(ScheduleActions, job.Action) {
+		return errors.New("unknown action: " + job.Action)
+	}
+	if job.Overlap != "" && !containsString(OverlapPolicies, job.Overlap) {
+		return errors.New("unknown overlap policy: " + job.Overlap)
+	}
+	_, err := NextRuns(job.Spec, time.Now(), 1)
+	return err
+}
+
+// Schedules a maintenance task, replacing any task with the same name (a nil f removes it). A task doesn't run again while it's still
+// running and only one harvester sharing the database runs it at a time, any others skip it.
+func (s *SocialHarvestSchedule) SetMaintenance(name string, spec string, f func()) error {
+	if f != nil {
+		if _, err := NextRuns(spec, time.Now(), 1); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tasks := []maintenanceTask{}
+	for _, t := range s.maintenance {
+		if t.name != name {
+			tasks = append(tasks, t)
+		}
+	}
+	if f != nil {
+		tasks = append(tasks, maintenanceTask{name: name, spec: spec, run: f})
+	}
+	s.maintenance = tasks
+	if f == nil {
+		s.removeFromCron("maintenance|" + name)
+		return nil
+	}
+	return s.addMaintenanceToCron(name, spec)
+}
+
+// Runs a maintenance task now (if it isn't already running). Returns false if it didn't run.
+func (s *SocialHarvestSchedule) RunMaintenance(name string) bool {
+	key := "maintenance|" + name
+	s.mu.Lock()
+	var task *maintenanceTask
+	for i := range s.maintenance {
+		if s.maintenance[i].name == name {
+			task = &s.maintenance[i]
+		}
+	}
+	if task == nil || s.running[key] > 0 {
+		s.mu.Unlock()
+		return false
+	}
+	f := task.run
+	s.running[key]++
+	s.mu.Unlock()
+	defer s.done(key, false)
+
+	unlock, ok := s.database().JobLock(key, false)
+	if !ok {
+		return false
+	}
+	defer unlock()
+	f()
+	return true
+}
+
+// Adds the job to the cron, unless it already has an entry (the id is derived from the spec, so the entry runs when the job should).
+// The entry is named after the job, which is unique just like its id. Must be called with the lock held.
+func (s *SocialHarvestSchedule) addToCron(job ScheduledJob) error {
+	id := job.Id
+	if _, ok := s.cronEntries[id]; ok {
+		return nil
+	}
+	err := s.Cron.AddFunc(job.Spec, func() {
+		s.runJob(id, false)
+	}, job.Name())
+	if err == nil {
+		s.cronEntries[id] = job.Name()
+	}
+	return err
+}
+
+// Adds the maintenance task to the cron, replacing its entry if the spec changed. Must be called with the lock held.
+func (s *SocialHarvestSchedule) addMaintenanceToCron(name string, spec string) error {
+	key := "maintenance|" + name
+	entry := "Maintenance " + name + " - " + spec
+	if s.cronEntries[key] == entry {
+		return nil
+	}
+	s.removeFromCron(key)
+	err := s.Cron.AddFunc(spec, func() {
+		s.RunMaintenance(name)
+	}, entry)
+	if err == nil {
+		s.cronEntries[key] = entry
+	}
+	return err
+}
+
+// Takes the entry for a job (or "maintenance|" and a task name) off the cron. Must be called with the lock held.
+func (s *SocialHarvestSchedule) removeFromCron(key string) {
+	if entry, ok := s.cronEntries[key]; ok {
+		s.Cron.RemoveJob(entry)
+		delete(s.cronEntries, key)
+	}
+}
+
+// Runs a job according to its overlap policy. Paused jobs, and jobs for territories owned by another harvester in the cluster, only run
+// when triggered.
+func (s *SocialHarvestSchedule) runJob(id string, triggered bool) {
+	s.mu.Lock()
+	j := s.find(id)
+	if j == nil || s.Run == nil || (j.Paused && !triggered) {
+		s.mu.Unlock()
+		return
+	}
+	job := *j
+	if !triggered && s.Cluster != nil && !s.Cluster.Owns(job.Territory, job.Network) {
+		s.mu.Unlock()
+		return
+	}
+	key := job.LockKey()
+	if job.Overlap != OverlapAllow && s.running[key] > 0 {
+		if job.Overlap == OverlapQueue {
+			s.queued[key] = true
+			log.Println(job.Name() + " is still running, queued to run again once it's done.")
+		} else {
+			log.Println(job.Name() + " is still running, skipped.")
+		}
+		s.mu.Unlock()
+		return
+	}
+	s.running[key]++
+	s.mu.Unlock()
+
+	for {
+		if !s.runWithLock(job, job.Overlap == OverlapQueue, func() { s.Run(job.Territory, job.Network, job.Action) }) {
+			log.Println(job.Name() + " is running on another harvester, skipped.")
+		}
+		if !s.done(key, true) {
+			return
+		}
+	}
+}
+
+// Runs f (an on-demand harvest) for the job's territory, network and action. It waits until any other run of the same territory, network
+// and action is done, here or on any other harvester sharing the database. A run queued in the meantime is started once it's done.
+func (s *SocialHarvestSchedule) RunNow(job ScheduledJob, f func()) {
+	key := job.LockKey()
+	s.mu.Lock()
+	for s.running[key] > 0 {
+		s.idle.Wait()
+	}
+	s.running[key]++
+	s.mu.Unlock()
+
+	s.runWithLock(job, true, f)
+	if s.done(key, false) {
+		// A scheduled run was queued while this ran, let a job for the same territory, network and action run it
+		s.mu.Lock()
+		var queued *ScheduledJob
+		for _, j := range s.jobs {
+			if j.LockKey() == key {
+				queued = j
+				break
+			}
+		}
+		s.mu.Unlock()
+		if queued != nil {
+			go s.runJob(queued.Id, false)
+		}
+	}
+}
+
+// Marks a run as done. Returns true if another run was queued, in which case (if keep is true) the run is still counted as in progress.
+func (s *SocialHarvestSchedule) done(key string, keep bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queued := s.queued[key]
+	if queued {
+		delete(s.queued, key)
+		if keep {
+			return true
+		}
+	}
+	s.running[key]--
+	s.idle.Broadcast()
+	return queued
+}
+
+// Runs f while holding the job's lock in the database so other harvesters don't run it at the same time (unless overlapping is allowed).
+// Returns false if the lock was held elsewhere (and f didn't run).
+func (s *SocialHarvestSchedule) runWithLock(job ScheduledJob, wait bool, f func()) bool {
+	if job.Overlap == OverlapAllow {
+		f()
+		return true
+	}
+	unlock, ok := s.database().JobLock(job.LockKey(), wait)
+	if !ok {
+		return false
+	}
+	defer unlock()
+	f()
+	return true
+}
+
+// Must be called with the lock held.
+func (s *SocialHarvestSchedule) find(id string) *ScheduledJob {
+	for _, j := range s.jobs {
+		if j.Id == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// Writes the API's changes to disk. Must be called with the lock held.
+func (s *SocialHarvestSchedule) save() {
+	state := scheduleState{Added: []ScheduledJob{}, Removed: s.removed, Paused: []string{}}
+	for _, j := range s.jobs {
+		if j.Source == ScheduleSourceApi {
+			state.Added = append(state.Added, *j)
+		}
+		if j.Paused {
+			state.Paused = append(state.Paused, j.Id)
+		}
+	}
+	b, err := json.Marshal(state)
+	if err == nil {
+		err = ioutil.WriteFile(ScheduleStateFile, b, 0644)
+	}
+	if err != nil {
+		log.Println("Could not save the schedule: " + err.Error())
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	l := []string{}
+	for _, v := range list {
+		if v != s {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// Returns the cron spec configured for a territory's network and action. If the network doesn't have its own schedule, the "everything"
+// schedule is used as the default. An empty string means the action should not be scheduled for that network.
+func (t Territory) ScheduleFor(network string, action string) string {
+	spec := ""
+	switch network {
+	case "twitter":
+		spec = pickSchedule(action, t.Schedule.Twitter.Content, t.Schedule.Twitter.Accounts)
+	case "facebook":
+		spec = pickSchedule(action, t.Schedule.Facebook.Content, t.Schedule.Facebook.Accounts)
+	case "instagram":
+		spec = pickSchedule(action, t.Schedule.Instagram.Content, t.Schedule.Instagram.Accounts)
+	case "googlePlus":
+		spec = pickSchedule(action, t.Schedule.GooglePlus.Content, t.Schedule.GooglePlus.Accounts)
+	case "youTube":
+		spec = pickSchedule(action, t.Schedule.YouTube.Content, t.Schedule.YouTube.Accounts)
+	}
+	if spec == "" {
+		spec = pickSchedule(action, t.Schedule.Everything.Content, t.Schedule.Everything.Accounts)
+	}
+	return spec
+}
+
+func pickSchedule(action string, content string, accounts string) string {
+	switch action {
+	case "content":
+		return content
+	case "accounts":
+		return accounts
+	}
+	return ""
 }
 
 func ListSchedule() {
@@ -49,6 +750,3 @@ func ListSchedule() {
 		log.Println(item.Next)
 	}
 }
-
-// TODO: add func that adds to the schedule... and pass it another fun to run on that schedule...
-// Now those can be anonymous or defined on their own in server.go to be reused for other purposes.
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScheduleFor(t *testing.T) {
+	territory := Territory{Name: "foo"}
+	territory.Schedule.Everything.Content = "@hourly"
+	territory.Schedule.Everything.Accounts = "@daily"
+	territory.Schedule.Twitter.Content = "@every 15m"
+
+	expected := []struct {
+		network string
+		action  string
+		spec    string
+	}{
+		{"twitter", "content", "@every 15m"},
+		{"twitter", "accounts", "@daily"},
+		{"facebook", "content", "@hourly"},
+		{"facebook", "accounts", "@daily"},
+		{"instagram", "content", "@hourly"},
+		{"googlePlus", "content", "@hourly"},
+		{"youTube", "accounts", "@daily"},
+	}
+	for _, e := range expected {
+		if actual := territory.ScheduleFor(e.network, e.action); actual != e.spec {
+			t.Errorf("%s %s schedule (expected) %s != %s (actual)", e.network, e.action, e.spec, actual)
+		}
+	}
+
+	// Nothing is scheduled without an "everything" default or a network specific schedule
+	empty := Territory{Name: "bar"}
+	if actual := empty.ScheduleFor("twitter", "content"); actual != "" {
+		t.Errorf("expected no schedule, got %s", actual)
+	}
+}
+
+func TestScheduleChangesPersist(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "schedule_")
+	defer os.RemoveAll(dir)
+	ScheduleStateFile = filepath.Join(dir, "schedule.json")
+
+	c := SocialHarvestConf{}
+	c.Harvest.Territories = []Territory{{Name: "foo"}}
+	s := NewSchedule(c)
+	configJob, _ := s.AddJob(ScheduledJob{Territory: "foo", Network: "twitter", Action: "content", Spec: "@hourly", Source: ScheduleSourceConfig})
+
+	if _, err := s.AddJob(ScheduledJob{Territory: "bar", Network: "twitter", Action: "content", Spec: "@hourly"}); err == nil {
+		t.Error("expected a job for an unknown territory to be rejected")
+	}
+	if _, err := s.AddJob(ScheduledJob{Territory: "foo", Network: "twitter", Action: "accounts", Spec: "not a spec"}); err == nil {
+		t.Error("expected an invalid cron spec to be rejected")
+	}
+	apiJob, err := s.AddJob(ScheduledJob{Territory: "foo", Network: "facebook", Action: "accounts", Spec: "@daily"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.PauseJob(apiJob.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RemoveJob(configJob.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	// As if restarted with the same config
+	s = NewSchedule(c)
+	s.AddJob(ScheduledJob{Territory: "foo", Network: "twitter", Action: "content", Spec: "@hourly", Source: ScheduleSourceConfig})
+	s.Restore()
+	jobs := s.Jobs()
+	if len(jobs) != 1 || jobs[0].Id != apiJob.Id || !jobs[0].Paused {
+		t.Errorf("expected only the paused job added through the API to be restored, got %v", jobs)
+	}
+
+	// Listing the schedule gives the same jobs without changing the saved schedule
+	before, _ := ioutil.ReadFile(ScheduleStateFile)
+	planned, err := PlannedJobs(c, []ScheduledJob{{Territory: "foo", Network: "twitter", Action: "content", Spec: "@hourly"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(planned) != 1 || planned[0].Id != apiJob.Id || !planned[0].Paused || planned[0].Source != ScheduleSourceApi {
+		t.Errorf("expected the planned jobs to match the restored ones, got %v", planned)
+	}
+	if after, _ := ioutil.ReadFile(ScheduleStateFile); string(after) != string(before) {
+		t.Error("listing the schedule shouldn't save it")
+	}
+}
+
+func TestSetConfigJobsOnlyAppliesChanges(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "schedule_")
+	defer os.RemoveAll(dir)
+	ScheduleStateFile = filepath.Join(dir, "schedule.json")
+
+	c := SocialHarvestConf{}
+	c.Harvest.Territories = []Territory{{Name: "foo"}}
+	s := NewSchedule(c)
+	twitter := ScheduledJob{Territory: "foo", Network: "twitter", Action: "content", Spec: "@hourly"}
+	facebook := ScheduledJob{Territory: "foo", Network: "facebook", Action: "content", Spec: "@hourly"}
+	if added, removed := s.SetConfigJobs(c, []ScheduledJob{twitter, facebook}); added != 2 || removed != 0 {
+		t.Fatalf("expected 2 jobs added and none removed, got %d and %d", added, removed)
+	}
+	twitterId := ScheduledJobId("foo", "twitter", "content", "@hourly")
+	s.PauseJob(twitterId, true)
+	twitterEntry := *s.Cron.Entries()[0]
+
+	// Reloaded with a different facebook schedule
+	facebook.Spec = "@daily"
+	if added, removed := s.SetConfigJobs(c, []ScheduledJob{twitter, facebook}); added != 1 || removed != 1 {
+		t.Fatalf("expected 1 job added and 1 removed, got %d and %d", added, removed)
+	}
+	job, err := s.Job(twitterId)
+	if err != nil || !job.Paused {
+		t.Errorf("expected the unchanged job to still be paused, got %v (%v)", job, err)
+	}
+	// The removed job's entry is taken off the cron and the unchanged job keeps its entry, so its timer isn't reset
+	entries := cronEntryNames(s)
+	if len(s.Cron.Entries()) != 2 || !entries[twitterEntry.Name] || !entries[facebook.Name()] {
+		t.Errorf("expected the changed job's entry to be replaced and the others left alone, got %v", entries)
+	}
+	for _, e := range s.Cron.Entries() {
+		if e.Name == twitterEntry.Name && !e.Next.Equal(twitterEntry.Next) {
+			t.Errorf("expected the unchanged job's entry to keep its timer, next run moved from %v to %v", twitterEntry.Next, e.Next)
+		}
+	}
+
+	// Removed jobs and maintenance tasks don't leave entries behind
+	s.RemoveJob(twitterId)
+	s.SetMaintenance("purge", "@hourly", func() {})
+	s.SetMaintenance("purge", "@daily", func() {})
+	entries = cronEntryNames(s)
+	if len(s.Cron.Entries()) != 2 || !entries[facebook.Name()] || !entries["Maintenance purge - @daily"] {
+		t.Errorf("expected only the facebook job's and the purge task's entries, got %v", entries)
+	}
+	s.SetMaintenance("purge", "", nil)
+	if entries = cronEntryNames(s); len(s.Cron.Entries()) != 1 {
+		t.Errorf("expected the purge task's entry to be removed, got %v", entries)
+	}
+}
+
+// The names of the schedule's cron entries (the cron hands out copies of them).
+func cronEntryNames(s *SocialHarvestSchedule) map[string]bool {
+	names := map[string]bool{}
+	for _, e := range s.Cron.Entries() {
+		names[e.Name] = true
+	}
+	return names
+}
+
+func TestOverlapPolicies(t *testing.T) {
+	c := SocialHarvestConf{}
+	c.Harvest.Territories = []Territory{{Name: "foo"}}
+	s := NewSchedule(c)
+
+	release := make(chan bool)
+	runs := make(chan string, 10)
+	s.Run = func(territory string, network string, action string) {
+		runs <- network
+		<-release
+	}
+	s.SetConfigJobs(c, []ScheduledJob{
+		{Territory: "foo", Network: "twitter", Action: "content", Spec: "@hourly", Overlap: OverlapSkip},
+		{Territory: "foo", Network: "facebook", Action: "content", Spec: "@hourly", Overlap: OverlapQueue},
+	})
+	skipId := ScheduledJobId("foo", "twitter", "content", "@hourly")
+	queueId := ScheduledJobId("foo", "facebook", "content", "@hourly")
+
+	go s.runJob(skipId, false)
+	go s.runJob(queueId, false)
+	<-runs
+	<-runs
+
+	// Both are running now, so these are skipped and queued (twice, which only queues one more run)
+	s.runJob(skipId, false)
+	s.runJob(queueId, false)
+	s.runJob(queueId, false)
+	release <- true
+	release <- true
+	if network := <-runs; network != "facebook" {
+		t.Fatalf("expected the queued job to run again, got %s", network)
+	}
+	release <- true
+	select {
+	case network := <-runs:
+		t.Errorf("expected nothing else to run, got %s", network)
+	default:
+	}
+}
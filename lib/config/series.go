@@ -61,6 +61,7 @@ import (
 // Where to store this stuff (log file, collection, and table names)
 var SeriesCollections = map[string]string{
 	"SocialHarvestMessage":           "messages",
+	"SocialHarvestMessageEngagement": "message_engagement",
 	"SocialHarvestSharedLink":        "shared_links",
 	"SocialHarvestMention":           "mentions",
 	"SocialHarvestHashtag":           "hashtags",
@@ -109,8 +110,8 @@ type SocialHarvestMessage struct {
 	IsQuestion int    `json:"is_question" db:"is_question" bson:"is_question"`
 	Category   string `json:"category" db:"category" bson:"category"`
 	Sentiment  int    `json:"sentiment" db:"sentiment" bson:"sentiment"`
-	// Note these values are at the time of harvest. it may be confusing enough to not need these values stored...but how long can we track each message? API rate limits...
-	// TODO: Maybe remove these? (think on it) also these technically don't need prefixes because we have the "network" field.
+	// Note these values are at the time of harvest. They're updated when the message is harvested again and each harvest of them is kept in the
+	// message_engagement series. These technically don't need prefixes because we have the "network" field.
 	FacebookShares       int `json:"facebook_shares" db:"facebook_shares" bson:"facebook_shares"`
 	TwitterRetweetCount  int `json:"twitter_retweet_count" db:"twitter_retweet_count" bson:"twitter_retweet_count"`
 	TwitterFavoriteCount int `json:"twitter_favorite_count" db:"twitter_favorite_count" bson:"twitter_favorite_count"`
@@ -121,6 +122,39 @@ type SocialHarvestMessage struct {
 	GooglePlusOnes     int64 `json:"google_plus_ones" db:"google_plus_ones" bson:"google_plus_ones"`
 }
 
+// A message's engagement counts as seen each time it was harvested (the time being when it was harvested, not when it was posted), so the
+// growth of a message's reach can be charted. The harvest id is the message's.
+type SocialHarvestMessageEngagement struct {
+	Time                 time.Time `json:"time" db:"time" bson:"time"`
+	HarvestId            string    `json:"harvest_id" db:"harvest_id" bson:"harvest_id"`
+	Territory            string    `json:"territory" db:"territory" bson:"territory"`
+	Network              string    `json:"network" db:"network" bson:"network"`
+	MessageId            string    `json:"message_id" db:"message_id" bson:"message_id"`
+	FacebookShares       int       `json:"facebook_shares" db:"facebook_shares" bson:"facebook_shares"`
+	TwitterRetweetCount  int       `json:"twitter_retweet_count" db:"twitter_retweet_count" bson:"twitter_retweet_count"`
+	TwitterFavoriteCount int       `json:"twitter_favorite_count" db:"twitter_favorite_count" bson:"twitter_favorite_count"`
+	LikeCount            int       `json:"like_count" db:"like_count" bson:"like_count"`
+	GooglePlusReshares   int64     `json:"google_plus_reshares" db:"google_plus_reshares" bson:"google_plus_reshares"`
+	GooglePlusOnes       int64     `json:"google_plus_ones" db:"google_plus_ones" bson:"google_plus_ones"`
+}
+
+// Returns the engagement counts of a message, as seen at the given time.
+func (m SocialHarvestMessage) Engagement(seen time.Time) SocialHarvestMessageEngagement {
+	return SocialHarvestMessageEngagement{
+		Time:                 seen,
+		HarvestId:            m.HarvestId,
+		Territory:            m.Territory,
+		Network:              m.Network,
+		MessageId:            m.MessageId,
+		FacebookShares:       m.FacebookShares,
+		TwitterRetweetCount:  m.TwitterRetweetCount,
+		TwitterFavoriteCount: m.TwitterFavoriteCount,
+		LikeCount:            m.LikeCount,
+		GooglePlusReshares:   m.GooglePlusReshares,
+		GooglePlusOnes:       m.GooglePlusOnes,
+	}
+}
+
 // Shared URLs. The "type" will tell us if it's media (video, photo, etc.) or HTML. It's more about content type. Not necessarily "blog" or something.
 // TODO: Possibly scrape those pages to get extra information to get semantic data being discussed/shared for a particular territory. This would enrich things like "type" ...
 type SocialHarvestSharedLink struct {
@@ -0,0 +1,211 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/SocialHarvestVendors/sqlx"
+	"strings"
+	"time"
+)
+
+// Settings are versioned by their modified time. Changing or deleting settings requires the modified time they were read with, so one
+// client doesn't overwrite another's changes without seeing them. Every version is kept in the settings_history table.
+var (
+	ErrSettingsNotFound = errors.New("settings not found")
+	ErrSettingsConflict = errors.New("the settings were changed since they were read")
+)
+
+// A version of the settings for a key. Deleting the settings adds a version too.
+type SettingsVersion struct {
+	Key      string    `json:"key" db:"key" bson:"key"`
+	Value    string    `json:"value" db:"value" bson:"value"`
+	Modified time.Time `json:"modified" db:"modified" bson:"modified"`
+	Deleted  bool      `json:"deleted" db:"deleted" bson:"deleted"`
+}
+
+// Returns the modified time for new settings. Times are kept to the second (MySQL doesn't keep any more than that) and always move
+// forward, so no two versions of a key share a modified time.
+func nextModified(current time.Time, now time.Time) time.Time {
+	modified := now.UTC().Truncate(time.Second)
+	if !current.IsZero() && !modified.After(current) {
+		modified = current.UTC().Truncate(time.Second).Add(time.Second)
+	}
+	return modified
+}
+
+// Whether settings last modified at the current time (zero if there are none) can be changed by someone who read them at the expected
+// time (zero if they expect there to be none).
+func sameVersion(current time.Time, expected time.Time) bool {
+	if current.IsZero() || expected.IsZero() {
+		return current.IsZero() && expected.IsZero()
+	}
+	return current.Truncate(time.Second).Equal(expected.Truncate(time.Second))
+}
+
+// Saves the value for a key if it's still at the expected version (unless force is true) and adds it to the history.
+func putSettings(db *sqlx.DB, dialect string, key string, value string, expected time.Time, force bool) (Settings, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return Settings{}, err
+	}
+	settingsRow, err := updateSettings(tx, dialect, key, value, expected, force, false)
+	if err != nil {
+		tx.Rollback()
+		return Settings{}, err
+	}
+	return settingsRow, tx.Commit()
+}
+
+// Deletes the settings for a key if they're still at the expected version and adds the deletion to the history.
+func deleteSettings(db *sqlx.DB, dialect string, key string, expected time.Time) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	if _, err := updateSettings(tx, dialect, key, "", expected, false, true); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateSettings(tx *sqlx.Tx, dialect string, key string, value string, expected time.Time, force bool, remove bool) (Settings, error) {
+	p := placeholderFor(dialect)
+	k := quoteColumn(dialect, "key")
+	var current time.Time
+	err := tx.Get(&current, "SELECT modified FROM settings WHERE "+k+" = "+p(1), key)
+	if err != nil && err != sql.ErrNoRows {
+		return Settings{}, err
+	}
+	exists := err == nil
+	if remove && !exists {
+		return Settings{}, ErrSettingsNotFound
+	}
+	if !force && !sameVersion(current, expected) {
+		return Settings{}, ErrSettingsConflict
+	}
+
+	settingsRow := Settings{Key: key, Value: value, Modified: nextModified(current, time.Now())}
+	var res sql.Result
+	switch {
+	case remove:
+		res, err = tx.Exec("DELETE FROM settings WHERE "+k+" = "+p(1)+" AND modified = "+p(2), key, current)
+	case exists:
+		res, err = tx.Exec("UPDATE settings SET value = "+p(1)+", modified = "+p(2)+" WHERE "+k+" = "+p(3)+" AND modified = "+p(4), value, settingsRow.Modified, key, current)
+	default:
+		res, err = tx.Exec("INSERT INTO settings ("+k+", value, modified) VALUES ("+p(1)+", "+p(2)+", "+p(3)+")", key, value, settingsRow.Modified)
+	}
+	// Someone else created them in the meantime
+	if err != nil && !exists && !remove && isUniqueViolation(err) {
+		return Settings{}, ErrSettingsConflict
+	}
+	if err != nil {
+		return Settings{}, err
+	}
+	// Someone else changed them in the meantime
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return Settings{}, ErrSettingsConflict
+	}
+
+	deleted := 0
+	if remove {
+		deleted = 1
+	}
+	_, err = tx.Exec("INSERT INTO settings_history ("+k+", value, modified, deleted) VALUES ("+p(1)+", "+p(2)+", "+p(3)+", "+p(4)+")", key, value, settingsRow.Modified, deleted)
+	return settingsRow, err
+}
+
+// Whether the error is from adding a row with a key that's already taken. Each database says so in its own way: Postgres (23505), MySQL
+// (1062) and SQLite.
+func isUniqueViolation(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "duplicate key value") || strings.Contains(message, "Duplicate entry") || strings.Contains(message, "UNIQUE constraint failed")
+}
+
+// Returns the keys of all the settings (with when they were modified, but not their values) in order.
+func listSettings(db *sqlx.DB, dialect string) ([]Settings, error) {
+	k := quoteColumn(dialect, "key")
+	settings := []Settings{}
+	err := db.Select(&settings, "SELECT "+k+", modified FROM settings ORDER BY "+k)
+	return settings, err
+}
+
+// Returns every version of the settings for a key, newest first.
+func settingsHistory(db *sqlx.DB, dialect string, key string) ([]SettingsVersion, error) {
+	k := quoteColumn(dialect, "key")
+	history := []SettingsVersion{}
+	err := db.Select(&history, "SELECT "+k+", value, modified, deleted FROM settings_history WHERE "+k+" = "+placeholderFor(dialect)(1)+" ORDER BY modified DESC", key)
+	return history, err
+}
+
+// Returns the database the settings are versioned in (see Migratable).
+func (database *SocialHarvestDB) settingsSQL() (*sqlx.DB, string, error) {
+	m, ok := database.Store.(Migratable)
+	if !ok {
+		return nil, "", errors.New("the database can't keep versions of settings")
+	}
+	db, dialect := m.SQL()
+	return db, dialect, nil
+}
+
+// Returns the settings for a key (ErrSettingsNotFound if there are none).
+func (database *SocialHarvestDB) GetSettings(key string) (Settings, error) {
+	settingsRow, err := database.Settings(key)
+	if err == sql.ErrNoRows {
+		err = ErrSettingsNotFound
+	}
+	return settingsRow, err
+}
+
+// Saves the value for a key, provided the settings haven't changed since they were read at the expected modified time (a zero time
+// when creating them). Returns the settings with their new modified time or ErrSettingsConflict.
+func (database *SocialHarvestDB) PutSettings(key string, value string, expected time.Time) (Settings, error) {
+	db, dialect, err := database.settingsSQL()
+	if err != nil {
+		return Settings{}, err
+	}
+	return putSettings(db, dialect, key, value, expected, false)
+}
+
+// Deletes the settings for a key, provided they haven't changed since they were read at the expected modified time.
+func (database *SocialHarvestDB) DeleteSettings(key string, expected time.Time) error {
+	db, dialect, err := database.settingsSQL()
+	if err != nil {
+		return err
+	}
+	return deleteSettings(db, dialect, key, expected)
+}
+
+// Returns the keys of all the settings and when they were last modified.
+func (database *SocialHarvestDB) ListSettings() ([]Settings, error) {
+	db, dialect, err := database.settingsSQL()
+	if err != nil {
+		return nil, err
+	}
+	return listSettings(db, dialect)
+}
+
+// Returns every version of the settings for a key, newest first.
+func (database *SocialHarvestDB) SettingsHistory(key string) ([]SettingsVersion, error) {
+	db, dialect, err := database.settingsSQL()
+	if err != nil {
+		return nil, err
+	}
+	return settingsHistory(db, dialect, key)
+}
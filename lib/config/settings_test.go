@@ -0,0 +1,106 @@
+package config
+
+import (
+	"errors"
+	"github.com/SocialHarvestVendors/sqlx"
+	"testing"
+	"time"
+)
+
+func TestSettingsVersions(t *testing.T) {
+	now := time.Date(2014, 10, 15, 12, 0, 0, 500, time.UTC)
+	if m := nextModified(time.Time{}, now); !m.Equal(now.Truncate(time.Second)) {
+		t.Errorf("expected the modified time to be kept to the second, got %v", m)
+	}
+	// Two changes within a second still get different versions
+	if m := nextModified(now.Truncate(time.Second), now); !m.Equal(now.Truncate(time.Second).Add(time.Second)) {
+		t.Errorf("expected the modified time to move forward, got %v", m)
+	}
+
+	if !sameVersion(time.Time{}, time.Time{}) || sameVersion(now, time.Time{}) || sameVersion(time.Time{}, now) {
+		t.Error("new settings can only be created without a modified time")
+	}
+	if !sameVersion(now.Truncate(time.Second), now) || sameVersion(now, now.Add(-time.Second)) {
+		t.Error("unexpected comparison of modified times")
+	}
+}
+
+// Opens an in-memory SQLite database with the tables migrated, so the settings SQL can be run for real. Skips the test if SQLite isn't
+// available.
+func sqliteTestDB(t *testing.T) *sqlx.DB {
+	db, err := sqlx.Connect("sqlite3", ":memory:")
+	if err != nil || db == nil || db.DB == nil {
+		t.Skip("SQLite isn't available")
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := migrateUp(db, "sqlite", 0); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSettingsInSQLite(t *testing.T) {
+	db := sqliteTestDB(t)
+	defer db.Close()
+
+	created, err := putSettings(db, "sqlite", "dashboard", "v1", time.Time{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Someone else creating them too, without having seen them
+	if _, err := putSettings(db, "sqlite", "dashboard", "other", time.Time{}, false); err != ErrSettingsConflict {
+		t.Errorf("expected creating the settings twice to conflict, got %v", err)
+	}
+	updated, err := putSettings(db, "sqlite", "dashboard", "v2", created.Modified, false)
+	if err != nil || !updated.Modified.After(created.Modified) {
+		t.Fatalf("expected the settings to be updated with a new version, got %v (%v)", updated, err)
+	}
+	// Changes from the version before are stale
+	if _, err := putSettings(db, "sqlite", "dashboard", "v3", created.Modified, false); err != ErrSettingsConflict {
+		t.Errorf("expected a stale update to conflict, got %v", err)
+	}
+	if err := deleteSettings(db, "sqlite", "dashboard", created.Modified); err != ErrSettingsConflict {
+		t.Errorf("expected a stale delete to conflict, got %v", err)
+	}
+	if err := deleteSettings(db, "sqlite", "dashboard", updated.Modified); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteSettings(db, "sqlite", "dashboard", updated.Modified); err != ErrSettingsNotFound {
+		t.Errorf("expected deleted settings not to be found, got %v", err)
+	}
+
+	history, err := settingsHistory(db, "sqlite", "dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || !history[0].Deleted || history[1].Value != "v2" || history[2].Value != "v1" || history[2].Deleted {
+		t.Errorf("expected the delete, v2 and v1 in the history, got %+v", history)
+	}
+}
+
+func TestUniqueViolations(t *testing.T) {
+	for _, message := range []string{
+		`pq: duplicate key value violates unique constraint "settings_pkey"`,
+		"Error 1062: Duplicate entry 'dashboard' for key 'PRIMARY'",
+		"UNIQUE constraint failed: settings.key",
+	} {
+		if !isUniqueViolation(errors.New(message)) {
+			t.Errorf("expected a unique violation: %s", message)
+		}
+	}
+	if isUniqueViolation(errors.New("pq: relation \"settings\" does not exist")) {
+		t.Error("expected other errors not to be unique violations")
+	}
+
+	// The error SQLite actually gives when two harvesters create the same settings at once
+	db := sqliteTestDB(t)
+	defer db.Close()
+	insert := "INSERT INTO settings (\"key\", value, modified) VALUES (?, ?, ?)"
+	if _, err := db.Exec(insert, "dashboard", "v1", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(insert, "dashboard", "v1", time.Now()); err == nil || !isUniqueViolation(err) {
+		t.Errorf("expected a unique violation, got %v", err)
+	}
+}
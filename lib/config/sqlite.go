@@ -0,0 +1,173 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"database/sql"
+	"errors"
+	_ "github.com/SocialHarvestVendors/go-sqlite3"
+	"github.com/SocialHarvestVendors/sqlx"
+	"strconv"
+	"time"
+)
+
+// Stores harvested data, harvest state and settings in a SQLite database file. There's no server to set up and the tables are created
+// (migrated) when the file is opened, so it's handy for a single harvester or for development. SQLite can't be shared by several harvesters though,
+// so there's no job locking or cluster support.
+type SQLiteStorage struct {
+	DB      *sqlx.DB
+	Compact bool
+}
+
+// The database file used when none is configured (relative to where the harvester runs).
+const defaultSQLiteFile = "social-harvest.db"
+
+func init() {
+	RegisterStorage("sqlite", NewSQLiteStorage)
+	RegisterStorage("sqlite3", NewSQLiteStorage)
+}
+
+// Opens (or creates) the configured SQLite database file (config.Database.Database) and applies any migrations that are missing.
+func NewSQLiteStorage(config SocialHarvestConf) (Storage, error) {
+	file := config.Database.Database
+	if file == "" {
+		file = defaultSQLiteFile
+	}
+	db, err := sqlx.Connect("sqlite3", file)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time and each connection to ":memory:" would be a different database
+	db.SetMaxOpenConns(1)
+	// The tables are always kept up to date, there's nothing to set up by hand
+	if _, err := migrateUp(db, "sqlite", 0); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStorage{DB: db, Compact: config.Schema.Compact}, nil
+}
+
+// Writes a row of harvested data (or harvest state) to the table for its series. Rows that were already stored (with the same harvest_id)
+// are skipped, so harvesting something twice doesn't fail.
+func (s *SQLiteStorage) StoreRow(row interface{}) error {
+	table, columns := seriesColumns(row, s.Compact)
+	if table == "" {
+		return errors.New("unknown series")
+	}
+	// A message that's already stored gets its engagement counts updated instead
+	if table == "messages" {
+		rows, err := updateEngagement(s.DB, []interface{}{row}, questionPlaceholder)
+		if err != nil || len(rows) == 0 {
+			return err
+		}
+	}
+	_, err := s.DB.NamedExec(insertQuery("INSERT OR IGNORE INTO", table, columns), row)
+	return err
+}
+
+// Writes several rows of the same series with one statement.
+func (s *SQLiteStorage) StoreRows(rows []interface{}) error {
+	table, columns := seriesColumns(rows[0], s.Compact)
+	if table == "" {
+		return errors.New("unknown series")
+	}
+	if table == "messages" {
+		var err error
+		if rows, err = updateEngagement(s.DB, rows, questionPlaceholder); err != nil || len(rows) == 0 {
+			return err
+		}
+	}
+	// Older versions of SQLite allow no more than 999 values in a statement
+	for _, batch := range batchesOf(rows, len(columns), 999) {
+		query, args := batchInsert("INSERT OR IGNORE INTO", table, columns, batch, questionPlaceholder)
+		if _, err := s.DB.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes a series' rows older than the given time, a batch at a time (there are no partitions to drop).
+func (s *SQLiteStorage) Purge(table string, before time.Time, batchSize int) (int64, []string, error) {
+	n, err := deleteInBatches(s.DB, "DELETE FROM "+table+" WHERE rowid IN (SELECT rowid FROM "+table+" WHERE \"time\" < ? LIMIT "+strconv.Itoa(batchSize)+")", before)
+	return n, []string{}, err
+}
+
+// Returns the messages harvested from a territory and network in the time range (just their ids and engagement counts).
+func (s *SQLiteStorage) Messages(territory string, network string, from time.Time, to time.Time) ([]SocialHarvestMessage, error) {
+	messages := []SocialHarvestMessage{}
+	err := s.DB.Select(&messages, messagesQuery("\"time\"", questionPlaceholder), territory, network, from, to)
+	return messages, err
+}
+
+// Saves where a harvest left off, replacing the cursor for its territory, network, action and value.
+func (s *SQLiteStorage) SaveCursor(cursor SocialHarvestHarvest) error {
+	_, err := s.DB.NamedExec(insertQuery("INSERT OR REPLACE INTO", "harvest", cursorColumns), cursor)
+	return err
+}
+
+// Returns the cursor for the action and value (it's empty if there isn't one).
+func (s *SQLiteStorage) LastHarvest(territory string, network string, action string, value string) (SocialHarvestHarvest, error) {
+	var lastHarvest SocialHarvestHarvest
+	err := s.DB.Get(&lastHarvest, "SELECT * FROM harvest WHERE network = ? AND action = ? AND value = ? AND territory = ?", network, action, value, territory)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return lastHarvest, err
+}
+
+// Returns the cursor for each action and value (keyword, account, etc.) harvested. The territory and network are optional.
+func (s *SQLiteStorage) Cursors(territory string, network string) ([]SocialHarvestHarvest, error) {
+	cursors := []SocialHarvestHarvest{}
+	err := s.DB.Select(&cursors, "SELECT * FROM harvest WHERE (?1 = '' OR territory = ?1) AND (?2 = '' OR network = ?2) ORDER BY territory, network, action, value", territory, network)
+	return cursors, err
+}
+
+// Removes cursors. The network, action and value are optional. Returns the number removed.
+func (s *SQLiteStorage) ResetCursors(territory string, network string, action string, value string) (int64, error) {
+	res, err := s.DB.Exec("DELETE FROM harvest WHERE territory = ?1 AND (?2 = '' OR network = ?2) AND (?3 = '' OR action = ?3) AND (?4 = '' OR value = ?4)", territory, network, action, value)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Saves a settings key/value, replacing it if the key already exists.
+func (s *SQLiteStorage) SaveSettings(settingsRow Settings) error {
+	_, err := s.DB.NamedExec("INSERT OR REPLACE INTO settings (key, value, modified) VALUES (:key, :value, :modified)", settingsRow)
+	return err
+}
+
+// Returns the settings for a key.
+func (s *SQLiteStorage) Settings(key string) (Settings, error) {
+	var settingsRow Settings
+	err := s.DB.Get(&settingsRow, "SELECT * FROM settings WHERE key = ?", key)
+	return settingsRow, err
+}
+
+func (s *SQLiteStorage) Ping() error {
+	var c int
+	return s.DB.Get(&c, "SELECT COUNT(*) FROM messages")
+}
+
+func (s *SQLiteStorage) SQL() (*sqlx.DB, string) {
+	return s.DB, "sqlite"
+}
+
+func (s *SQLiteStorage) Close() error {
+	return s.DB.Close()
+}
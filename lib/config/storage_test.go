@@ -0,0 +1,329 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Written to by the writers' goroutines, so everything is behind the lock.
+type memoryStorage struct {
+	lock     sync.Mutex
+	rows     []interface{}
+	cursors  map[string]SocialHarvestHarvest
+	reads    int
+	settings map[string]Settings
+	closed   bool
+}
+
+func (m *memoryStorage) StoreRow(row interface{}) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.rows = append(m.rows, row)
+	return nil
+}
+
+func (m *memoryStorage) SaveCursor(cursor SocialHarvestHarvest) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.cursors[cursorKey(cursor.Territory, cursor.Network, cursor.Action, cursor.Value)] = cursor
+	return nil
+}
+
+func (m *memoryStorage) LastHarvest(territory string, network string, action string, value string) (SocialHarvestHarvest, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.reads++
+	return m.cursors[cursorKey(territory, network, action, value)], nil
+}
+
+func (m *memoryStorage) Cursors(territory string, network string) ([]SocialHarvestHarvest, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.reads++
+	cursors := []SocialHarvestHarvest{}
+	for _, c := range m.cursors {
+		if (territory == "" || c.Territory == territory) && (network == "" || c.Network == network) {
+			cursors = append(cursors, c)
+		}
+	}
+	return cursors, nil
+}
+
+func (m *memoryStorage) ResetCursors(territory string, network string, action string, value string) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var n int64
+	for k, c := range m.cursors {
+		if c.Territory == territory && (network == "" || c.Network == network) && (action == "" || c.Action == action) && (value == "" || c.Value == value) {
+			delete(m.cursors, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStorage) SaveSettings(settingsRow Settings) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.settings[settingsRow.Key] = settingsRow
+	return nil
+}
+
+func (m *memoryStorage) Settings(key string) (Settings, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s, ok := m.settings[key]
+	if !ok {
+		return s, errors.New("not found")
+	}
+	return s, nil
+}
+
+func (m *memoryStorage) Purge(table string, before time.Time, batchSize int) (int64, []string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var n int64
+	rows := []interface{}{}
+	for _, row := range m.rows {
+		rowTable, _ := seriesColumns(row, false)
+		if rowTable == table && reflect.ValueOf(row).FieldByName("Time").Interface().(time.Time).Before(before) {
+			n++
+			continue
+		}
+		rows = append(rows, row)
+	}
+	m.rows = rows
+	return n, []string{}, nil
+}
+
+func (m *memoryStorage) Ping() error {
+	return nil
+}
+
+func (m *memoryStorage) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closed = true
+	return nil
+}
+
+func TestDatabaseUsesRegisteredStorage(t *testing.T) {
+	store := &memoryStorage{cursors: map[string]SocialHarvestHarvest{}, settings: map[string]Settings{}}
+	RegisterStorage("memory-test", func(config SocialHarvestConf) (Storage, error) {
+		return store, nil
+	})
+	var c SocialHarvestConf
+	c.Database.Type = "memory-test"
+	c.Database.RetentionDays = 1
+	db := NewDatabase(c)
+	if db.Store != store || !db.HasAccess() {
+		t.Fatal("expected the registered storage to be used")
+	}
+
+	db.SetLastHarvestTime("test", "twitter", "keyword", "go", time.Unix(1412000000, 0), "42", 10)
+	if db.GetLastHarvestId("test", "twitter", "keyword", "go") != "42" {
+		t.Error("expected the harvest state to be read back from the storage")
+	}
+	// Outside the retention period
+	db.StoreRow(SocialHarvestMessage{Time: time.Now().AddDate(0, 0, -2)})
+	db.StoreRow(SocialHarvestMessage{Time: time.Now(), HarvestId: "m", TwitterRetweetCount: 3})
+	// The harvest history and the message within the retention period are queued to be written (the harvesters emit engagement themselves)
+	if !db.StopWriting(time.Second) {
+		t.Fatal("timed out writing the queued rows")
+	}
+	if len(store.rows) != 2 || db.WriteCounts()["messages"].Written != 1 || db.WriteCounts()["message_engagement"].Written != 0 {
+		t.Errorf("expected 2 rows to be stored, got %d", len(store.rows))
+	}
+
+	// The storage doesn't keep track of nodes or locks
+	if err := db.NodeHeartbeat(HarvesterNode{Id: "a"}); err == nil {
+		t.Error("expected an error for a storage that can't keep track of nodes")
+	}
+	if _, ok := db.JobLock("job", false); !ok {
+		t.Error("the lock should always be taken without a storage that can lock")
+	}
+	db.Close()
+	if !store.closed {
+		t.Error("expected the storage to be closed")
+	}
+}
+
+// Never finishes writing a row until it's released.
+type stalledStorage struct {
+	memoryStorage
+	release chan bool
+}
+
+func (s *stalledStorage) StoreRow(row interface{}) error {
+	<-s.release
+	return nil
+}
+
+func TestStopWritingWithStalledDatabase(t *testing.T) {
+	store := &stalledStorage{release: make(chan bool)}
+	w := newBatchWriter(store, WriteOptions{BatchSize: 1, QueueSize: 1, Writers: 1})
+	// One row being written, one queued and one waiting for room
+	queued := make(chan bool, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			queued <- w.enqueue("hashtags", SocialHarvestHashtag{})
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	started := time.Now()
+	if w.stop(100 * time.Millisecond) {
+		t.Error("the writers can't have finished with the database stalled")
+	}
+	if time.Since(started) > time.Second {
+		t.Error("stopping should give up once the timeout passes")
+	}
+	if <-queued && <-queued && <-queued {
+		t.Error("the row waiting for room should not have been queued once stopped")
+	}
+	close(store.release)
+	if !w.stop(time.Second) {
+		t.Error("expected the writers to finish once the database recovered")
+	}
+}
+
+func TestDatabaseWithoutStorage(t *testing.T) {
+	var c SocialHarvestConf
+	c.Database.Type = "nonexistent"
+	db := NewDatabase(c)
+	if db.Store != nil || db.HasAccess() {
+		t.Error("an unknown database type shouldn't have a storage")
+	}
+	db.StoreRow(SocialHarvestMessage{})
+	if !db.GetLastHarvestTime("test", "twitter", "keyword", "go").IsZero() {
+		t.Error("expected no harvest state without a storage")
+	}
+}
+
+func TestSeriesColumnsMatchRows(t *testing.T) {
+	rows := []interface{}{SocialHarvestMessage{}, SocialHarvestSharedLink{}, SocialHarvestMention{}, SocialHarvestHashtag{}, SocialHarvestContributorGrowth{}, SocialHarvestHarvest{}, SocialHarvestMessageEngagement{}}
+	for _, row := range rows {
+		tags := map[string]bool{}
+		v := reflect.TypeOf(row)
+		for i := 0; i < v.NumField(); i++ {
+			tags[strings.Split(v.Field(i).Tag.Get("db"), ",")[0]] = true
+		}
+		for _, compact := range []bool{true, false} {
+			table, columns := seriesColumns(row, compact)
+			if table == "" {
+				t.Fatalf("no table for %s", v.Name())
+			}
+			for _, c := range columns {
+				if !tags[c] {
+					t.Errorf("%s has no field for the %s column", v.Name(), c)
+				}
+			}
+		}
+	}
+	if table, _ := seriesColumns(Settings{}, false); table != "" {
+		t.Error("settings aren't one of the series")
+	}
+	if q := insertQuery("INSERT INTO", "harvest", []string{"territory", "network"}); q != "INSERT INTO harvest (territory, network) VALUES (:territory, :network)" {
+		t.Errorf("unexpected query: %s", q)
+	}
+}
+
+func TestCursorsLoadedForTerritory(t *testing.T) {
+	store := &memoryStorage{cursors: map[string]SocialHarvestHarvest{}, settings: map[string]Settings{}}
+	db := &SocialHarvestDB{Store: store}
+	db.SetLastHarvestTime("test", "twitter", "keyword", "go", time.Unix(1412000000, 0), "1", 10)
+	db.SetLastHarvestTime("test", "twitter", "keyword", "go", time.Unix(1412000100, 0), "2", 20)
+	if len(store.cursors) != 1 || len(store.rows) != 2 {
+		t.Fatalf("expected one cursor and two rows of history, got %d and %d", len(store.cursors), len(store.rows))
+	}
+
+	db.LoadCursors("test")
+	reads := store.reads
+	if db.GetLastHarvestId("test", "twitter", "keyword", "go") != "2" || db.GetLastHarvestId("test", "twitter", "keyword", "rust") != "" {
+		t.Error("unexpected cursors after loading them")
+	}
+	db.SetLastHarvestTime("test", "twitter", "keyword", "rust", time.Unix(1412000200, 0), "3", 5)
+	if db.GetLastHarvestId("test", "twitter", "keyword", "rust") != "3" {
+		t.Error("expected the loaded cursors to be kept up to date")
+	}
+	if store.reads != reads {
+		t.Error("loaded cursors shouldn't be read from the storage again")
+	}
+
+	// Another harvest of the territory starts and the first one finishes, the cursors are kept until the last one is done
+	db.LoadCursors("test")
+	db.ReleaseCursors("test")
+	reads = store.reads
+	db.GetLastHarvestId("test", "twitter", "keyword", "go")
+	if store.reads != reads {
+		t.Error("the cursors should be kept while a harvest is still using them")
+	}
+	db.ReleaseCursors("test")
+	if db.GetLastHarvestId("test", "twitter", "keyword", "go") != "2" || store.reads != reads+1 {
+		t.Error("expected the cursors to be read from the storage once no harvest is using them")
+	}
+
+	db.ResetHarvestState("test", "twitter", "", "")
+	if db.GetLastHarvestId("test", "twitter", "keyword", "go") != "" {
+		t.Error("expected the cursors to be reset")
+	}
+}
+
+func TestBatchInsert(t *testing.T) {
+	rows := []interface{}{
+		SocialHarvestHarvest{Territory: "test", Network: "twitter"},
+		SocialHarvestHarvest{Territory: "test", Network: "facebook"},
+	}
+	query, args := batchInsert("INSERT INTO", "harvest", []string{"territory", "network"}, rows, postgresPlaceholder)
+	if query != "INSERT INTO harvest (territory, network) VALUES ($1, $2), ($3, $4)" {
+		t.Errorf("unexpected query: %s", query)
+	}
+	if len(args) != 4 || args[0] != "test" || args[3] != "facebook" {
+		t.Errorf("unexpected values: %v", args)
+	}
+
+	batches := batchesOf(append(rows, rows[0]), 2, 5)
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Errorf("expected batches of 2 rows, got %v", batches)
+	}
+}
+
+func TestMySQLLockName(t *testing.T) {
+	key := ScheduledJob{Territory: strings.Repeat("territory", 20), Network: "googlePlus", Action: "content"}.LockKey()
+	name := mysqlLockName(key)
+	if len(name) > 64 || !strings.HasPrefix(name, "social_harvest_") {
+		t.Errorf("expected a lock name MySQL accepts, got %s", name)
+	}
+	if name != mysqlLockName(key) || name == mysqlLockName(key+"s") {
+		t.Error("expected each key to have its own lock name")
+	}
+}
+
+func TestEnforceRetention(t *testing.T) {
+	store := &memoryStorage{cursors: map[string]SocialHarvestHarvest{}, settings: map[string]Settings{}}
+	db := &SocialHarvestDB{Store: store, Series: SeriesNames, RetentionDays: 7, Retention: map[string]int{"contributor_growth": 30, "hashtags": 0}, retention: map[string]RetentionReport{}}
+	if db.RetentionFor("messages") != 7 || db.RetentionFor("contributor_growth") != 30 || db.RetentionFor("hashtags") != 0 || db.RetentionFor("harvest_history") != 0 {
+		t.Error("unexpected retention periods")
+	}
+	store.rows = []interface{}{
+		SocialHarvestMessage{Time: time.Now().AddDate(0, 0, -10)},
+		SocialHarvestMessage{Time: time.Now()},
+		SocialHarvestContributorGrowth{Time: time.Now().AddDate(0, 0, -10)},
+		SocialHarvestHashtag{Time: time.Now().AddDate(0, 0, -100)},
+	}
+	reports := db.EnforceRetention()
+	if len(store.rows) != 3 || len(reports) != 5 {
+		t.Fatalf("expected only the old message to be removed, %d rows and %d reports left", len(store.rows), len(reports))
+	}
+	db.EnforceRetention()
+	if r := db.RetentionReports()["messages"]; r.Rows != 0 || r.TotalRows != 1 || r.Days != 7 {
+		t.Errorf("unexpected report for messages: %+v", r)
+	}
+	if _, ok := db.RetentionReports()["hashtags"]; ok {
+		t.Error("hashtags are kept forever")
+	}
+}
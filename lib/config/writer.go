@@ -0,0 +1,291 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Harvested data is written to the database in batches. Each series has a queue (of a limited size) and a few writers that take rows off
+// of it, writing them once there's a batch's worth or the flush interval passes. When the database can't keep up, the queue fills and
+// storing a row waits for room, which slows the harvest down rather than piling rows up in memory.
+type batchWriter struct {
+	store   Storage
+	options WriteOptions
+	queues  map[string]chan interface{}
+	stopped bool
+	lock    sync.RWMutex
+	// Closed when the writers are stopped. Rows being queued when it's closed are tracked by sending.
+	done       chan bool
+	sending    sync.WaitGroup
+	writers    sync.WaitGroup
+	counts     map[string]*WriteCounts
+	countsLock sync.Mutex
+}
+
+// How harvested data is written to the database.
+type WriteOptions struct {
+	BatchSize     int
+	QueueSize     int
+	Writers       int
+	FlushInterval time.Duration
+}
+
+// The number of rows queued, written and that failed to be written for a series.
+type WriteCounts struct {
+	Queued  int64 `json:"queued"`
+	Written int64 `json:"written"`
+	Failed  int64 `json:"failed"`
+}
+
+// A Storage that can write several rows (all of the same series) at once.
+type BatchStorer interface {
+	StoreRows(rows []interface{}) error
+}
+
+func writeOptionsFor(config SocialHarvestConf) WriteOptions {
+	return WriteOptions{
+		BatchSize:     config.Database.BatchSize,
+		QueueSize:     config.Database.QueueSize,
+		Writers:       config.Database.Writers,
+		FlushInterval: time.Duration(config.Database.FlushSeconds) * time.Second,
+	}
+}
+
+// Returns the options with defaults for anything that wasn't set.
+func (o WriteOptions) withDefaults() WriteOptions {
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = 1000
+	}
+	if o.Writers <= 0 {
+		o.Writers = 2
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = time.Second
+	}
+	return o
+}
+
+// Starts the writers for each series (and the harvest history).
+func newBatchWriter(store Storage, options WriteOptions) *batchWriter {
+	w := &batchWriter{
+		store:   store,
+		options: options.withDefaults(),
+		queues:  map[string]chan interface{}{},
+		done:    make(chan bool),
+		counts:  map[string]*WriteCounts{},
+	}
+	for _, table := range append(SeriesNames, "harvest_history") {
+		queue := make(chan interface{}, w.options.QueueSize)
+		w.queues[table] = queue
+		w.counts[table] = &WriteCounts{}
+		for i := 0; i < w.options.Writers; i++ {
+			w.writers.Add(1)
+			go w.write(table, queue)
+		}
+	}
+	return w
+}
+
+// Queues a row to be written, waiting for room when the queue is full. Returns false if the row can't be queued (the writers were
+// stopped, even while waiting, or there's no queue for its table), in which case it should be written right away instead.
+func (w *batchWriter) enqueue(table string, row interface{}) bool {
+	// The lock is never held while waiting for room, otherwise stop() would wait on a stalled database too
+	w.lock.RLock()
+	queue, ok := w.queues[table]
+	if w.stopped || !ok {
+		w.lock.RUnlock()
+		return false
+	}
+	w.sending.Add(1)
+	w.lock.RUnlock()
+	defer w.sending.Done()
+
+	select {
+	case queue <- row:
+		w.count(table, 1, 0, 0)
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *batchWriter) write(table string, queue chan interface{}) {
+	defer w.writers.Done()
+	ticker := time.NewTicker(w.options.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]interface{}, 0, w.options.BatchSize)
+	add := func(row interface{}) {
+		batch = append(batch, row)
+		if len(batch) >= w.options.BatchSize {
+			w.flush(table, batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case row := <-queue:
+			add(row)
+		case <-ticker.C:
+			w.flush(table, batch)
+			batch = batch[:0]
+		case <-w.done:
+			// Once nothing is being queued anymore, write what's left in the queue
+			w.sending.Wait()
+			for {
+				select {
+				case row := <-queue:
+					add(row)
+				default:
+					w.flush(table, batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// Writes a batch of rows. If the batch can't be written all at once (rows that were already stored are skipped, so it's something else
+// like a value a column won't take), the rows are written one at a time so only the ones at fault are lost.
+func (w *batchWriter) flush(table string, batch []interface{}) {
+	if len(batch) == 0 {
+		return
+	}
+	if b, ok := w.store.(BatchStorer); ok && len(batch) > 1 {
+		if err := b.StoreRows(batch); err == nil {
+			w.count(table, 0, int64(len(batch)), 0)
+			return
+		}
+	}
+	var failed int64
+	var lastErr error
+	for _, row := range batch {
+		if err := w.store.StoreRow(row); err != nil {
+			failed++
+			lastErr = err
+		}
+	}
+	w.count(table, 0, int64(len(batch))-failed, failed)
+	if lastErr != nil {
+		log.Println("Could not write " + strconv.FormatInt(failed, 10) + " " + table + " rows to the database: " + lastErr.Error())
+	}
+}
+
+func (w *batchWriter) count(table string, queued int64, written int64, failed int64) {
+	w.countsLock.Lock()
+	defer w.countsLock.Unlock()
+	c := w.counts[table]
+	c.Queued += queued
+	c.Written += written
+	c.Failed += failed
+}
+
+// Stops taking rows and waits for the writers to write what's queued. Returns false if they didn't finish within the timeout.
+func (w *batchWriter) stop(timeout time.Duration) bool {
+	done := make(chan bool)
+	go func() {
+		w.lock.Lock()
+		if !w.stopped {
+			w.stopped = true
+			close(w.done)
+		}
+		w.lock.Unlock()
+		w.writers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Returns a multi-row insert statement for the rows and the values for it. The placeholder func returns the placeholder for the nth
+// value (starting at 1), ie. "$1" for Postgres and "?" for MySQL.
+func batchInsert(insert string, table string, columns []string, rows []interface{}, placeholder func(n int) string) (string, []interface{}) {
+	args := make([]interface{}, 0, len(rows)*len(columns))
+	values := make([]string, 0, len(rows))
+	placeholders := make([]string, len(columns))
+	for _, row := range rows {
+		for i := range placeholders {
+			placeholders[i] = placeholder(len(args) + i + 1)
+		}
+		values = append(values, "("+strings.Join(placeholders, ", ")+")")
+		args = append(args, columnValues(row, columns)...)
+	}
+	return insert + " " + table + " (" + strings.Join(columns, ", ") + ") VALUES " + strings.Join(values, ", "), args
+}
+
+// Splits the rows into batches small enough to stay under the database's limit on the number of values in a statement.
+func batchesOf(rows []interface{}, columns int, maxValues int) [][]interface{} {
+	size := maxValues / columns
+	if size < 1 {
+		size = 1
+	}
+	batches := [][]interface{}{}
+	for len(rows) > size {
+		batches = append(batches, rows[:size])
+		rows = rows[size:]
+	}
+	return append(batches, rows)
+}
+
+// Returns the values of the row's fields for the columns (which are the fields' `db` tags).
+func columnValues(row interface{}, columns []string) []interface{} {
+	v := reflect.ValueOf(row)
+	fields := fieldsByColumn(v.Type())
+	values := make([]interface{}, len(columns))
+	for i, c := range columns {
+		values[i] = v.Field(fields[c]).Interface()
+	}
+	return values
+}
+
+var columnFields = map[reflect.Type]map[string]int{}
+var columnFieldsLock sync.Mutex
+
+// Returns the index of the field for each column of a series struct.
+func fieldsByColumn(t reflect.Type) map[string]int {
+	columnFieldsLock.Lock()
+	defer columnFieldsLock.Unlock()
+	fields, ok := columnFields[t]
+	if !ok {
+		fields = map[string]int{}
+		for i := 0; i < t.NumField(); i++ {
+			fields[strings.Split(t.Field(i).Tag.Get("db"), ",")[0]] = i
+		}
+		columnFields[t] = fields
+	}
+	return fields
+}
+
+func postgresPlaceholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func questionPlaceholder(n int) string {
+	return "?"
+}
@@ -0,0 +1,287 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package harvester
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// This file contains a record/replay layer for the harvester's HTTP transport. In record mode, real API exchanges are passed through to the
+// network and captured (with credentials scrubbed from the URLs, headers and bodies) into a "cassette" file. In replay mode, the cassette is used to answer requests without
+// touching the network at all. This lets tests run the normalization code in TwitterSearch(), FacebookSearch(), InstagramSearch(), etc.
+// against real world payloads and it makes it easy to notice when a vendor changes the shape of their responses (just record again and diff).
+
+const (
+	CassetteReplay = "replay"
+	CassetteRecord = "record"
+)
+
+// The value credentials are replaced with before anything is written to a cassette (or matched against one).
+const scrubbedValue = "SCRUBBED"
+
+// Querystring params and headers that carry credentials. They never make it into a cassette.
+var scrubbedParams = []string{"access_token", "client_id", "client_secret", "key", "appsecret_proof", "oauth_token", "oauth_signature", "oauth_consumer_key", "oauth_nonce", "oauth_timestamp"}
+var scrubbedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// Credentials can also show up in bodies, ie. in the links to the next page of results or in a token exchange. These catch them as
+// querystring (or form) params and as JSON fields.
+var scrubbedParamPattern = regexp.MustCompile(`\b(` + strings.Join(scrubbedParams, "|") + `)=[^&"'\s\\]+`)
+var scrubbedFieldPattern = regexp.MustCompile(`"(` + strings.Join(scrubbedParams, "|") + `)"\s*:\s*"[^"]*"`)
+
+// The quoted values in an Authorization header
+var authorizationValuePattern = regexp.MustCompile(`"([^"]+)"`)
+
+var ErrCassetteNoMatch = errors.New("no recorded interaction matches the request")
+
+// A single request/response pair.
+type CassetteInteraction struct {
+	Request struct {
+		Method string `json:"method"`
+		Url    string `json:"url"`
+		Body   string `json:"body,omitempty"`
+	} `json:"request"`
+	Response struct {
+		StatusCode int         `json:"status_code"`
+		Header     http.Header `json:"header"`
+		Body       string      `json:"body"`
+	} `json:"response"`
+	replayed bool
+}
+
+type Cassette struct {
+	Interactions []*CassetteInteraction `json:"interactions"`
+}
+
+// An http.RoundTripper that records to, or replays from, a cassette file.
+type CassetteTransport struct {
+	Path      string
+	Mode      string
+	Transport http.RoundTripper
+	cassette  Cassette
+	mu        sync.Mutex
+}
+
+// Creates a new transport for the given cassette file. In replay mode the file must exist. In record mode requests will go out through the
+// given transport (or http.DefaultTransport if nil) and Save() must be called to write the cassette.
+func NewCassetteTransport(path string, mode string, transport http.RoundTripper) (*CassetteTransport, error) {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	t := &CassetteTransport{
+		Path:      path,
+		Mode:      mode,
+		Transport: transport,
+	}
+	if mode == CassetteRecord {
+		return t, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return t, err
+	}
+	err = json.Unmarshal(b, &t.cassette)
+	return t, err
+}
+
+// Handles the request by either replaying a matching interaction from the cassette or by making the request and recording it.
+func (t *CassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Mode == CassetteRecord {
+		return t.record(req)
+	}
+	return t.replay(req)
+}
+
+// Writes the recorded interactions to the cassette file (creating directories as needed).
+func (t *CassetteTransport) Save() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, err := json.MarshalIndent(t.cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(t.Path), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(t.Path, b, 0644)
+}
+
+func (t *CassetteTransport) record(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		reqBody, _ = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	// Whatever credentials the request carried are scrubbed wherever they turn up, not just where they were sent
+	secrets := requestSecrets(req, reqBody)
+	i := &CassetteInteraction{}
+	i.Request.Method = req.Method
+	i.Request.Url = scrubUrl(req.URL)
+	i.Request.Body = scrubText(string(reqBody), secrets)
+	i.Response.StatusCode = resp.StatusCode
+	i.Response.Header = scrubHeader(resp.Header)
+	for k, v := range i.Response.Header {
+		scrubbed := make([]string, len(v))
+		for j := range v {
+			scrubbed[j] = scrubText(v[j], secrets)
+		}
+		i.Response.Header[k] = scrubbed
+	}
+	i.Response.Body = scrubText(string(respBody), secrets)
+
+	t.mu.Lock()
+	t.cassette.Interactions = append(t.cassette.Interactions, i)
+	t.mu.Unlock()
+
+	return resp, nil
+}
+
+// Finds the first interaction not yet replayed that matches on method and the full (scrubbed) URL. If there is none, it falls back to matching
+// on method, host, and path. This keeps replays working when a client library adds or reorders a querystring param between versions.
+func (t *CassetteTransport) replay(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	reqUrl := scrubUrl(req.URL)
+	var match *CassetteInteraction
+	for _, i := range t.cassette.Interactions {
+		if !i.replayed && i.Request.Method == req.Method && i.Request.Url == reqUrl {
+			match = i
+			break
+		}
+	}
+	if match == nil {
+		for _, i := range t.cassette.Interactions {
+			if !i.replayed && i.Request.Method == req.Method && sameEndpoint(i.Request.Url, req.URL) {
+				match = i
+				break
+			}
+		}
+	}
+	if match == nil {
+		return nil, ErrCassetteNoMatch
+	}
+	match.replayed = true
+
+	resp := &http.Response{
+		Status:        http.StatusText(match.Response.StatusCode),
+		StatusCode:    match.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(bytes.NewBufferString(match.Response.Body)),
+		ContentLength: int64(len(match.Response.Body)),
+		Request:       req,
+	}
+	for k, v := range match.Response.Header {
+		resp.Header[k] = v
+	}
+	return resp, nil
+}
+
+// Returns the URL as a string with any credentials in the querystring replaced. The querystring is re-encoded so params are sorted by key.
+func scrubUrl(u *url.URL) string {
+	c := *u
+	c.User = nil
+	q := c.Query()
+	for _, p := range scrubbedParams {
+		if _, ok := q[p]; ok {
+			q.Set(p, scrubbedValue)
+		}
+	}
+	c.RawQuery = q.Encode()
+	return c.String()
+}
+
+// Returns the credentials sent with the request: the values of the scrubbed params in the querystring and form body, and the Authorization
+// header (along with each quoted value in it, like OAuth's oauth_token="...").
+func requestSecrets(req *http.Request, body []byte) []string {
+	secrets := []string{}
+	params := []url.Values{req.URL.Query()}
+	if form, err := url.ParseQuery(string(body)); err == nil {
+		params = append(params, form)
+	}
+	for _, values := range params {
+		for _, p := range scrubbedParams {
+			secrets = append(secrets, values[p]...)
+		}
+	}
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		secrets = append(secrets, auth)
+		for _, quoted := range authorizationValuePattern.FindAllStringSubmatch(auth, -1) {
+			secrets = append(secrets, quoted[1], url.QueryEscape(quoted[1]))
+		}
+	}
+	return secrets
+}
+
+// Replaces the given secrets, and anything that looks like a credential param or field, in the text.
+func scrubText(text string, secrets []string) string {
+	for _, secret := range secrets {
+		// Short values (ie. "1") would scrub more than credentials
+		if len(secret) >= 8 && secret != scrubbedValue {
+			text = strings.Replace(text, secret, scrubbedValue, -1)
+		}
+	}
+	text = scrubbedParamPattern.ReplaceAllString(text, "$1="+scrubbedValue)
+	return scrubbedFieldPattern.ReplaceAllString(text, `"$1":"`+scrubbedValue+`"`)
+}
+
+func scrubHeader(h http.Header) http.Header {
+	c := http.Header{}
+	for k, v := range h {
+		c[k] = v
+	}
+	for _, k := range scrubbedHeaders {
+		c.Del(k)
+	}
+	return c
+}
+
+func sameEndpoint(recorded string, u *url.URL) bool {
+	r, err := url.Parse(recorded)
+	if err != nil {
+		return false
+	}
+	return r.Host == u.Host && r.Path == u.Path
+}
@@ -0,0 +1,187 @@
+package harvester
+
+import (
+	"encoding/json"
+	"github.com/SocialHarvest/harvester/lib/config"
+	"github.com/SocialHarvest/sentiment"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Cassettes are replayed by default. To record new ones against the real APIs, run the tests with SH_CASSETTE_MODE=record and point
+// SH_TEST_CONF at a Social Harvest config file that has API credentials (credentials are scrubbed before anything is written to disk).
+var cassetteMode = os.Getenv("SH_CASSETTE_MODE")
+var sentimentOnce sync.Once
+
+// Returns the services config to use for adapter tests (empty unless recording).
+func testServicesConfig(t *testing.T) config.ServicesConfig {
+	c := config.SocialHarvestConf{}
+	if cassetteMode == CassetteRecord && os.Getenv("SH_TEST_CONF") != "" {
+		b, err := ioutil.ReadFile(os.Getenv("SH_TEST_CONF"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(b, &c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c.Services
+}
+
+// Sets the harvester's transport to replay (or record) the named cassette in testdata/cassettes. The returned func must be deferred.
+func useCassette(t *testing.T, name string) func() {
+	sentimentOnce.Do(func() {
+		services.sentimentAnalyzer = sentiment.NewAnalyzer()
+	})
+
+	// ExpandUrl() uses the shared client, which is normally set up by New()
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+
+	mode := CassetteReplay
+	if cassetteMode == CassetteRecord {
+		mode = CassetteRecord
+	}
+	ct, err := NewCassetteTransport(filepath.Join("testdata", "cassettes", name+".json"), mode, nil)
+	if err != nil {
+		t.Fatalf("could not load cassette %s - %s", name, err)
+	}
+	SetTransport(ct)
+
+	return func() {
+		if mode == CassetteRecord {
+			if err := ct.Save(); err != nil {
+				t.Errorf("could not save cassette %s - %s", name, err)
+			}
+		}
+	}
+}
+
+// Captures what the harvester emits, in place of any sinks. The returned func stops capturing and must be deferred.
+func captureEmitted(t *testing.T) (*testSink, func()) {
+	sink := &testSink{records: map[string][]interface{}{}}
+	RegisterSink("capture", func(conf config.SinkConfig) (Sink, error) {
+		return sink, nil
+	})
+	if err := NewSinks([]config.SinkConfig{{Type: "capture"}}); err != nil {
+		t.Fatal(err)
+	}
+	return sink, func() {
+		StopSinks(5 * time.Second)
+	}
+}
+
+// Whether or not a hashtag with the given tag was emitted.
+func emittedTag(sink *testSink, tag string) bool {
+	for _, record := range sink.emitted("hashtags") {
+		if record.(config.SocialHarvestHashtag).Tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCassetteRecordAndReplay(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=secret")
+		io.WriteString(w, `{"path":"`+req.URL.Path+`"}`)
+	}))
+	defer ts.Close()
+
+	dir, _ := ioutil.TempDir("", "cassettes_")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cassettes", "test.json")
+	recorder, err := NewCassetteTransport(path, CassetteRecord, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: recorder}
+	req, _ := http.NewRequest("GET", ts.URL+"/search?q=golang&access_token=secret-token", nil)
+	req.Header.Set("Authorization", "OAuth secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != `{"path":"/search"}` {
+		t.Fatalf("unexpected recorded body %s", body)
+	}
+	if err = recorder.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(saved), "secret") {
+		t.Fatalf("credentials were written to the cassette: %s", saved)
+	}
+
+	// The server is gone, so this can only be answered by the cassette (and the token given doesn't need to match)
+	ts.Close()
+	player, err := NewCassetteTransport(path, CassetteReplay, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = &http.Client{Transport: player}
+	resp, err = client.Get(ts.URL + "/search?access_token=another-token&q=golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != `{"path":"/search"}` {
+		t.Fatalf("unexpected replayed body %s", body)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("expected the recorded headers to be replayed")
+	}
+
+	// Each interaction is only replayed once
+	if _, err = client.Get(ts.URL + "/search?q=golang"); err == nil {
+		t.Fatalf("expected no match for a request that was already replayed")
+	}
+}
+
+func TestCassetteScrubsCredentialsFromBodies(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		w.Header().Set("Location", "/next?access_token="+req.Form.Get("client_secret"))
+		io.WriteString(w, `{"access_token":"issued-token","paging":{"next":"https://example.com/search?access_token=issued-token\u0026until=1"},"echo":"`+req.Form.Get("client_secret")+`"}`)
+	}))
+	defer ts.Close()
+
+	dir, _ := ioutil.TempDir("", "cassettes_")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.json")
+	recorder, _ := NewCassetteTransport(path, CassetteRecord, nil)
+	client := &http.Client{Transport: recorder}
+	resp, err := client.PostForm(ts.URL+"/oauth/access_token", url.Values{"client_id": {"my-client-id"}, "client_secret": {"my-client-secret"}, "grant_type": {"client_credentials"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err = recorder.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, _ := ioutil.ReadFile(path)
+	for _, secret := range []string{"my-client-id", "my-client-secret", "issued-token"} {
+		if strings.Contains(string(saved), secret) {
+			t.Errorf("%s was written to the cassette: %s", secret, saved)
+		}
+	}
+	if !strings.Contains(string(saved), "grant_type=client_credentials") || !strings.Contains(string(saved), "until=1") {
+		t.Errorf("only credentials should be scrubbed: %s", saved)
+	}
+}
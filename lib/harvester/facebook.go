@@ -23,10 +23,12 @@ import (
 	//"github.com/mitchellh/mapstructure"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	//"sync"
 	"time"
 )
@@ -169,15 +171,22 @@ func NewFacebook(servicesConfig config.ServicesConfig) {
 
 // If the territory has a different appToken to use
 func NewFacebookTerritoryCredentials(territory string) {
-	for _, t := range harvestConfig.Territories {
-		if t.Name == territory {
-			if t.Services.Facebook.AppToken != "" {
-				// TODO: This actually should be passed on each harvest. Because otherwise it'd overwrite the harvest wide token.
+	if token := FacebookTerritoryToken(territory); token != "" {
+		// TODO: This actually should be passed on each harvest. Because otherwise it'd overwrite the harvest wide token.
 
-				services.facebookAppToken = t.Services.Facebook.AppToken
-			}
+		services.facebookAppToken = token
+	}
+}
+
+// Returns the appToken the territory has to use instead of the harvest wide one (empty if it doesn't have one). Pass it in the params,
+// functions like FacebookEngagement() use the harvest wide token when the params don't have one.
+func FacebookTerritoryToken(territory string) string {
+	for _, t := range currentHarvestConfig().Territories {
+		if t.Name == territory {
+			return t.Services.Facebook.AppToken
 		}
 	}
+	return ""
 }
 
 // Takes an array of Post structs and converts it to JSON and logs to file (to be picked up by Fluentd, Logstash, Ik, etc.)
@@ -282,10 +291,10 @@ func FacebookPostsOut(posts []FacebookPost, territoryName string, params Faceboo
 				FacebookShares:            post.Shares.Count,
 				Category:                  contributor.Category,
 				Sentiment:                 services.sentimentAnalyzer.Classify(post.Message),
-				IsQuestion:                Btoi(IsQuestion(post.Message, harvestConfig.QuestionRegex)),
+				IsQuestion:                Btoi(IsQuestion(post.Message, currentHarvestConfig().QuestionRegex)),
 			}
-			StoreHarvestedData(messageRow)
-			LogJson(messageRow, "messages")
+			Emit("messages", messageRow)
+			Emit("message_engagement", messageRow.Engagement(time.Now()))
 
 			// Keywords are stored on the same collection as hashtags - but under a `keyword` field instead of `tag` field as to not confuse the two.
 			// Limit to words 4 characters or more and only return 8 keywords. This could greatly increase the database size if not limited.
@@ -317,8 +326,7 @@ func FacebookPostsOut(posts []FacebookPost, territoryName string, params Faceboo
 							ContributorCountry:        contributorCountry,
 							Keyword:                   keyword,
 						}
-						StoreHarvestedData(hashtag)
-						LogJson(hashtag, "hashtags")
+						Emit("hashtags", hashtag)
 					}
 				}
 			}
@@ -352,8 +360,7 @@ func FacebookPostsOut(posts []FacebookPost, territoryName string, params Faceboo
 					ExpandedUrl:               ExpandUrl(post.Link),
 					Host:                      hostName,
 				}
-				StoreHarvestedData(sharedLinksRow)
-				LogJson(sharedLinksRow, "shared_links")
+				Emit("shared_links", sharedLinksRow)
 			}
 
 			// mentions row (note the harvest id in the following - any post that has multiple subobjects to be stored separately will need a different harvest id, else only one of those subobjects would be stored)
@@ -416,8 +423,7 @@ func FacebookPostsOut(posts []FacebookPost, territoryName string, params Faceboo
 						MentionedGeohash:    mentionedLocationGeoHash,
 						MentionedLang:       LocaleToLanguageISO(mentionedContributor.Locale),
 					}
-					StoreHarvestedData(mentionRow)
-					LogJson(mentionRow, "mentions")
+					Emit("mentions", mentionRow)
 				}
 			}
 			// Also try MessageTags (which exist on user and page feeds, whereas StoryTags are available on public posts search)
@@ -481,8 +487,7 @@ func FacebookPostsOut(posts []FacebookPost, territoryName string, params Faceboo
 						MentionedGeohash:    mentionedLocationGeoHash,
 						MentionedLang:       LocaleToLanguageISO(mentionedContributor.Locale),
 					}
-					StoreHarvestedData(mentionRow)
-					LogJson(mentionRow, "mentions")
+					Emit("mentions", mentionRow)
 				}
 			}
 
@@ -506,7 +511,9 @@ func FacebookSearch(territoryName string, harvestState config.HarvestState, para
 		params.AccessToken = fbToken
 	}
 	// If that happens to be empty, just return.
+	harvestState.Error = nil
 	if params.AccessToken == "" {
+		harvestState.Error = errors.New("no Facebook app token")
 		return params, harvestState
 	}
 
@@ -518,6 +525,7 @@ func FacebookSearch(territoryName string, harvestState config.HarvestState, para
 	// convert struct to querystring params
 	v, err := query.Values(params)
 	if err != nil {
+		harvestState.Error = err
 		return params, harvestState
 	}
 	buffer.WriteString(v.Encode())
@@ -527,14 +535,20 @@ func FacebookSearch(territoryName string, harvestState config.HarvestState, para
 	// set up the request
 	req, err := http.NewRequest("GET", searchUrl, nil)
 	if err != nil {
+		harvestState.Error = err
 		return params, harvestState
 	}
 	// doo it
 	resp, err := fbHttpClient.Do(req)
 	if err != nil {
+		harvestState.Error = err
 		return params, harvestState
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		harvestState.Error = errors.New("Facebook responded " + resp.Status)
+		return params, harvestState
+	}
 
 	// now to parse response, store and contine along.
 	data := struct {
@@ -569,8 +583,10 @@ func FacebookSearch(territoryName string, harvestState config.HarvestState, para
 
 	// Only attempt to store if we have some results.
 	if len(data.Posts) > 0 {
-		// Save, then return updated params and harvest state for next round (if there is another one)
-		harvestState.ItemsHarvested, harvestState.LastId, harvestState.LastTime = FacebookPostsOut(data.Posts, territoryName, params)
+		// Save, then return updated params and harvest state for next round (if there is another one). Items add up across pages, like the other networks.
+		var itemsHarvested int
+		itemsHarvested, harvestState.LastId, harvestState.LastTime = FacebookPostsOut(data.Posts, territoryName, params)
+		harvestState.ItemsHarvested += itemsHarvested
 	}
 
 	return params, harvestState
@@ -587,7 +603,9 @@ func FacebookFeed(territoryName string, harvestState config.HarvestState, accoun
 		params.AccessToken = fbToken
 	}
 	// If that happens to be empty, just return.
+	harvestState.Error = nil
 	if params.AccessToken == "" {
+		harvestState.Error = errors.New("no Facebook app token")
 		return params, harvestState
 	}
 
@@ -599,6 +617,7 @@ func FacebookFeed(territoryName string, harvestState config.HarvestState, accoun
 	// convert struct to querystring params
 	v, err := query.Values(params)
 	if err != nil {
+		harvestState.Error = err
 		return params, harvestState
 	}
 	buffer.WriteString(v.Encode())
@@ -608,14 +627,20 @@ func FacebookFeed(territoryName string, harvestState config.HarvestState, accoun
 	// set up the request
 	req, err := http.NewRequest("GET", feedUrl, nil)
 	if err != nil {
+		harvestState.Error = err
 		return params, harvestState
 	}
 	// doo it
 	resp, err := fbHttpClient.Do(req)
 	if err != nil {
+		harvestState.Error = err
 		return params, harvestState
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		harvestState.Error = errors.New("Facebook responded " + resp.Status)
+		return params, harvestState
+	}
 
 	// now to parse response, store and contine along.
 	data := struct {
@@ -650,8 +675,10 @@ func FacebookFeed(territoryName string, harvestState config.HarvestState, accoun
 
 	// Only attempt to store if we have some results.
 	if len(data.Posts) > 0 {
-		// Save, then return updated params and harvest state for next round (if there is another one)
-		harvestState.ItemsHarvested, harvestState.LastId, harvestState.LastTime = FacebookPostsOut(data.Posts, territoryName, params)
+		// Save, then return updated params and harvest state for next round (if there is another one). Items add up across pages, like the other networks.
+		var itemsHarvested int
+		itemsHarvested, harvestState.LastId, harvestState.LastTime = FacebookPostsOut(data.Posts, territoryName, params)
+		harvestState.ItemsHarvested += itemsHarvested
 	}
 
 	return params, harvestState
@@ -659,50 +686,67 @@ func FacebookFeed(territoryName string, harvestState config.HarvestState, accoun
 
 // Gets basic info about an account on Facebook
 func FacebookGetUserInfo(id string, params FacebookParams) FacebookAccount {
-	var account FacebookAccount
+	account, _ := facebookGetUserInfo(id, params)
+	return account
+}
 
-	if id != "" {
-		var buffer bytes.Buffer
-		buffer.WriteString(fbGraphApiBaseUrl)
-		buffer.WriteString(id)
-		buffer.WriteString("?")
+// Gets basic info about an account on Facebook, returning why it couldn't if it couldn't.
+func facebookGetUserInfo(id string, params FacebookParams) (FacebookAccount, error) {
+	var account FacebookAccount
+	if id == "" {
+		return account, errors.New("no Facebook account id")
+	}
+	// Look for access_token override, if not present, use default fbToken from config
+	if params.AccessToken == "" {
+		params.AccessToken = fbToken
+	}
 
-		// convert struct to querystring params (for now, only pass the access_token, the other stuff doesn't matter for our use here)
-		userInfoParams := FacebookParams{AccessToken: params.AccessToken}
-		v, err := query.Values(userInfoParams)
-		if err != nil {
-			return account
-		}
-		buffer.WriteString(v.Encode())
-		userInfoUrl := buffer.String()
-		buffer.Reset()
+	var buffer bytes.Buffer
+	buffer.WriteString(fbGraphApiBaseUrl)
+	buffer.WriteString(id)
+	buffer.WriteString("?")
 
-		// set up the request
-		req, err := http.NewRequest("GET", userInfoUrl, nil)
-		if err != nil {
-			return account
-		}
-		// doo it
-		resp, err := fbHttpClient.Do(req)
-		if err != nil {
-			return account
-		}
-		defer resp.Body.Close()
+	// convert struct to querystring params (for now, only pass the access_token, the other stuff doesn't matter for our use here)
+	userInfoParams := FacebookParams{AccessToken: params.AccessToken}
+	v, err := query.Values(userInfoParams)
+	if err != nil {
+		return account, err
+	}
+	buffer.WriteString(v.Encode())
+	userInfoUrl := buffer.String()
+	buffer.Reset()
 
-		dec := json.NewDecoder(resp.Body)
-		dec.Decode(&account)
-		// close the response now, we don't need it anymore - it should close right after this anyway because of the defer... but these calls are atomic. so just to be safe.
-		// i've had too much trouble with unclosed http requests. i'm happy to be paranoid and safe rather than sorry, because i've been sorry and sore before.
-		resp.Body.Close()
+	// set up the request
+	req, err := http.NewRequest("GET", userInfoUrl, nil)
+	if err != nil {
+		return account, err
+	}
+	// doo it
+	resp, err := fbHttpClient.Do(req)
+	if err != nil {
+		return account, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return account, errors.New("Facebook responded " + resp.Status)
 	}
 
-	return account
+	dec := json.NewDecoder(resp.Body)
+	err = dec.Decode(&account)
+	// close the response now, we don't need it anymore - it should close right after this anyway because of the defer... but these calls are atomic. so just to be safe.
+	// i've had too much trouble with unclosed http requests. i'm happy to be paranoid and safe rather than sorry, because i've been sorry and sore before.
+	resp.Body.Close()
+	return account, err
 }
 
-// Harvests Facebook account details to track changes in likes, etc. (only for public pages)
-func FacebookAccountDetails(territoryName string, account string) {
-	params := FacebookParams{}
-	contributor := FacebookGetUserInfo(account, params)
+// Harvests Facebook account details to track changes in likes, etc. (only for public pages). Returns the API's error if the account
+// couldn't be looked up.
+func FacebookAccountDetails(territoryName string, account string) error {
+	params := FacebookParams{AccessToken: FacebookTerritoryToken(territoryName)}
+	contributor, err := facebookGetUserInfo(account, params)
+	if err != nil {
+		return err
+	}
 	now := time.Now()
 	// The harvest id in this case will be unique by time / account / network / territory, since there is no post id or anything else like that
 	harvestId := GetHarvestMd5(account + now.String() + "facebook" + territoryName)
@@ -718,7 +762,72 @@ func FacebookAccountDetails(territoryName string, account string) {
 		WereHere:      contributor.WereHereCount,
 		Checkins:      contributor.Checkins,
 	}
-	StoreHarvestedData(row)
-	LogJson(row, "contributor_growth")
-	return
+	Emit("contributor_growth", row)
+	return nil
+}
+
+// Looks up the share and like counts of posts that were already harvested (50 at a time, which is as many ids as the Graph API takes in one
+// request) and stores them in the message_engagement series. Returns the number of posts found and the API calls made.
+func FacebookEngagement(messages []config.SocialHarvestMessage, params FacebookParams) (int, int) {
+	if params.AccessToken == "" {
+		params.AccessToken = fbToken
+	}
+	found := 0
+	calls := 0
+	if params.AccessToken == "" {
+		return found, calls
+	}
+	for start := 0; start < len(messages); start += 50 {
+		end := start + 50
+		if end > len(messages) {
+			end = len(messages)
+		}
+		byId := map[string]config.SocialHarvestMessage{}
+		ids := []string{}
+		for _, m := range messages[start:end] {
+			ids = append(ids, m.MessageId)
+			byId[m.MessageId] = m
+		}
+		v := url.Values{}
+		v.Set("ids", strings.Join(ids, ","))
+		v.Set("fields", "shares,likes.limit(0).summary(true)")
+		v.Set("access_token", params.AccessToken)
+
+		req, err := http.NewRequest("GET", fbGraphApiBaseUrl+"?"+v.Encode(), nil)
+		if err != nil {
+			continue
+		}
+		resp, err := fbHttpClient.Do(req)
+		calls++
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		posts := map[string]struct {
+			Shares struct {
+				Count int `json:"count"`
+			} `json:"shares"`
+			Likes struct {
+				Summary struct {
+					TotalCount int `json:"total_count"`
+				} `json:"summary"`
+			} `json:"likes"`
+		}{}
+		err = json.NewDecoder(resp.Body).Decode(&posts)
+		resp.Body.Close()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		now := time.Now()
+		for id, post := range posts {
+			if m, ok := byId[id]; ok {
+				m.FacebookShares = post.Shares.Count
+				m.LikeCount = post.Likes.Summary.TotalCount
+				Emit("message_engagement", m.Engagement(now))
+				found++
+			}
+		}
+	}
+	return found, calls
 }
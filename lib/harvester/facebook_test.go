@@ -266,3 +266,76 @@ func TestFacebookGetUserInfo(t *testing.T) {
 	}
 }
 */
+
+import (
+	"github.com/SocialHarvest/harvester/lib/config"
+	"testing"
+	"time"
+)
+
+func TestFacebookSearch(t *testing.T) {
+	NewFacebook(testServicesConfig(t))
+	defer useCassette(t, "facebook_search")()
+	emitted, stop := captureEmitted(t)
+	defer stop()
+
+	params := FacebookParams{
+		Type:        "post",
+		Q:           "javascript",
+		Limit:       "2",
+		AccessToken: "test-token",
+	}
+	updatedParams, harvestState := FacebookSearch("javascript", config.HarvestState{}, params)
+
+	if harvestState.ItemsHarvested != 2 {
+		t.Fatalf("expected 2 posts to be harvested, got %d", harvestState.ItemsHarvested)
+	}
+	if harvestState.LastId != "113124472034820_738319376181990" {
+		t.Errorf("expected the most recent post id to be kept, got %s", harvestState.LastId)
+	}
+	if harvestState.LastTime.Unix() != 1413397862 {
+		t.Errorf("expected the most recent post time to be kept, got %s", harvestState.LastTime)
+	}
+	// The "until" value from the "next" paging link is used to get the next page
+	if updatedParams.Until != "1413393159" {
+		t.Errorf("expected the next page until value to be set, got %s", updatedParams.Until)
+	}
+
+	if !FlushSinks(5 * time.Second) {
+		t.Fatal("flushing the sinks timed out")
+	}
+	messages := emitted.emitted("messages")
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages to be emitted, got %d", len(messages))
+	}
+	page := messages[0].(config.SocialHarvestMessage)
+	if page.MessageId != "113124472034820_738319376181990" || page.ContributorType != "company" || page.ContributorLikes != 91412 || page.Category != "Computers/technology" || page.FacebookShares != 14 {
+		t.Errorf("unexpected message from a page: %+v", page)
+	}
+	person := messages[1].(config.SocialHarvestMessage)
+	if person.ContributorType != "person" || person.ContributorGender != -1 || person.ContributorLang != "en" {
+		t.Errorf("unexpected message from a person: %+v", person)
+	}
+	if engagement := emitted.emitted("message_engagement"); len(engagement) != 2 || engagement[0].(config.SocialHarvestMessageEngagement).FacebookShares != 14 {
+		t.Errorf("expected the engagement of each message to be emitted, got %+v", engagement)
+	}
+	links := emitted.emitted("shared_links")
+	if len(links) != 1 || links[0].(config.SocialHarvestSharedLink).Host != "docs.angularjs.org" {
+		t.Errorf("expected the link to be emitted, got %+v", links)
+	}
+}
+
+func TestFacebookTerritoryToken(t *testing.T) {
+	previous, database := currentHarvestConfig(), currentDatabase()
+	defer setConfig(previous, database)
+	territory := config.Territory{Name: "override"}
+	territory.Services.Facebook.AppToken = "territory-token"
+	setConfig(config.HarvestConfig{Territories: []config.Territory{territory, {Name: "default"}}}, database)
+
+	if token := FacebookTerritoryToken("override"); token != "territory-token" {
+		t.Errorf("expected the territory's token, got %s", token)
+	}
+	if token := FacebookTerritoryToken("default"); token != "" {
+		t.Errorf("expected no token for a territory without one, got %s", token)
+	}
+}
@@ -42,7 +42,7 @@ func NewGooglePlus(servicesConfig config.ServicesConfig) {
 
 // If the territory has different keys to use
 func NewGooglePlusTerritoryCredentials(territory string) {
-	for _, t := range harvestConfig.Territories {
+	for _, t := range currentHarvestConfig().Territories {
 		if t.Name == territory {
 			if t.Services.Google.ServerKey != "" {
 				client := &http.Client{
@@ -72,6 +72,7 @@ func GooglePlusActivitySearch(territoryName string, harvestState config.HarvestS
 	nextPageToken := options.Get("nextPageToken")
 
 	activities, err := services.googlePlus.Activities.Search(query).MaxResults(limit).PageToken(nextPageToken).Do()
+	harvestState.Error = err
 	if err == nil {
 		// Passed back to whatever called this function, so it can continue with the next page.
 		options.Set("nextPageToken", activities.NextPageToken)
@@ -97,6 +98,7 @@ func GooglePlusActivitySearch(territoryName string, harvestState config.HarvestS
 				contributor, err := services.googlePlus.People.Get(item.Actor.Id).Do()
 				if err != nil {
 					log.Println(err)
+					harvestState.Error = err
 					return options, harvestState
 				}
 
@@ -158,12 +160,12 @@ func GooglePlusActivitySearch(territoryName string, harvestState config.HarvestS
 					ContributorCountry:        contributorCountry,
 					Message:                   item.Object.Content,
 					Sentiment:                 services.sentimentAnalyzer.Classify(item.Object.Content),
-					IsQuestion:                Btoi(IsQuestion(item.Object.OriginalContent, harvestConfig.QuestionRegex)),
+					IsQuestion:                Btoi(IsQuestion(item.Object.OriginalContent, currentHarvestConfig().QuestionRegex)),
 					GooglePlusReshares:        item.Object.Resharers.TotalItems,
 					GooglePlusOnes:            item.Object.Plusoners.TotalItems,
 				}
-				StoreHarvestedData(messageRow)
-				LogJson(messageRow, "messages")
+				Emit("messages", messageRow)
+				Emit("message_engagement", messageRow.Engagement(time.Now()))
 
 				// Keywords are stored on the same collection as hashtags - but under a `keyword` field instead of `tag` field as to not confuse the two.
 				// Limit to words 4 characters or more and only return 8 keywords. This could greatly increase the database size if not limited.
@@ -195,8 +197,7 @@ func GooglePlusActivitySearch(territoryName string, harvestState config.HarvestS
 								ContributorCountry:        contributorCountry,
 								Keyword:                   keyword,
 							}
-							StoreHarvestedData(hashtag)
-							LogJson(hashtag, "hashtags")
+							Emit("hashtags", hashtag)
 						}
 					}
 				}
@@ -244,8 +245,7 @@ func GooglePlusActivitySearch(territoryName string, harvestState config.HarvestS
 							ExpandedUrl:               ExpandUrl(attachment.Url),
 							Host:                      hostName,
 						}
-						StoreHarvestedData(sharedLinksRow)
-						LogJson(sharedLinksRow, "shared_links")
+						Emit("shared_links", sharedLinksRow)
 					}
 				}
 
@@ -271,6 +271,7 @@ func GooglePlusActivityByAccount(territoryName string, harvestState config.Harve
 	nextPageToken := options.Get("nextPageToken")
 
 	activities, err := services.googlePlus.Activities.List(account, "public").MaxResults(limit).PageToken(nextPageToken).Do()
+	harvestState.Error = err
 	if err == nil {
 		// Passed back to whatever called this function, so it can continue with the next page.
 		options.Set("nextPageToken", activities.NextPageToken)
@@ -296,6 +297,7 @@ func GooglePlusActivityByAccount(territoryName string, harvestState config.Harve
 				contributor, err := services.googlePlus.People.Get(item.Actor.Id).Do()
 				if err != nil {
 					log.Println(err)
+					harvestState.Error = err
 					return options, harvestState
 				}
 
@@ -356,12 +358,12 @@ func GooglePlusActivityByAccount(territoryName string, harvestState config.Harve
 					ContributorRegion:         contributorRegion,
 					ContributorCountry:        contributorCountry,
 					Message:                   item.Object.Content,
-					IsQuestion:                Btoi(IsQuestion(item.Object.OriginalContent, harvestConfig.QuestionRegex)),
+					IsQuestion:                Btoi(IsQuestion(item.Object.OriginalContent, currentHarvestConfig().QuestionRegex)),
 					GooglePlusReshares:        item.Object.Resharers.TotalItems,
 					GooglePlusOnes:            item.Object.Plusoners.TotalItems,
 				}
-				StoreHarvestedData(messageRow)
-				LogJson(messageRow, "messages")
+				Emit("messages", messageRow)
+				Emit("message_engagement", messageRow.Engagement(time.Now()))
 
 				if len(item.Object.Attachments) > 0 {
 					for _, attachment := range item.Object.Attachments {
@@ -406,8 +408,7 @@ func GooglePlusActivityByAccount(territoryName string, harvestState config.Harve
 							ExpandedUrl:               ExpandUrl(attachment.Url),
 							Host:                      hostName,
 						}
-						StoreHarvestedData(sharedLinksRow)
-						LogJson(sharedLinksRow, "shared_links")
+						Emit("shared_links", sharedLinksRow)
 					}
 				}
 
@@ -421,7 +422,8 @@ func GooglePlusActivityByAccount(territoryName string, harvestState config.Harve
 }
 
 // Harvests Google+ account details to track changes in followers, etc. (NOTE: Pages can't currently be tracked by the existing API, it's invite only)
-func GooglePlusAccountDetails(territoryName string, account string) {
+// Returns the API's error if the account couldn't be looked up.
+func GooglePlusAccountDetails(territoryName string, account string) error {
 	contributor, err := services.googlePlus.People.Get(account).Do()
 	if err == nil {
 		now := time.Now()
@@ -437,8 +439,34 @@ func GooglePlusAccountDetails(territoryName string, account string) {
 			Followers:     int(contributor.CircledByCount),
 			PlusOnes:      int(contributor.PlusOneCount),
 		}
-		StoreHarvestedData(row)
-		LogJson(row, "contributor_growth")
+		Emit("contributor_growth", row)
 	}
-	return
+	return err
+}
+
+// Looks up the reshare and +1 counts of activities that were already harvested and stores them in the message_engagement series. Google+
+// can only look up one at a time. Returns the number of activities found and the API calls made.
+func GooglePlusEngagement(messages []config.SocialHarvestMessage) (int, int) {
+	found := 0
+	calls := 0
+	if services.googlePlus == nil {
+		return found, calls
+	}
+	now := time.Now()
+	for _, m := range messages {
+		activity, err := services.googlePlus.Activities.Get(m.MessageId).Do()
+		calls++
+		if err != nil || activity == nil || activity.Object == nil {
+			continue
+		}
+		if activity.Object.Resharers != nil {
+			m.GooglePlusReshares = activity.Object.Resharers.TotalItems
+		}
+		if activity.Object.Plusoners != nil {
+			m.GooglePlusOnes = activity.Object.Plusoners.TotalItems
+		}
+		Emit("message_engagement", m.Engagement(now))
+		found++
+	}
+	return found, calls
 }
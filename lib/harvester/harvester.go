@@ -24,8 +24,11 @@ import (
 	"github.com/SocialHarvestVendors/go-instagram/instagram"
 	"github.com/SocialHarvestVendors/google-api-go-client/plus/v1"
 	"github.com/SocialHarvestVendors/google-api-go-client/youtube/v3"
+	"log"
 	"net"
 	"net/http"
+	"reflect"
+	"sync"
 	"time"
 )
 
@@ -44,9 +47,31 @@ var services = harvesterServices{}
 var socialHarvestDB *config.SocialHarvestDB
 var httpClient *http.Client
 
+// Guards the harvest config and the database, which a reload swaps while harvests are running
+var configLock sync.RWMutex
+
+func currentHarvestConfig() config.HarvestConfig {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return harvestConfig
+}
+
+func currentDatabase() *config.SocialHarvestDB {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return socialHarvestDB
+}
+
+func setConfig(configuration config.HarvestConfig, database *config.SocialHarvestDB) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	harvestConfig = configuration
+	socialHarvestDB = database
+}
+
 // Sets up a new harvester with the given configuration (which is comprised of several "services")
 func New(configuration config.SocialHarvestConf, database *config.SocialHarvestDB) {
-	harvestConfig = configuration.Harvest
+	setConfig(configuration.Harvest, database)
 	// Now set up all the services with the configuration
 	NewTwitter(configuration.Services)
 	NewFacebook(configuration.Services)
@@ -58,11 +83,14 @@ func New(configuration config.SocialHarvestConf, database *config.SocialHarvestD
 	// Same for the sentiment analyzer (note: both of these packages require an up front data download and memory allocation).
 	services.sentimentAnalyzer = sentiment.NewAnalyzer()
 
-	// StoreHarvestedData() needs this now
-	socialHarvestDB = database
-
 	// Internal logging (log4go became problematic for concurrency and I've found a better solution in less than 100 lines now anyway)
-	NewLoggers(configuration.Logs.Directory)
+	NewLoggers(configuration.Logs.Directory, logOptionsFor(configuration))
+
+	// Harvested data goes wherever the sinks say (the database and log files by default)
+	if err := NewSinks(configuration.Sinks); err != nil {
+		log.Println("Could not set up the sinks, harvested data will go to the database and log files: " + err.Error())
+		NewSinks(nil)
+	}
 
 	// Set up an http.Client for a variety of uses including expanding shortened URLs.
 	httpClient = &http.Client{
@@ -83,10 +111,82 @@ func New(configuration config.SocialHarvestConf, database *config.SocialHarvestD
 	}
 }
 
-// Rather than using an observer, just call this function instead (the observer was causing memory leaks)
-// TODO: Look back into channels in the future because I like the idea of pub/sub. In the future it could expand into something useful.
-// The thing I don't like (and why I used the observer) is passing all the configuration stuff around.
+// Swaps in a new configuration (for a config reload). Unlike New(), the geocoder, sentiment analyzer, HTTP client and log workers are
+// kept as they are. The services are rebuilt with the new credentials. Harvests that are running pick up the new config and services
+// as they go (just like they pick up a territory's own credentials), the records they emit go to the new database.
+func Reload(configuration config.SocialHarvestConf, database *config.SocialHarvestDB) {
+	setConfig(configuration.Harvest, database)
+	NewTwitter(configuration.Services)
+	NewFacebook(configuration.Services)
+	NewInstagram(configuration.Services)
+	NewGooglePlus(configuration.Services)
+	NewYouTube(configuration.Services)
+
+	// The log workers only need to be started if there weren't any before. Workers write to the directory they were started with.
+	if logRootDir == "" {
+		NewLoggers(configuration.Logs.Directory, logOptionsFor(configuration))
+	} else if logRootDir != configuration.Logs.Directory || !reflect.DeepEqual(logOptions, logOptionsFor(configuration).withDefaults()) {
+		log.Println("The log settings can not be changed by reloading the config, a restart is required.")
+	}
+
+	// Sinks are replaced (after writing what they have) only when their configuration changed
+	sinksLock.RLock()
+	changed := !reflect.DeepEqual(sinkConfigs, configuration.Sinks) && !(len(configuration.Sinks) == 0 && reflect.DeepEqual(sinkConfigs, defaultSinks))
+	sinksLock.RUnlock()
+	if changed {
+		if err := NewSinks(configuration.Sinks); err != nil {
+			log.Println("Could not set up the sinks, keeping the ones there were: " + err.Error())
+		}
+	}
+}
+
+func logOptionsFor(configuration config.SocialHarvestConf) LogOptions {
+	logs := configuration.Logs
+	return LogOptions{
+		Workers:        logs.Workers,
+		BufferBytes:    logs.BufferBytes,
+		FlushInterval:  time.Duration(logs.FlushSeconds) * time.Second,
+		MaxFileBytes:   logs.MaxFileBytes,
+		RotateInterval: time.Duration(logs.RotateMinutes) * time.Minute,
+		Compress:       logs.Compress,
+		Manifest:       logs.Manifest,
+		Overflow:       logs.Overflow,
+		SeriesOverflow: logs.SeriesOverflow,
+	}
+}
+
+// Stores a record in the database (if configured). Harvest functions don't call this directly, they Emit() records and the database sink
+// calls this (see sinks.go).
 func StoreHarvestedData(message interface{}) {
-	// Write to database (if configured)
-	socialHarvestDB.StoreRow(message)
+	// Write to database (if configured), this waits when the database is falling behind
+	if database := currentDatabase(); database != nil {
+		database.StoreRow(message)
+	}
+}
+
+// Waits for the harvested data queued for the database to be written, after which data is written as it's stored. Returns false if it
+// wasn't all written within the timeout.
+func WaitForWrites(timeout time.Duration) bool {
+	database := currentDatabase()
+	if database == nil {
+		return true
+	}
+	return database.StopWriting(timeout)
+}
+
+// Swaps the HTTP transport used to talk to each service's API. Only the services that have been set up (via New() or NewTwitter(), etc.) are changed.
+// It's mostly useful for tests, which can pass a CassetteTransport in order to replay recorded API responses instead of making real requests.
+func SetTransport(transport http.RoundTripper) {
+	if httpClient != nil {
+		httpClient.Transport = transport
+	}
+	if fbHttpClient != nil {
+		fbHttpClient.Transport = transport
+	}
+	if instagramHttpClient != nil {
+		instagramHttpClient.Transport = transport
+	}
+	if services.twitter != nil {
+		services.twitter.HttpClient = &http.Client{Transport: transport}
+	}
 }
@@ -57,7 +57,7 @@ func NewInstagram(servicesConfig config.ServicesConfig) {
 
 // If the territory has different keys to use
 func NewInstagramTerritoryCredentials(territory string) {
-	for _, t := range harvestConfig.Territories {
+	for _, t := range currentHarvestConfig().Territories {
 		if t.Name == territory {
 			if t.Services.Instagram.ClientId != "" {
 				services.instagram.ClientID = t.Services.Instagram.ClientId
@@ -80,6 +80,7 @@ func InstagramSearch(territoryName string, harvestState config.HarvestState, tag
 	}
 
 	media, next, err := services.instagram.Tags.RecentMedia(tag, opt)
+	harvestState.Error = err
 
 	if err == nil {
 		for _, item := range media {
@@ -149,7 +150,7 @@ func InstagramSearch(territoryName string, harvestState config.HarvestState, tag
 				isQuestion := 0
 				if item.Caption != nil {
 					caption = item.Caption.Text
-					isQuestion = Btoi(IsQuestion(caption, harvestConfig.QuestionRegex))
+					isQuestion = Btoi(IsQuestion(caption, currentHarvestConfig().QuestionRegex))
 				}
 
 				message := config.SocialHarvestMessage{
@@ -178,8 +179,8 @@ func InstagramSearch(territoryName string, harvestState config.HarvestState, tag
 					LikeCount:                 item.Likes.Count,
 				}
 				// Send to the harvester observer
-				go StoreHarvestedData(message)
-				LogJson(message, "messages")
+				Emit("messages", message)
+				Emit("message_engagement", message.Engagement(time.Now()))
 
 				// Keywords are stored on the same collection as hashtags - but under a `keyword` field instead of `tag` field as to not confuse the two.
 				// Limit to words 4 characters or more and only return 8 keywords. This could greatly increase the database size if not limited.
@@ -210,8 +211,7 @@ func InstagramSearch(territoryName string, harvestState config.HarvestState, tag
 								ContributorType:           contributorType,
 								Keyword:                   keyword,
 							}
-							StoreHarvestedData(hashtag)
-							LogJson(hashtag, "hashtags")
+							Emit("hashtags", hashtag)
 						}
 					}
 				}
@@ -260,8 +260,7 @@ func InstagramSearch(territoryName string, harvestState config.HarvestState, tag
 					Source:                    source,
 				}
 				// Send to the harvester observer
-				StoreHarvestedData(sharedLink)
-				LogJson(sharedLink, "shared_links")
+				Emit("shared_links", sharedLink)
 
 				// hashtags
 				if len(item.Tags) > 0 {
@@ -291,8 +290,7 @@ func InstagramSearch(territoryName string, harvestState config.HarvestState, tag
 								Tag:                       tag,
 							}
 							// Send to the harvester observer
-							StoreHarvestedData(hashtag)
-							LogJson(hashtag, "hashtags")
+							Emit("hashtags", hashtag)
 						}
 					}
 				}
@@ -349,8 +347,8 @@ func InstagramFindTags(keyword string) string {
 	return tag
 }
 
-// Harvests Instagram account details to track changes in followers, etc.
-func InstagramAccountDetails(territoryName string, account string) {
+// Harvests Instagram account details to track changes in followers, etc. Returns the API's error if the account couldn't be looked up.
+func InstagramAccountDetails(territoryName string, account string) error {
 	contributor, err := services.instagram.Users.Get(account)
 	if err == nil {
 		now := time.Now()
@@ -367,8 +365,28 @@ func InstagramAccountDetails(territoryName string, account string) {
 			Following:     contributor.Counts.Follows,
 			StatusUpdates: contributor.Counts.Media,
 		}
-		StoreHarvestedData(row)
-		LogJson(row, "contributor_growth")
+		Emit("contributor_growth", row)
 	}
-	return
+	return err
+}
+
+// Looks up the like counts of media that was already harvested and stores them in the message_engagement series. Instagram can only look
+// up one at a time. Returns the number of media found and the API calls made.
+func InstagramEngagement(messages []config.SocialHarvestMessage) (int, int) {
+	found := 0
+	calls := 0
+	now := time.Now()
+	for _, m := range messages {
+		media, err := services.instagram.Media.Get(m.MessageId)
+		calls++
+		if err != nil || media == nil {
+			continue
+		}
+		if media.Likes != nil {
+			m.LikeCount = media.Likes.Count
+		}
+		Emit("message_engagement", m.Engagement(now))
+		found++
+	}
+	return found, calls
 }
@@ -0,0 +1,55 @@
+package harvester
+
+import (
+	"github.com/SocialHarvest/harvester/lib/config"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestInstagramSearch(t *testing.T) {
+	NewInstagram(testServicesConfig(t))
+	defer useCassette(t, "instagram_search")()
+	emitted, stop := captureEmitted(t)
+	defer stop()
+
+	params := url.Values{}
+	params.Set("count", "2")
+	options, harvestState := InstagramSearch("javascript", config.HarvestState{}, "golang", params)
+
+	if harvestState.ItemsHarvested != 2 {
+		t.Fatalf("expected 2 instagrams to be harvested, got %d", harvestState.ItemsHarvested)
+	}
+	// Instagram's pagination id is kept (rather than the media id) so the next harvest can continue from there
+	if harvestState.LastId != "1413403451032000" {
+		t.Errorf("expected the next max tag id to be kept, got %s", harvestState.LastId)
+	}
+	if options.Get("max_tag_id") != "1413403451032000" {
+		t.Errorf("expected max_tag_id to be set for the next page, got %s", options.Get("max_tag_id"))
+	}
+	if harvestState.LastTime.Unix() != 1413405521 {
+		t.Errorf("expected the most recent instagram time to be kept, got %s", harvestState.LastTime)
+	}
+
+	if !FlushSinks(5 * time.Second) {
+		t.Fatal("flushing the sinks timed out")
+	}
+	messages := emitted.emitted("messages")
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages to be emitted, got %d", len(messages))
+	}
+	message := messages[0].(config.SocialHarvestMessage)
+	if message.MessageId != "829221315910159163_36017741" || message.ContributorScreenName != "renee_codes" || message.ContributorFollowers != 9821 || message.LikeCount != 31 {
+		t.Errorf("unexpected message: %+v", message)
+	}
+	if engagement := emitted.emitted("message_engagement"); len(engagement) != 2 || engagement[0].(config.SocialHarvestMessageEngagement).LikeCount != 31 {
+		t.Errorf("expected the engagement of each message to be emitted, got %+v", engagement)
+	}
+	if !emittedTag(emitted, "gopher") {
+		t.Error("expected the #gopher hashtag to be emitted")
+	}
+	links := emitted.emitted("shared_links")
+	if len(links) != 2 || links[0].(config.SocialHarvestSharedLink).Type != "image" || links[0].(config.SocialHarvestSharedLink).Url != "http://instagram.com/p/uJ2k0oQm3x/" {
+		t.Errorf("expected the images to be emitted as shared links, got %+v", links)
+	}
+}
@@ -17,11 +17,17 @@
 package harvester
 
 import (
+	"compress/gzip"
 	"encoding/json"
+	"fmt"
+	"github.com/SocialHarvest/harvester/lib/config"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -29,54 +35,184 @@ import (
 // The upside is speed. The downside is multiple files (not a huge deal).
 // So folders for "messages" and "hashtags" and "mentions" must be made.
 // This code is a modified version of: http://openmymind.net/Concurrent-Friendly-Logging-With-Go/
+//
+// Each line of a log file is a JSON document (newline-delimited JSON). Workers append to a file in the "_working" directory and once it
+// reaches a certain size or age, it's moved to <series>/<year>/<month>/<day>/ under the log directory. Files are never moved there until
+// they're complete, so anything picking them up (Fluentd, batch jobs, etc.) won't see partial files. If configured, a manifest is written
+// next to each file after it's moved.
 
-// This may be configurable? It's a more technical configuration though. Maybe automatically set it based on things like number of territories and/or criteria within.
-// We could then get a sense for the amount of volume that might be coming through and make a reasonable worker count here. Playing with this is going to greatly
-// affect performance and efficiency.
-const workerCount = 4
+// This represents a channel for each series (all of config.SeriesNames, so no series is silently left out of the logs).
+var logChannels = newLogChannels()
 
-// This represents a channel for each series.
-// TODO: Maybe keep this in sync with the series listed in config/series.go or maybe make it be passed to NewLogggers() (if the latter, we could turn this into its own package)
-var logChannels = map[string]chan []byte{
-	"messages":           make(chan []byte, 1024),
-	"mentions":           make(chan []byte, 1024),
-	"hashtags":           make(chan []byte, 1024),
-	"shared_links":       make(chan []byte, 1024),
-	"contributor_growth": make(chan []byte, 1024),
+func newLogChannels() map[string]chan []byte {
+	channels := map[string]chan []byte{}
+	for _, series := range config.SeriesNames {
+		channels[series] = make(chan []byte, 1024)
+	}
+	return channels
 }
+
 var logWorkers = map[string][]*Worker{}
 var logRootDir string
+var logOptions LogOptions
+
+// Records that don't fit on a full channel are written straight to disk by these (one for each series) when the series spills.
+var spillWorkers = map[string]*Worker{}
+var spillLock sync.Mutex
+
+// Where workers keep the files they're writing to (within the log directory).
+const workingDir = "_working"
+
+// What happens to a record when its series' channel is full (the workers can't keep up).
+const (
+	// Wait for room on the channel (which slows down the harvest)
+	LogOverflowBlock = "block"
+	// Write the record to disk right away (slower than buffering, but nothing waits on the workers and nothing is lost)
+	LogOverflowSpill = "spill"
+	// Throw the record away (it's counted as dropped)
+	LogOverflowDrop = "drop"
+)
 
-// This also has an effect on performance and efficiency. It changes the buffer size (and ultimately the amount of data in each log file).
-// One risk that occurs when making this larger is that should the server crash during the middle of things buffering, more data would be lost.
-// If keeping this small then less data would be lost if something were to crash.
-// TODO: Maybe also make this configurable. WAS: 32768 - but I saw a lot of over capacity warnings...
-const capacity = 65536
+// How log files are written. Zero values get the defaults (see withDefaults()).
+type LogOptions struct {
+	// The number of workers for each series and the size of each one's buffer
+	Workers     int
+	BufferBytes int
+	// How often the buffer is written out, even if it isn't full
+	FlushInterval time.Duration
+	// Files are rotated once they reach this size (before compression) or age
+	MaxFileBytes   int
+	RotateInterval time.Duration
+	Compress       bool
+	Manifest       bool
+	// LogOverflowBlock, LogOverflowSpill or LogOverflowDrop (default) for every series, unless set for the series in SeriesOverflow
+	Overflow       string
+	SeriesOverflow map[string]string
+}
+
+// The number of records for a series that were put on its channel, written to log files, spilled to disk and dropped.
+type LogCounts struct {
+	Enqueued int `json:"enqueued"`
+	Written  int `json:"written"`
+	Spilled  int `json:"spilled"`
+	Dropped  int `json:"dropped"`
+}
+
+var logCounts = map[string]*LogCounts{}
+var logCountsMutex sync.Mutex
+
+// Describes a complete log file, written as <file>.manifest.json. From and To are when the first and last records were logged.
+type LogManifest struct {
+	File    string    `json:"file"`
+	Series  string    `json:"series"`
+	Records int       `json:"records"`
+	Bytes   int       `json:"bytes"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Gzip    bool      `json:"gzip"`
+}
 
 type Worker struct {
-	fileRoot string
+	name     string
+	series   string
 	buffer   []byte
 	position int
+	records  int
+	from     time.Time
+	to       time.Time
+	file     *logFile
+	flush    chan flushRequest
+}
+
+// Asks a worker to write out everything it has, optionally stopping afterwards. It answers on done.
+type flushRequest struct {
+	done chan bool
+	stop bool
+}
+
+// The file a worker is currently writing to.
+type logFile struct {
+	f       *os.File
+	gz      *gzip.Writer
+	w       io.Writer
+	path    string
+	opened  time.Time
+	bytes   int
+	records int
+	from    time.Time
+	to      time.Time
+}
+
+// Fills in the defaults. More workers and bigger buffers have an effect on performance and efficiency. The risk of making the buffers
+// larger is that should the server crash in the middle of things buffering, more data would be lost.
+func (o LogOptions) withDefaults() LogOptions {
+	if o.Workers <= 0 {
+		o.Workers = 4
+	}
+	if o.BufferBytes <= 0 {
+		// WAS: 32768 - but I saw a lot of over capacity warnings...
+		o.BufferBytes = 65536
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = time.Minute
+	}
+	if o.MaxFileBytes <= 0 {
+		o.MaxFileBytes = 10 * 1024 * 1024
+	}
+	if o.RotateInterval <= 0 {
+		o.RotateInterval = time.Hour
+	}
+	if o.Overflow == "" {
+		o.Overflow = LogOverflowDrop
+	}
+	return o
+}
+
+// Returns what happens to the series' records when its channel is full.
+func (o LogOptions) OverflowPolicy(series string) string {
+	if policy, ok := o.SeriesOverflow[series]; ok && policy != "" {
+		return policy
+	}
+	return o.Overflow
 }
 
 // Creates and configures new workers on each of the logging channels and sets the directory path to store the log files.
-func NewLoggers(dir string) {
+func NewLoggers(dir string, options LogOptions) {
 	// If not configured, this could be empty. We need a directory to write to. So just return if an empty string was passed.
 	if dir == "" {
 		return
 	}
 	logRootDir = dir
+	logOptions = options.withDefaults()
+	os.MkdirAll(filepath.Join(logRootDir, workingDir), 0755)
 	// Get the workers for each channel.
 	for k, _ := range logChannels {
-		logWorkers[k] = make([]*Worker, workerCount)
-		for i := 0; i < workerCount; i++ {
-			logWorkers[k][i] = NewWorker(i, k)
+		logWorkers[k] = make([]*Worker, logOptions.Workers)
+		for i := 0; i < logOptions.Workers; i++ {
+			logWorkers[k][i] = NewWorker(strconv.Itoa(i), k)
 			// Work it baby!
 			go logWorkers[k][i].Work(logChannels[k])
 		}
+		spillWorkers[k] = NewWorker("spill", k)
 	}
 }
 
+// The number of items harvested for each series since the harvester started. Everything harvested goes through Emit(), whichever sinks
+// are configured, so that's where items are counted.
+var harvestedCounts = map[string]int{}
+var harvestedCountsMutex sync.Mutex
+
+// Returns the number of items harvested for each series since the harvester started.
+func HarvestedCounts() map[string]int {
+	harvestedCountsMutex.Lock()
+	defer harvestedCountsMutex.Unlock()
+	counts := map[string]int{}
+	for series, count := range harvestedCounts {
+		counts[series] = count
+	}
+	return counts
+}
+
 // Converts the various things to JSON first before sending those bytes to Log()
 func LogJson(message interface{}, channelName string) {
 	// If NewLoggers() was not called, there would be no root directory and thus no where to write to and no workers. Just return.
@@ -89,59 +225,306 @@ func LogJson(message interface{}, channelName string) {
 	}
 }
 
-// Sends to the buffered channel to eventually flush to disk.
+// Sends to the buffered channel to eventually flush to disk. If the channel is full, the series' overflow policy decides what happens.
 func Log(event []byte, channelName string) {
 	// If NewLoggers() was not called, there would be no root directory and thus no where to write to and no workers. Just return.
 	if logRootDir == "" {
 		return
 	}
-	select {
-	case logChannels[channelName] <- event:
-	case <-time.After(5 * time.Second):
-		return // do we need this? i feel like while memory stops climbing after a harvest...it isn't being released. would this force GC?
-		// or would i need to close all the logChannels and open them back up again on next harvest?
-		// throw away the message, so sad
+	channel, ok := logChannels[channelName]
+	if !ok {
+		return
+	}
+	switch logOptions.OverflowPolicy(channelName) {
+	case LogOverflowBlock:
+		channel <- event
+	case LogOverflowSpill:
+		select {
+		case channel <- event:
+		default:
+			spill(event, channelName)
+			return
+		}
 	default:
-		// need this? if there's a timeout?
+		select {
+		case channel <- event:
+		default:
+			countLog(channelName, func(c *LogCounts) { c.Dropped++ })
+			return
+		}
+	}
+	countLog(channelName, func(c *LogCounts) { c.Enqueued++ })
+}
+
+// Writes the record to disk right away, bypassing the channel and the workers.
+func spill(event []byte, series string) {
+	countLog(series, func(c *LogCounts) { c.Spilled++ })
+	spillLock.Lock()
+	defer spillLock.Unlock()
+	w, ok := spillWorkers[series]
+	if !ok {
+		return
+	}
+	w.write(event)
+	w.Save()
+	if w.file != nil && time.Since(w.file.opened) >= logOptions.RotateInterval {
+		w.rotate()
 	}
 }
 
-// Each worker gets an id and a series name which get combined for a file name and directory within the root directory defined in the Social Harvest configuration.
-func NewWorker(id int, series string) (w *Worker) {
-	os.Mkdir(logRootDir+"/"+series, 0755)
+func countLog(series string, f func(c *LogCounts)) {
+	logCountsMutex.Lock()
+	defer logCountsMutex.Unlock()
+	c, ok := logCounts[series]
+	if !ok {
+		c = &LogCounts{}
+		logCounts[series] = c
+	}
+	f(c)
+}
+
+// Returns the number of records enqueued, written, spilled and dropped for each series since the harvester started.
+func LogCountsBySeries() map[string]LogCounts {
+	logCountsMutex.Lock()
+	defer logCountsMutex.Unlock()
+	counts := map[string]LogCounts{}
+	for series, c := range logCounts {
+		counts[series] = *c
+	}
+	return counts
+}
+
+// Returns the overflow policy for each series.
+func LogOverflowPolicies() map[string]string {
+	policies := map[string]string{}
+	for series := range logChannels {
+		policies[series] = logOptions.OverflowPolicy(series)
+	}
+	return policies
+}
+
+// Each worker gets a name (its number) and a series name which get combined for a file name within the root directory defined in the Social Harvest configuration.
+func NewWorker(name string, series string) (w *Worker) {
 	return &Worker{
-		//move the root path to some config or something
-		fileRoot: logRootDir + "/" + series + "/" + strconv.Itoa(id) + "_",
-		buffer:   make([]byte, capacity),
+		name:   name,
+		series: series,
+		buffer: make([]byte, logOptions.BufferBytes),
+		flush:  make(chan flushRequest, 1),
 	}
 }
 
 // Assigns a worker to work on the given channel.
 func (w *Worker) Work(channelName chan []byte) {
+	ticker := time.NewTicker(logOptions.FlushInterval)
+	defer ticker.Stop()
 	for {
-		event := <-channelName
-		length := len(event)
-		// we run with nginx's client_max_body_size set to 2K which makes this unlikely to happen, but, just in case...
-		if length > capacity {
-			log.Println("message received was too large")
-			continue
-		}
-		if (length + w.position) > capacity {
+		select {
+		case event := <-channelName:
+			w.write(event)
+		case <-ticker.C:
+			w.Save()
+			if w.file != nil && time.Since(w.file.opened) >= logOptions.RotateInterval {
+				w.rotate()
+			}
+		case request := <-w.flush:
+			// Take whatever is waiting on the channel too, otherwise it would be left behind
+			for drained := false; !drained; {
+				select {
+				case event := <-channelName:
+					w.write(event)
+				default:
+					drained = true
+				}
+			}
 			w.Save()
+			w.rotate()
+			request.done <- true
+			if request.stop {
+				return
+			}
 		}
-		copy(w.buffer[w.position:], event)
-		w.position += length
 	}
 }
 
-// Writes the buffer to a temporary file that gets moved to it's final location. Logging is split up among multiple files by worker id and time.
+// Adds the event (and a newline) to the buffer, saving the buffer first if the event won't fit.
+func (w *Worker) write(event []byte) {
+	length := len(event) + 1
+	// we run with nginx's client_max_body_size set to 2K which makes this unlikely to happen, but, just in case...
+	if length > len(w.buffer) {
+		log.Println("message received was too large")
+		countLog(w.series, func(c *LogCounts) { c.Dropped++ })
+		return
+	}
+	if (length + w.position) > len(w.buffer) {
+		w.Save()
+	}
+	copy(w.buffer[w.position:], event)
+	w.buffer[w.position+length-1] = '\n'
+	w.position += length
+
+	now := time.Now()
+	if w.records == 0 {
+		w.from = now
+	}
+	w.to = now
+	w.records++
+}
+
+// Has every worker save what's in its buffer (and on its channel) to disk and finish the file it's writing, otherwise it would only be
+// done once the buffer is full or the file rotated. Returns false if the workers didn't all finish within the timeout. The workers carry
+// on working afterwards.
+func FlushLoggers(timeout time.Duration) bool {
+	return flushWorkers(timeout, false)
+}
+
+// Flushes the workers (see FlushLoggers()) and stops them. Nothing is logged afterwards, unless NewLoggers() is called again.
+func StopLoggers(timeout time.Duration) bool {
+	if !flushWorkers(timeout, true) {
+		return false
+	}
+	logRootDir = ""
+	logWorkers = map[string][]*Worker{}
+	return true
+}
+
+func flushWorkers(timeout time.Duration, stop bool) bool {
+	count := 0
+	for _, workers := range logWorkers {
+		count += len(workers)
+	}
+	// Buffered so a worker that finishes after the timeout doesn't get stuck
+	done := make(chan bool, count)
+	requests := 0
+	for _, workers := range logWorkers {
+		for _, w := range workers {
+			select {
+			case w.flush <- flushRequest{done: done, stop: stop}:
+				requests++
+			default:
+				// Still busy with an earlier flush that timed out
+			}
+		}
+	}
+	// Spilled records are already on disk, but the file they're in needs finishing
+	spillLock.Lock()
+	for _, w := range spillWorkers {
+		w.Save()
+		w.rotate()
+	}
+	if stop {
+		spillWorkers = map[string]*Worker{}
+	}
+	spillLock.Unlock()
+
+	deadline := time.After(timeout)
+	for i := 0; i < requests; i++ {
+		select {
+		case <-done:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
+}
+
+// Appends the buffer to the file the worker is writing to. The file is rotated if it got too big.
 func (w *Worker) Save() {
 	if w.position == 0 {
 		return
 	}
-	f, _ := ioutil.TempFile("", "logs_")
-	f.Write(w.buffer[0:w.position])
-	f.Close()
-	os.Rename(f.Name(), w.fileRoot+strconv.FormatInt(time.Now().UnixNano(), 10)+".log")
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			log.Println("Could not open a log file for " + w.series + ": " + err.Error())
+			return
+		}
+	}
+	records := w.records
+	if _, err := w.file.w.Write(w.buffer[0:w.position]); err != nil {
+		log.Println("Could not write to log file " + w.file.path + ": " + err.Error())
+	} else {
+		countLog(w.series, func(c *LogCounts) { c.Written += records })
+	}
+	w.file.bytes += w.position
+	if w.file.records == 0 {
+		w.file.from = w.from
+	}
+	w.file.to = w.to
+	w.file.records += w.records
 	w.position = 0
+	w.records = 0
+
+	if w.file.bytes >= logOptions.MaxFileBytes {
+		w.rotate()
+	}
+}
+
+func (w *Worker) open() error {
+	now := time.Now()
+	path := filepath.Join(logRootDir, workingDir, w.series+"_"+w.name+"_"+strconv.FormatInt(now.UnixNano(), 10)+".log")
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w.file = &logFile{f: f, w: f, path: path, opened: now}
+	if logOptions.Compress {
+		w.file.gz = gzip.NewWriter(f)
+		w.file.w = w.file.gz
+	}
+	return nil
+}
+
+// Closes the file the worker is writing to and moves it to its date partitioned directory, followed by its manifest.
+func (w *Worker) rotate() {
+	file := w.file
+	if file == nil {
+		return
+	}
+	w.file = nil
+	if file.gz != nil {
+		file.gz.Close()
+	}
+	file.f.Close()
+
+	dir := filepath.Join(logRootDir, w.series, file.opened.UTC().Format("2006/01/02"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Println("Could not create log directory " + dir + ": " + err.Error())
+		return
+	}
+	name := filepath.Base(file.path)
+	if file.gz != nil {
+		name += ".gz"
+	}
+	final := filepath.Join(dir, name)
+	if err := os.Rename(file.path, final); err != nil {
+		log.Println("Could not move log file " + file.path + ": " + err.Error())
+		return
+	}
+
+	if logOptions.Manifest {
+		manifest := LogManifest{
+			File:    name,
+			Series:  w.series,
+			Records: file.records,
+			Bytes:   file.bytes,
+			From:    file.from,
+			To:      file.to,
+			Gzip:    file.gz != nil,
+		}
+		if err := writeManifest(final+".manifest.json", manifest); err != nil {
+			log.Println("Could not write the manifest for log file " + final + ": " + err.Error())
+		}
+	}
+}
+
+// Writes the manifest to a temporary file first so it only ever appears complete.
+func writeManifest(path string, manifest LogManifest) error {
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(logRootDir, workingDir, fmt.Sprintf("%s.%d", filepath.Base(path), time.Now().UnixNano()))
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
 }
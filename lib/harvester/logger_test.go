@@ -0,0 +1,131 @@
+package harvester
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"github.com/SocialHarvest/harvester/lib/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Starts the log workers in a temporary directory. The returned function stops them and removes the directory.
+func startTestLoggers(t *testing.T, options LogOptions) (string, func()) {
+	dir, err := ioutil.TempDir("", "sh-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewLoggers(dir, options)
+	return dir, func() {
+		StopLoggers(5 * time.Second)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFlushLoggersWritesNewlineDelimitedFiles(t *testing.T) {
+	dir, stop := startTestLoggers(t, LogOptions{Manifest: true})
+	defer stop()
+
+	LogJson(map[string]string{"message": "hello"}, "messages")
+	LogJson(map[string]string{"message": "world"}, "messages")
+	if !FlushLoggers(5 * time.Second) {
+		t.Fatal("flushing the log workers timed out")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "messages", time.Now().UTC().Format("2006/01/02"), "*.log"))
+	records := 0
+	for _, f := range files {
+		b, _ := ioutil.ReadFile(f)
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			m := map[string]string{}
+			if err := json.Unmarshal([]byte(line), &m); err != nil {
+				t.Errorf("each line should be a JSON document, got: %s", line)
+			}
+			records++
+		}
+
+		manifest := LogManifest{}
+		b, err := ioutil.ReadFile(f + ".manifest.json")
+		if err != nil {
+			t.Fatal("there should be a manifest for " + f)
+		}
+		json.Unmarshal(b, &manifest)
+		if manifest.Series != "messages" || manifest.Records == 0 || manifest.From.IsZero() {
+			t.Errorf("unexpected manifest: %+v", manifest)
+		}
+	}
+	if records != 2 {
+		t.Errorf("expected 2 records, got %d", records)
+	}
+
+	working, _ := ioutil.ReadDir(filepath.Join(dir, workingDir))
+	if len(working) != 0 {
+		t.Errorf("there should be no working files left after a flush, got %d", len(working))
+	}
+}
+
+func TestLogFilesRotateBySizeAndCompress(t *testing.T) {
+	dir, stop := startTestLoggers(t, LogOptions{MaxFileBytes: 10, Compress: true})
+	defer stop()
+
+	// Each record is over 10 bytes, so each save rotates the file
+	LogJson(map[string]string{"message": "hello"}, "hashtags")
+	FlushLoggers(5 * time.Second)
+	LogJson(map[string]string{"message": "world"}, "hashtags")
+	FlushLoggers(5 * time.Second)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "hashtags", "*", "*", "*", "*.log.gz"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 compressed log files, got %d", len(files))
+	}
+	f, _ := os.Open(files[0])
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(gz)
+	if !strings.HasSuffix(string(b), "}\n") {
+		t.Errorf("the log file should hold newline-delimited JSON, got: %s", b)
+	}
+}
+
+func TestLogOverflowPolicies(t *testing.T) {
+	dir, stop := startTestLoggers(t, LogOptions{SeriesOverflow: map[string]string{"spilling": LogOverflowSpill}})
+	defer stop()
+	// Channels without workers (or room) are always full
+	logChannels["spilling"] = make(chan []byte)
+	logChannels["dropping"] = make(chan []byte)
+	spillWorkers["spilling"] = NewWorker("spill", "spilling")
+	defer func() {
+		delete(logChannels, "spilling")
+		delete(logChannels, "dropping")
+	}()
+
+	Log([]byte(`{"message":"hello"}`), "spilling")
+	Log([]byte(`{"message":"hello"}`), "dropping")
+	FlushLoggers(5 * time.Second)
+
+	counts := LogCountsBySeries()
+	if counts["spilling"].Spilled != 1 || counts["spilling"].Written != 1 || counts["spilling"].Dropped != 0 {
+		t.Errorf("the record should have been spilled to disk, got %+v", counts["spilling"])
+	}
+	if counts["dropping"].Dropped != 1 || counts["dropping"].Written != 0 {
+		t.Errorf("the record should have been dropped, got %+v", counts["dropping"])
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "spilling", "*", "*", "*", "spilling_spill_*.log"))
+	if len(files) != 1 {
+		t.Errorf("expected 1 spill file, got %d", len(files))
+	}
+}
+
+func TestEverySeriesIsLogged(t *testing.T) {
+	for _, series := range config.SeriesNames {
+		if _, ok := logChannels[series]; !ok {
+			t.Errorf("there should be a log channel for %s", series)
+		}
+	}
+}
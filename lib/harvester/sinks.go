@@ -0,0 +1,554 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package harvester
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/SocialHarvest/harvester/lib/config"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Harvest functions Emit() each record once and the configured sinks decide where it goes: the database, the log files, standard out, a
+// webhook, etc. Each sink works on its own with its own queue, batches, retries and filters. A sink without a queue writes records as
+// they're emitted (the database and the log files buffer on their own, so they don't need one).
+
+// Writes a batch of records from one series somewhere. Returning an error has the whole batch tried again (up to the sink's retries).
+type Sink interface {
+	Write(series string, records []interface{}) error
+}
+
+// Creates a sink from its configuration.
+type SinkFactory func(conf config.SinkConfig) (Sink, error)
+
+var sinkTypes = map[string]SinkFactory{
+	"database": newDatabaseSink,
+	"log":      newLogSink,
+	"stdout":   newStdoutSink,
+	"webhook":  newWebhookSink,
+}
+var sinkTypesLock sync.Mutex
+
+// Where harvested data goes when no sinks are configured (as it always has).
+var defaultSinks = []config.SinkConfig{
+	{Type: "database"},
+	{Type: "log"},
+}
+
+// How long to wait for the sinks being replaced by a config reload to write what they have.
+const sinkReplaceTimeout = 30 * time.Second
+
+// The number of records for a sink that were queued, written, tried again, failed (after all retries) and dropped (its queue was full).
+// Records that were filtered out aren't counted.
+type SinkCounts struct {
+	Queued  int `json:"queued"`
+	Written int `json:"written"`
+	Retried int `json:"retried"`
+	Failed  int `json:"failed"`
+	Dropped int `json:"dropped"`
+}
+
+type sinkRecord struct {
+	series string
+	record interface{}
+}
+
+// A configured sink along with its queue and counts.
+type sinkPipe struct {
+	name   string
+	conf   config.SinkConfig
+	sink   Sink
+	series map[string]bool
+	queue  chan sinkRecord
+	flush  chan flushRequest
+	// Closed to stop the worker, which closes finished once it has written what it has
+	done     chan bool
+	finished chan bool
+	stopping sync.Once
+	retries  int
+	backoff  time.Duration
+	counts   SinkCounts
+	lock     sync.Mutex
+}
+
+var sinks = []*sinkPipe{}
+var sinkConfigs []config.SinkConfig
+var sinksLock sync.RWMutex
+
+// Adds a type of sink that can be configured (replacing any existing type of the same name).
+func RegisterSink(sinkType string, factory SinkFactory) {
+	sinkTypesLock.Lock()
+	defer sinkTypesLock.Unlock()
+	sinkTypes[sinkType] = factory
+}
+
+// Sets up the sinks (the database and log files if none are configured) and starts their workers. Any sinks set up before are flushed
+// and stopped once the new ones are in place. If a sink can't be set up, the sinks are left as they were.
+func NewSinks(confs []config.SinkConfig) error {
+	if len(confs) == 0 {
+		confs = defaultSinks
+	}
+	pipes := []*sinkPipe{}
+	names := map[string]bool{}
+	for i, conf := range confs {
+		sinkTypesLock.Lock()
+		factory, ok := sinkTypes[conf.Type]
+		sinkTypesLock.Unlock()
+		if !ok {
+			return errors.New("unknown sink type \"" + conf.Type + "\"")
+		}
+		sink, err := factory(conf)
+		if err != nil {
+			return errors.New("sink " + strconv.Itoa(i) + " (" + conf.Type + "): " + err.Error())
+		}
+		p := newSinkPipe(conf, sink)
+		if names[p.name] {
+			p.name += "_" + strconv.Itoa(i)
+		}
+		names[p.name] = true
+		pipes = append(pipes, p)
+	}
+	for _, p := range pipes {
+		p.start()
+	}
+
+	sinksLock.Lock()
+	previous := sinks
+	sinks = pipes
+	sinkConfigs = confs
+	sinksLock.Unlock()
+	if !stopPipes(previous, sinkReplaceTimeout) {
+		log.Println("Timed out waiting for the replaced sinks to write, some harvested data may be lost.")
+	}
+	return nil
+}
+
+// Fills in the defaults for the sink's configuration.
+func sinkDefaults(conf config.SinkConfig) config.SinkConfig {
+	if conf.Name == "" {
+		conf.Name = conf.Type
+	}
+	if conf.QueueSize <= 0 && conf.Type != "database" && conf.Type != "log" {
+		conf.QueueSize = 1000
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 100
+	}
+	if conf.FlushSeconds <= 0 {
+		conf.FlushSeconds = 5
+	}
+	if conf.Retries == nil || *conf.Retries < 0 {
+		retries := 3
+		conf.Retries = &retries
+	}
+	if conf.RetrySeconds <= 0 {
+		conf.RetrySeconds = 1
+	}
+	if conf.Overflow == "" {
+		conf.Overflow = LogOverflowBlock
+	}
+	return conf
+}
+
+func newSinkPipe(conf config.SinkConfig, sink Sink) *sinkPipe {
+	conf = sinkDefaults(conf)
+	p := &sinkPipe{
+		name:    conf.Name,
+		conf:    conf,
+		sink:    sink,
+		retries: *conf.Retries,
+		backoff: time.Duration(conf.RetrySeconds) * time.Second,
+	}
+	if len(conf.Series) > 0 {
+		p.series = map[string]bool{}
+		for _, s := range conf.Series {
+			p.series[s] = true
+		}
+	}
+	if conf.QueueSize > 0 {
+		p.queue = make(chan sinkRecord, conf.QueueSize)
+		p.flush = make(chan flushRequest, 1)
+		p.done = make(chan bool)
+		p.finished = make(chan bool)
+	}
+	return p
+}
+
+// Sends the record (from the given series) to every sink that takes it. Every record harvested goes through here, so it's also where
+// records are counted (see HarvestedCounts()).
+func Emit(series string, record interface{}) {
+	harvestedCountsMutex.Lock()
+	harvestedCounts[series]++
+	harvestedCountsMutex.Unlock()
+
+	// Not held while emitting, a sink with a full queue would otherwise keep the sinks from being stopped (or replaced). A sink that
+	// is stopped meanwhile gives up on the record instead.
+	sinksLock.RLock()
+	pipes := sinks
+	sinksLock.RUnlock()
+	for _, p := range pipes {
+		p.emit(series, record)
+	}
+}
+
+func (p *sinkPipe) emit(series string, record interface{}) {
+	if p.series != nil && !p.series[series] {
+		return
+	}
+	if !p.keeps(record) {
+		return
+	}
+	if p.queue == nil {
+		p.write(series, []interface{}{record})
+		return
+	}
+	if p.conf.Overflow == LogOverflowDrop {
+		select {
+		case p.queue <- sinkRecord{series: series, record: record}:
+		default:
+			p.count(func(c *SinkCounts) { c.Dropped++ })
+			return
+		}
+	} else {
+		select {
+		case p.queue <- sinkRecord{series: series, record: record}:
+		case <-p.done:
+			p.count(func(c *SinkCounts) { c.Dropped++ })
+			return
+		}
+	}
+	p.count(func(c *SinkCounts) { c.Queued++ })
+}
+
+// Whether or not the record makes it through the sink's filters.
+func (p *sinkPipe) keeps(record interface{}) bool {
+	for _, f := range p.conf.Filters {
+		value, ok := fieldValue(record, f.Field)
+		if !ok {
+			continue
+		}
+		matched := false
+		for _, v := range f.Values {
+			if v == value {
+				matched = true
+				break
+			}
+		}
+		if matched == f.Exclude {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the value of a record's field (as a string) by the name it has in JSON, which is also the name used by the databases.
+func fieldValue(record interface{}, field string) (string, bool) {
+	v := reflect.Indirect(reflect.ValueOf(record))
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = t.Field(i).Name
+			}
+			if name == field && t.Field(i).PkgPath == "" {
+				return fmt.Sprint(v.Field(i).Interface()), true
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return "", false
+		}
+		value := v.MapIndex(reflect.ValueOf(field).Convert(v.Type().Key()))
+		if value.IsValid() {
+			return fmt.Sprint(value.Interface()), true
+		}
+	}
+	return "", false
+}
+
+// Writes a batch, trying again (waiting twice as long each time) if the sink fails. The batch is given up on after the last retry.
+func (p *sinkPipe) write(series string, records []interface{}) {
+	for attempt := 0; ; attempt++ {
+		err := p.sink.Write(series, records)
+		if err == nil {
+			p.count(func(c *SinkCounts) { c.Written += len(records) })
+			return
+		}
+		if attempt >= p.retries {
+			log.Println("Sink " + p.name + " could not write " + strconv.Itoa(len(records)) + " " + series + " records: " + err.Error())
+			p.count(func(c *SinkCounts) { c.Failed += len(records) })
+			return
+		}
+		p.count(func(c *SinkCounts) { c.Retried += len(records) })
+		time.Sleep(p.backoff << uint(attempt))
+	}
+}
+
+// Starts the worker that writes what's queued, in batches by series. Sinks without a queue don't need one.
+func (p *sinkPipe) start() {
+	if p.queue == nil {
+		return
+	}
+	go func() {
+		defer close(p.finished)
+		ticker := time.NewTicker(time.Duration(p.conf.FlushSeconds) * time.Second)
+		defer ticker.Stop()
+		batches := map[string][]interface{}{}
+		add := func(r sinkRecord) {
+			batches[r.series] = append(batches[r.series], r.record)
+			if len(batches[r.series]) >= p.conf.BatchSize {
+				p.write(r.series, batches[r.series])
+				delete(batches, r.series)
+			}
+		}
+		writeAll := func() {
+			for series, records := range batches {
+				p.write(series, records)
+				delete(batches, series)
+			}
+		}
+		// Takes whatever is waiting in the queue too, otherwise it would be left behind
+		drainAll := func() {
+			for drained := false; !drained; {
+				select {
+				case r := <-p.queue:
+					add(r)
+				default:
+					drained = true
+				}
+			}
+			writeAll()
+		}
+		for {
+			select {
+			case r := <-p.queue:
+				add(r)
+			case <-ticker.C:
+				writeAll()
+			case request := <-p.flush:
+				drainAll()
+				request.done <- true
+			case <-p.done:
+				drainAll()
+				// Answers a flush that was asked for meanwhile, so nothing waits on it for longer than it has to
+				select {
+				case request := <-p.flush:
+					request.done <- true
+				default:
+				}
+				return
+			}
+		}
+	}()
+}
+
+func (p *sinkPipe) count(f func(c *SinkCounts)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	f(&p.counts)
+}
+
+// Has every sink write what it has queued. Returns false if they didn't all finish within the timeout. The sinks carry on afterwards.
+func FlushSinks(timeout time.Duration) bool {
+	sinksLock.RLock()
+	pipes := sinks
+	sinksLock.RUnlock()
+	return flushPipes(pipes, timeout)
+}
+
+// Flushes the sinks (see FlushSinks()) and stops them. Records emitted afterwards go nowhere, unless NewSinks() is called again.
+func StopSinks(timeout time.Duration) bool {
+	sinksLock.Lock()
+	pipes := sinks
+	sinks = []*sinkPipe{}
+	sinkConfigs = nil
+	sinksLock.Unlock()
+	return stopPipes(pipes, timeout)
+}
+
+// Has every sink write what it has queued and stop. Returns false if they didn't all finish within the timeout, in which case the
+// workers that are still busy (ie. retrying a batch) stop once they're done.
+func stopPipes(pipes []*sinkPipe, timeout time.Duration) bool {
+	for _, p := range pipes {
+		if p.done != nil {
+			p.stopping.Do(func() { close(p.done) })
+		}
+	}
+	deadline := time.After(timeout)
+	for _, p := range pipes {
+		if p.finished == nil {
+			continue
+		}
+		select {
+		case <-p.finished:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
+}
+
+func flushPipes(pipes []*sinkPipe, timeout time.Duration) bool {
+	// Buffered so a worker that finishes after the timeout doesn't get stuck
+	done := make(chan bool, len(pipes))
+	requests := 0
+	for _, p := range pipes {
+		if p.flush == nil {
+			continue
+		}
+		select {
+		case p.flush <- flushRequest{done: done}:
+			requests++
+		default:
+			// Still busy with an earlier flush that timed out
+		}
+	}
+	deadline := time.After(timeout)
+	for i := 0; i < requests; i++ {
+		select {
+		case <-done:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the counts for each sink (by name) since it was set up.
+func SinkCountsByName() map[string]SinkCounts {
+	sinksLock.RLock()
+	defer sinksLock.RUnlock()
+	counts := map[string]SinkCounts{}
+	for _, p := range sinks {
+		p.lock.Lock()
+		counts[p.name] = p.counts
+		p.lock.Unlock()
+	}
+	return counts
+}
+
+// Stores records in the database (see StoreHarvestedData()), which waits when the database is falling behind.
+type databaseSink struct{}
+
+func newDatabaseSink(conf config.SinkConfig) (Sink, error) {
+	return databaseSink{}, nil
+}
+
+func (s databaseSink) Write(series string, records []interface{}) error {
+	for _, r := range records {
+		StoreHarvestedData(r)
+	}
+	return nil
+}
+
+// Writes records to the log files (see LogJson()).
+type logSink struct{}
+
+func newLogSink(conf config.SinkConfig) (Sink, error) {
+	return logSink{}, nil
+}
+
+func (s logSink) Write(series string, records []interface{}) error {
+	for _, r := range records {
+		LogJson(r, series)
+	}
+	return nil
+}
+
+// How records are sent by the stdout and webhook sinks, one series at a time.
+type sinkBatch struct {
+	Series  string        `json:"series"`
+	Records []interface{} `json:"records"`
+}
+
+// Writes records to standard out, each on a line of its own as a JSON document with the series and the record.
+type stdoutSink struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+func newStdoutSink(conf config.SinkConfig) (Sink, error) {
+	return &stdoutSink{w: os.Stdout}, nil
+}
+
+func (s *stdoutSink) Write(series string, records []interface{}) error {
+	var buf bytes.Buffer
+	for _, r := range records {
+		line, err := json.Marshal(map[string]interface{}{"series": series, "record": r})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+// POSTs batches of records to a URL as JSON (see sinkBatch). Any response other than a 2xx has the batch tried again.
+type webhookSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newWebhookSink(conf config.SinkConfig) (Sink, error) {
+	if conf.Url == "" {
+		return nil, errors.New("a url is required")
+	}
+	return &webhookSink{url: conf.Url, headers: conf.Headers, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (s *webhookSink) Write(series string, records []interface{}) error {
+	body, err := json.Marshal(sinkBatch{Series: series, Records: records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("webhook responded " + resp.Status)
+	}
+	return nil
+}
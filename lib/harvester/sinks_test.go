@@ -0,0 +1,207 @@
+package harvester
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/SocialHarvest/harvester/lib/config"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Keeps what's written to it, by series.
+type testSink struct {
+	records map[string][]interface{}
+	lock    sync.Mutex
+}
+
+func (s *testSink) Write(series string, records []interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.records[series] = append(s.records[series], records...)
+	return nil
+}
+
+func (s *testSink) emitted(series string) []interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.records[series]
+}
+
+func (s *testSink) count(series string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.records[series])
+}
+
+func TestEmitFansOutBySeriesAndFilters(t *testing.T) {
+	written := map[string]*testSink{}
+	RegisterSink("test", func(conf config.SinkConfig) (Sink, error) {
+		s := &testSink{records: map[string][]interface{}{}}
+		written[conf.Name] = s
+		return s, nil
+	})
+	defer StopSinks(5 * time.Second)
+
+	err := NewSinks([]config.SinkConfig{
+		{Type: "test", Name: "twitter-messages", Series: []string{"messages"}, Filters: []config.SinkFilter{{Field: "network", Values: []string{"twitter"}}}},
+		{Type: "test", Name: "not-facebook", QueueSize: 10, Filters: []config.SinkFilter{{Field: "network", Values: []string{"facebook"}, Exclude: true}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := HarvestedCounts()
+	Emit("messages", config.SocialHarvestMessage{Network: "twitter"})
+	Emit("messages", config.SocialHarvestMessage{Network: "facebook"})
+	Emit("hashtags", config.SocialHarvestHashtag{Network: "twitter"})
+	if !FlushSinks(5 * time.Second) {
+		t.Fatal("flushing the sinks timed out")
+	}
+
+	if n := written["twitter-messages"].count("messages"); n != 1 {
+		t.Errorf("expected 1 message for the twitter-messages sink, got %d", n)
+	}
+	if n := written["twitter-messages"].count("hashtags"); n != 0 {
+		t.Errorf("expected no hashtags for the twitter-messages sink, got %d", n)
+	}
+	if n := written["not-facebook"].count("messages") + written["not-facebook"].count("hashtags"); n != 2 {
+		t.Errorf("expected 2 records for the not-facebook sink, got %d", n)
+	}
+	if n := HarvestedCounts()["messages"] - before["messages"]; n != 2 {
+		t.Errorf("expected 2 messages to be counted, got %d", n)
+	}
+	counts := SinkCountsByName()
+	if counts["not-facebook"].Queued != 2 || counts["not-facebook"].Written != 2 {
+		t.Errorf("unexpected counts for the not-facebook sink: %+v", counts["not-facebook"])
+	}
+
+	if err := NewSinks([]config.SinkConfig{{Type: "nope"}}); err == nil {
+		t.Error("expected an error for an unknown type of sink")
+	}
+}
+
+func TestWebhookSinkRetries(t *testing.T) {
+	requests := 0
+	var batch sinkBatch
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&batch)
+	}))
+	defer server.Close()
+
+	conf := config.SinkConfig{Type: "webhook", Url: server.URL, QueueSize: 10}
+	sink, err := newWebhookSink(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newSinkPipe(conf, sink)
+	p.backoff = time.Millisecond
+	p.start()
+	p.emit("mentions", config.SocialHarvestMention{Network: "twitter"})
+	p.emit("mentions", config.SocialHarvestMention{Network: "twitter"})
+	if !stopPipes([]*sinkPipe{p}, 5*time.Second) {
+		t.Fatal("stopping the sink timed out")
+	}
+
+	if requests != 2 {
+		t.Errorf("expected the batch to be posted twice, got %d requests", requests)
+	}
+	if batch.Series != "mentions" || len(batch.Records) != 2 {
+		t.Errorf("unexpected batch posted: %+v", batch)
+	}
+	if p.counts.Retried != 2 || p.counts.Written != 2 || p.counts.Failed != 0 {
+		t.Errorf("unexpected counts: %+v", p.counts)
+	}
+}
+
+// Fails every write, after waiting to be let go if it's stalled.
+type stalledSink struct {
+	writes  int
+	release chan bool
+	lock    sync.Mutex
+}
+
+func (s *stalledSink) Write(series string, records []interface{}) error {
+	if s.release != nil {
+		<-s.release
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.writes++
+	return errors.New("unavailable")
+}
+
+func TestStalledSinkDoesNotHoldUpStopping(t *testing.T) {
+	sink := &stalledSink{release: make(chan bool)}
+	retries := 0
+	RegisterSink("stalled", func(conf config.SinkConfig) (Sink, error) {
+		return sink, nil
+	})
+	if err := NewSinks([]config.SinkConfig{{Type: "stalled", QueueSize: 1, BatchSize: 1, Retries: &retries}}); err != nil {
+		t.Fatal(err)
+	}
+	sinksLock.RLock()
+	p := sinks[0]
+	sinksLock.RUnlock()
+
+	// The first record is taken by the (stalled) worker and the second fills the queue, so the third waits for room
+	emitted := make(chan bool)
+	go func() {
+		for i := 0; i < 3; i++ {
+			Emit("mentions", config.SocialHarvestMention{Network: "twitter"})
+		}
+		emitted <- true
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan bool)
+	go func() {
+		stopped <- StopSinks(50 * time.Millisecond)
+	}()
+	select {
+	case ok := <-stopped:
+		if ok {
+			t.Error("expected stopping the stalled sink to time out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopping the sinks waited on the stalled sink")
+	}
+	select {
+	case <-emitted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("emitting to the stopped sink never gave up")
+	}
+
+	// Once the sink comes back the worker finishes up and stops
+	close(sink.release)
+	select {
+	case <-p.finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the worker didn't stop once the sink came back")
+	}
+}
+
+func TestSinkWithoutRetries(t *testing.T) {
+	retries := 0
+	sink := &stalledSink{}
+	// Without a queue, so it's written right away
+	p := newSinkPipe(config.SinkConfig{Type: "database", Retries: &retries}, sink)
+	p.emit("mentions", config.SocialHarvestMention{Network: "twitter"})
+
+	if sink.writes != 1 {
+		t.Errorf("expected the record to be written once, got %d writes", sink.writes)
+	}
+	if p.counts.Retried != 0 || p.counts.Failed != 1 {
+		t.Errorf("unexpected counts: %+v", p.counts)
+	}
+	if p := newSinkPipe(config.SinkConfig{Type: "stalled"}, sink); p.retries != 3 {
+		t.Errorf("expected 3 retries by default, got %d", p.retries)
+	}
+}
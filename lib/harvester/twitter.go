@@ -34,7 +34,7 @@ func NewTwitter(servicesConfig config.ServicesConfig) {
 
 // If the territory has different keys to use
 func NewTwitterTerritoryCredentials(territory string) {
-	for _, t := range harvestConfig.Territories {
+	for _, t := range currentHarvestConfig().Territories {
 		if t.Name == territory {
 			if t.Services.Twitter.ApiKey != "" && t.Services.Twitter.ApiSecret != "" && t.Services.Twitter.AccessToken != "" && t.Services.Twitter.AccessTokenSecret != "" {
 				anaconda.SetConsumerKey(t.Services.Twitter.ApiKey)
@@ -59,7 +59,8 @@ func NewTwitterTerritoryCredentials(territory string) {
 // Always passed in first (always): the territory name, and the position in the harvest (HarvestState) ... the rest are going to vary based on the API but typically are the query and options
 // @return options(for pagination), count of items, last id, last time.
 func TwitterSearch(territoryName string, harvestState config.HarvestState, query string, options url.Values) (url.Values, config.HarvestState) {
-	searchResults, _ := services.twitter.GetSearch(query, options)
+	searchResults, err := services.twitter.GetSearch(query, options)
+	harvestState.Error = err
 	// The cool thing about Twitter's API is that we have all the user data we need already. So we make less HTTP requests than when using Facebook's API.
 	for _, tweet := range searchResults.Statuses {
 		//log.Println(tweet)
@@ -161,13 +162,13 @@ func TwitterSearch(territoryName string, harvestState config.HarvestState, query
 				ContributorType:           contributorType,
 				Message:                   tweet.Text,
 				Sentiment:                 services.sentimentAnalyzer.Classify(tweet.Text),
-				IsQuestion:                Btoi(IsQuestion(tweet.Text, harvestConfig.QuestionRegex)),
+				IsQuestion:                Btoi(IsQuestion(tweet.Text, currentHarvestConfig().QuestionRegex)),
 				MessageId:                 tweet.IdStr,
 				TwitterRetweetCount:       tweet.RetweetCount,
 				TwitterFavoriteCount:      tweet.FavoriteCount,
 			}
-			go StoreHarvestedData(message)
-			LogJson(message, "messages")
+			Emit("messages", message)
+			Emit("message_engagement", message.Engagement(time.Now()))
 
 			// Keywords are stored on the same collection as hashtags - but under a `keyword` field instead of `tag` field as to not confuse the two.
 			// Keywords are found across every network, whereas hashtags are only found on a few.
@@ -201,8 +202,7 @@ func TwitterSearch(territoryName string, harvestState config.HarvestState, query
 							ContributorCountry:        contributorCountry,
 							Keyword:                   keyword,
 						}
-						StoreHarvestedData(hashtag)
-						LogJson(hashtag, "hashtags")
+						Emit("hashtags", hashtag)
 					}
 				}
 			}
@@ -241,8 +241,7 @@ func TwitterSearch(territoryName string, harvestState config.HarvestState, query
 							ExpandedUrl:               link.Expanded_url,
 							Host:                      linkHostName,
 						}
-						StoreHarvestedData(sharedLink)
-						LogJson(sharedLink, "shared_links")
+						Emit("shared_links", sharedLink)
 					}
 				}
 			}
@@ -282,8 +281,7 @@ func TwitterSearch(territoryName string, harvestState config.HarvestState, query
 							Type:                      media.Type,
 							Source:                    media.Media_url,
 						}
-						StoreHarvestedData(sharedMedia)
-						LogJson(sharedMedia, "shared_links")
+						Emit("shared_links", sharedMedia)
 					}
 				}
 			}
@@ -315,8 +313,7 @@ func TwitterSearch(territoryName string, harvestState config.HarvestState, query
 							ContributorCountry:        contributorCountry,
 							Tag:                       tag.Text,
 						}
-						StoreHarvestedData(hashtag)
-						LogJson(hashtag, "hashtags")
+						Emit("hashtags", hashtag)
 					}
 				}
 			}
@@ -348,8 +345,7 @@ func TwitterSearch(territoryName string, harvestState config.HarvestState, query
 							MentionedScreenName: mentionedUser.Screen_name,
 							MentionedName:       mentionedUser.Name,
 						}
-						StoreHarvestedData(mention)
-						LogJson(mention, "mentions")
+						Emit("mentions", mention)
 					}
 				}
 			}
@@ -366,7 +362,8 @@ func TwitterSearch(territoryName string, harvestState config.HarvestState, query
 // Harvests from a specific Twitter account stream
 func TwitterAccountStream(territoryName string, harvestState config.HarvestState, options url.Values) (url.Values, config.HarvestState) {
 
-	searchResults, _ := services.twitter.GetUserTimeline(options)
+	searchResults, err := services.twitter.GetUserTimeline(options)
+	harvestState.Error = err
 	// The cool thing about Twitter's API is that we have all the user data we need already. So we make less HTTP requests than when using Facebook's API.
 	for _, tweet := range searchResults {
 		//log.Println(tweet)
@@ -463,14 +460,14 @@ func TwitterAccountStream(territoryName string, harvestState config.HarvestState
 				ContributorGender:         contributorGender,
 				ContributorType:           contributorType,
 				Message:                   tweet.Text,
-				IsQuestion:                Btoi(IsQuestion(tweet.Text, harvestConfig.QuestionRegex)),
+				IsQuestion:                Btoi(IsQuestion(tweet.Text, currentHarvestConfig().QuestionRegex)),
 				MessageId:                 tweet.IdStr,
 				TwitterRetweetCount:       tweet.RetweetCount,
 				TwitterFavoriteCount:      tweet.FavoriteCount,
 			}
 			// Send to the harvester observer
-			StoreHarvestedData(message)
-			LogJson(message, "messages")
+			Emit("messages", message)
+			Emit("message_engagement", message.Engagement(time.Now()))
 
 			// shared links
 			if len(tweet.Entities.Urls) > 0 {
@@ -508,8 +505,7 @@ func TwitterAccountStream(territoryName string, harvestState config.HarvestState
 							Host:                      linkHostName,
 						}
 						// Send to the harvester observer
-						StoreHarvestedData(sharedLink)
-						LogJson(sharedLink, "shared_links")
+						Emit("shared_links", sharedLink)
 					}
 				}
 			}
@@ -551,8 +547,7 @@ func TwitterAccountStream(territoryName string, harvestState config.HarvestState
 							Source:                    media.Media_url,
 						}
 						// Send to the harvester observer
-						StoreHarvestedData(sharedMedia)
-						LogJson(sharedMedia, "shared_links")
+						Emit("shared_links", sharedMedia)
 					}
 				}
 			}
@@ -586,8 +581,7 @@ func TwitterAccountStream(territoryName string, harvestState config.HarvestState
 							Tag:                       tag.Text,
 						}
 						// Send to the harvester observer
-						StoreHarvestedData(hashtag)
-						LogJson(hashtag, "hashtags")
+						Emit("hashtags", hashtag)
 					}
 				}
 			}
@@ -621,8 +615,7 @@ func TwitterAccountStream(territoryName string, harvestState config.HarvestState
 							MentionedName:       mentionedUser.Name,
 						}
 						// Send to the harvester observer
-						StoreHarvestedData(mention)
-						LogJson(mention, "mentions")
+						Emit("mentions", mention)
 					}
 				}
 			}
@@ -636,14 +629,18 @@ func TwitterAccountStream(territoryName string, harvestState config.HarvestState
 	return options, harvestState
 }
 
-// Harvests Twitter account details to track changes in followers, etc.
-func TwitterAccountDetails(territoryName string, account string) {
+// Harvests Twitter account details to track changes in followers, etc. Returns the API's error if the account couldn't be looked up.
+func TwitterAccountDetails(territoryName string, account string) error {
 	params := url.Values{}
 	var contributor anaconda.User
-	if accountId, err := strconv.Atoi(account); err == nil {
-		contributor, _ = services.twitter.GetUsersShowById(int64(accountId), params)
+	var err error
+	if accountId, convErr := strconv.Atoi(account); convErr == nil {
+		contributor, err = services.twitter.GetUsersShowById(int64(accountId), params)
 	} else {
-		contributor, _ = services.twitter.GetUsersShow(account, params)
+		contributor, err = services.twitter.GetUsersShow(account, params)
+	}
+	if err != nil {
+		return err
 	}
 
 	now := time.Now()
@@ -662,7 +659,48 @@ func TwitterAccountDetails(territoryName string, account string) {
 		Listed:        int(contributor.ListedCount),
 		Favorites:     int(contributor.FavouritesCount),
 	}
-	StoreHarvestedData(row)
-	LogJson(row, "contributor_growth")
-	return
+	Emit("contributor_growth", row)
+	return nil
+}
+
+// Looks up the retweet and favorite counts of tweets that were already harvested (100 at a time) and stores them in the message_engagement
+// series. Returns the number of tweets found and the API calls made.
+func TwitterEngagement(messages []config.SocialHarvestMessage) (int, int) {
+	found := 0
+	calls := 0
+	for start := 0; start < len(messages); start += 100 {
+		end := start + 100
+		if end > len(messages) {
+			end = len(messages)
+		}
+		byId := map[string]config.SocialHarvestMessage{}
+		ids := []int64{}
+		for _, m := range messages[start:end] {
+			if id, err := strconv.ParseInt(m.MessageId, 10, 64); err == nil {
+				ids = append(ids, id)
+				byId[m.MessageId] = m
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		params := url.Values{}
+		params.Set("include_entities", "false")
+		tweets, err := services.twitter.GetTweetsLookupByIds(ids, params)
+		calls++
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		now := time.Now()
+		for _, tweet := range tweets {
+			if m, ok := byId[tweet.IdStr]; ok {
+				m.TwitterRetweetCount = tweet.RetweetCount
+				m.TwitterFavoriteCount = tweet.FavoriteCount
+				Emit("message_engagement", m.Engagement(now))
+				found++
+			}
+		}
+	}
+	return found, calls
 }
@@ -0,0 +1,56 @@
+package harvester
+
+import (
+	"github.com/SocialHarvest/harvester/lib/config"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTwitterSearch(t *testing.T) {
+	NewTwitter(testServicesConfig(t))
+	defer useCassette(t, "twitter_search")()
+	emitted, stop := captureEmitted(t)
+	defer stop()
+
+	params := url.Values{}
+	params.Set("include_entities", "true")
+	params.Set("count", "2")
+	_, harvestState := TwitterSearch("javascript", config.HarvestState{}, "golang", params)
+
+	if harvestState.ItemsHarvested != 2 {
+		t.Fatalf("expected 2 tweets to be harvested, got %d", harvestState.ItemsHarvested)
+	}
+	if harvestState.LastId != "522837413544165376" {
+		t.Errorf("expected the most recent tweet id to be kept, got %s", harvestState.LastId)
+	}
+	if harvestState.LastTime.Unix() != 1413403451 {
+		t.Errorf("expected the most recent tweet time to be kept, got %s", harvestState.LastTime)
+	}
+
+	if !FlushSinks(5 * time.Second) {
+		t.Fatal("flushing the sinks timed out")
+	}
+	messages := emitted.emitted("messages")
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages to be emitted, got %d", len(messages))
+	}
+	message := messages[0].(config.SocialHarvestMessage)
+	if message.MessageId != "522837413544165376" || message.ContributorScreenName != "enneff" || message.ContributorFollowers != 14232 || message.TwitterRetweetCount != 7 || message.TwitterFavoriteCount != 12 {
+		t.Errorf("unexpected message: %+v", message)
+	}
+	if engagement := emitted.emitted("message_engagement"); len(engagement) != 2 || engagement[0].(config.SocialHarvestMessageEngagement).HarvestId != message.HarvestId {
+		t.Errorf("expected the engagement of each message to be emitted, got %+v", engagement)
+	}
+	if !emittedTag(emitted, "golang") {
+		t.Error("expected the #golang hashtag to be emitted")
+	}
+	mentions := emitted.emitted("mentions")
+	if len(mentions) != 1 || mentions[0].(config.SocialHarvestMention).MentionedScreenName != "golang" {
+		t.Errorf("expected the mention of @golang to be emitted, got %+v", mentions)
+	}
+	links := emitted.emitted("shared_links")
+	if len(links) != 1 || links[0].(config.SocialHarvestSharedLink).ExpandedUrl != "http://talks.golang.org/2012/concurrency.slide" {
+		t.Errorf("expected the expanded link to be emitted, got %+v", links)
+	}
+}
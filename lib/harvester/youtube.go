@@ -40,7 +40,7 @@ func NewYouTube(servicesConfig config.ServicesConfig) {
 
 // If the territory has different keys to use
 func NewYouTubeTerritoryCredentials(territory string) {
-	for _, t := range harvestConfig.Territories {
+	for _, t := range currentHarvestConfig().Territories {
 		if t.Name == territory {
 			if t.Services.Google.ServerKey != "" {
 				client := &http.Client{
@@ -58,7 +58,8 @@ func NewYouTubeTerritoryCredentials(territory string) {
 }
 
 // Harvests YouTube channel details to track changes in subscribers. (in theory this could be a comma separated list of account names)
-func YouTubeAccountDetails(territoryName string, account string) {
+// Returns the API's error if the channel couldn't be looked up.
+func YouTubeAccountDetails(territoryName string, account string) error {
 	channelListResp, err := services.youTube.Channels.List("statistics").ForUsername(account).Do()
 	if err == nil {
 		now := time.Now()
@@ -77,11 +78,10 @@ func YouTubeAccountDetails(territoryName string, account string) {
 				StatusUpdates: int(c.Statistics.VideoCount),
 				Views:         int(c.Statistics.ViewCount),
 			}
-			StoreHarvestedData(row)
-			LogJson(row, "contributor_growth")
+			Emit("contributor_growth", row)
 		}
 	}
-	return
+	return err
 }
 
 // Example API calls (TODO: Figure out what to gather in the future)
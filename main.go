@@ -22,56 +22,322 @@ import (
 	"github.com/SocialHarvest/harvester/lib/config"
 	"github.com/SocialHarvest/harvester/lib/harvester"
 	"github.com/SocialHarvestVendors/color"
+	"github.com/SocialHarvestVendors/cron"
 	"github.com/SocialHarvestVendors/go-json-rest/rest"
 	"github.com/bugsnag/bugsnag-go"
 	"log"
 	"net/http"
 	//_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"reflect"
 	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var appVersion = "0.16.1-alpha"
 var confFile string
-var socialHarvest = config.SocialHarvest{}
+var socialHarvest = config.SocialHarvest{Budgets: config.NewBudgetTracker()}
 
 // --------- Route functions for the harvester API (which allows for the configuration of the harvester after it is up and running as well as various statistics about the harvester)
 
 // API: Shows the harvest schedule as currently configured
 func ShowSchedule(w rest.ResponseWriter, r *rest.Request) {
-	res := config.NewHypermediaResource()
-	res.AddCurie("schedule", "/docs/rels/{rel}", true)
+	res := setScheduleLinks("self")
 
-	res.Links["self"] = config.HypermediaLink{
-		Href: "/schedule/read",
-	}
-	res.Links["schedule:add"] = config.HypermediaLink{
-		Href: "/schedule/add",
-	}
-	res.Links["schedule:delete"] = config.HypermediaLink{
-		Href:      "/schedule/delete/{id}",
-		Templated: true,
+	// The cron knows when jobs last ran and will run next
+	entries := map[string]*cron.Entry{}
+	for _, item := range socialHarvest.Schedule.Cron.Entries() {
+		entries[item.Name] = item
 	}
 
 	jobs := []map[string]interface{}{}
-	for _, item := range socialHarvest.Schedule.Cron.Entries() {
+	for _, job := range socialHarvest.Schedule.Jobs() {
 		m := make(map[string]interface{})
-		m["id"] = item.Id
-		m["name"] = item.Name
-		m["next"] = item.Next
-		m["prev"] = item.Prev
-		m["job"] = getFunctionName(item.Job)
+		m["id"] = job.Id
+		m["name"] = job.Name()
+		m["territory"] = job.Territory
+		m["network"] = job.Network
+		m["action"] = job.Action
+		m["spec"] = job.Spec
+		m["paused"] = job.Paused
+		m["source"] = job.Source
+		m["overlap"] = job.Overlap
+		m["running"] = socialHarvest.Schedule.Running(job.Id)
+		if entry, ok := entries[job.Name()]; ok {
+			m["next"] = entry.Next
+			m["prev"] = entry.Prev
+		}
 		jobs = append(jobs, m)
 	}
 	res.Data["totalJobs"] = len(jobs)
 	res.Data["jobs"] = jobs
+	// How often keywords and accounts are harvested for territories with adaptive scheduling
+	res.Data["adaptive"] = socialHarvest.Schedule.Adaptive.Keys()
 
 	res.Success()
 	w.WriteJson(res.End("There are " + strconv.Itoa(len(jobs)) + " jobs scheduled."))
 }
 
+// API: Adds a job to the schedule. Expects JSON with "territory", "network", "action" and "spec" (a cron expression) and optionally
+// "overlap" ("skip", "queue" or "allow").
+func AddScheduledJob(w rest.ResponseWriter, r *rest.Request) {
+	res := setScheduleLinks("schedule:add")
+
+	job := config.ScheduledJob{}
+	err := r.DecodeJsonPayload(&job)
+	if err != nil {
+		res.Meta.Message = "Invalid job."
+		w.WriteJson(res.End())
+		return
+	}
+	if len(harvestFunctions[job.Network][job.Action]) == 0 {
+		res.Meta.Message = "There is nothing to harvest for " + job.Network + " " + job.Action + "."
+		w.WriteJson(res.End())
+		return
+	}
+	job.Source = config.ScheduleSourceApi
+	job, err = socialHarvest.Schedule.AddJob(job)
+	if err != nil {
+		res.Meta.Message = "Could not add the job: " + err.Error()
+		w.WriteJson(res.End())
+		return
+	}
+
+	res.Data["job"] = job
+	res.Data["nextRuns"], _ = config.NextRuns(job.Spec, time.Now(), 5)
+	res.Success()
+	w.WriteJson(res.End("Job added."))
+}
+
+// API: Removes a job from the schedule
+func DeleteScheduledJob(w rest.ResponseWriter, r *rest.Request) {
+	res := setScheduleLinks("schedule:delete")
+	err := socialHarvest.Schedule.RemoveJob(r.PathParam("id"))
+	if err != nil {
+		res.Meta.Message = err.Error()
+		w.WriteJson(res.End())
+		return
+	}
+	res.Success()
+	w.WriteJson(res.End("Job removed."))
+}
+
+// API: Pauses a job, it stays on the schedule but won't run until resumed
+func PauseScheduledJob(w rest.ResponseWriter, r *rest.Request) {
+	res := setScheduleLinks("schedule:pause")
+	job, err := socialHarvest.Schedule.PauseJob(r.PathParam("id"), true)
+	if err != nil {
+		res.Meta.Message = err.Error()
+		w.WriteJson(res.End())
+		return
+	}
+	res.Data["job"] = job
+	res.Success()
+	w.WriteJson(res.End("Job paused."))
+}
+
+// API: Resumes a paused job
+func ResumeScheduledJob(w rest.ResponseWriter, r *rest.Request) {
+	res := setScheduleLinks("schedule:resume")
+	job, err := socialHarvest.Schedule.PauseJob(r.PathParam("id"), false)
+	if err != nil {
+		res.Meta.Message = err.Error()
+		w.WriteJson(res.End())
+		return
+	}
+	res.Data["job"] = job
+	res.Success()
+	w.WriteJson(res.End("Job resumed."))
+}
+
+// API: Runs a job right away (in the background), paused or not
+func TriggerScheduledJob(w rest.ResponseWriter, r *rest.Request) {
+	res := setScheduleLinks("schedule:trigger")
+	job, err := socialHarvest.Schedule.TriggerJob(r.PathParam("id"))
+	if err != nil {
+		res.Meta.Message = err.Error()
+		w.WriteJson(res.End())
+		return
+	}
+	res.Data["job"] = job
+	res.Success()
+	w.WriteJson(res.End("Job triggered."))
+}
+
+// API: Validates a cron expression and shows when it would run next. Takes "spec" and optionally "count" (default 5, up to 100).
+func PreviewSchedule(w rest.ResponseWriter, r *rest.Request) {
+	res := setScheduleLinks("schedule:preview")
+
+	queryParams := r.URL.Query()
+	count := 5
+	if c, err := strconv.Atoi(queryParams.Get("count")); err == nil && c > 0 && c <= 100 {
+		count = c
+	}
+	runs, err := config.NextRuns(queryParams.Get("spec"), time.Now(), count)
+	if err != nil {
+		res.Data["valid"] = false
+		res.Meta.Message = "Invalid cron expression: " + err.Error()
+		w.WriteJson(res.End())
+		return
+	}
+	res.Data["valid"] = true
+	res.Data["spec"] = queryParams.Get("spec")
+	res.Data["nextRuns"] = runs
+	res.Success()
+	w.WriteJson(res.End())
+}
+
+// Sets the hypermedia response "_links" section with all of the routes we have defined for the schedule.
+func setScheduleLinks(self string) *config.HypermediaResource {
+	res := config.NewHypermediaResource()
+	res.AddCurie("schedule", "/docs/rels/{rel}", true)
+
+	links := map[string]config.HypermediaLink{
+		"self":             config.HypermediaLink{Href: "/schedule/read"},
+		"schedule:add":     config.HypermediaLink{Href: "/schedule/add"},
+		"schedule:delete":  config.HypermediaLink{Href: "/schedule/delete/{id}", Templated: true},
+		"schedule:pause":   config.HypermediaLink{Href: "/schedule/pause/{id}", Templated: true},
+		"schedule:resume":  config.HypermediaLink{Href: "/schedule/resume/{id}", Templated: true},
+		"schedule:trigger": config.HypermediaLink{Href: "/schedule/trigger/{id}", Templated: true},
+		"schedule:preview": config.HypermediaLink{Href: "/schedule/preview{?spec,count}", Templated: true},
+	}
+	for link, l := range links {
+		if link == self {
+			res.Links["self"] = l
+		} else if link == "self" {
+			res.Links["schedule:read"] = l
+		} else {
+			res.Links[link] = l
+		}
+	}
+	return res
+}
+
+// API: Shows the harvesters in the cluster and which one harvests each territory (or territory and network)
+func ShowCluster(w rest.ResponseWriter, r *rest.Request) {
+	res := config.NewHypermediaResource()
+	res.Links["self"] = config.HypermediaLink{
+		Href: "/cluster/read",
+	}
+	cluster := socialHarvest.Cluster
+
+	ownership := []map[string]string{}
+	for _, territory := range currentConfig().Harvest.Territories {
+		if cluster.ShardBy() == config.ShardByNetwork {
+			for _, network := range config.ScheduleNetworks {
+				ownership = append(ownership, map[string]string{"territory": territory.Name, "network": network, "node": cluster.Owner(territory.Name, network)})
+			}
+		} else {
+			ownership = append(ownership, map[string]string{"territory": territory.Name, "node": cluster.Owner(territory.Name, "")})
+		}
+	}
+
+	res.Data["enabled"] = cluster.Enabled()
+	res.Data["node"] = cluster.NodeId
+	res.Data["shardBy"] = cluster.ShardBy()
+	res.Data["nodes"] = cluster.Nodes()
+	res.Data["ownership"] = ownership
+	res.Success()
+	w.WriteJson(res.End())
+}
+
+// API: Shows what each territory spent of its budgets (API calls and items harvested) this hour and today and what's left
+func ShowBudgets(w rest.ResponseWriter, r *rest.Request) {
+	res := config.NewHypermediaResource()
+	res.Links["self"] = config.HypermediaLink{
+		Href: "/budget/read",
+	}
+
+	budgets := []config.BudgetStatus{}
+	for _, territory := range currentConfig().Harvest.Territories {
+		for _, network := range config.ScheduleNetworks {
+			if _, ok := territory.BudgetFor(network); ok {
+				budgets = append(budgets, socialHarvest.Budgets.Status(territory, network, time.Now()))
+			}
+		}
+	}
+	res.Data["budgets"] = budgets
+	res.Success()
+	w.WriteJson(res.End())
+}
+
+// API: Shows how many records were logged (enqueued, written, spilled to disk and dropped) for each series and what happens when a series' log workers can't keep up, along with the counts for each sink
+func ShowLogStats(w rest.ResponseWriter, r *rest.Request) {
+	res := config.NewHypermediaResource()
+	res.Links["self"] = config.HypermediaLink{
+		Href: "/logs/stats",
+	}
+	res.Data["series"] = harvester.LogCountsBySeries()
+	res.Data["overflow"] = harvester.LogOverflowPolicies()
+	res.Data["sinks"] = harvester.SinkCountsByName()
+	res.Success()
+	w.WriteJson(res.End())
+}
+
+// API: Queues a harvest of a territory for a network and action (optionally for just one keyword or account) and returns the run to poll
+func StartHarvest(w rest.ResponseWriter, r *rest.Request) {
+	res := config.NewHypermediaResource()
+	res.Links["self"] = config.HypermediaLink{
+		Href: "/harvest",
+	}
+	res.Links["harvest:read"] = config.HypermediaLink{
+		Href:      "/harvest/{id}",
+		Templated: true,
+	}
+
+	request := struct {
+		Territory string `json:"territory"`
+		Network   string `json:"network"`
+		Action    string `json:"action"`
+		Value     string `json:"value"`
+	}{}
+	err := r.DecodeJsonPayload(&request)
+	if err != nil {
+		res.Meta.Message = "Invalid harvest request."
+		w.WriteJson(res.End())
+		return
+	}
+	run, err := startHarvestRun(request.Territory, request.Network, request.Action, request.Value)
+	if err != nil {
+		res.Meta.Message = "Could not start the harvest: " + err.Error()
+		w.WriteJson(res.End())
+		return
+	}
+
+	res.Links["harvest:read"] = config.HypermediaLink{
+		Href: "/harvest/" + run.Id,
+	}
+	res.Data["run"] = run
+	res.Success()
+	w.WriteJson(res.End("Harvest queued."))
+}
+
+// API: Shows the status and progress of a harvest started with StartHarvest()
+func ShowHarvestRun(w rest.ResponseWriter, r *rest.Request) {
+	res := config.NewHypermediaResource()
+	res.Links["self"] = config.HypermediaLink{
+		Href: "/harvest/" + r.PathParam("id"),
+	}
+	res.Links["harvest:start"] = config.HypermediaLink{
+		Href: "/harvest",
+	}
+
+	run, ok := harvestRun(r.PathParam("id"))
+	if !ok {
+		res.Meta.Message = "Harvest run not found."
+		w.WriteJson(res.End())
+		return
+	}
+	res.Data["run"] = run
+	res.Success()
+	w.WriteJson(res.End())
+}
+
 // API: Shows the current harvester configuration
 func ShowSocialHarvestConfig(w rest.ResponseWriter, r *rest.Request) {
 	res := config.NewHypermediaResource()
@@ -84,7 +350,7 @@ func ShowSocialHarvestConfig(w rest.ResponseWriter, r *rest.Request) {
 	res.Links["write"] = config.HypermediaLink{
 		Href: "/config/write",
 	}
-	res.Data["config"] = socialHarvest.Config.Harvest
+	res.Data["config"] = currentConfig().Harvest
 	res.Success()
 	w.WriteJson(res.End())
 }
@@ -110,10 +376,14 @@ func ReloadSocialHarvestConfig(w rest.ResponseWriter, r *rest.Request) {
 		original = true
 		res.Meta.Message = "Original configuration loaded."
 	}
-	setConfig(original)
+	if err := setConfig(original); err != nil {
+		res.Meta.Message = "Could not reload the configuration: " + err.Error()
+		w.WriteJson(res.End())
+		return
+	}
 
 	// Return the updated config
-	res.Data["config"] = socialHarvest.Config.Harvest
+	res.Data["config"] = currentConfig().Harvest
 	res.Success()
 	w.WriteJson(res.End())
 }
@@ -157,20 +427,147 @@ func DatabaseInfo(w rest.ResponseWriter, r *rest.Request) {
 		Href: "/database/info",
 	}
 
-	if socialHarvest.Database.Postgres != nil {
-		res.Data["type"] = "postgres"
+	snapshot, done := useConfig()
+	defer done()
+	if snapshot.Database.Store != nil {
+		res.Data["type"] = snapshot.Database.Type
 		// SELECT * FROM has_database_privilege('username', 'database', 'connect');
 		// var r struct {
 		// 	hasAccess string `db:"has_database_privilege" json:"has_database_privilege"`
 		// }
-		//err := socialHarvest.Database.Postgres.Get(&r, "SELECT * FROM has_database_privilege("+socialHarvest.Config.Database.User+", "+socialHarvest.Config.Database.Database+", 'connect')")
+		//err := snapshot.Database.Postgres.Get(&r, "SELECT * FROM has_database_privilege("+snapshot.Config.Database.User+", "+snapshot.Config.Database.Database+", 'connect')")
 		//res.Data["r"] = r
 		//res.Data["err"] = err
-		res.Data["hasAccess"] = socialHarvest.Database.HasAccess()
+		res.Data["hasAccess"] = snapshot.Database.HasAccess()
+		res.Data["writes"] = snapshot.Database.WriteCounts()
+		res.Data["retention"] = snapshot.Database.RetentionReports()
+	}
+
+	res.Data["configuredType"] = snapshot.Config.Database.Type
+	res.Data["availableTypes"] = config.StorageTypes()
+
+	res.Success()
+	w.WriteJson(res.End())
+}
+
+// The settings routes let the dashboard (or anything else) keep its configuration in the database. Settings are changed or deleted
+// with the "modified" time they were read with, if they were changed in the meantime a 409 (conflict) is returned.
+func setSettingsLinks(self string) *config.HypermediaResource {
+	res := config.NewHypermediaResource()
+	res.AddCurie("settings", "/docs/rels/{rel}", true)
+
+	links := map[string]config.HypermediaLink{
+		"self":             config.HypermediaLink{Href: "/settings/read"},
+		"settings:get":     config.HypermediaLink{Href: "/settings/read/{key}", Templated: true},
+		"settings:write":   config.HypermediaLink{Href: "/settings/write/{key}", Templated: true},
+		"settings:delete":  config.HypermediaLink{Href: "/settings/delete/{key}{?modified}", Templated: true},
+		"settings:history": config.HypermediaLink{Href: "/settings/history/{key}", Templated: true},
 	}
+	for link, l := range links {
+		if link == self {
+			res.Links["self"] = l
+		} else if link == "self" {
+			res.Links["settings:read"] = l
+		} else {
+			res.Links[link] = l
+		}
+	}
+	return res
+}
 
-	res.Data["configuredType"] = socialHarvest.Config.Database.Type
+// Writes a settings error, with the matching status code for missing settings and conflicting changes.
+func settingsError(w rest.ResponseWriter, res *config.HypermediaResource, err error) {
+	res.Meta.Message = err.Error()
+	switch err {
+	case config.ErrSettingsNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	case config.ErrSettingsConflict:
+		w.WriteHeader(http.StatusConflict)
+	}
+	w.WriteJson(res.End())
+}
 
+// API: Lists the keys of all the settings (and when they were modified)
+func ListSettings(w rest.ResponseWriter, r *rest.Request) {
+	res := setSettingsLinks("self")
+	snapshot, done := useConfig()
+	defer done()
+	settings, err := snapshot.Database.ListSettings()
+	if err != nil {
+		settingsError(w, res, err)
+		return
+	}
+	res.Data["settings"] = settings
+	res.Success()
+	w.WriteJson(res.End())
+}
+
+// API: Returns the settings for a key
+func ShowSettings(w rest.ResponseWriter, r *rest.Request) {
+	res := setSettingsLinks("settings:get")
+	snapshot, done := useConfig()
+	defer done()
+	settings, err := snapshot.Database.GetSettings(r.PathParam("key"))
+	if err != nil {
+		settingsError(w, res, err)
+		return
+	}
+	res.Data["settings"] = settings
+	res.Success()
+	w.WriteJson(res.End())
+}
+
+// API: Saves the settings for a key. Expects JSON with the "value" and the "modified" time the settings were read with (left out for new settings).
+func WriteSettings(w rest.ResponseWriter, r *rest.Request) {
+	res := setSettingsLinks("settings:write")
+	settings := config.Settings{}
+	if err := r.DecodeJsonPayload(&settings); err != nil {
+		res.Meta.Message = "Invalid settings."
+		w.WriteJson(res.End())
+		return
+	}
+	snapshot, done := useConfig()
+	defer done()
+	settings, err := snapshot.Database.PutSettings(r.PathParam("key"), settings.Value, settings.Modified)
+	if err != nil {
+		settingsError(w, res, err)
+		return
+	}
+	res.Data["settings"] = settings
+	res.Success()
+	w.WriteJson(res.End("Settings saved."))
+}
+
+// API: Deletes the settings for a key. Takes the "modified" time the settings were read with.
+func DeleteSettings(w rest.ResponseWriter, r *rest.Request) {
+	res := setSettingsLinks("settings:delete")
+	modified, err := time.Parse(time.RFC3339, r.URL.Query().Get("modified"))
+	if err != nil {
+		res.Meta.Message = "The time the settings were modified is required."
+		w.WriteJson(res.End())
+		return
+	}
+	snapshot, done := useConfig()
+	defer done()
+	if err := snapshot.Database.DeleteSettings(r.PathParam("key"), modified); err != nil {
+		settingsError(w, res, err)
+		return
+	}
+	res.Success()
+	w.WriteJson(res.End("Settings deleted."))
+}
+
+// API: Returns every version of the settings for a key, newest first
+func ShowSettingsHistory(w rest.ResponseWriter, r *rest.Request) {
+	res := setSettingsLinks("settings:history")
+	snapshot, done := useConfig()
+	defer done()
+	history, err := snapshot.Database.SettingsHistory(r.PathParam("key"))
+	if err != nil {
+		settingsError(w, res, err)
+		return
+	}
+	res.Data["history"] = history
 	res.Success()
 	w.WriteJson(res.End())
 }
@@ -178,7 +575,7 @@ func DatabaseInfo(w rest.ResponseWriter, r *rest.Request) {
 // API: Territory list returns all currently configured territories and their settings
 func TerritoryList(w rest.ResponseWriter, r *rest.Request) {
 	res := setTerritoryLinks("territory:list")
-	res.Data["territories"] = socialHarvest.Config.Harvest.Territories
+	res.Data["territories"] = currentConfig().Harvest.Territories
 	res.Success()
 	w.WriteJson(res.End())
 }
@@ -225,7 +622,7 @@ func (bamw *BasicAuthMw) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFu
 		}
 
 		keyFound := false
-		for _, key := range socialHarvest.Config.HarvesterServer.AuthKeys {
+		for _, key := range currentConfig().HarvesterServer.AuthKeys {
 			if bamw.Key == key {
 				keyFound = true
 			}
@@ -247,20 +644,110 @@ func (bamw *BasicAuthMw) unauthorized(writer rest.ResponseWriter) {
 
 // --------- Initial schedule
 
-// Set the initial schedule entries from config SocialHarvestConf
-func setInitialSchedule() {
-	// NOTE: For now the schedule will always be set by an entire config reload, but in the future allowing the schedule to be updated without an entire config reload would be nice.
-	// TODO: ^^^^
-	for _, territory := range socialHarvest.Config.Harvest.Territories {
-		if territory.Schedule.Everything.Accounts != "" {
-			socialHarvest.Schedule.Cron.AddFunc(territory.Schedule.Everything.Accounts, HarvestAllAccounts, "Harvesting all accounts - "+territory.Schedule.Everything.Accounts)
+// Returns the harvest jobs for the territories' schedules in the config.
+func configJobs(c config.SocialHarvestConf) []config.ScheduledJob {
+	jobs := []config.ScheduledJob{}
+	for _, territory := range c.Harvest.Territories {
+		for _, network := range config.ScheduleNetworks {
+			for _, action := range config.ScheduleActions {
+				spec := territory.ScheduleFor(network, action)
+				if spec == "" || len(harvestFunctions[network][action]) == 0 {
+					continue
+				}
+				// Keywords and accounts are harvested when they're due (see harvestDue()), so the job just needs to check often enough
+				if action == "content" && territory.Schedule.Adaptive.Enabled {
+					spec = territory.AdaptiveSpec()
+				}
+				jobs = append(jobs, config.ScheduledJob{
+					Territory: territory.Name,
+					Network:   network,
+					Action:    action,
+					Spec:      spec,
+					Overlap:   territory.Schedule.Overlap,
+				})
+			}
 		}
-		if territory.Schedule.Everything.Content != "" {
-			socialHarvest.Schedule.Cron.AddFunc(territory.Schedule.Everything.Content, HarvestAllContent, "Harvesting all content - "+territory.Schedule.Everything.Content)
+	}
+	return jobs
+}
+
+// Set the schedule entries from config SocialHarvestConf
+// Each territory gets its own job for each network and action ("content" and "accounts") so that a job only ever harvests one territory.
+// A network without its own schedule falls back to the territory's "everything" schedule.
+// When the config is reloaded, only the jobs that changed are removed or added.
+func setSchedule(restore bool) {
+	c := currentConfig()
+	added, removed := socialHarvest.Schedule.SetConfigJobs(c, configJobs(c))
+	log.Println("Schedule updated from config: " + strconv.Itoa(added) + " jobs added, " + strconv.Itoa(removed) + " jobs removed.")
+
+	// Jobs added, removed or paused through the API
+	if restore {
+		socialHarvest.Schedule.Restore()
+	}
+
+	// Keep partitions ready ahead of time in Postgres (run once now, in case the harvester was down when they were due)
+	if c.Database.PartitionDays > 0 {
+		socialHarvest.Schedule.SetMaintenance("partitions", "@daily", preparePartitions)
+		go socialHarvest.Schedule.RunMaintenance("partitions")
+	} else {
+		socialHarvest.Schedule.SetMaintenance("partitions", "", nil)
+	}
+
+	// Remove data that's past its retention period
+	retention := c.Database.RetentionDays > 0
+	for _, days := range c.Database.Retention {
+		retention = retention || days > 0
+	}
+	if retention {
+		socialHarvest.Schedule.SetMaintenance("retention", "@daily", enforceRetention)
+		go socialHarvest.Schedule.RunMaintenance("retention")
+	} else {
+		socialHarvest.Schedule.SetMaintenance("retention", "", nil)
+	}
+
+	// Look up the engagement of messages again as they reach each age
+	if len(c.Harvest.Engagement.Ages) > 0 {
+		engagement := c.Harvest.Engagement
+		if err := socialHarvest.Schedule.SetMaintenance("engagement", engagement.ScheduleSpec(), lookUpEngagement); err != nil {
+			log.Println("Could not schedule engagement lookups: " + err.Error())
 		}
+	} else {
+		socialHarvest.Schedule.SetMaintenance("engagement", "", nil)
 	}
+}
+
+// Looks up the engagement of messages from every territory that reached one of the configured ages. Like harvests, maintenance tasks
+// hold the harvest lock while they run (so shutting down waits for them) and carry on with the config they started with.
+func lookUpEngagement() {
+	harvestLock.RLock()
+	defer harvestLock.RUnlock()
+	snapshot, done := useConfig()
+	defer done()
+	MessageEngagementByAge(snapshot, snapshot.Config.Harvest.Territories...)
+}
+
+// Creates the database partitions for the series that will be needed soon.
+func preparePartitions() {
+	harvestLock.RLock()
+	defer harvestLock.RUnlock()
+	snapshot, done := useConfig()
+	defer done()
+	if err := snapshot.Database.PreparePartitions(); err != nil {
+		log.Println("Could not prepare partitions: " + err.Error())
+	}
+}
 
-	// Set cron tasks for creating partitions in Postgres
+// Removes expired data from the database.
+func enforceRetention() {
+	harvestLock.RLock()
+	defer harvestLock.RUnlock()
+	snapshot, done := useConfig()
+	defer done()
+	for _, r := range snapshot.Database.EnforceRetention() {
+		if r.Rows > 0 {
+			log.Println("Removed " + strconv.FormatInt(r.Rows, 10) + " expired rows from " + r.Series + ".")
+		}
+	}
 }
 
 // Helper function to get the name of a function (primarily used to show scheduled tasks)
@@ -268,41 +755,66 @@ func getFunctionName(i interface{}) string {
 	return runtime.FuncForPC(reflect.ValueOf(i).Pointer()).Name()
 }
 
-// Sets (or updates) the configuration for the application. If true is passed, then it won't look for an updated config in the "sh-data" path. The original config will be used instead.
-func setConfig(original bool) error {
+// Reads the configuration. If true is passed, then it won't look for an updated config in the "sh-data" path. The original config will be used instead.
+func loadConfig(original bool) (config.SocialHarvestConf, error) {
 	var err error
 	var f *os.File
+	c := config.SocialHarvestConf{}
 	// First try to load the config file from the "sh-data" path where it would be if it was updated via the API. Unless the original config is to be loaded.
 	if !original {
 		f, err = os.Open("./sh-data/social-harvest-conf.json")
-		if !os.IsExist(err) {
+		if err != nil {
 			// If that fails, go back to the original "confFile" path given at run time using the "--conf" flag (or the default value).
 			// In this case, the config may have been updated on disk and perhaps someone wanted to reload the config without restarting the application.
-			// Of course there is no reload config from the command line. This call must be made from the RESTful API for now.
+			// The config can be reloaded from the RESTful API or by sending the process a SIGHUP.
 			f, err = os.Open(confFile)
 		}
 	} else {
 		f, err = os.Open(confFile)
 	}
+	if err != nil {
+		log.Println("config open error:", err)
+		return c, err
+	}
+	defer f.Close()
 
 	decoder := json.NewDecoder(f)
-	c := config.SocialHarvestConf{}
 	err = decoder.Decode(&c)
 	if err != nil {
 		log.Println("config decode error:", err)
+	}
+	return c, err
+}
+
+// Sets (or updates) the configuration for the application. If true is passed, then it won't look for an updated config in the "sh-data" path. The original config will be used instead.
+// The first call sets everything up, after that the config is reloaded in place (see reloadConfig()).
+func setConfig(original bool) error {
+	c, err := loadConfig(original)
+	if err != nil {
 		return err
 	}
-	socialHarvest.Config = c
+	if socialHarvest.Schedule != nil {
+		reloadConfig(c)
+		return nil
+	}
+	configureHarvester(c)
+
+	socialHarvest.Schedule = config.NewSchedule(c)
+	socialHarvest.Schedule.Run = HarvestTerritory
+	socialHarvest.Schedule.Database = currentDatabase()
+	socialHarvest.Cluster = config.NewCluster(c, socialHarvest.Schedule.Database)
+	socialHarvest.Schedule.Cluster = socialHarvest.Cluster
+
+	// Set the initial schedule (can be changed via API if available)
+	setSchedule(true)
 
+	return nil
+}
+
+// Sets up the database and harvester with the given config. This is everything needed to harvest (the schedule is separate).
+func configureHarvester(c config.SocialHarvestConf) {
 	// Setup Bugsnag (first), profiling, etc.
-	if socialHarvest.Config.Debug.Bugsnag.ApiKey != "" {
-		bugsnag.Configure(bugsnag.Configuration{
-			APIKey:          socialHarvest.Config.Debug.Bugsnag.ApiKey,
-			ReleaseStage:    socialHarvest.Config.Debug.Bugsnag.ReleaseStage,
-			ProjectPackages: []string{"main", "github.com/SocialHarvest/harvester/*"},
-			AppVersion:      appVersion,
-		})
-	}
+	configureBugsnag(c)
 
 	// Check the data directory, copy data needed by the harvester for various analysis of harvested data.
 	// Note: The data will only be copied if it doesn't exist already.
@@ -311,36 +823,165 @@ func setConfig(original bool) error {
 	config.CopyTrainingData()
 
 	// Continue configuration
-	socialHarvest.Database = config.NewDatabase(socialHarvest.Config)
-	socialHarvest.Schedule = config.NewSchedule(socialHarvest.Config)
+	database := config.NewDatabase(c)
+	publishConfig(c, database)
+	socialHarvest.Budgets.SetStore(database)
 
 	// this gets the configuration and the database. TODO: Make database optional
-	harvester.New(socialHarvest.Config, socialHarvest.Database)
+	harvester.New(c, database)
 	// Load new gender data from CSV files for detecting gender (this is callable so it can be changed during runtime)
 	// TODO: Considerations with an asset system.
 	harvester.NewGenderData("./sh-data/census-female-names.csv", "./sh-data/census-male-names.csv")
+}
 
-	// Set the initial schedule (can be changed via API if available)
-	setInitialSchedule()
+// The config and the database that goes with it. A reload publishes a new snapshot rather than changing the current one, so harvests
+// (and API requests) carry on with the one they started with and nothing has to wait for them. The database a reload replaced is only
+// closed once the harvests using it are done (see useConfig()).
+type configSnapshot struct {
+	Config   config.SocialHarvestConf
+	Database *config.SocialHarvestDB
+	// The harvests (and maintenance tasks) using the snapshot, idle is closed once a reload replaced it and they're all done
+	users    int
+	replaced bool
+	idle     chan bool
+	lock     sync.Mutex
+}
+
+var currentSnapshot atomic.Value
+
+func init() {
+	currentSnapshot.Store(&configSnapshot{idle: make(chan bool)})
+}
+
+// Returns the current config and database. Neither may be changed, a reload publishes new ones instead (see publishConfig()).
+func current() *configSnapshot {
+	return currentSnapshot.Load().(*configSnapshot)
+}
 
-	return err
+func currentConfig() config.SocialHarvestConf {
+	return current().Config
+}
+
+func currentDatabase() *config.SocialHarvestDB {
+	return current().Database
+}
+
+// Makes the config and database current. Returns the snapshot that was current before.
+func publishConfig(c config.SocialHarvestConf, database *config.SocialHarvestDB) *configSnapshot {
+	old := current()
+	currentSnapshot.Store(&configSnapshot{Config: c, Database: database, idle: make(chan bool)})
+	old.lock.Lock()
+	defer old.lock.Unlock()
+	old.replaced = true
+	if old.users == 0 {
+		close(old.idle)
+	}
+	return old
+}
+
+// Returns the current snapshot for a harvest (or maintenance task) to use. Its database stays open until the returned function is called,
+// even if a reload replaces it meanwhile.
+func useConfig() (*configSnapshot, func()) {
+	for {
+		s := current()
+		s.lock.Lock()
+		// A reload replaced it in between, the new one is current by now
+		if s.replaced {
+			s.lock.Unlock()
+			continue
+		}
+		s.users++
+		s.lock.Unlock()
+		return s, func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			s.users--
+			if s.replaced && s.users == 0 {
+				close(s.idle)
+			}
+		}
+	}
+}
+
+// Reloads (from the API and SIGHUP) happen one at a time.
+var reloadLock sync.Mutex
+
+// Swaps in a new configuration while the harvester is running. Harvests (and maintenance tasks) that are running finish with the config
+// they started with and the ones that start after use the new one, nothing waits for the running ones. The database is only reconnected
+// if its settings changed (the old one is closed once the harvests using it are done) and the schedule only changes where the config's
+// schedule changed.
+func reloadConfig(c config.SocialHarvestConf) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	previous := current()
+	database := previous.Database
+	if !reflect.DeepEqual(c.Database, previous.Config.Database) || c.Schema != previous.Config.Schema {
+		database = config.NewDatabase(c)
+	}
+	configureBugsnag(c)
+	harvester.Reload(c, database)
+	if database != previous.Database {
+		socialHarvest.Budgets.SetStore(database)
+	}
+	socialHarvest.Schedule.SetDatabase(database)
+	socialHarvest.Cluster.SetDatabase(database)
+	socialHarvest.Cluster.Configure(c)
+	old := publishConfig(c, database)
+
+	if database != old.Database {
+		go func() {
+			<-old.idle
+			old.Database.Close()
+		}()
+	}
+	setSchedule(false)
+	log.Println("Configuration reloaded.")
+}
+
+func configureBugsnag(c config.SocialHarvestConf) {
+	if c.Debug.Bugsnag.ApiKey != "" {
+		bugsnag.Configure(bugsnag.Configuration{
+			APIKey:          c.Debug.Bugsnag.ApiKey,
+			ReleaseStage:    c.Debug.Bugsnag.ReleaseStage,
+			ProjectPackages: []string{"main", "github.com/SocialHarvest/harvester/*"},
+			AppVersion:      appVersion,
+		})
+	}
+}
+
+// Reloads the config whenever the process receives a SIGHUP (just like the /config/reload route).
+func reloadOnSighup() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			log.Println(sig.String() + " received, reloading the configuration.")
+			setConfig(false)
+		}
+	}()
 }
 
 // Main - initializes, configures, and sets routes for API
 func main() {
 	// Optionally allow a config JSON file to be passed via command line
 	flag.StringVar(&confFile, "conf", "social-harvest-conf.json", "Path to the Social Harvest configuration file.")
+	flag.Usage = usage
 	flag.Parse()
 
+	// Ad-hoc harvests and such from the command line (see cli.go), otherwise the harvester runs on its schedule with the API server
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
 	// Set the configuration, DB client, etc. so that it is available to other stuff.
 	cErr := setConfig(false)
 	if cErr != nil {
 		log.Fatalln("Failed to load the harvester configuration.")
 	}
-	// NOTE: A database is optional for Social Harvest (harvested data can be logged for use with Fluentd for example)
-	if socialHarvest.Database.Postgres != nil {
-		defer socialHarvest.Database.Postgres.Close()
-	}
+	reloadOnSighup()
+	// Log files are flushed and the database (which is optional) is closed on the way out
+	shutdownOnSignal()
 
 	// Debug - do not compile with this
 	// runtime.SetBlockProfileRate(1)
@@ -359,37 +1000,21 @@ func main() {
 	color.Yellow("_____________________________________________version " + appVersion)
 	color.Cyan("   ")
 
-	// Immedate calls to use for testing during development
-	// Search Facebook public posts using keywords in Social Harvest config
-	// go FacebookPublicMessagesByKeyword()
-	// //Search Facebook public feeds using account ids in Social Harvest config
-	// go FacebookMessagesByAccount()
-	// //Search Twitter using keywords in Social Harvest config
-	// go TwitterPublicMessagesByKeyword()
-	// go TwitterPublicMessagesByAccount()
-	// // Search Instagram
-	// go InstagramMediaByKeyword()
-	// go GooglePlusActivitieByKeyword()
-	// go GooglePlusActivitieByAccount()
-	// go HarvestAllContent()
-	// go HarvestAllAccounts()
-
-	//TODO: Continue with this...
-	//socialHarvest.Database.CreatePartitionTable("messages")
+	// To harvest right away (for testing during development, etc.) use the "run" command, ie. harvester run --network twitter --once
 
 	// The RESTful API harvester server can be completely disabled by setting {"harvesterServer":{"disabled": true}} in the config.
 	// NOTE: The actual API server (if running) can not be updated (port changes, etc.) without the harvester application being restarted.
-	// TODO: Think about accepting command line arguments for adhoc harvesting (useful if the server is disabled because main() will return then).
-	if !socialHarvest.Config.HarvesterServer.Disabled {
+	c := currentConfig()
+	if !c.HarvesterServer.Disabled {
 		restMiddleware := []rest.Middleware{}
 
 		// If additional origins were allowed for CORS, handle them
-		if len(socialHarvest.Config.HarvesterServer.Cors.AllowedOrigins) > 0 {
+		if len(c.HarvesterServer.Cors.AllowedOrigins) > 0 {
 			restMiddleware = append(restMiddleware,
 				&rest.CorsMiddleware{
 					RejectNonCorsRequests: false,
 					OriginValidator: func(origin string, request *rest.Request) bool {
-						for _, allowedOrigin := range socialHarvest.Config.HarvesterServer.Cors.AllowedOrigins {
+						for _, allowedOrigin := range currentConfig().HarvesterServer.Cors.AllowedOrigins {
 							// If the request origin matches one of the allowed origins, return true
 							if origin == allowedOrigin {
 								return true
@@ -397,7 +1022,7 @@ func main() {
 						}
 						return false
 					},
-					AllowedMethods: []string{"GET", "POST", "PUT"},
+					AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
 					AllowedHeaders: []string{
 						"Accept", "Content-Type", "X-Custom-Header", "Origin"},
 					AccessControlAllowCredentials: true,
@@ -406,7 +1031,7 @@ func main() {
 			)
 		}
 		// If api keys are defined, setup basic auth (any key listed allows full access, there are no roles for now, this is just very basic auth)
-		if len(socialHarvest.Config.HarvesterServer.AuthKeys) > 0 {
+		if len(c.HarvesterServer.AuthKeys) > 0 {
 			restMiddleware = append(restMiddleware,
 				&BasicAuthMw{
 					Realm: "Social Harvest (harvester) API",
@@ -421,27 +1046,46 @@ func main() {
 		}
 		err := handler.SetRoutes(
 			&rest.Route{"GET", "/schedule/read", ShowSchedule},
+			&rest.Route{"POST", "/schedule/add", AddScheduledJob},
+			&rest.Route{"DELETE", "/schedule/delete/:id", DeleteScheduledJob},
+			&rest.Route{"POST", "/schedule/pause/:id", PauseScheduledJob},
+			&rest.Route{"POST", "/schedule/resume/:id", ResumeScheduledJob},
+			&rest.Route{"POST", "/schedule/trigger/:id", TriggerScheduledJob},
+			&rest.Route{"GET", "/schedule/preview", PreviewSchedule},
+			&rest.Route{"GET", "/cluster/read", ShowCluster},
+			&rest.Route{"GET", "/logs/stats", ShowLogStats},
+			&rest.Route{"GET", "/budget/read", ShowBudgets},
+			&rest.Route{"POST", "/harvest", StartHarvest},
+			&rest.Route{"GET", "/harvest/:id", ShowHarvestRun},
 			&rest.Route{"GET", "/config/read", ShowSocialHarvestConfig},
 			&rest.Route{"POST", "/config/write", WriteSocialHarvestConfig},
 			&rest.Route{"GET", "/config/reload", ReloadSocialHarvestConfig},
 			&rest.Route{"GET", "/database/info", DatabaseInfo},
 			&rest.Route{"GET", "/territory/list", TerritoryList},
+			&rest.Route{"GET", "/settings/read", ListSettings},
+			&rest.Route{"GET", "/settings/read/:key", ShowSettings},
+			&rest.Route{"POST", "/settings/write/:key", WriteSettings},
+			&rest.Route{"DELETE", "/settings/delete/:key", DeleteSettings},
+			&rest.Route{"GET", "/settings/history/:key", ShowSettingsHistory},
 		)
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		// Allow the port to be configured (we need it as a string, but let the config define an int)
-		p := strconv.Itoa(socialHarvest.Config.HarvesterServer.Port)
+		p := strconv.Itoa(c.HarvesterServer.Port)
 		// But if it can't be parsed (maybe wasn't set) then set it to 3000
 		if p == "0" {
 			p = "3000"
 		}
 		log.Println("Social Harvest (harvester) API listening on port " + p)
-		if socialHarvest.Config.Debug.Bugsnag.ApiKey != "" {
+		if c.Debug.Bugsnag.ApiKey != "" {
 			log.Println(http.ListenAndServe(":"+p, bugsnag.Handler(&handler)))
 		} else {
 			log.Fatal(http.ListenAndServe(":"+p, &handler))
 		}
+	} else {
+		// Without the API server, keep harvesting on the schedule until stopped (see shutdownOnSignal())
+		select {}
 	}
 }
@@ -0,0 +1,247 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/SocialHarvest/harvester/lib/config"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// On-demand harvest runs (requested through the API). A run harvests one territory for a network and action, optionally for just one of
+// its keywords or accounts. Runs go through the schedule (see SocialHarvestSchedule.RunNow()) so they wait for any other run of the same
+// territory, network and action to finish first, be it scheduled, on-demand or on another harvester.
+type HarvestRun struct {
+	Id        string    `json:"id"`
+	Territory string    `json:"territory"`
+	Network   string    `json:"network"`
+	Action    string    `json:"action"`
+	Value     string    `json:"value,omitempty"`
+	Status    string    `json:"status"`
+	Queued    time.Time `json:"queued"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Pages     int       `json:"pages"`
+	Items     int       `json:"items"`
+	Errors    []string  `json:"errors"`
+	// The names of the harvest functions the run calls and the progress reported by each for each keyword, account, etc.
+	functions []string
+	progress  map[string]*runProgress
+}
+
+type runProgress struct {
+	pages int
+	items int
+}
+
+const (
+	RunQueued   = "queued"
+	RunRunning  = "running"
+	RunFinished = "finished"
+	RunFailed   = "failed"
+)
+
+// Finished runs are kept around (in memory) for a while so their status can be checked
+const finishedRunsKept = 100
+
+var harvestRuns = map[string]*HarvestRun{}
+var finishedRuns = []string{}
+var harvestRunsLock sync.Mutex
+
+// Queues an on-demand harvest and returns a copy of the run right away (the harvest happens in the background).
+func startHarvestRun(territoryName string, network string, action string, value string) (HarvestRun, error) {
+	territories := territoriesToHarvest(territoryName)
+	if territoryName == "" || len(territories) == 0 {
+		return HarvestRun{}, errors.New("unknown territory: " + territoryName)
+	}
+	funcs := harvestFunctionsFor(network, action)
+	if len(funcs) == 0 {
+		return HarvestRun{}, errors.New("there is nothing to harvest for network " + network + " and action " + action)
+	}
+	// Asked for now, so it doesn't matter when the keywords are due
+	territory := territories[0]
+	territory.Schedule.Adaptive.Enabled = false
+	if value != "" {
+		var ok bool
+		territory, ok = territoryWithValue(territory, network, value)
+		if !ok {
+			return HarvestRun{}, errors.New(value + " is not a keyword or account of " + territoryName + " on " + network)
+		}
+	}
+
+	run := &HarvestRun{
+		Id:        strconv.FormatInt(time.Now().UnixNano(), 36),
+		Territory: territoryName,
+		Network:   network,
+		Action:    action,
+		Value:     value,
+		Status:    RunQueued,
+		Queued:    time.Now(),
+		Errors:    []string{},
+		progress:  map[string]*runProgress{},
+	}
+	for _, f := range funcs {
+		run.functions = append(run.functions, strings.TrimPrefix(getFunctionName(f), "main."))
+	}
+	harvestRunsLock.Lock()
+	harvestRuns[run.Id] = run
+	copy := *run
+	harvestRunsLock.Unlock()
+
+	job := config.ScheduledJob{Territory: territoryName, Network: network, Action: scheduledAction(action)}
+	go socialHarvest.Schedule.RunNow(job, func() {
+		run.harvest(territory, funcs)
+	})
+	return copy, nil
+}
+
+// Returns a copy of the run with the given id.
+func harvestRun(id string) (HarvestRun, bool) {
+	harvestRunsLock.Lock()
+	defer harvestRunsLock.Unlock()
+	run, ok := harvestRuns[id]
+	if !ok {
+		return HarvestRun{}, false
+	}
+	return *run, true
+}
+
+func (run *HarvestRun) harvest(territory config.Territory, funcs []harvestFunc) {
+	harvestRunsLock.Lock()
+	run.Status = RunRunning
+	run.Started = time.Now()
+	harvestRunsLock.Unlock()
+
+	defer func() {
+		harvestRunsLock.Lock()
+		defer harvestRunsLock.Unlock()
+		if r := recover(); r != nil {
+			run.Errors = append(run.Errors, fmt.Sprint(r))
+		}
+		run.Status = RunFinished
+		if len(run.Errors) > 0 {
+			run.Status = RunFailed
+		}
+		run.Finished = time.Now()
+
+		finishedRuns = append(finishedRuns, run.Id)
+		if len(finishedRuns) > finishedRunsKept {
+			delete(harvestRuns, finishedRuns[0])
+			finishedRuns = finishedRuns[1:]
+		}
+	}()
+
+	for _, f := range funcs {
+		runHarvest(f, territory)
+	}
+}
+
+// Updates the progress of running on-demand harvests. Harvest functions report after each page of results (or account) they harvest. There
+// can only be one run at a time for a territory, network and action (see RunNow()), so the progress can be matched up to the run by those.
+func reportHarvestProgress(territory string, network string, action string, value string, itemsHarvested int) {
+	harvestRunsLock.Lock()
+	defer harvestRunsLock.Unlock()
+	for _, run := range harvestRuns {
+		if run.Status != RunRunning || run.Territory != territory || run.Network != network || !containsFunction(run.functions, action) {
+			continue
+		}
+		p, ok := run.progress[action+"|"+value]
+		if !ok {
+			p = &runProgress{}
+			run.progress[action+"|"+value] = p
+		}
+		// Items harvested are counted for all the pages harvested for the keyword, account, etc. so far
+		p.pages++
+		p.items = itemsHarvested
+
+		run.Pages, run.Items = 0, 0
+		for _, p := range run.progress {
+			run.Pages += p.pages
+			run.Items += p.items
+		}
+	}
+}
+
+// The number of API errors harvests ran into since the harvester started (see harvestErrorCount()).
+var harvestErrors = 0
+
+// Logs an API error a harvest function ran into for a page of results (or an account) and adds it to the errors of the running on-demand
+// harvests it belongs to (matched up like their progress). The harvest carries on with the next keyword, account, etc.
+func reportHarvestError(territory string, network string, action string, value string, err error) {
+	message := territory + " " + network + " " + action + " " + value + ": " + err.Error()
+	log.Println(message)
+
+	harvestRunsLock.Lock()
+	defer harvestRunsLock.Unlock()
+	harvestErrors++
+	for _, run := range harvestRuns {
+		if run.Status != RunRunning || run.Territory != territory || run.Network != network || !containsFunction(run.functions, action) {
+			continue
+		}
+		run.Errors = append(run.Errors, message)
+	}
+}
+
+// Returns the number of API errors harvests ran into so far.
+func harvestErrorCount() int {
+	harvestRunsLock.Lock()
+	defer harvestRunsLock.Unlock()
+	return harvestErrors
+}
+
+// Returns a copy of the territory with only the given keyword or account (for the network). Returns false if the territory doesn't have it.
+func territoryWithValue(territory config.Territory, network string, value string) (config.Territory, bool) {
+	found := false
+	only := func(list []string) []string {
+		for _, v := range list {
+			if v == value {
+				found = true
+				return []string{value}
+			}
+		}
+		return []string{}
+	}
+	territory.Content.Keywords = only(territory.Content.Keywords)
+	territory.Content.InstagramTags = only(territory.Content.InstagramTags)
+	switch network {
+	case "twitter":
+		territory.Accounts.Twitter = only(territory.Accounts.Twitter)
+	case "facebook":
+		territory.Accounts.Facebook = only(territory.Accounts.Facebook)
+	case "instagram":
+		territory.Accounts.Instagram = only(territory.Accounts.Instagram)
+	case "googlePlus":
+		territory.Accounts.GooglePlus = only(territory.Accounts.GooglePlus)
+	case "youTube":
+		territory.Accounts.YouTube = only(territory.Accounts.YouTube)
+	}
+	return territory, found
+}
+
+func containsFunction(functions []string, name string) bool {
+	for _, f := range functions {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,18 @@
+SET NAMES utf8;
+SET FOREIGN_KEY_CHECKS = 0;
+
+-- ----------------------------
+--  Table structure for `budget_spending`
+-- ----------------------------
+DROP TABLE IF EXISTS `budget_spending`;
+CREATE TABLE `budget_spending` (
+  `territory` varchar(150) NOT NULL,
+  `network` varchar(75) NOT NULL,
+  `period` varchar(10) NOT NULL,
+  `start` timestamp(6) NOT NULL DEFAULT '0000-00-00 00:00:00.000000',
+  `calls` int(11) DEFAULT NULL,
+  `items` int(11) DEFAULT NULL,
+  PRIMARY KEY (`territory`,`network`,`period`,`start`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+SET FOREIGN_KEY_CHECKS = 1;
@@ -10,15 +10,15 @@ SET FOREIGN_KEY_CHECKS = 0;
 -- ----------------------------
 DROP TABLE IF EXISTS `harvest`;
 CREATE TABLE `harvest` (
-  `territory` varchar(150) DEFAULT NULL,
-  `network` varchar(75) DEFAULT NULL,
-  `action` varchar(255) DEFAULT NULL,
-  `value` text,
+  `territory` varchar(150) NOT NULL DEFAULT '',
+  `network` varchar(75) NOT NULL DEFAULT '',
+  `action` varchar(150) NOT NULL DEFAULT '',
+  `value` varchar(255) NOT NULL DEFAULT '',
   `last_time_harvested` timestamp(6) NULL DEFAULT NULL,
   `last_id_harvested` varchar(255) DEFAULT NULL,
   `items_harvested` int(11) DEFAULT NULL,
   `harvest_time` timestamp(6) NOT NULL DEFAULT '0000-00-00 00:00:00.000000',
-  PRIMARY KEY (`harvest_time`)
-) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+  PRIMARY KEY (`territory`, `network`, `action`, `value`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 ROW_FORMAT=DYNAMIC;
 
 SET FOREIGN_KEY_CHECKS = 1;
@@ -0,0 +1,16 @@
+SET NAMES utf8;
+SET FOREIGN_KEY_CHECKS = 0;
+
+-- ----------------------------
+--  Table structure for `harvester_nodes`
+-- ----------------------------
+DROP TABLE IF EXISTS `harvester_nodes`;
+CREATE TABLE `harvester_nodes` (
+  `id` varchar(255) NOT NULL,
+  `hostname` varchar(255) DEFAULT NULL,
+  `started` timestamp(6) NULL DEFAULT NULL,
+  `heartbeat` timestamp(6) NOT NULL DEFAULT '0000-00-00 00:00:00.000000',
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+SET FOREIGN_KEY_CHECKS = 1;
@@ -0,0 +1,25 @@
+SET NAMES utf8;
+SET FOREIGN_KEY_CHECKS = 0;
+
+-- ----------------------------
+--  Table structure for `message_engagement`
+-- ----------------------------
+DROP TABLE IF EXISTS `message_engagement`;
+CREATE TABLE `message_engagement` (
+  `time` timestamp(6) NOT NULL,
+  `harvest_id` varchar(255) NOT NULL,
+  `territory` varchar(255) DEFAULT NULL,
+  `network` varchar(75) DEFAULT NULL,
+  `message_id` varchar(255) DEFAULT NULL,
+  `facebook_shares` int(11) DEFAULT 0,
+  `twitter_retweet_count` int(11) DEFAULT 0,
+  `twitter_favorite_count` int(11) DEFAULT 0,
+  `like_count` int(11) DEFAULT 0,
+  `google_plus_reshares` int(11) DEFAULT 0,
+  `google_plus_ones` int(11) DEFAULT 0,
+  PRIMARY KEY (`harvest_id`, `time`),
+  KEY `me_time_key` (`time`),
+  KEY `me_message_id_key` (`message_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+SET FOREIGN_KEY_CHECKS = 1;
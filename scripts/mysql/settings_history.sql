@@ -0,0 +1,16 @@
+SET NAMES utf8;
+SET FOREIGN_KEY_CHECKS = 0;
+
+-- ----------------------------
+--  Table structure for `settings_history`
+-- ----------------------------
+DROP TABLE IF EXISTS `settings_history`;
+CREATE TABLE `settings_history` (
+  `key` varchar(150) NOT NULL,
+  `value` text,
+  `modified` timestamp(6) NULL DEFAULT NULL,
+  `deleted` smallint(6) DEFAULT 0,
+  KEY `settings_history_key_key` (`key`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+SET FOREIGN_KEY_CHECKS = 1;
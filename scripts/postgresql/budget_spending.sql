@@ -0,0 +1,22 @@
+/*
+ PostgreSQL
+*/
+
+-- ----------------------------
+--  Table structure for budget_spending
+-- ----------------------------
+DROP TABLE IF EXISTS "budget_spending";
+CREATE TABLE "budget_spending" (
+	"territory" varchar(150) COLLATE "default" NOT NULL,
+	"network" varchar(75) COLLATE "default" NOT NULL,
+	"period" varchar(10) COLLATE "default" NOT NULL,
+	"start" timestamp(6) NOT NULL,
+	"calls" int4,
+	"items" int4
+)
+WITH (OIDS=FALSE);
+
+-- ----------------------------
+--  Primary key structure for table budget_spending
+-- ----------------------------
+ALTER TABLE "budget_spending" ADD PRIMARY KEY ("territory", "network", "period", "start") NOT DEFERRABLE INITIALLY IMMEDIATE;
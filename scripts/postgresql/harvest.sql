@@ -22,5 +22,5 @@ WITH (OIDS=FALSE);
 -- ----------------------------
 --  Primary key structure for table harvest
 -- ----------------------------
-ALTER TABLE "harvest" ADD PRIMARY KEY ("harvest_time") NOT DEFERRABLE INITIALLY IMMEDIATE;
+ALTER TABLE "harvest" ADD PRIMARY KEY ("territory", "network", "action", "value") NOT DEFERRABLE INITIALLY IMMEDIATE;
 
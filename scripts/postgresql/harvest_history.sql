@@ -0,0 +1,21 @@
+-- ----------------------------
+--  Table structure for harvest_history
+-- ----------------------------
+DROP TABLE IF EXISTS "harvest_history";
+CREATE TABLE "harvest_history" (
+	"territory" varchar(150) COLLATE "default",
+	"network" varchar(75) COLLATE "default",
+	"action" varchar(255) COLLATE "default",
+	"value" text COLLATE "default",
+	"last_time_harvested" timestamp(6) NULL,
+	"last_id_harvested" varchar(255) COLLATE "default",
+	"items_harvested" int4,
+	"harvest_time" timestamp(6) NOT NULL
+)
+WITH (OIDS=FALSE);
+
+-- ----------------------------
+--  Indexes structure for table harvest_history
+-- ----------------------------
+CREATE INDEX  "harvest_history_time_key" ON "harvest_history" USING btree(harvest_time ASC NULLS LAST);
+
@@ -0,0 +1,20 @@
+/*
+ PostgreSQL
+*/
+
+-- ----------------------------
+--  Table structure for harvester_nodes
+-- ----------------------------
+DROP TABLE IF EXISTS "harvester_nodes";
+CREATE TABLE "harvester_nodes" (
+	"id" varchar(255) COLLATE "default" NOT NULL,
+	"hostname" varchar(255) COLLATE "default",
+	"started" timestamp(6) NULL,
+	"heartbeat" timestamp(6) NOT NULL
+)
+WITH (OIDS=FALSE);
+
+-- ----------------------------
+--  Primary key structure for table harvester_nodes
+-- ----------------------------
+ALTER TABLE "harvester_nodes" ADD PRIMARY KEY ("id") NOT DEFERRABLE INITIALLY IMMEDIATE;
@@ -0,0 +1,33 @@
+/*
+ PostgreSQL
+*/
+
+-- ----------------------------
+--  Table structure for message_engagement
+-- ----------------------------
+DROP TABLE IF EXISTS "message_engagement";
+CREATE TABLE "message_engagement" (
+	"time" timestamp(6) NOT NULL,
+	"harvest_id" varchar(255) NOT NULL COLLATE "default",
+	"territory" varchar(255) COLLATE "default",
+	"network" varchar(75) COLLATE "default",
+	"message_id" varchar(255) COLLATE "default",
+	"facebook_shares" int4,
+	"twitter_retweet_count" int4,
+	"twitter_favorite_count" int4,
+	"like_count" int4,
+	"google_plus_reshares" int4,
+	"google_plus_ones" int4
+)
+WITH (OIDS=FALSE);
+
+-- ----------------------------
+--  Primary key structure for table message_engagement
+-- ----------------------------
+ALTER TABLE "message_engagement" ADD PRIMARY KEY ("harvest_id", "time") NOT DEFERRABLE INITIALLY IMMEDIATE;
+
+-- ----------------------------
+--  Indexes structure for table message_engagement
+-- ----------------------------
+CREATE INDEX  "me_message_id_key" ON "message_engagement" USING btree(message_id COLLATE "default" DESC NULLS LAST);
+CREATE INDEX  "me_time_key" ON "message_engagement" USING btree("time" DESC NULLS LAST);
@@ -0,0 +1,20 @@
+/*
+ PostgreSQL
+*/
+
+-- ----------------------------
+--  Table structure for settings_history
+-- ----------------------------
+DROP TABLE IF EXISTS "settings_history";
+CREATE TABLE "settings_history" (
+	"key" varchar(150) NOT NULL COLLATE "default",
+	"value" text COLLATE "default",
+	"modified" timestamp(6) NULL,
+	"deleted" int2
+)
+WITH (OIDS=FALSE);
+
+-- ----------------------------
+--  Indexes structure for table settings_history
+-- ----------------------------
+CREATE INDEX  "settings_history_key_key" ON "settings_history" USING btree("key" COLLATE "default" ASC NULLS LAST);
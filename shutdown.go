@@ -0,0 +1,98 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/SocialHarvest/harvester/lib/harvester"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// How long to wait, all together, for harvests to stop and harvested data to be written before giving up and exiting anyway.
+const shutdownTimeout = 30 * time.Second
+
+// Set once the harvester starts shutting down. Harvest functions check it between pages.
+var stopping int32
+
+// Whether or not the harvester is shutting down. Harvests stop at the next page (or account) when it is.
+func shuttingDown() bool {
+	return atomic.LoadInt32(&stopping) == 1
+}
+
+// Shuts down gracefully when the process receives a SIGINT or SIGTERM.
+func shutdownOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Println(sig.String() + " received, shutting down.")
+		shutdown(shutdownTimeout)
+		os.Exit(exitOk)
+	}()
+}
+
+// Stops the schedule, lets harvests that are running get to the end of the page they're on, then waits for the harvested data to be
+// written by the sinks, to the database and to the log files before closing the database (unless harvests didn't stop in time). It all has
+// to happen within the timeout. Nothing is harvested after this is called.
+func shutdown(timeout time.Duration) {
+	atomic.StoreInt32(&stopping, 1)
+	deadline := time.Now().Add(timeout)
+	if socialHarvest.Schedule != nil {
+		socialHarvest.Schedule.Stop()
+	}
+
+	// Harvests hold a read lock while they run (see runHarvest()). This lock is never released, so nothing else gets harvested.
+	stopped := make(chan bool)
+	go func() {
+		harvestLock.Lock()
+		close(stopped)
+	}()
+	harvesting := false
+	select {
+	case <-stopped:
+	case <-time.After(deadline.Sub(time.Now())):
+		log.Println("Timed out waiting for harvests to stop.")
+		harvesting = true
+	}
+
+	// The sinks go first, what they have queued is written to the database and log files
+	if !harvester.StopSinks(deadline.Sub(time.Now())) {
+		log.Println("Timed out waiting for the sinks to write, some harvested data may be lost.")
+	}
+	if !harvester.WaitForWrites(deadline.Sub(time.Now())) {
+		log.Println("Timed out waiting for harvested data to be written to the database, some of it may be lost.")
+	}
+	if !harvester.StopLoggers(deadline.Sub(time.Now())) {
+		log.Println("Timed out writing the log files, some harvested data may not have been logged.")
+	}
+
+	if socialHarvest.Cluster != nil {
+		socialHarvest.Cluster.Leave()
+	}
+	// Harvests that are still going would write to a closed database, so it's left for the process to exit with
+	if harvesting {
+		log.Println("Harvests are still running, leaving the database open.")
+		return
+	}
+	if err := currentDatabase().CloseWithin(deadline.Sub(time.Now())); err != nil {
+		log.Println(err)
+	}
+}